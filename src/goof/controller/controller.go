@@ -4,12 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"goof/of"
+	"goof/pcap"
+	"goof/record"
 	"io"
 	"log"
 	"net"
+	"sync"
 )
 
+// Handlers are called from the goroutine running Switch.Serve.  The message
+// passed to a handler, including the frame of a PacketIn, is reused for later
+// messages once the handler returns, so handlers must copy anything they
+// want to keep.
 type PacketInHandler func(msg *of.PacketIn)
 type SwitchFeaturesHandler func(msg *of.SwitchFeatures)
 type NewSwitchHandler func(sw *Switch)
@@ -37,13 +45,32 @@ type Controller struct {
 }
 
 type Switch struct {
-	tcpConn              *net.TCPConn
+	conn                 net.Conn
 	rb                   *bufio.Reader
+	reader               *Reader
 	controller           *Controller
+	// The message passed to each handler below is only valid until the
+	// handler returns: Serve decodes the next PacketIn or PortStatus into
+	// the same message, and the next message of any type into the buffer
+	// that slices such as a PacketIn's Data point into.  A handler that
+	// keeps a message, or a PacketIn's Data, EthFrame or Packet, for later
+	// must copy it first.
 	HandlePacketIn       PacketInHandler
 	HandleSwitchFeatures SwitchFeaturesHandler
 	HandleError ErrorHandler
 	HandlePortStatus PortStatusHandler
+	// If set before Serve, PacketIn frames are not parsed up front and
+	// handlers read them through msg.Packet; msg.EthFrame is nil.
+	LazyFrames bool
+	// Set from the SwitchFeatures reply, before HandleSwitchFeatures runs.
+	DatapathId uint64
+	capture    *pcap.Writer
+	recorder   *record.Writer
+	sendMu     sync.Mutex // guards sendBuf and writes to conn
+	sendBuf    bytes.Buffer
+	xid        uint32 // the last xid of the Switch's own requests
+	reconcileMu sync.Mutex // guards reconciling
+	reconciling map[uint32]*reconciliation
 }
 
 func NewController() *Controller {
@@ -62,51 +89,129 @@ func (self *Controller) Accept(port int, h NewSwitchHandler) error {
 		if err != nil {
 			continue
 		}
-		rb := bufio.NewReader(tcpConn)
-		sw := &Switch{tcpConn, rb, self, emptyPacketInHandler,
-			emptySwitchFeaturesHandler, emptyErrorHandler,
-		emptyPortStatusHandler}
+		sw := NewSwitch(tcpConn)
+		sw.controller = self
 		go h(sw)
 	}
+}
 
-	panic("unreachable code")
+// Returns a Switch speaking OpenFlow over conn, with handlers that log and
+// discard messages.  Accept makes one for each switch that connects; tests
+// and replays make their own over other kinds of connection.
+func NewSwitch(conn net.Conn) *Switch {
+	rb := bufio.NewReader(conn)
+	return &Switch{
+		conn:                 conn,
+		rb:                   rb,
+		reader:               NewReader(rb),
+		HandlePacketIn:       emptyPacketInHandler,
+		HandleSwitchFeatures: emptySwitchFeaturesHandler,
+		HandleError:          emptyErrorHandler,
+		HandlePortStatus:     emptyPortStatusHandler,
+	}
 }
 
+// Sends msg to the switch.  It is safe to call from many goroutines: each
+// message is encoded whole and then written at once, so messages whose
+// Write makes several writes cannot interleave on the connection.
 func (self *Switch) Send(msg of.ToSwitch) error {
-	return msg.Write(self.tcpConn)
+	if m, ok := msg.(*of.PacketOut); ok && self.capture != nil {
+		self.writeCapture(self.capture.WritePacketOut(self.DatapathId, m))
+	}
+	self.sendMu.Lock()
+	defer self.sendMu.Unlock()
+	self.sendBuf.Reset()
+	err := msg.Write(&self.sendBuf)
+	if err != nil {
+		return err
+	}
+	if self.recorder != nil {
+		self.writeRecord(record.ToSwitch, self.sendBuf.Bytes())
+	}
+	_, err = self.conn.Write(self.sendBuf.Bytes())
+	return err
+}
+
+// Writes the frame of every PacketIn and the payload of every PacketOut to
+// w, from now on.  Many switches may share one Writer.
+func (self *Switch) Capture(w *pcap.Writer) {
+	self.capture = w
+}
+
+func (self *Switch) writeCapture(err error) {
+	if err != nil {
+		log.Printf("capture failed, err = %s", err)
+	}
+}
+
+// Records every message sent or received from now on to w.  Set it before
+// Serve to record the whole connection, ready for Replay.
+func (self *Switch) Record(w *record.Writer) {
+	self.recorder = w
 }
 
-func (self *Switch) Recv() interface{} {
+func (self *Switch) writeRecord(d record.Direction, data []byte) {
+	err := self.recorder.Write(d, data)
+	if err != nil {
+		log.Printf("recording failed, err = %s", err)
+	}
+}
+
+// Returns the address of the switch end of the connection.
+func (self *Switch) RemoteAddr() net.Addr {
+	return self.conn.RemoteAddr()
+}
+
+func (self *Switch) Recv() (interface{}, error) {
 	return ReadMsg(self.rb)
 }
 
+// Dispatches messages to the handlers until the connection fails.
 func (self *Switch) Serve() {
 	self.loop()
-	log.Panicf("Unreachable code in (*Switch)serve")
 }
 
 func (self *Switch) loop() {
+	defer self.reader.Release()
+	defer self.abandonReconciliations()
+	self.reader.decoder.Lazy = self.LazyFrames
 	for {
-		msg := self.Recv()
+		msg, err := self.reader.ReadMsg()
+		if self.recorder != nil && self.reader.Raw() != nil {
+			self.writeRecord(record.FromSwitch, self.reader.Raw())
+		}
+		if _, ok := err.(*DecodeError); ok {
+			// Handlers never see a message decoded only in part.
+			log.Printf("dropped message, err = %s", err)
+			continue
+		}
+		if err != nil {
+			log.Printf("recv failed, err = %s", err)
+			self.Close()
+			return
+		}
+		if self.reconcile(msg) {
+			continue
+		}
 		switch m := msg.(type) {
 		case *of.Header:
 			log.Printf("Recv unknown packet type: %s", m.Type)
 		case *of.Hello:
-			err := self.Send(&of.Hello{of.Header{Xid: m.Xid}})
+			err := self.Send(&of.Hello{Header: of.Header{Xid: m.Xid}})
 			if err != nil {
 				log.Printf("send HELLO response failed, err = %s", err)
 				self.Close()
 				return
 			}
-      err = self.Send(&of.SwitchFeaturesRequest{0})
+			err = self.Send(&of.SwitchFeaturesRequest{Xid: 0})
 			if err != nil {
 				log.Printf("send features request failed, err = %s", err)
 				self.Close()
 				return
 			}
 		case *of.EchoRequest:
-			err := self.Send(&of.EchoReply{of.Header{Xid: m.Xid},
-				m.Body})
+			err := self.Send(&of.EchoReply{Header: of.Header{Xid: m.Xid},
+				Body: m.Body})
 			if err != nil {
 				log.Printf("send ECHO reply failed, err = %s", err)
 				self.Close()
@@ -115,8 +220,12 @@ func (self *Switch) loop() {
 		case *of.PortStatus:
 			self.HandlePortStatus(m)
 		case *of.PacketIn:
+			if self.capture != nil {
+				self.writeCapture(self.capture.WritePacketIn(self.DatapathId, m))
+			}
 			self.HandlePacketIn(m)
 		case *of.SwitchFeatures:
+			self.DatapathId = m.DatapathId
 			self.HandleSwitchFeatures(m)
 		case *of.Error:
 			self.HandleError(m)
@@ -127,51 +236,41 @@ func (self *Switch) loop() {
 }
 
 func (self *Switch) Close() {
-	self.tcpConn.Close()
+	self.conn.Close()
 }
 
-func ReadMsg(netBuf *bufio.Reader) interface{} {
+// Reads the next message from netBuf.  A message whose body fails to decode
+// is consumed and reported as a *DecodeError, after which the next message
+// may still be read; any other error means the stream itself is broken
+// (short read or impossible length).  Messages of unknown type are returned
+// as their *of.Header.
+func ReadMsg(netBuf *bufio.Reader) (interface{}, error) {
 	var header of.Header
 	rawHeader := make([]byte, of.HeaderSize)
-	// Panic if fewer bytes are read and don't care about recovering this
-	// connection.
 	_, err := io.ReadFull(netBuf, rawHeader)
 	if err != nil {
-		log.Panicf("error reading header; %s", err)
+		return nil, fmt.Errorf("error reading header; %s", err)
 	}
 	binary.Read(bytes.NewBuffer(rawHeader), binary.BigEndian, &header) // no err
+	if header.Length < of.HeaderSize {
+		return nil, fmt.Errorf("bad message length %d", header.Length)
+	}
 
 	var rawBody []byte
 	rawBody = make([]byte, header.Length-of.HeaderSize)
 	_, err = io.ReadFull(netBuf, rawBody)
 	if err != nil {
-		log.Panicf("error reading body; %s", err)
+		return nil, fmt.Errorf("error reading body; %s", err)
 	}
 
-	var msg of.FromSwitch
-	switch header.Type {
-	case of.OFPT_HELLO:
-		msg = new(of.Hello)
-	case of.OFPT_ECHO_REQUEST:
-		msg = new(of.EchoRequest)
-	case of.OFPT_ECHO_REPLY:
-		msg = new(of.EchoReply)
-	case of.OFPT_FEATURES_REPLY:
-		msg = new(of.SwitchFeatures)
-	case of.OFPT_PACKET_IN:
-		msg = new(of.PacketIn)
-	case of.OFPT_ERROR:
-		msg = new(of.Error)
-	case of.OFPT_PORT_STATUS:
-		msg = new(of.PortStatus)
-	default:
+	msg := of.NewMessage(header.Type)
+	if msg == nil {
 		log.Printf("Unknown message, returning header %v", header.String())
-		return header
+		return &header, nil
 	}
 	err = msg.Read(&header, rawBody)
 	if err != nil {
-		log.Printf("Error reading msg: %v", err)
+		return nil, &DecodeError{header, err}
 	}
-	return msg
-
+	return msg, nil
 }
@@ -0,0 +1,495 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"goof/of"
+	"goof/packets"
+	"goof/record"
+	"goof/softswitch"
+	"net"
+	"testing"
+	"time"
+)
+
+func FuzzReadMsg(f *testing.F) {
+	f.Add([]byte{1, 0, 0, 8, 0, 0, 0, 1})                      // HELLO
+	f.Add([]byte{1, 2, 0, 12, 0, 0, 0, 2, 'a', 'b', 'c', 'd'}) // ECHO_REQUEST
+	f.Add([]byte{1, 10, 0, 18, 0, 0, 0, 0, 0, 0, 1, 0, 0, 42, 0, 1, 0, 0})
+	f.Add([]byte{1, 0, 0, 4, 0, 0, 0, 1})  // length shorter than the header
+	f.Add([]byte{1, 99, 0, 8, 0, 0, 0, 1}) // unknown type
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rb := bufio.NewReader(bytes.NewReader(data))
+		for {
+			_, err := ReadMsg(rb)
+			if _, ok := err.(*DecodeError); ok {
+				continue
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+// Endlessly repeats one message, so benchmarks read from a stream that
+// never runs dry and never allocates.
+type repeatReader struct {
+	msg []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.msg[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.msg)
+	}
+	return n, nil
+}
+
+// A PacketIn carrying a TCP SYN, as a learning switch sees constantly.
+func packetInBytes() []byte {
+	frame, _ := hex.DecodeString("000000000002000000000001" + "0800" +
+		"450000280001000040060000" + "0a000001" + "0a000002" +
+		"04000050" + "00000000" + "00000000" + "50022000" + "00000000")
+	var buf bytes.Buffer
+	msg := &of.PacketIn{Header: &of.Header{}, BufferId: 1,
+		TotalLen: uint16(len(frame)), InPort: 1, Data: frame}
+	msg.Write(&buf)
+	return buf.Bytes()
+}
+
+func TestReaderPacketInAllocs(t *testing.T) {
+	r := NewReader(bufio.NewReader(&repeatReader{msg: packetInBytes()}))
+	defer r.Release()
+	r.ReadMsg() // take a buffer from the pool
+	allocs := testing.AllocsPerRun(1000, func() {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := msg.(*of.PacketIn); !ok || m.EthFrame == nil {
+			t.Fatalf("bad message %#v", msg)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per PacketIn, want 0", allocs)
+	}
+}
+
+func BenchmarkReaderPacketIn(b *testing.B) {
+	msg := packetInBytes()
+	r := NewReader(bufio.NewReader(&repeatReader{msg: msg}))
+	defer r.Release()
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.ReadMsg()
+	}
+}
+
+// What a learning switch pays per PacketIn when it only reads the MACs.
+func BenchmarkReaderPacketInLazy(b *testing.B) {
+	msg := packetInBytes()
+	r := NewReader(bufio.NewReader(&repeatReader{msg: msg}))
+	r.decoder.Lazy = true
+	defer r.Release()
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m, _ := r.ReadMsg()
+		m.(*of.PacketIn).Packet.SrcMAC()
+	}
+}
+
+func BenchmarkReadMsgPacketIn(b *testing.B) {
+	msg := packetInBytes()
+	rb := bufio.NewReader(&repeatReader{msg: msg})
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ReadMsg(rb)
+	}
+}
+
+func TestReaderMatchesReadMsg(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(packetInBytes())
+	(&of.EchoRequest{Header: of.Header{Xid: 2}, Body: []byte("ping")}).Write(&stream)
+	(&of.PortStatus{Header: &of.Header{Xid: 3}, Reason: of.PortAdd}).Write(&stream)
+	(&of.Error{Header: of.Header{Xid: 4}, Type: of.BadRequest}).Write(&stream)
+	stream.Write([]byte{1, 99, 0, 8, 0, 0, 0, 5}) // unknown type
+	raw := stream.Bytes()
+
+	rb := bufio.NewReader(bytes.NewReader(raw))
+	r := NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	defer r.Release()
+	for {
+		want, err1 := ReadMsg(rb)
+		got, err2 := r.ReadMsg()
+		if (err1 == nil) != (err2 == nil) {
+			t.Fatalf("errors differ: %v, %v", err1, err2)
+		}
+		if err1 != nil {
+			return
+		}
+		w, _ := json.Marshal(want)
+		g, _ := json.Marshal(got)
+		if !bytes.Equal(w, g) {
+			t.Errorf("want %s, got %s", w, g)
+		}
+	}
+}
+
+func TestReaderLazyPacketIn(t *testing.T) {
+	r := NewReader(bufio.NewReader(&repeatReader{msg: packetInBytes()}))
+	r.decoder.Lazy = true
+	defer r.Release()
+	r.ReadMsg()
+	allocs := testing.AllocsPerRun(1000, func() {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := msg.(*of.PacketIn)
+		if m.EthFrame != nil || m.Packet.DstMAC() != [6]byte{0, 0, 0, 0, 0, 2} {
+			t.Fatalf("bad message %#v", msg)
+		}
+		if tcp, _ := m.Packet.TCP(); tcp == nil || tcp.DstPort != 80 {
+			t.Fatalf("bad TCP layer %+v", tcp)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per PacketIn, want 0", allocs)
+	}
+}
+
+// A PacketIn too short to decode, with xid 2.
+var shortPacketIn = []byte{1, byte(of.OFPT_PACKET_IN), 0, 12, 0, 0, 0, 2, 0, 0, 0, 7}
+
+func TestDecodeError(t *testing.T) {
+	var stream bytes.Buffer
+	(&of.EchoRequest{Header: of.Header{Xid: 1}}).Write(&stream)
+	stream.Write(shortPacketIn)
+	(&of.EchoRequest{Header: of.Header{Xid: 3}}).Write(&stream)
+	raw := stream.Bytes()
+
+	rb := bufio.NewReader(bytes.NewReader(raw))
+	r := NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	defer r.Release()
+	for i, read := range []func() (interface{}, error){
+		func() (interface{}, error) { return ReadMsg(rb) }, r.ReadMsg} {
+		read()
+		msg, err := read()
+		if e, ok := err.(*DecodeError); !ok || msg != nil || e.Header.Xid != 2 {
+			t.Errorf("reader %d: got %v, %v for a short PACKET_IN", i, msg, err)
+		}
+		if m, err := read(); err != nil || m.(*of.EchoRequest).Xid != 3 {
+			t.Errorf("reader %d: got %v, %v after the short PACKET_IN", i, m, err)
+		}
+	}
+}
+
+// Serve drops a message it cannot decode and goes on with the next.
+func TestServeSkipsBadMessage(t *testing.T) {
+	ctrlEnd, switchEnd := net.Pipe()
+	sw := NewSwitch(ctrlEnd)
+	var ports []uint16
+	sw.HandlePacketIn = func(msg *of.PacketIn) {
+		ports = append(ports, msg.InPort)
+	}
+	done := make(chan bool)
+	go func() {
+		sw.Serve()
+		done <- true
+	}()
+	switchEnd.Write(shortPacketIn)
+	(&of.PacketIn{Header: &of.Header{Xid: 3}, BufferId: 8, InPort: 4}).Write(switchEnd)
+	switchEnd.Close()
+	<-done
+	if len(ports) != 1 || ports[0] != 4 {
+		t.Errorf("handler saw PacketIns from ports %v, want [4]", ports)
+	}
+}
+
+// A switch sends only the first miss_send_len bytes of a frame, 128 by
+// default, and such PacketIns still reach the handler.
+func TestServeClippedFrames(t *testing.T) {
+	udp := &packets.UDPHeader{SrcPort: 68, DstPort: 67, Payload: make([]byte, 300)}
+	dhcp, _ := packets.NewEthFrame([6]byte{0, 0, 0, 0, 0, 1}, [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		packets.NewIPv4(0, 0xffffffff, udp)).Serialize()
+	tcp, _ := packets.NewEthFrame([6]byte{0, 0, 0, 0, 0, 1}, [6]byte{0, 0, 0, 0, 0, 2},
+		packets.NewIPv4(1, 2, &packets.TCPHeader{SrcPort: 1, DstPort: 2})).Serialize()
+
+	ctrlEnd, switchEnd := net.Pipe()
+	sw := NewSwitch(ctrlEnd)
+	var ports []uint16
+	var udpPorts []uint16
+	var frameErrs int
+	sw.HandlePacketIn = func(msg *of.PacketIn) {
+		ports = append(ports, msg.InPort)
+		if msg.FrameErr != nil {
+			frameErrs++
+		}
+		if h, _ := msg.Packet.UDP(); h != nil {
+			udpPorts = append(udpPorts, h.DstPort)
+		}
+	}
+	done := make(chan bool)
+	go func() {
+		sw.Serve()
+		done <- true
+	}()
+	(&of.PacketIn{Header: &of.Header{Xid: 1}, BufferId: 8, TotalLen: uint16(len(dhcp)),
+		InPort: 1, Data: dhcp[:128]}).Write(switchEnd)
+	(&of.PacketIn{Header: &of.Header{Xid: 2}, BufferId: 9, TotalLen: uint16(len(tcp)),
+		InPort: 2, Data: tcp[:14+20+10]}).Write(switchEnd) // inside the TCP header
+	switchEnd.Close()
+	<-done
+	if len(ports) != 2 || ports[0] != 1 || ports[1] != 2 {
+		t.Errorf("handler saw PacketIns from ports %v, want [1 2]", ports)
+	}
+	if len(udpPorts) != 1 || udpPorts[0] != 67 || frameErrs != 1 {
+		t.Errorf("handler saw UDP ports %v and %d frame errors", udpPorts, frameErrs)
+	}
+}
+
+// PortMod.Write makes several writes; messages sent from many goroutines
+// must still reach the switch whole.
+func TestSendConcurrent(t *testing.T) {
+	ctrlEnd, switchEnd := net.Pipe()
+	sw := NewSwitch(ctrlEnd)
+	const senders, each = 4, 50
+	for i := 0; i < senders; i++ {
+		go func(port uint16) {
+			for j := 0; j < each; j++ {
+				sw.Send(&of.PortMod{Xid: uint32(j), PortNo: port, Config: 1, Mask: 1})
+			}
+		}(uint16(i + 1))
+	}
+	rb := bufio.NewReader(switchEnd)
+	for n := 0; n < senders*each; n++ {
+		msg, err := ReadMsg(rb)
+		if err != nil {
+			t.Fatalf("after %d messages: %v", n, err)
+		}
+		m, ok := msg.(*of.PortMod)
+		if !ok || m.PortNo < 1 || m.PortNo > senders || m.Config != 1 || m.Mask != 1 {
+			t.Fatalf("after %d messages got %#v", n, msg)
+		}
+	}
+	ctrlEnd.Close()
+}
+
+// An app that floods every PacketIn and notes its in_port.
+func floodApp(ports *[]uint16) NewSwitchHandler {
+	return func(sw *Switch) {
+		sw.HandlePacketIn = func(msg *of.PacketIn) {
+			*ports = append(*ports, msg.InPort)
+			sw.Send(&of.PacketOut{BufferId: msg.BufferId, InPort: msg.InPort,
+				Actions: []of.Action{&of.ActionOutput{Port: of.PortFlood}}})
+		}
+		sw.Serve()
+	}
+}
+
+func readRecords(t *testing.T, b []byte) []*record.Record {
+	r, err := record.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []*record.Record
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			return recs
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	var live bytes.Buffer
+	w, _ := record.NewWriter(&live)
+	ctrlEnd, switchEnd := net.Pipe()
+	sw := NewSwitch(ctrlEnd)
+	sw.Record(w)
+	var ports []uint16
+	done := make(chan bool)
+	go func() {
+		floodApp(&ports)(sw)
+		done <- true
+	}()
+
+	// Play the switch.
+	rb := bufio.NewReader(switchEnd)
+	expect := func(want of.Type) {
+		r := NewReader(rb)
+		defer r.Release()
+		if _, err := r.ReadMsg(); err != nil {
+			t.Fatal(err)
+		}
+		if got := of.Type(r.Raw()[1]); got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	(&of.Hello{Header: of.Header{Xid: 1}}).Write(switchEnd)
+	expect(of.OFPT_HELLO)
+	expect(of.OFPT_FEATURES_REQUEST)
+	for port := uint16(1); port <= 2; port++ {
+		(&of.PacketIn{Header: &of.Header{Xid: 2}, BufferId: 7, InPort: port}).Write(switchEnd)
+		expect(of.OFPT_PACKET_OUT)
+	}
+	switchEnd.Close()
+	<-done
+
+	recs := readRecords(t, live.Bytes())
+	wantDirs := []record.Direction{record.FromSwitch, record.ToSwitch, record.ToSwitch,
+		record.FromSwitch, record.ToSwitch, record.FromSwitch, record.ToSwitch}
+	if len(recs) != len(wantDirs) {
+		t.Fatalf("%d records, want %d", len(recs), len(wantDirs))
+	}
+	for i, rec := range recs {
+		if rec.Direction != wantDirs[i] {
+			t.Errorf("record %d is %v, want %v", i, rec.Direction, wantDirs[i])
+		}
+	}
+
+	var replayed bytes.Buffer
+	w2, _ := record.NewWriter(&replayed)
+	var replayPorts []uint16
+	r, _ := record.NewReader(bytes.NewReader(live.Bytes()))
+	err := Replay(r, func(sw *Switch) {
+		sw.Record(w2)
+		floodApp(&replayPorts)(sw)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayPorts) != 2 || replayPorts[0] != 1 || replayPorts[1] != 2 {
+		t.Errorf("replay saw PacketIns from ports %v, want [1 2]", replayPorts)
+	}
+	again := readRecords(t, replayed.Bytes())
+	if len(again) != len(recs) {
+		t.Fatalf("replay made %d records, want %d", len(again), len(recs))
+	}
+	for i := range recs {
+		if again[i].Direction != recs[i].Direction || !bytes.Equal(again[i].Data, recs[i].Data) {
+			t.Errorf("record %d differs: % x, want % x", i, again[i].Data, recs[i].Data)
+		}
+	}
+}
+
+// Sends the FlowMods an earlier run of an app left on a switch.
+func installStale(sw *Switch) {
+	for _, f := range []struct {
+		cookie uint64
+		tpDst  uint16
+		port   uint16
+	}{
+		{7, 22, 1},   // no longer wanted
+		{7, 53, 3},   // still wanted
+		{7, 80, 1},   // wanted to output to 2
+		{9, 25, 1},   // another app's
+		{7, 21, 1},   // wanted until it expired
+		{7, 8080, 4}, // wanted with an idle timeout
+	} {
+		sw.Send(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll &^ of.FwTpDst, TpDst: f.tpDst},
+			Cookie: f.cookie, BufferId: 0xffffffff, Priority: 10,
+			Actions: []of.Action{&of.ActionOutput{Port: f.port}}})
+	}
+}
+
+// Returns the commands of the FlowMods recorded as sent to the switch.
+func flowModCommands(t *testing.T, b []byte) []of.FlowModCommand {
+	var cmds []of.FlowModCommand
+	for _, rec := range readRecords(t, b) {
+		if rec.Direction != record.ToSwitch {
+			continue
+		}
+		msg, err := ReadMsg(bufio.NewReader(bytes.NewReader(rec.Data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fm, ok := msg.(*of.FlowMod); ok {
+			cmds = append(cmds, fm.Command)
+		}
+	}
+	return cmds
+}
+
+func TestReconcile(t *testing.T) {
+	var want of.FlowTable
+	now := time.Now()
+	for _, f := range []struct {
+		tpDst, port, idle, hard uint16
+		added                   time.Time
+	}{
+		{53, 3, 0, 0, now},
+		{80, 2, 0, 0, now},
+		{443, 4, 0, 0, now},
+		{21, 1, 0, 1, now.Add(-2 * time.Second)}, // expired before reconciling
+		{8080, 4, 30, 0, now},
+	} {
+		want.Apply(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll &^ of.FwTpDst, TpDst: f.tpDst},
+			Priority: 10, IdleTimeout: f.idle, HardTimeout: f.hard,
+			Actions: []of.Action{&of.ActionOutput{Port: f.port}}}, f.added)
+	}
+
+	soft := softswitch.New(1)
+	for no := uint16(1); no <= 4; no++ {
+		soft.AddPort(no, "", func([]byte) {})
+	}
+	ctrlEnd, switchEnd := net.Pipe()
+	go soft.Serve(switchEnd)
+	defer switchEnd.Close()
+
+	var sent bytes.Buffer
+	w, _ := record.NewWriter(&sent)
+	sw := NewSwitch(ctrlEnd)
+	done := make(chan error, 2)
+	sw.HandleSwitchFeatures = func(msg *of.SwitchFeatures) {
+		sw.Record(w)
+		installStale(sw)
+		sw.Reconcile(7, &want, func(err error) {
+			done <- err
+			// Once converged, there is nothing left to do.
+			sw.Reconcile(7, &want, func(err error) { done <- err })
+		})
+	}
+	go sw.Serve()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("reconciliation did not finish")
+		}
+	}
+
+	cmds := flowModCommands(t, sent.Bytes())
+	wantCmds := []of.FlowModCommand{of.FCAdd, of.FCAdd, of.FCAdd, of.FCAdd, of.FCAdd, of.FCAdd,
+		of.FCDeleteStrict, of.FCDeleteStrict, of.FCDeleteStrict, // 8080, 22, 21
+		of.FCModifyStrict, of.FCAdd, of.FCAdd} // 80, 443, 8080
+	if len(cmds) != len(wantCmds) {
+		t.Fatalf("sent FlowMods %v, want %v", cmds, wantCmds)
+	}
+	for i := range cmds {
+		if cmds[i] != wantCmds[i] {
+			t.Fatalf("sent FlowMods %v, want %v", cmds, wantCmds)
+		}
+	}
+	// Port 53, 80, 443 and 8080 flows for app 7 and port 25 for app 9.
+	if n := soft.FlowCount(); n != 5 {
+		t.Errorf("%d flows on the switch, want 5", n)
+	}
+	if n := want.Len(); n != 4 {
+		t.Errorf("%d flows wanted after expiry, want 4", n)
+	}
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"goof/of"
+	"io"
+	"log"
+	"sync"
+)
+
+// Largest message that the 16-bit length field allows.
+const maxMsgLen = 0xffff
+
+// Message buffers shared by all connections.  Each one holds the largest
+// possible message, so a Reader never needs to grow its buffer.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new([maxMsgLen]byte) },
+}
+
+// The error returned for a message that was read whole but whose body failed
+// to decode.  The stream is still in step, so reading may go on past it.  A
+// PacketIn whose frame fails to parse is returned without one; its error is
+// in FrameErr.
+type DecodeError struct {
+	Header of.Header
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("bad %s message: %v", e.Header.Type, e.Err)
+}
+
+// A Reader reads messages from a switch connection like ReadMsg, but without
+// allocating for the messages a busy switch sends most (see of.Decoder).  The
+// body buffer is taken from a shared pool on the first read and handed back
+// by Release.
+//
+// Each message returned by ReadMsg is only valid until the next call.
+type Reader struct {
+	rb      *bufio.Reader
+	buf     *[maxMsgLen]byte // the header and body of the last message
+	length  int
+	decoder of.Decoder
+	unknown of.Header
+}
+
+func NewReader(rb *bufio.Reader) *Reader {
+	return &Reader{rb: rb}
+}
+
+// Reads the next message, with the same results as ReadMsg.
+func (r *Reader) ReadMsg() (interface{}, error) {
+	if r.buf == nil {
+		r.buf = bufPool.Get().(*[maxMsgLen]byte)
+	}
+	r.length = 0
+	header := r.buf[:of.HeaderSize]
+	_, err := io.ReadFull(r.rb, header)
+	if err != nil {
+		return nil, fmt.Errorf("error reading header; %s", err)
+	}
+	h := of.Header{
+		Version: header[0],
+		Type:    of.Type(header[1]),
+		Length:  binary.BigEndian.Uint16(header[2:]),
+		Xid:     binary.BigEndian.Uint32(header[4:]),
+	}
+	if h.Length < of.HeaderSize {
+		return nil, fmt.Errorf("bad message length %d", h.Length)
+	}
+
+	body := r.buf[of.HeaderSize:h.Length]
+	_, err = io.ReadFull(r.rb, body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body; %s", err)
+	}
+	r.length = int(h.Length)
+
+	msg, err := r.decoder.Decode(&h, body)
+	if msg == nil {
+		r.unknown = h
+		log.Printf("Unknown message, returning header %v", r.unknown.String())
+		return &r.unknown, nil
+	}
+	if err != nil {
+		return nil, &DecodeError{h, err}
+	}
+	return msg, nil
+}
+
+// Returns the raw bytes of the message last read, header included, or nil
+// if the last read failed other than with a DecodeError.  Like the message,
+// they are only valid until the next call to ReadMsg.
+func (r *Reader) Raw() []byte {
+	if r.length == 0 {
+		return nil
+	}
+	return r.buf[:r.length]
+}
+
+// Returns the buffer to the pool.  Messages read so far become invalid; the
+// Reader may still be used and takes a new buffer when needed.
+func (r *Reader) Release() {
+	if r.buf != nil {
+		bufPool.Put(r.buf)
+		r.buf = nil
+		r.length = 0
+	}
+}
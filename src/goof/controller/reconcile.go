@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"goof/of"
+	"sync/atomic"
+	"time"
+)
+
+var errClosed = errors.New("connection closed")
+
+// A reconciliation in progress, from the flow stats request to the barrier
+// that follows its FlowMods.  Every message it sends carries xid, so errors
+// the switch sends back can be told apart.
+type reconciliation struct {
+	cookie uint64
+	want   *of.FlowTable
+	done   func(err error)
+	xid    uint32
+	have   []*of.FlowStat
+	synced bool // the FlowMods and barrier are sent
+	err    error
+}
+
+// Returns an xid for a request the Switch makes itself.  They count down
+// from 0xffffffff, away from the xids apps usually pick.
+func (self *Switch) newXid() uint32 {
+	return atomic.AddUint32(&self.xid, ^uint32(0)) + 1
+}
+
+// Brings the flows with cookie on the switch in line with want, the flows
+// an app means to have installed there, as it must after a restart when
+// the switch kept the flows of the app's previous run.  The switch's flows
+// are read with a flow stats request; then flows with cookie that want
+// lacks are deleted, those whose actions differ are modified and those
+// missing are added with cookie, and a barrier follows.  A strict modify
+// changes only the actions in OpenFlow 1.0, so a flow whose timeouts differ
+// is deleted and added again instead.  Flow stats do not report a flow's
+// flags, so those are not compared.  Flows with other cookies belong to
+// other apps and are left alone, though adding a flow replaces any other
+// with the same match and priority, as it always does.
+//
+// want is read, and its expired entries removed, on the goroutine running
+// Serve once the switch's flows have arrived, so handlers may keep changing
+// it until then.  done, if not nil,
+// is called on that goroutine when the barrier is answered, with the first
+// error the switch sent back for any of the requests, or when the
+// connection closes first.
+func (self *Switch) Reconcile(cookie uint64, want *of.FlowTable, done func(err error)) error {
+	xid := self.newXid()
+	req, err := of.NewStatsRequest(xid, of.StatsFlow, &of.FlowStatsRequest{
+		Match: of.Match{Wildcards: of.FwAll}, TableId: 0xff, OutPort: of.OFPP_NONE})
+	if err != nil {
+		return err
+	}
+	self.reconcileMu.Lock()
+	if self.reconciling == nil {
+		self.reconciling = make(map[uint32]*reconciliation)
+	}
+	self.reconciling[xid] = &reconciliation{cookie: cookie, want: want, done: done, xid: xid}
+	self.reconcileMu.Unlock()
+	err = self.Send(req)
+	if err != nil {
+		self.reconcileMu.Lock()
+		delete(self.reconciling, xid)
+		self.reconcileMu.Unlock()
+	}
+	return err
+}
+
+// Passes a message to the reconciliation it answers, if any, and reports
+// whether it did.
+func (self *Switch) reconcile(msg interface{}) bool {
+	var xid uint32
+	switch m := msg.(type) {
+	case *of.StatsReply:
+		xid = m.Xid
+	case *of.BarrierReply:
+		xid = m.Xid
+	case *of.Error:
+		xid = m.Xid
+	default:
+		return false
+	}
+	self.reconcileMu.Lock()
+	r := self.reconciling[xid]
+	self.reconcileMu.Unlock()
+	if r == nil {
+		return false
+	}
+	switch m := msg.(type) {
+	case *of.StatsReply:
+		stats, err := m.Stats()
+		if err != nil {
+			self.finish(r, err)
+			return true
+		}
+		for _, s := range stats {
+			if s, ok := s.(*of.FlowStat); ok {
+				r.have = append(r.have, s)
+			}
+		}
+		if m.Flags&of.StatsReplyMore == 0 {
+			self.sync(r)
+		}
+	case *of.BarrierReply:
+		self.finish(r, r.err)
+	case *of.Error:
+		err := fmt.Errorf("switch refused reconciliation: %v", m)
+		if !r.synced {
+			self.finish(r, err)
+		} else if r.err == nil {
+			r.err = err
+		}
+	}
+	return true
+}
+
+// Sends the FlowMods that bring the switch to r.want, and the barrier.
+func (self *Switch) sync(r *reconciliation) {
+	r.synced = true
+	for _, fm := range r.flowMods(time.Now()) {
+		fm.Xid = r.xid
+		if err := self.Send(fm); err != nil {
+			self.finish(r, err)
+			return
+		}
+	}
+	if err := self.Send(&of.BarrierRequest{Xid: r.xid}); err != nil {
+		self.finish(r, err)
+	}
+}
+
+func (self *Switch) finish(r *reconciliation, err error) {
+	self.reconcileMu.Lock()
+	delete(self.reconciling, r.xid)
+	self.reconcileMu.Unlock()
+	if r.done != nil {
+		r.done(err)
+	}
+}
+
+// Ends the reconciliations still waiting when the connection closes.
+func (self *Switch) abandonReconciliations() {
+	self.reconcileMu.Lock()
+	pending := self.reconciling
+	self.reconciling = nil
+	self.reconcileMu.Unlock()
+	for _, r := range pending {
+		if r.done != nil {
+			r.done(errClosed)
+		}
+	}
+}
+
+// Returns the fewest FlowMods that turn the flows with r.cookie on the
+// switch into r.want as of now: strict deletes first, then strict modifies
+// and adds.
+func (r *reconciliation) flowMods(now time.Time) []*of.FlowMod {
+	r.want.Expire(now)
+	type key struct {
+		match    of.Match
+		priority uint16
+	}
+	have := make(map[key]*of.FlowStat)
+	for _, s := range r.have {
+		if s.Cookie == r.cookie {
+			have[key{s.Match.Normalized(), s.Priority}] = s
+		}
+	}
+	var deletes, mods []*of.FlowMod
+	wanted := make(map[key]bool)
+	for _, e := range r.want.Entries() {
+		k := key{e.Match, e.Priority}
+		wanted[k] = true
+		s, ok := have[k]
+		sameTimeouts := ok && s.IdleTimeout == e.IdleTimeout && s.HardTimeout == e.HardTimeout
+		if sameTimeouts && sameActions(s.Actions, e.Actions) {
+			continue
+		}
+		fm := &of.FlowMod{Match: e.Match, Cookie: r.cookie, Command: of.FCAdd,
+			IdleTimeout: e.IdleTimeout, HardTimeout: e.HardTimeout, Priority: e.Priority,
+			BufferId: 0xffffffff, OutPort: of.OFPP_NONE, Flags: e.Flags, Actions: e.Actions}
+		switch {
+		case sameTimeouts:
+			fm.Command = of.FCModifyStrict
+		case ok:
+			deletes = append(deletes, deleteStrict(s, r.cookie))
+		}
+		mods = append(mods, fm)
+	}
+	for _, s := range r.have {
+		k := key{s.Match.Normalized(), s.Priority}
+		if s.Cookie != r.cookie || wanted[k] {
+			continue
+		}
+		deletes = append(deletes, deleteStrict(s, r.cookie))
+	}
+	return append(deletes, mods...)
+}
+
+func deleteStrict(s *of.FlowStat, cookie uint64) *of.FlowMod {
+	return &of.FlowMod{Match: s.Match, Cookie: cookie, Command: of.FCDeleteStrict,
+		Priority: s.Priority, BufferId: 0xffffffff, OutPort: of.OFPP_NONE}
+}
+
+// Reports whether two action lists encode the same.
+func sameActions(a, b []of.Action) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var x, y bytes.Buffer
+	for i := range a {
+		x.Reset()
+		y.Reset()
+		if a[i].WriteAction(&x) != nil || b[i].WriteAction(&y) != nil ||
+			!bytes.Equal(x.Bytes(), y.Bytes()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"goof/record"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// Feeds the switch side of a recording to h, as if that switch had just
+// connected, and returns once h does.  Messages reach the Switch in their
+// recorded order, one after another and without the recorded delays, so a
+// bug seen with a real switch can be reproduced at will.  What the app
+// sends is discarded unless it records the Switch itself.
+//
+// h is run on the calling goroutine and should end by calling Serve, which
+// returns when the recording runs out.
+func Replay(r *record.Reader, h NewSwitchHandler) error {
+	ctrlEnd, switchEnd := net.Pipe()
+	fed := make(chan error, 1)
+	go func() {
+		fed <- feed(r, switchEnd)
+	}()
+	go io.Copy(ioutil.Discard, switchEnd)
+
+	sw := NewSwitch(ctrlEnd)
+	h(sw)
+	sw.Close()
+	return <-fed
+}
+
+// Writes the messages that came from the switch to conn, then closes it.
+func feed(r *record.Reader, conn net.Conn) error {
+	defer conn.Close()
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Direction != record.FromSwitch {
+			continue
+		}
+		_, err = conn.Write(rec.Data)
+		if err != nil {
+			return nil // the app closed the connection early
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Package dhcp implements a DHCP server that runs inside the controller:
+// requests reach it as PacketIns and replies leave as PacketOuts on the port
+// the request came in on.
+package dhcp
+
+import (
+	"errors"
+	"fmt"
+	"goof/controller"
+	"goof/of"
+	"goof/packets"
+	"log"
+	"sync"
+	"time"
+)
+
+// Pools are chosen by the datapath and VLAN a request arrives on.  A pool
+// added for AnyDatapath or AnyVLAN serves requests that no more specific
+// pool does; requests on untagged ports have VLAN of.OFP_VLAN_NONE.
+const (
+	AnyDatapath = ^uint64(0)
+	AnyVLAN     = 0xfffe
+)
+
+// How long an offered address is held for the client it was offered to.
+const offerTimeout = 30 * time.Second
+
+// A range of addresses and the configuration handed out with them.
+type Pool struct {
+	Start     uint32 // first address to lease
+	End       uint32 // last address to lease
+	Mask      uint32
+	Router    uint32   // omitted if 0
+	DNS       []uint32 // omitted if empty
+	LeaseTime time.Duration
+}
+
+type lease struct {
+	mac     [6]byte
+	ip      uint32
+	expires time.Time
+	bound   bool // acknowledged rather than only offered
+}
+
+type pool struct {
+	Pool
+	byMAC map[[6]byte]*lease
+	byIP  map[uint32]*lease
+}
+
+type poolKey struct {
+	dpid uint64
+	vlan uint16
+}
+
+type Server struct {
+	ip    uint32
+	mac   [6]byte
+	mu    sync.Mutex
+	pools map[poolKey]*pool
+	now   func() time.Time
+}
+
+// Returns a server that answers from address ip and hardware address mac.
+func NewServer(ip uint32, mac [6]byte) *Server {
+	return &Server{ip: ip, mac: mac, pools: make(map[poolKey]*pool),
+		now: time.Now}
+}
+
+func (s *Server) AddPool(dpid uint64, vlan uint16, p Pool) error {
+	if p.Start > p.End {
+		return errors.New("pool ends before it starts")
+	}
+	if p.LeaseTime < time.Second {
+		return errors.New("lease time under a second")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := poolKey{dpid, vlan}
+	if s.pools[key] != nil {
+		return fmt.Errorf("pool for datapath %x, VLAN %d already added", dpid, vlan)
+	}
+	s.pools[key] = &pool{p, make(map[[6]byte]*lease), make(map[uint32]*lease)}
+	return nil
+}
+
+func (s *Server) pool(dpid uint64, vlan uint16) *pool {
+	for _, key := range []poolKey{{dpid, vlan}, {dpid, AnyVLAN},
+		{AnyDatapath, vlan}, {AnyDatapath, AnyVLAN}} {
+		if p := s.pools[key]; p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *pool) contains(ip uint32) bool {
+	return ip >= p.Start && ip <= p.End
+}
+
+func (p *pool) free(ip uint32, now time.Time) bool {
+	l := p.byIP[ip]
+	return l == nil || now.After(l.expires)
+}
+
+func (p *pool) remove(l *lease) {
+	if p.byMAC[l.mac] == l {
+		delete(p.byMAC, l.mac)
+	}
+	if p.byIP[l.ip] == l {
+		delete(p.byIP, l.ip)
+	}
+}
+
+// Returns the lease of mac, taking a free address for it if it has none.
+// The requested address is preferred.  Returns nil if the pool is
+// exhausted.
+func (p *pool) allocate(mac [6]byte, requested uint32, now time.Time) *lease {
+	if l := p.byMAC[mac]; l != nil {
+		return l
+	}
+	ip := uint32(0)
+	if p.contains(requested) && p.free(requested, now) {
+		ip = requested
+	} else {
+		for a := p.Start; ; a++ {
+			if p.free(a, now) {
+				ip = a
+				break
+			}
+			if a == p.End {
+				return nil
+			}
+		}
+	}
+	if old := p.byIP[ip]; old != nil {
+		p.remove(old)
+	}
+	l := &lease{mac: mac, ip: ip}
+	p.byMAC[mac] = l
+	p.byIP[ip] = l
+	return l
+}
+
+// Answers msg if it is a DHCP request, returning the reply (nil if none is
+// due) and whether msg was a DHCP request at all.  dpid identifies the
+// switch msg came from.
+func (s *Server) Handle(dpid uint64, msg *of.PacketIn) (*of.PacketOut, bool) {
+	pkt := msg.Packet
+	if pkt == nil {
+		pkt = packets.NewPacket(msg.Data)
+	}
+	udp, _ := pkt.UDP()
+	if udp == nil || udp.DstPort != packets.DHCPServerPort {
+		return nil, false
+	}
+	req, err := packets.ParseDHCP(udp.Payload)
+	if err != nil || req.Op != packets.BootRequest {
+		return nil, false
+	}
+	tags, _ := pkt.Tags()
+	vlan := uint16(of.OFP_VLAN_NONE)
+	if len(tags) > 0 {
+		vlan = tags[0].VID
+	}
+
+	s.mu.Lock()
+	reply := s.answer(s.pool(dpid, vlan), req)
+	s.mu.Unlock()
+	if reply == nil {
+		return nil, true
+	}
+	data, err := s.frame(req, reply, tags)
+	if err != nil {
+		log.Printf("dhcp: %v", err)
+		return nil, true
+	}
+	return &of.PacketOut{BufferId: 0xffffffff, InPort: of.OFPP_NONE,
+		Actions: []of.Action{&of.ActionOutput{Port: msg.InPort}},
+		Data:    data}, true
+}
+
+// Works out the reply to req from pool p, which may be nil.  Called with
+// s.mu held.
+func (s *Server) answer(p *pool, req *packets.DHCPPacket) *packets.DHCPPacket {
+	if p == nil {
+		return nil
+	}
+	now := s.now()
+	mac := req.ClientMAC()
+	switch req.MessageType() {
+	case packets.DHCPDiscover:
+		l := p.allocate(mac, req.OptionIP(packets.DHCPOptRequestedIP), now)
+		if l == nil {
+			log.Printf("dhcp: no address left for %x", mac)
+			return nil
+		}
+		if !l.bound {
+			l.expires = now.Add(offerTimeout)
+		}
+		return s.reply(p, req, packets.DHCPOffer, l.ip)
+	case packets.DHCPRequest:
+		if id := req.OptionIP(packets.DHCPOptServerID); id != 0 && id != s.ip {
+			// The client took another server's offer.
+			if l := p.byMAC[mac]; l != nil && !l.bound {
+				p.remove(l)
+			}
+			return nil
+		}
+		requested := req.OptionIP(packets.DHCPOptRequestedIP)
+		if requested == 0 {
+			requested = req.CIAddr // renewing
+		}
+		l := p.byMAC[mac]
+		if l == nil && p.contains(requested) {
+			l = p.allocate(mac, requested, now) // rebooting with an old address
+		}
+		if l == nil || l.ip != requested {
+			if l != nil && !l.bound {
+				p.remove(l)
+			}
+			return s.reply(p, req, packets.DHCPNak, 0)
+		}
+		l.bound = true
+		l.expires = now.Add(p.LeaseTime)
+		return s.reply(p, req, packets.DHCPAck, l.ip)
+	case packets.DHCPDecline:
+		// Someone else has the address; keep it out of use for a lease time.
+		if l := p.byMAC[mac]; l != nil {
+			p.remove(l)
+			taken := &lease{ip: l.ip, expires: now.Add(p.LeaseTime), bound: true}
+			p.byIP[l.ip] = taken
+		}
+	case packets.DHCPRelease:
+		if l := p.byMAC[mac]; l != nil && l.ip == req.CIAddr {
+			p.remove(l)
+		}
+	case packets.DHCPInform:
+		return s.reply(p, req, packets.DHCPAck, 0)
+	}
+	return nil
+}
+
+func (s *Server) reply(p *pool, req *packets.DHCPPacket, t uint8,
+	yiaddr uint32) *packets.DHCPPacket {
+	reply := req.Reply()
+	reply.YIAddr = yiaddr
+	reply.AddOption(packets.DHCPOptMessageType, []byte{t})
+	reply.AddOptionIP(packets.DHCPOptServerID, s.ip)
+	if t == packets.DHCPNak {
+		return reply
+	}
+	if yiaddr != 0 {
+		secs := uint32(p.LeaseTime / time.Second)
+		reply.AddOptionUint32(packets.DHCPOptLeaseTime, secs)
+		reply.AddOptionUint32(packets.DHCPOptRenewalTime, secs/2)
+		reply.AddOptionUint32(packets.DHCPOptRebindingTime, secs/8*7)
+	}
+	reply.AddOptionIP(packets.DHCPOptSubnetMask, p.Mask)
+	if p.Router != 0 {
+		reply.AddOptionIP(packets.DHCPOptRouter, p.Router)
+	}
+	if len(p.DNS) > 0 {
+		reply.AddOptionIP(packets.DHCPOptDNS, p.DNS...)
+	}
+	return reply
+}
+
+// Builds the frame carrying reply, addressed as RFC 2131 section 4.1
+// describes for clients without relays.
+func (s *Server) frame(req, reply *packets.DHCPPacket,
+	tags []packets.VLANTag) ([]byte, error) {
+	payload, err := reply.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	dstMAC, dstIP := req.ClientMAC(), reply.YIAddr
+	switch {
+	case req.CIAddr != 0:
+		dstIP = req.CIAddr
+	case req.Flags&packets.DHCPFlagBroadcast != 0 || reply.MessageType() == packets.DHCPNak:
+		dstMAC, dstIP = packets.BroadcastMAC, 0xffffffff
+	}
+	udp := &packets.UDPHeader{SrcPort: packets.DHCPServerPort,
+		DstPort: packets.DHCPClientPort, Payload: payload}
+	frame := packets.NewEthFrame(s.mac, dstMAC, packets.NewIPv4(s.ip, dstIP, udp))
+	frame.Tags = tags
+	return frame.Serialize()
+}
+
+// The flow Attach installs.  A switch sends only the first miss_send_len
+// bytes of a packet that misses, 128 by default, which cuts a DHCP request
+// off long before its options; this flow has the switch send the whole of
+// every datagram to the server port instead, ahead of any other flow.
+func requestFlow() *of.FlowMod {
+	return &of.FlowMod{
+		Match: of.Match{Wildcards: of.FwAll &^ (of.FwDlType | of.FwNwProto | of.FwTpDst),
+			EthFrameType: uint16(packets.EthTypeIP), NwProto: uint8(packets.ProtocolUDP),
+			TpDst: packets.DHCPServerPort},
+		Command: of.FCAdd, Priority: 0xffff, BufferId: 0xffffffff, OutPort: of.OFPP_NONE,
+		Actions: []of.Action{&of.ActionOutput{Port: of.OFPP_CONTROLLER, MaxLen: 0xffff}},
+	}
+}
+
+// Makes s answer DHCP requests arriving at sw, installing a flow that
+// brings them to the controller whole once sw has sent its features.
+// Other PacketIns go to the handler sw had before, so call Attach after
+// setting it.
+func (s *Server) Attach(sw *controller.Switch) {
+	next := sw.HandlePacketIn
+	features := sw.HandleSwitchFeatures
+	var dpid uint64
+	sw.HandleSwitchFeatures = func(msg *of.SwitchFeatures) {
+		dpid = msg.DatapathId
+		err := sw.Send(requestFlow())
+		if err != nil {
+			log.Printf("dhcp: installing the request flow failed, err = %s", err)
+		}
+		features(msg)
+	}
+	sw.HandlePacketIn = func(msg *of.PacketIn) {
+		out, ok := s.Handle(dpid, msg)
+		if !ok {
+			next(msg)
+			return
+		}
+		if out == nil {
+			return
+		}
+		err := sw.Send(out)
+		if err != nil {
+			log.Printf("dhcp: sending reply failed, err = %s", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package dhcp
+
+import (
+	"goof/controller"
+	"goof/of"
+	"goof/packets"
+	"goof/topology"
+	"testing"
+	"time"
+)
+
+var serverMAC = [6]byte{0x02, 0, 0, 0, 0, 0xfe}
+
+func newTestServer(t *testing.T) *Server {
+	s := NewServer(0x0a0000fe, serverMAC)
+	err := s.AddPool(AnyDatapath, AnyVLAN, Pool{Start: 0x0a00000a, End: 0x0a00000b,
+		Mask: 0xffffff00, Router: 0x0a000001, LeaseTime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddPool(1, 20, Pool{Start: 0x0a001400, End: 0x0a0014ff,
+		Mask: 0xffffff00, LeaseTime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Returns a PacketIn carrying a DHCP message of type t from the client
+// with the given MAC.
+func request(t *testing.T, mac byte, typ uint8, vlan uint16,
+	opts ...packets.DHCPOption) *of.PacketIn {
+	m := &packets.DHCPPacket{Op: packets.BootRequest, HType: 1, HLen: 6, Xid: 42}
+	m.CHAddr[5] = mac
+	m.AddOption(packets.DHCPOptMessageType, []byte{typ})
+	m.Options = append(m.Options, opts...)
+	payload, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &packets.UDPHeader{SrcPort: packets.DHCPClientPort,
+		DstPort: packets.DHCPServerPort, Payload: payload}
+	frame := packets.NewEthFrame(m.ClientMAC(), packets.BroadcastMAC,
+		packets.NewIPv4(0, 0xffffffff, udp))
+	if vlan != of.OFP_VLAN_NONE {
+		frame.Tags = []packets.VLANTag{{VID: vlan}}
+	}
+	data, err := frame.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &of.PacketIn{Header: &of.Header{}, BufferId: 0xffffffff, InPort: 3,
+		Data: data, Packet: packets.NewPacket(data)}
+}
+
+// Decodes the DHCP reply carried by out.
+func reply(t *testing.T, out *of.PacketOut) *packets.DHCPPacket {
+	if out == nil {
+		t.Fatal("no reply")
+	}
+	if len(out.Actions) != 1 || out.Actions[0].(*of.ActionOutput).Port != 3 {
+		t.Errorf("reply not sent back to the client port: %v", out.Actions)
+	}
+	udp, _ := packets.NewPacket(out.Data).UDP()
+	if udp == nil || udp.DstPort != packets.DHCPClientPort {
+		t.Fatalf("reply %x is not to the DHCP client port", out.Data)
+	}
+	m, err := packets.ParseDHCP(udp.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func ipOption(code uint8, ip uint32) packets.DHCPOption {
+	return packets.DHCPOption{Code: code,
+		Data: []byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}}
+}
+
+func TestLease(t *testing.T) {
+	s := newTestServer(t)
+	out, ok := s.Handle(1, request(t, 1, packets.DHCPDiscover, of.OFP_VLAN_NONE))
+	if !ok {
+		t.Fatal("discover not recognized")
+	}
+	offer := reply(t, out)
+	if offer.MessageType() != packets.DHCPOffer || offer.YIAddr != 0x0a00000a ||
+		offer.OptionIP(packets.DHCPOptRouter) != 0x0a000001 {
+		t.Fatalf("bad offer %+v", offer)
+	}
+
+	// A second client is offered the other address while the first is held.
+	out, _ = s.Handle(1, request(t, 2, packets.DHCPDiscover, of.OFP_VLAN_NONE))
+	if ip := reply(t, out).YIAddr; ip != 0x0a00000b {
+		t.Errorf("second client offered %x", ip)
+	}
+	out, _ = s.Handle(1, request(t, 3, packets.DHCPDiscover, of.OFP_VLAN_NONE))
+	if out != nil {
+		t.Error("offered an address from an exhausted pool")
+	}
+
+	out, _ = s.Handle(1, request(t, 1, packets.DHCPRequest, of.OFP_VLAN_NONE,
+		ipOption(packets.DHCPOptRequestedIP, 0x0a00000a),
+		ipOption(packets.DHCPOptServerID, 0x0a0000fe)))
+	ack := reply(t, out)
+	if ack.MessageType() != packets.DHCPAck || ack.YIAddr != 0x0a00000a {
+		t.Fatalf("bad ack %+v", ack)
+	}
+	out, _ = s.Handle(1, request(t, 2, packets.DHCPRequest, of.OFP_VLAN_NONE,
+		ipOption(packets.DHCPOptRequestedIP, 0x0a00000a)))
+	if m := reply(t, out); m.MessageType() != packets.DHCPNak {
+		t.Errorf("request for a leased address got %+v", m)
+	}
+
+	// Offers expire; leases do not until their time is up.
+	s.now = func() time.Time { return time.Now().Add(time.Minute) }
+	out, _ = s.Handle(1, request(t, 3, packets.DHCPDiscover, of.OFP_VLAN_NONE))
+	if ip := reply(t, out).YIAddr; ip != 0x0a00000b {
+		t.Errorf("third client offered %x after the offer expired", ip)
+	}
+}
+
+func TestPoolByVLAN(t *testing.T) {
+	s := newTestServer(t)
+	out, _ := s.Handle(1, request(t, 1, packets.DHCPDiscover, 20))
+	if ip := reply(t, out).YIAddr; ip != 0x0a001400 {
+		t.Errorf("VLAN 20 on datapath 1 offered %x", ip)
+	}
+	out, _ = s.Handle(2, request(t, 1, packets.DHCPDiscover, 20))
+	if ip := reply(t, out).YIAddr; ip != 0x0a00000a {
+		t.Errorf("VLAN 20 on datapath 2 offered %x", ip)
+	}
+	tags, _ := packets.NewPacket(out.Data).Tags()
+	if len(tags) != 1 || tags[0].VID != 20 {
+		t.Errorf("reply tagged %v", tags)
+	}
+}
+
+func TestIgnoresOtherTraffic(t *testing.T) {
+	s := newTestServer(t)
+	frame, _ := packets.NewEthFrame([6]byte{}, [6]byte{}, packets.NewIPv4(1, 2,
+		&packets.UDPHeader{SrcPort: 53, DstPort: 53})).Serialize()
+	msg := &of.PacketIn{Header: &of.Header{}, Data: frame}
+	if _, ok := s.Handle(1, msg); ok {
+		t.Error("handled a DNS datagram")
+	}
+}
+
+// A discover sent through a switch, which sends the controller only the
+// first 128 bytes of what misses its flows, is still answered.
+func TestAttach(t *testing.T) {
+	n, err := topology.New(topology.Tree(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	s := newTestServer(t)
+	err = n.Start(func(sw *controller.Switch) {
+		sw.LazyFrames = true
+		sw.HandlePacketIn = func(msg *of.PacketIn) {
+			sw.Send(&of.PacketOut{BufferId: msg.BufferId, InPort: msg.InPort,
+				Actions: []of.Action{&of.ActionOutput{Port: of.PortFlood}}})
+		}
+		s.Attach(sw)
+		sw.Serve()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The flow goes out as the features arrive, which may be after Start
+	// returns.
+	sw := n.Switch("s1")
+	for deadline := time.Now().Add(2 * time.Second); sw.FlowCount() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no flow installed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	h1 := n.Host("h1")
+	m := &packets.DHCPPacket{Op: packets.BootRequest, HType: 1, HLen: 6, Xid: 7}
+	copy(m.CHAddr[:], h1.MAC[:])
+	m.AddOption(packets.DHCPOptMessageType, []byte{packets.DHCPDiscover})
+	payload, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := packets.NewEthFrame(h1.MAC, packets.BroadcastMAC,
+		packets.NewIPv4(0, 0xffffffff, &packets.UDPHeader{SrcPort: packets.DHCPClientPort,
+			DstPort: packets.DHCPServerPort, Payload: payload})).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1.Send(frame)
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		n.Settle()
+		for _, f := range h1.Received() {
+			ip, ok := f.Body.(*packets.IPFragment)
+			if !ok {
+				continue
+			}
+			udp, ok := ip.Body.(*packets.UDPHeader)
+			if !ok || udp.DstPort != packets.DHCPClientPort {
+				continue
+			}
+			offer, err := packets.ParseDHCP(udp.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offer.MessageType() != packets.DHCPOffer || offer.YIAddr != 0x0a00000a {
+				t.Fatalf("bad offer %+v", offer)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no offer for a %d byte discover", len(frame))
+}
@@ -0,0 +1,94 @@
+// Command dhcpd is a controller that answers DHCP requests itself and
+// floods all other traffic, so Mininet hosts can be configured without a
+// DHCP server of their own.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"goof/controller"
+	"goof/dhcp"
+	"goof/of"
+	"goof/pcap"
+	"log"
+	"net"
+	"time"
+)
+
+func parseIPv4(s string) uint32 {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		log.Fatalf("bad IPv4 address %q", s)
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+func main() {
+	port := flag.Int("port", 6633, "OpenFlow port to listen on")
+	serverIP := flag.String("server", "10.0.0.254", "address the server answers from")
+	serverMAC := flag.String("mac", "02:00:00:00:00:fe", "hardware address of the server")
+	start := flag.String("start", "10.0.0.100", "first address to lease")
+	end := flag.String("end", "10.0.0.199", "last address to lease")
+	prefix := flag.Int("prefix", 8, "prefix length of the leased addresses")
+	router := flag.String("router", "", "default router, if any")
+	leaseTime := flag.Duration("lease", time.Hour, "lease time")
+	capture := flag.String("pcap", "", "write PacketIns and PacketOuts to this pcap or pcapng file")
+	flag.Parse()
+
+	mac, err := net.ParseMAC(*serverMAC)
+	if err != nil || len(mac) != 6 {
+		log.Fatalf("bad MAC address %q", *serverMAC)
+	}
+	var hw [6]byte
+	copy(hw[:], mac)
+	pool := dhcp.Pool{
+		Start:     parseIPv4(*start),
+		End:       parseIPv4(*end),
+		Mask:      ^uint32(0) << uint(32-*prefix),
+		LeaseTime: *leaseTime,
+	}
+	if *router != "" {
+		pool.Router = parseIPv4(*router)
+	}
+	server := dhcp.NewServer(parseIPv4(*serverIP), hw)
+	err = server.AddPool(dhcp.AnyDatapath, dhcp.AnyVLAN, pool)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var w *pcap.Writer
+	if *capture != "" {
+		w, err = pcap.Create(*capture)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+	}
+
+	log.Printf("Starting server ...")
+	ctrl := controller.NewController()
+	err = ctrl.Accept(*port, func(sw *controller.Switch) {
+		sw.LazyFrames = true
+		if w != nil {
+			sw.Capture(w)
+		}
+		sw.HandlePacketIn = func(msg *of.PacketIn) {
+			out := &of.PacketOut{BufferId: msg.BufferId, InPort: msg.InPort,
+				Actions: []of.Action{&of.ActionOutput{Port: of.PortFlood}}}
+			if msg.BufferId == 0xffffffff {
+				out.Data = msg.Data
+			}
+			err := sw.Send(out)
+			if err != nil {
+				log.Printf("flooding failed, err = %s", err)
+			}
+		}
+		sw.HandleSwitchFeatures = func(msg *of.SwitchFeatures) {
+			log.Printf("Datapath %x online", msg.DatapathId)
+		}
+		sw.HandlePortStatus = func(msg *of.PortStatus) {}
+		server.Attach(sw)
+		sw.Serve()
+	})
+	log.Fatal(err)
+}
@@ -0,0 +1,183 @@
+// Command goof-dump prints the OpenFlow messages in a capture of the
+// traffic between switches and a controller, decoded down to matches,
+// actions and stats.  It reads pcap and pcapng files as written by tcpdump
+// or Wireshark, puts the TCP streams back together and decodes them with
+// package of.
+//
+//	goof-dump [-port 6633] capture.pcap
+package main
+
+import (
+	"flag"
+	"fmt"
+	"goof/packets"
+	"goof/pcap"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+var port = flag.Int("port", 6633, "TCP port of the controller")
+
+// Link types carrying packets without an Ethernet header.
+const (
+	linkTypeNull      = 0   // BSD loopback: a 4-byte address family
+	linkTypeLinuxSLL  = 113 // tcpdump -i any
+	linkTypeLinuxSLL2 = 276
+)
+
+// Returns the packet as an Ethernet frame, inventing a header for link
+// types that have none, or nil if the link type is not understood.
+func ethernetFrame(linkType uint16, data []byte) []byte {
+	var t packets.EthType
+	switch linkType {
+	case pcap.LinkTypeEthernet:
+		return data
+	case pcap.LinkTypeRaw:
+		data, t = ipPacket(data)
+	case linkTypeNull:
+		if len(data) < 4 {
+			return nil
+		}
+		data, t = ipPacket(data[4:])
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		data, t = data[16:], packets.EthType(uint16(data[14])<<8|uint16(data[15]))
+	case linkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		data, t = data[20:], packets.EthType(uint16(data[0])<<8|uint16(data[1]))
+	default:
+		return nil
+	}
+	if t == 0 {
+		return nil
+	}
+	frame := make([]byte, 14, 14+len(data))
+	frame[12], frame[13] = byte(t>>8), byte(t)
+	return append(frame, data...)
+}
+
+// Tells IPv4 from IPv6 by the version field.
+func ipPacket(data []byte) ([]byte, packets.EthType) {
+	if len(data) == 0 {
+		return nil, 0
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return data, packets.EthTypeIP
+	case 6:
+		return data, packets.EthTypeIPv6
+	}
+	return nil, 0
+}
+
+func formatAddr(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+type dumper struct {
+	streams map[string]*halfStream
+	reasm   *packets.Reassembler
+	out     io.Writer
+}
+
+// Feeds one captured packet to the stream it belongs to and prints the
+// messages it completes.
+func (d *dumper) packet(ts time.Time, frame []byte) {
+	frame, err := d.reasm.Add(frame)
+	if frame == nil || err != nil {
+		return
+	}
+	eth, err := packets.Parse(frame)
+	if err != nil || eth == nil {
+		return
+	}
+	var src, dst net.IP
+	var tcp *packets.TCPHeader
+	switch body := eth.Body.(type) {
+	case *packets.IPFragment:
+		src = net.IPv4(byte(body.SrcAddr>>24), byte(body.SrcAddr>>16), byte(body.SrcAddr>>8), byte(body.SrcAddr))
+		dst = net.IPv4(byte(body.DstAddr>>24), byte(body.DstAddr>>16), byte(body.DstAddr>>8), byte(body.DstAddr))
+		tcp, _ = body.Body.(*packets.TCPHeader)
+	case *packets.IPv6Packet:
+		src, dst = net.IP(body.SrcAddr[:]), net.IP(body.DstAddr[:])
+		tcp, _ = body.Body.(*packets.TCPHeader)
+	}
+	if tcp == nil || int(tcp.SrcPort) != *port && int(tcp.DstPort) != *port {
+		return
+	}
+	name := formatAddr(src, tcp.SrcPort) + " > " + formatAddr(dst, tcp.DstPort)
+	s := d.streams[name]
+	if s == nil {
+		s = new(halfStream)
+		d.streams[name] = s
+	}
+	msgs, notes := s.add(tcp)
+	stamp := ts.Format("15:04:05.000000")
+	for _, note := range notes {
+		fmt.Fprintf(d.out, "%s %s: %s\n", stamp, name, note)
+	}
+	for _, msg := range msgs {
+		fmt.Fprintf(d.out, "%s %s %s\n", stamp, name, describe(msg))
+	}
+	if tcp.HasFlags(packets.TCPFin) || tcp.HasFlags(packets.TCPRst) {
+		if len(s.buf) > 0 {
+			fmt.Fprintf(d.out, "%s %s: closed with %d bytes of a message\n",
+				stamp, name, len(s.buf))
+		}
+		delete(d.streams, name)
+	}
+}
+
+// Prints the OpenFlow messages in the capture read from in.
+func dump(in io.Reader, out io.Writer) error {
+	r, err := pcap.NewReader(in)
+	if err != nil {
+		return err
+	}
+	d := &dumper{
+		streams: make(map[string]*halfStream),
+		reasm:   packets.NewReassembler(time.Minute),
+		out:     out,
+	}
+	for {
+		data, ci, err := r.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if frame := ethernetFrame(r.LinkType(), data); frame != nil {
+			d.packet(ci.Timestamp, frame)
+		}
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goof-dump [-port n] capture.pcap\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	err = dump(f, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"goof/of"
+	"goof/packets"
+	"goof/pcap"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A TCP segment from the switch at 10.0.0.2:40000 to the controller.
+type segment struct {
+	flags   packets.TCPFlags
+	seq     uint32
+	payload []byte
+}
+
+// Returns a pcap file holding segs, a millisecond apart.
+func capture(t *testing.T, segs []segment) []byte {
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf, pcap.PCAP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1300000000, 0)
+	for _, s := range segs {
+		tcp := &packets.TCPHeader{SrcPort: 40000, DstPort: 6633, Seq: s.seq,
+			Flags: s.flags | packets.TCPAck, Window: 0xffff, Payload: s.payload}
+		frame, err := packets.NewEthFrame([6]byte{0, 0, 0, 0, 0, 2}, [6]byte{0, 0, 0, 0, 0, 1},
+			packets.NewIPv4(0x0a000002, 0x0a000001, tcp)).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.WritePacket(pcap.CaptureInfo{Timestamp: ts}, frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(time.Millisecond)
+	}
+	return buf.Bytes()
+}
+
+// Returns what goof-dump prints for segs, without the timestamps and the
+// stream name.
+func dumpSegments(t *testing.T, segs []segment) string {
+	var out bytes.Buffer
+	err := dump(bytes.NewReader(capture(t, segs)), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, " ") {
+			continue
+		}
+		const name = "10.0.0.2:40000 > 10.0.0.1:6633"
+		j := strings.Index(line, name)
+		if j < 0 {
+			t.Fatalf("no stream name in %q", line)
+		}
+		lines[i] = strings.TrimLeft(line[j+len(name):], ": ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func wire(t *testing.T, msgs ...of.ToSwitch) []byte {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		err := msg.Write(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestStream(t *testing.T) {
+	hello := wire(t, &of.Hello{Header: of.Header{Xid: 1}})
+	echo := wire(t, &of.EchoRequest{Header: of.Header{Xid: 2}, Body: []byte("ping")})
+	both := append(append([]byte(nil), hello...), echo...)
+	const isn = 1000 // the SYN's sequence number
+	helloLine := "OFPT_HELLO xid=1"
+	echoLine := "OFPT_ECHO_REQUEST xid=2 4 bytes"
+
+	tests := []struct {
+		name string
+		segs []segment
+		want []string
+	}{
+		{"in order", []segment{
+			{packets.TCPSyn, isn, nil},
+			{0, isn + 1, hello},
+			{0, isn + 9, echo},
+		}, []string{helloLine, echoLine}},
+		{"out of order", []segment{
+			{packets.TCPSyn, isn, nil},
+			{0, isn + 9, echo},
+			{0, isn + 1, hello},
+		}, []string{helloLine, echoLine}},
+		{"split header", []segment{
+			{packets.TCPSyn, isn, nil},
+			{0, isn + 1, both[:11]},
+			{0, isn + 12, both[11:]},
+		}, []string{helloLine, echoLine}},
+		{"retransmitted overlap", []segment{
+			{packets.TCPSyn, isn, nil},
+			{0, isn + 1, both[:10]},
+			{0, isn + 1, both[:4]},
+			{0, isn + 6, both[5:]},
+			{0, isn + 9, echo},
+		}, []string{helloLine, echoLine}},
+		{"mid-message start", []segment{
+			{0, 5000, echo[2:]},
+			{0, 5010, hello},
+		}, []string{"no message header, skipping 10 bytes", helloLine}},
+		{"fin with partial message", []segment{
+			{packets.TCPSyn, isn, nil},
+			{0, isn + 1, hello},
+			{packets.TCPFin, isn + 9, echo[:6]},
+		}, []string{helloLine, "closed with 6 bytes of a message"}},
+	}
+	for _, test := range tests {
+		got := dumpSegments(t, test.segs)
+		if want := strings.Join(test.want, "\n"); got != want {
+			t.Errorf("%s: printed\n%s\nwant\n%s", test.name, got, want)
+		}
+	}
+}
+
+// Segments held after a lost one are given up on once there are more than
+// maxPendingSegments of them, and the stream resumes after the gap.
+func TestStreamGap(t *testing.T) {
+	hello := wire(t, &of.Hello{})
+	segs := []segment{{packets.TCPSyn, 0, nil}, {0, 1, hello[:3]}}
+	seq := uint32(1 + len(hello)) // the rest of the first hello is lost
+	for i := 0; i <= maxPendingSegments; i++ {
+		segs = append(segs, segment{0, seq, hello})
+		seq += uint32(len(hello))
+	}
+	lines := strings.Split(dumpSegments(t, segs), "\n")
+	want := "5 bytes missing, dropping 3 buffered"
+	if len(lines) != 2+maxPendingSegments || lines[0] != want {
+		t.Fatalf("printed %d lines, first %q; want %d, first %q", len(lines), lines[0],
+			2+maxPendingSegments, want)
+	}
+	for _, line := range lines[1:] {
+		if line != "OFPT_HELLO xid=0" {
+			t.Fatalf("printed %q after the gap", line)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	match := of.Match{Wildcards: of.FwAll &^ (of.FwInPort | of.FwDlType),
+		InPort: 1, EthFrameType: 0x0806}
+	frame, err := packets.NewEthFrame([6]byte{0, 0, 0, 0, 0, 1},
+		[6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		packets.NewARPRequest([6]byte{0, 0, 0, 0, 0, 1}, 0x0a000001, 0x0a000002)).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := of.NewStatsReply(9, of.StatsAggregate,
+		&of.AggregateStats{PacketCount: 2, ByteCount: 128, FlowCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply.Flags = of.StatsReplyMore
+	tcp, err := packets.NewEthFrame([6]byte{0, 0, 0, 0, 0, 1}, [6]byte{0, 0, 0, 0, 0, 2},
+		packets.NewIPv4(0x0a000001, 0x0a000002, &packets.TCPHeader{SrcPort: 1, DstPort: 2})).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		msg  of.ToSwitch
+		want string
+	}{
+		{&of.FlowMod{Xid: 3, Match: match, Command: of.FCAdd, Priority: 10,
+			BufferId: 0xffffffff, OutPort: of.OFPP_NONE,
+			Actions: []of.Action{&of.ActionOutput{Port: 2}}},
+			"OFPT_FLOW_MOD xid=3 add buffer=none\n" +
+				"    priority=10,in_port=1,arp,actions=output:2"},
+		{&of.FlowMod{Xid: 4, Match: match, Command: of.FCDeleteStrict,
+			BufferId: 0xffffffff, OutPort: 2},
+			"OFPT_FLOW_MOD xid=4 delete_strict buffer=none out_port=2\n" +
+				"    priority=0,in_port=1,arp,actions=drop"},
+		{&of.PacketIn{Header: &of.Header{Xid: 5}, BufferId: 0x100,
+			TotalLen: uint16(len(frame)), InPort: 1, Reason: of.ReasonNoMatch, Data: frame},
+			"OFPT_PACKET_IN xid=5 buffer=0x100 total_len=42 in_port=1 reason=no_match\n" +
+				"    00:00:00:00:00:01 > ff:ff:ff:ff:ff:ff ARP who-has 10.0.0.2 tell 10.0.0.1"},
+		{&of.PacketIn{Header: &of.Header{Xid: 7}, BufferId: 0x101,
+			TotalLen: uint16(len(tcp)), InPort: 2, Reason: of.ReasonNoMatch, Data: tcp[:44]},
+			"OFPT_PACKET_IN xid=7 buffer=0x101 total_len=54 in_port=2 reason=no_match\n" +
+				"    00:00:00:00:00:01 > 00:00:00:00:00:02 10.0.0.1 > 10.0.0.2 TCP (unexpected EOF)"},
+		{&of.PortStatus{Header: &of.Header{Xid: 6}, Reason: of.PortDeleted,
+			Desc: of.PhyPort{PortNo: 3, Name: [16]byte{'e', 't', 'h', '3'}}},
+			"OFPT_PORT_STATUS xid=6 reason=delete\n" +
+				"    port 3 \"eth3\" addr 00:00:00:00:00:00 config 0x0 state 0x0"},
+		{reply, "OFPT_STATS_REPLY xid=9 type=aggregate more\n" +
+			"    packet_count=2,byte_count=128,flow_count=1"},
+	}
+	for _, test := range tests {
+		if got := describe(wire(t, test.msg)); got != test.want {
+			t.Errorf("%T described as\n%s\nwant\n%s", test.msg, got, test.want)
+		}
+	}
+
+	// A message of a type package of does not decode, and one too short for
+	// its type.
+	vendor := []byte{1, byte(of.OFPT_VENDOR), 0, 12, 0, 0, 0, 7, 0, 0, 0x23, 0x20}
+	if got, want := describe(vendor), "OFPT_VENDOR xid=7 (4 byte body not decoded)"; got != want {
+		t.Errorf("vendor message described as %q, want %q", got, want)
+	}
+	short := []byte{1, byte(of.OFPT_PORT_MOD), 0, 12, 0, 0, 0, 8, 0, 1, 0, 0}
+	if got, want := describe(short),
+		"OFPT_PORT_MOD xid=8\n    decode error: PORT_MOD too short"; got != want {
+		t.Errorf("short PORT_MOD described as %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"goof/of"
+	"goof/packets"
+	"net"
+	"strings"
+)
+
+var flowModCommands = []string{
+	of.FCAdd:          "add",
+	of.FCModify:       "modify",
+	of.FCModifyStrict: "modify_strict",
+	of.FCDelete:       "delete",
+	of.FCDeleteStrict: "delete_strict",
+}
+
+var flowRemovedReasons = []string{
+	of.RemovedReasonIdleTimeout: "idle_timeout",
+	of.RemovedReasonHardTimeout: "hard_timeout",
+	of.RemovedReasonDelete:      "delete",
+}
+
+var portReasons = []string{
+	of.PortAdd:      "add",
+	of.PortDeleted:  "delete",
+	of.PortModified: "modify",
+}
+
+// Returns names[i] if there is one and the number otherwise.
+func name(names []string, i int) string {
+	if i >= 0 && i < len(names) && names[i] != "" {
+		return names[i]
+	}
+	return fmt.Sprint(i)
+}
+
+func formatMAC(mac [6]byte) string {
+	return net.HardwareAddr(mac[:]).String()
+}
+
+func formatIPv4(ip uint32) string {
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String()
+}
+
+func formatBuffer(id uint32) string {
+	if id == 0xffffffff {
+		return "none"
+	}
+	return fmt.Sprintf("0x%x", id)
+}
+
+// Describes the frame of a PacketIn or PacketOut in a line, tcpdump style.
+func summarizeFrame(data []byte) string {
+	frame, err := packets.Parse(data)
+	if frame == nil {
+		return fmt.Sprintf("%d bytes, %v", len(data), err)
+	}
+	s := fmt.Sprintf("%s > %s", formatMAC(frame.SrcMAC), formatMAC(frame.DstMAC))
+	if frame.Tagged() {
+		s += fmt.Sprintf(" vlan %d", frame.VID())
+	}
+	switch body := frame.Body.(type) {
+	case *packets.ARPPacket:
+		if body.Operation == packets.ARPRequest {
+			s += fmt.Sprintf(" ARP who-has %s tell %s", formatIPv4(body.TargetIP),
+				formatIPv4(body.SenderIP))
+		} else {
+			s += fmt.Sprintf(" ARP %s is-at %s", formatIPv4(body.SenderIP),
+				formatMAC(body.SenderHW))
+		}
+	case *packets.IPFragment:
+		s += fmt.Sprintf(" %s > %s %v", formatIPv4(body.SrcAddr), formatIPv4(body.DstAddr),
+			body.Protocol)
+		s += summarizeTransport(body.Body)
+	case *packets.IPv6Packet:
+		s += fmt.Sprintf(" %s > %s %v", net.IP(body.SrcAddr[:]), net.IP(body.DstAddr[:]),
+			body.Protocol)
+		s += summarizeTransport(body.Body)
+	case *packets.LLDPPacket:
+		s += " LLDP"
+	default:
+		s += fmt.Sprintf(" ethertype 0x%04x", uint16(frame.Type))
+	}
+	if err != nil {
+		s += fmt.Sprintf(" (%v)", err)
+	}
+	return s
+}
+
+func summarizeTransport(body interface{}) string {
+	switch l4 := body.(type) {
+	case *packets.TCPHeader:
+		return fmt.Sprintf(" %d > %d [%v] seq %d", l4.SrcPort, l4.DstPort, l4.Flags, l4.Seq)
+	case *packets.UDPHeader:
+		return fmt.Sprintf(" %d > %d", l4.SrcPort, l4.DstPort)
+	case *packets.ICMPHeader:
+		return fmt.Sprintf(" type %d code %d", l4.Type, l4.Code)
+	case *packets.ICMPv6Header:
+		return fmt.Sprintf(" type %d code %d", l4.Type, l4.Code)
+	}
+	return ""
+}
+
+func describePort(p *of.PhyPort) string {
+	name := string(p.Name[:])
+	if i := strings.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return fmt.Sprintf("port %d %q addr %s config 0x%x state 0x%x", p.PortNo, name,
+		formatMAC(p.HwAddr), p.Config, p.State)
+}
+
+// Describes a whole message in readable form.  Lines after the first are
+// indented.
+func describe(raw []byte) string {
+	h := of.Header{
+		Version: raw[0],
+		Type:    of.Type(raw[1]),
+		Length:  binary.BigEndian.Uint16(raw[2:]),
+		Xid:     binary.BigEndian.Uint32(raw[4:]),
+	}
+	lines := []string{fmt.Sprintf("%v xid=%d", h.Type, h.Xid)}
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	addDetail := func(format string, args ...interface{}) {
+		lines[0] += " " + fmt.Sprintf(format, args...)
+	}
+
+	msg := of.NewMessage(h.Type)
+	if msg == nil {
+		if h.Length > of.HeaderSize {
+			addDetail("(%d byte body not decoded)", h.Length-of.HeaderSize)
+		}
+		return strings.Join(lines, "\n    ")
+	}
+	if err := msg.Read(&h, raw[of.HeaderSize:]); err != nil {
+		// What was decoded before the error may be stale or zero.
+		add("decode error: %v", err)
+		return strings.Join(lines, "\n    ")
+	}
+	switch m := msg.(type) {
+	case *of.EchoRequest:
+		addDetail("%d bytes", len(m.Body))
+	case *of.EchoReply:
+		addDetail("%d bytes", len(m.Body))
+	case *of.Error:
+		addDetail("%v code=%d", m, m.Code)
+		if len(m.Data) > 0 {
+			add("data % x", m.Data)
+		}
+	case *of.SwitchFeatures:
+		addDetail("dpid=%016x n_buffers=%d n_tables=%d capabilities=0x%x actions=0x%x",
+			m.DatapathId, m.NBuffers, m.NTables, m.Capabilities, m.Actions)
+		for i := range m.Ports {
+			add("%s", describePort(&m.Ports[i]))
+		}
+	case *of.SwitchConfig:
+		addDetail("flags=0x%x miss_send_len=%d", m.Flags, m.MissSendLen)
+	case *of.PacketIn:
+		reason := "no_match"
+		if !m.PacketNotMatched() {
+			reason = "action"
+		}
+		addDetail("buffer=%s total_len=%d in_port=%d reason=%s", formatBuffer(m.BufferId),
+			m.TotalLen, m.InPort, reason)
+		add("%s", summarizeFrame(m.Data))
+	case *of.PacketOut:
+		addDetail("buffer=%s in_port=%d actions=%s", formatBuffer(m.BufferId), m.InPort,
+			of.FormatActions(m.Actions))
+		if len(m.Data) > 0 {
+			add("%s", summarizeFrame(m.Data))
+		}
+	case *of.FlowMod:
+		addDetail("%s buffer=%s", name(flowModCommands, int(m.Command)), formatBuffer(m.BufferId))
+		if m.Command == of.FCDelete || m.Command == of.FCDeleteStrict {
+			addDetail("out_port=%d", m.OutPort)
+		}
+		add("%v", m)
+	case *of.FlowRemoved:
+		addDetail("reason=%s cookie=0x%x priority=%d duration=%d.%03ds n_packets=%d n_bytes=%d",
+			name(flowRemovedReasons, int(m.Reason)), m.Cookie, m.Priority, m.DurationSec,
+			m.DurationNsec/1000000, m.PacketCount, m.ByteCount)
+		add("%v", m.Match)
+	case *of.PortStatus:
+		addDetail("reason=%s", name(portReasons, int(m.Reason)))
+		add("%s", describePort(&m.Desc))
+	case *of.PortMod:
+		addDetail("port=%d addr=%s config=0x%x mask=0x%x advertise=0x%x", m.PortNo,
+			formatMAC(m.HwAddr), m.Config, m.Mask, m.Advertise)
+	case *of.StatsRequest:
+		addDetail("type=%v flags=0x%x", m.Type, m.Flags)
+		if s, err := m.Stat(); err != nil {
+			add("body: %v", err)
+		} else if s != nil {
+			add("%v", s)
+		}
+	case *of.StatsReply:
+		addDetail("type=%v", of.StatsType(m.Type))
+		if m.Flags&of.StatsReplyMore != 0 {
+			addDetail("more")
+		}
+		stats, err := m.Stats()
+		if err != nil {
+			add("body: %v", err)
+		}
+		for _, s := range stats {
+			add("%v", s)
+		}
+	}
+	return strings.Join(lines, "\n    ")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"goof/of"
+	"goof/packets"
+)
+
+// Out-of-order segments held per direction before giving up on the missing
+// data and skipping past it.
+const maxPendingSegments = 256
+
+// One direction of a TCP connection, put back in order and cut into
+// OpenFlow messages.
+type halfStream struct {
+	synced  bool   // whether next is known
+	next    uint32 // sequence number of the next byte wanted
+	pending map[uint32][]byte
+	buf     []byte // bytes of the next messages, not yet complete
+}
+
+// Adds a segment and returns the messages it completes.  Problems such as
+// lost data are returned as notes for the reader.
+func (s *halfStream) add(tcp *packets.TCPHeader) (msgs [][]byte, notes []string) {
+	seq := tcp.Seq
+	if tcp.HasFlags(packets.TCPSyn) {
+		seq++
+		s.synced = false
+		s.buf = nil
+		s.pending = nil
+	}
+	if !s.synced {
+		s.next = seq
+		s.synced = true
+	}
+	if len(tcp.Payload) > 0 {
+		if s.pending == nil {
+			s.pending = make(map[uint32][]byte)
+		}
+		if _, ok := s.pending[seq]; !ok {
+			s.pending[seq] = append([]byte(nil), tcp.Payload...)
+		}
+	}
+	s.drain()
+	if len(s.pending) > maxPendingSegments {
+		// Everything left is after a gap; carry on from the earliest.
+		first, found := uint32(0), false
+		for seq := range s.pending {
+			if !found || int32(seq-first) < 0 {
+				first, found = seq, true
+			}
+		}
+		notes = append(notes, fmt.Sprintf("%d bytes missing, dropping %d buffered",
+			first-s.next, len(s.buf)))
+		s.next = first
+		s.buf = nil
+		s.drain()
+	}
+
+	for len(s.buf) >= of.HeaderSize {
+		length := int(binary.BigEndian.Uint16(s.buf[2:]))
+		if s.buf[0] != of.OFP_VERSION || length < of.HeaderSize {
+			// Most likely the capture started in the middle of a message.
+			notes = append(notes, fmt.Sprintf("no message header, skipping %d bytes",
+				len(s.buf)))
+			s.buf = nil
+			break
+		}
+		if len(s.buf) < length {
+			break
+		}
+		msgs = append(msgs, s.buf[:length:length])
+		s.buf = s.buf[length:]
+	}
+	return msgs, notes
+}
+
+// Reports whether the segment starting at seq begins at or before next.
+func (s *halfStream) drainable(seq uint32) bool {
+	return int32(seq-s.next) <= 0
+}
+
+// Moves every pending segment that continues the stream into buf.
+func (s *halfStream) drain() {
+	for progress := true; progress; {
+		progress = false
+		for seq, data := range s.pending {
+			if !s.drainable(seq) {
+				continue
+			}
+			delete(s.pending, seq)
+			skip := s.next - seq // already have these bytes
+			if uint32(len(data)) > skip {
+				s.buf = append(s.buf, data[skip:]...)
+				s.next += uint32(len(data)) - skip
+				progress = true
+			}
+		}
+	}
+}
@@ -1,59 +1,103 @@
 package main
 
 import (
+  "flag"
+  "fmt"
   "goof/controller"
+  "goof/record"
   "log"
   "goof/of"
   "os"
+  "path/filepath"
   "runtime/pprof"
+  "time"
 )
 
+var recordDir = flag.String("record", "", "record each switch connection to a file in this directory")
+var replayFile = flag.String("replay", "", "replay a recorded connection instead of listening")
+
+// Marks the flows the learning switch installs, so that after a restart it
+// can tell them from other apps' flows.
+const cookie uint64 = 0x6c6561726e696e67 // "learning"
+
 func newSwitch(sw *controller.Switch) {
   defer func() {
     pprof.StopCPUProfile()
     recover()
   }()
 
+  if *recordDir != "" {
+    name := filepath.Join(*recordDir, fmt.Sprintf("%s.ofrec", sw.RemoteAddr()))
+    w, err := record.Create(name)
+    if err != nil {
+      log.Printf("not recording: %v", err)
+    } else {
+      defer w.Close()
+      sw.Record(w)
+    }
+  }
+
   // Learning switch
   routes := make(map[[of.EthAlen]uint8]uint16, 1000)
+  // The flows installed on this switch, as they would be if the switch
+  // applied each FlowMod as it was sent.
+  var installed of.FlowTable
+  install := func(fm *of.FlowMod) {
+    fm.Cookie = cookie
+    installed.Expire(time.Now())
+    installed.Apply(fm, time.Now())
+    err := sw.Send(fm)
+    if err != nil {
+      log.Printf("Erroring sending: %v", err)
+    }
+  }
 
+  // Only the MAC addresses are needed, so leave the rest of each frame
+  // undecoded.
+  sw.LazyFrames = true
   sw.HandlePacketIn = func(msg *of.PacketIn) {
-    routes[msg.EthFrame.SrcMAC] = msg.InPort
-    outPort, found := routes[msg.EthFrame.DstMAC]
+    src, dst := msg.Packet.SrcMAC(), msg.Packet.DstMAC()
+    routes[src] = msg.InPort
+    outPort, found := routes[dst]
     if !found {
-      err := sw.Send(&of.FlowMod{
+      install(&of.FlowMod{
       Xid: msg.Xid,
       Match: of.Match{
 				Wildcards: of.FwAll ^ of.FwDlSrc ^ of.FwDlDst,
-        DlSrc: msg.EthFrame.SrcMAC,
-        DlDst: msg.EthFrame.DstMAC },
+        DlSrc: src,
+        DlDst: dst },
 			BufferId: msg.BufferId,
       Flags: of.FCAdd,
 			HardTimeout: 5,
-      Actions: []of.Action{&of.ActionOutput{of.PortFlood, 0}}})
-      if err != nil {
-        log.Printf("Erroring sending: %v", err)
-      }
-			log.Printf("flooding %v", msg.EthFrame.EthernetHeader)
+      Actions: []of.Action{&of.ActionOutput{Port: of.PortFlood}}})
+			log.Printf("flooding %x -> %x", src, dst)
     } else {
-      err := sw.Send(&of.FlowMod{
+      install(&of.FlowMod{
       Xid: msg.Xid,
       Match: of.Match{
 				Wildcards: of.FwAll ^ of.FwDlSrc ^ of.FwDlDst,
-        DlSrc: msg.EthFrame.SrcMAC,
-        DlDst: msg.EthFrame.DstMAC },
+        DlSrc: src,
+        DlDst: dst },
 			BufferId: msg.BufferId,
       Flags: of.FCAdd,
 			HardTimeout: 60,
-      Actions: []of.Action{&of.ActionOutput{outPort, 0}}})			
-      if err != nil {
-        log.Printf("Erroring sending: %v", err)
-      }
-
+      Actions: []of.Action{&of.ActionOutput{Port: outPort}}})			
     }
   }
 	sw.HandleSwitchFeatures = func(msg *of.SwitchFeatures) {
 		log.Printf("Datapath %x online", msg.DatapathId)
+		// Flows a previous run left behind point at routes this run has not
+		// learned; remove them.
+		dpid := msg.DatapathId
+		installed.Expire(time.Now())
+		err := sw.Reconcile(cookie, &installed, func(err error) {
+			if err != nil {
+				log.Printf("Datapath %x not reconciled: %v", dpid, err)
+			}
+		})
+		if err != nil {
+			log.Printf("Erroring sending: %v", err)
+		}
 	}
 
 	sw.HandlePortStatus = func(msg *of.PortStatus) {
@@ -64,6 +108,7 @@ func newSwitch(sw *controller.Switch) {
 }
 
 func main() {
+  flag.Parse()
   f, _ := os.Create("profile")
   err2 := pprof.StartCPUProfile(f)
   if err2 != nil { panic(err2) }
@@ -71,6 +116,21 @@ func main() {
     log.Printf("Unprofiling")
   }()
   
+  if *replayFile != "" {
+    f, err := os.Open(*replayFile)
+    if err != nil {
+      log.Fatal(err)
+    }
+    r, err := record.NewReader(f)
+    if err == nil {
+      err = controller.Replay(r, newSwitch)
+    }
+    if err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
+
   log.Printf("Starting server ...")
   ctrl := controller.NewController()
   err := ctrl.Accept(6633, newSwitch)
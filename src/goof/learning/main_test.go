@@ -0,0 +1,31 @@
+package main
+
+import (
+	"goof/topology"
+	"testing"
+	"time"
+)
+
+// What mininet-tests/pingTree.py does: every host pings every other one
+// through a tree of switches run by the learning switch.
+func pingTree(t *testing.T, depth, fanout int) {
+	n, err := topology.New(topology.Tree(depth, fanout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if err := n.Start(newSwitch); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range n.PingAll(2 * time.Second) {
+		t.Error(err)
+	}
+}
+
+func TestPingTree(t *testing.T) {
+	pingTree(t, 1, 2)
+}
+
+func TestPingTreeDeep(t *testing.T) {
+	pingTree(t, 2, 3)
+}
@@ -2,6 +2,8 @@ package of
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -65,6 +67,15 @@ func (m *ActionVlanPcp) WriteAction(w io.Writer) error {
 	return genericWriteAction(w, m, OFPAT_SET_VLAN_PCP)
 }
 
+/* Action structure for OFPAT_STRIP_VLAN.  The body is padding only. */
+type ActionStripVlan struct {
+	uint32
+}
+
+func (m *ActionStripVlan) WriteAction(w io.Writer) error {
+	return genericWriteAction(w, m, OFPAT_STRIP_VLAN)
+}
+
 type ActionSetDlSrc struct {
 	DlAddr [EthAlen]uint8 /* Ethernet address. */
 	uint32
@@ -141,3 +152,72 @@ type ActionEnqueue struct {
 func (m *ActionEnqueue) WriteAction(w io.Writer) error {
     return genericWriteAction(w, m, OFPAT_ENQUEUE)
 }
+
+// Size of the type and length fields that start every action.
+const actionHeaderSize = 4
+
+// Decodes a list of actions as found in FLOW_MOD and PACKET_OUT messages.
+func ReadActions(body []byte) ([]Action, error) {
+	actions := []Action{}
+	for len(body) > 0 {
+		if len(body) < actionHeaderSize {
+			return nil, errors.New("truncated action header")
+		}
+		t := ActionType(binary.BigEndian.Uint16(body[0:]))
+		length := int(binary.BigEndian.Uint16(body[2:]))
+		if length < 8 || length%8 != 0 || length > len(body) {
+			return nil, fmt.Errorf("bad length %d for action %d", length, t)
+		}
+		a, err := readAction(t, body[actionHeaderSize:length])
+		if err != nil {
+			return nil, err
+		}
+		if int(ActionLen(a)) != length {
+			return nil, fmt.Errorf("bad length %d for action %d", length, t)
+		}
+		actions = append(actions, a)
+		body = body[length:]
+	}
+	return actions, nil
+}
+
+func readAction(t ActionType, b []byte) (Action, error) {
+	switch t {
+	case OFPAT_OUTPUT:
+		return &ActionOutput{Port: binary.BigEndian.Uint16(b[0:]),
+			MaxLen: binary.BigEndian.Uint16(b[2:])}, nil
+	case OFPAT_SET_VLAN_VID:
+		return &ActionVlanVid{VlanVid: binary.BigEndian.Uint16(b[0:])}, nil
+	case OFPAT_SET_VLAN_PCP:
+		return &ActionVlanPcp{VlanPcp: b[0]}, nil
+	case OFPAT_STRIP_VLAN:
+		return &ActionStripVlan{}, nil
+	case OFPAT_SET_DL_SRC:
+		a := &ActionSetDlSrc{}
+		copy(a.DlAddr[:], b)
+		return a, nil
+	case OFPAT_SET_DL_DST:
+		a := &ActionSetDlDst{}
+		copy(a.DlAddr[:], b)
+		return a, nil
+	case OFPAT_SET_NW_SRC:
+		return &ActionNwAddrSrc{NwAddr: binary.BigEndian.Uint32(b[0:])}, nil
+	case OFPAT_SET_NW_DST:
+		return &ActionNwAddrDst{NwAddr: binary.BigEndian.Uint32(b[0:])}, nil
+	case OFPAT_SET_NW_TOS:
+		return &ActionNwTos{NwTos: b[0]}, nil
+	case OFPAT_SET_TP_SRC:
+		return &ActionTpPortSrc{TpPort: binary.BigEndian.Uint16(b[0:])}, nil
+	case OFPAT_SET_TP_DST:
+		return &ActionTpPortDst{TpPort: binary.BigEndian.Uint16(b[0:])}, nil
+	case OFPAT_ENQUEUE:
+		if len(b) < 12 {
+			break
+		}
+		return &ActionEnqueue{Port: binary.BigEndian.Uint16(b[0:]),
+			QueueId: binary.BigEndian.Uint32(b[8:])}, nil
+	default:
+		return nil, fmt.Errorf("unsupported action type %d", t)
+	}
+	return nil, fmt.Errorf("action %d too short", t)
+}
@@ -0,0 +1,52 @@
+package of
+
+import (
+	"goof/packets"
+)
+
+// A Decoder decodes messages into storage that it reuses from one call to
+// the next.  PACKET_IN, ECHO_REQUEST and PORT_STATUS, the messages a busy
+// switch sends most, decode without allocating; other types are decoded into
+// fresh messages as with NewMessage.
+//
+// A message returned by Decode, including the frame of a PacketIn, is only
+// valid until the next call to Decode.  It also shares the body slice passed
+// to Decode.
+type Decoder struct {
+	// If set, the frame of a PacketIn is not parsed: EthFrame is nil and
+	// layers are decoded only when asked for through Packet.  Handlers that
+	// look at a few fields, such as the MAC addresses, then skip the rest.
+	Lazy bool
+
+	header     Header
+	packetIn   PacketIn
+	echo       EchoRequest
+	portStatus PortStatus
+	frame      packets.Decoded
+	packet     packets.Packet
+}
+
+// Decodes the message with header h and the given body.  A body that fails
+// to decode yields the error along with the message as far as it was
+// decoded, which is only fit for inspection.  The message is nil only if the
+// type has no representation in this package.
+func (d *Decoder) Decode(h *Header, body []byte) (Message, error) {
+	d.header = *h
+	switch h.Type {
+	case OFPT_PACKET_IN:
+		return &d.packetIn, d.packetIn.read(&d.header, body, &d.frame, &d.packet,
+			d.Lazy)
+	case OFPT_ECHO_REQUEST:
+		d.echo = EchoRequest{}
+		return &d.echo, d.echo.Read(&d.header, body)
+	case OFPT_PORT_STATUS:
+		d.portStatus = PortStatus{}
+		return &d.portStatus, d.portStatus.Read(&d.header, body)
+	}
+	msg := NewMessage(h.Type)
+	if msg == nil {
+		return nil, nil
+	}
+	header := d.header
+	return msg, msg.Read(&header, body)
+}
@@ -0,0 +1,238 @@
+package of
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// The errors FlowTable.Apply returns, which a switch reports as a
+// FlowModFailed error with code FlowModOverlap or FlowModBadCommand.
+var (
+	ErrFlowOverlap = errors.New("flow overlaps an entry of the same priority")
+	ErrBadCommand  = errors.New("unknown flow mod command")
+)
+
+// An entry of a FlowTable.
+type FlowEntry struct {
+	Match       Match // normalized
+	Priority    uint16
+	Cookie      uint64
+	IdleTimeout uint16
+	HardTimeout uint16
+	Flags       uint16
+	Actions     []Action
+
+	Created     time.Time
+	LastUsed    time.Time
+	PacketCount uint64
+	ByteCount   uint64
+}
+
+// Reports whether e wildcards no field, which puts it ahead of every
+// wildcarded entry whatever the priorities.
+func (e *FlowEntry) Exact() bool {
+	return e.Match.Wildcards&FwAll == 0
+}
+
+// Reports whether e outputs to port, as the OutPort of a delete or a flow
+// stats request asks.  OFPP_NONE matches every entry.
+func (e *FlowEntry) OutputsTo(port uint16) bool {
+	if port == OFPP_NONE {
+		return true
+	}
+	for _, a := range e.Actions {
+		switch a := a.(type) {
+		case *ActionOutput:
+			if a.Port == port {
+				return true
+			}
+		case *ActionEnqueue:
+			if a.Port == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the flow stats of e as of now, for table 0.
+func (e *FlowEntry) Stat(now time.Time) *FlowStat {
+	d := now.Sub(e.Created)
+	return &FlowStat{
+		Match:        e.Match,
+		DurationSec:  uint32(d / time.Second),
+		DurationNsec: uint32(d % time.Second),
+		Priority:     e.Priority,
+		IdleTimeout:  e.IdleTimeout,
+		HardTimeout:  e.HardTimeout,
+		Cookie:       e.Cookie,
+		PacketCount:  e.PacketCount,
+		ByteCount:    e.ByteCount,
+		Actions:      e.Actions,
+	}
+}
+
+// A single flow table with OpenFlow 1.0 semantics: FlowMods are applied as a
+// switch would apply them and lookups find the entry a packet would hit,
+// exact-match entries first and then by priority.  A switch keeps its flows
+// in one; an app can keep one as a shadow copy of the flows it installed.
+// Emergency flows are not kept apart.  The zero value is an empty table.
+// A FlowTable is not safe for concurrent use.
+type FlowTable struct {
+	entries []*FlowEntry
+}
+
+// Returns the entries, in lookup order.  The slice must not be changed.
+func (t *FlowTable) Entries() []*FlowEntry {
+	return t.entries
+}
+
+func (t *FlowTable) Len() int {
+	return len(t.entries)
+}
+
+func (t *FlowTable) sort() {
+	sort.SliceStable(t.entries, func(i, j int) bool {
+		a, b := t.entries[i], t.entries[j]
+		if a.Exact() != b.Exact() {
+			return a.Exact()
+		}
+		return a.Priority > b.Priority
+	})
+}
+
+// Returns the entry a packet with the exact match pkt hits, or nil on a
+// miss.  The entry's counters are not updated.
+func (t *FlowTable) Lookup(pkt *Match) *FlowEntry {
+	for _, e := range t.entries {
+		if e.Match.Covers(pkt) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns the entries that a flow stats request or a non-strict modify or
+// delete with match m and outPort selects.
+func (t *FlowTable) Select(m Match, outPort uint16) []*FlowEntry {
+	m = m.Normalized()
+	var r []*FlowEntry
+	for _, e := range t.entries {
+		if m.Covers(&e.Match) && e.OutputsTo(outPort) {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+// Reports whether e is selected by a modify or delete with the normalized
+// match m and priority.  A strict command selects only the entry with
+// exactly that match and priority; otherwise every entry m covers is.
+func selected(e *FlowEntry, m *Match, priority uint16, strict bool) bool {
+	if strict {
+		return e.Match == *m && e.Priority == priority
+	}
+	return m.Covers(&e.Match)
+}
+
+// Applies fm as of now and returns the entries it deleted.  Adds replace an
+// entry with the same match and priority, resetting its counters, and fail
+// with ErrFlowOverlap if fm has the CheckOverlap flag and a packet could
+// match both it and another entry of the same priority.  Modifies replace
+// the actions of the entries they select and keep their counters, or add
+// the flow if none is selected.  Deletes remove the selected entries that
+// output to fm.OutPort.
+func (t *FlowTable) Apply(fm *FlowMod, now time.Time) ([]*FlowEntry, error) {
+	switch fm.Command {
+	case FCAdd:
+		return nil, t.add(fm, now)
+	case FCModify, FCModifyStrict:
+		return nil, t.modify(fm, fm.Command == FCModifyStrict, now)
+	case FCDelete, FCDeleteStrict:
+		return t.delete(fm, fm.Command == FCDeleteStrict), nil
+	}
+	return nil, ErrBadCommand
+}
+
+func (t *FlowTable) add(fm *FlowMod, now time.Time) error {
+	e := &FlowEntry{
+		Match:       fm.Match.Normalized(),
+		Priority:    fm.Priority,
+		Cookie:      fm.Cookie,
+		IdleTimeout: fm.IdleTimeout,
+		HardTimeout: fm.HardTimeout,
+		Flags:       fm.Flags,
+		Actions:     fm.Actions,
+		Created:     now,
+		LastUsed:    now,
+	}
+	if fm.Flags&CheckOverlap != 0 {
+		for _, old := range t.entries {
+			if old.Priority == e.Priority && old.Match.Overlaps(&e.Match) {
+				return ErrFlowOverlap
+			}
+		}
+	}
+	for i, old := range t.entries {
+		if old.Match == e.Match && old.Priority == e.Priority {
+			t.entries[i] = e
+			return nil
+		}
+	}
+	t.entries = append(t.entries, e)
+	t.sort()
+	return nil
+}
+
+func (t *FlowTable) modify(fm *FlowMod, strict bool, now time.Time) error {
+	match := fm.Match.Normalized()
+	found := false
+	for _, e := range t.entries {
+		if selected(e, &match, fm.Priority, strict) {
+			e.Actions = fm.Actions
+			found = true
+		}
+	}
+	if found {
+		return nil
+	}
+	return t.add(fm, now)
+}
+
+func (t *FlowTable) delete(fm *FlowMod, strict bool) []*FlowEntry {
+	match := fm.Match.Normalized()
+	var removed []*FlowEntry
+	kept := t.entries[:0]
+	for _, e := range t.entries {
+		if selected(e, &match, fm.Priority, strict) && e.OutputsTo(fm.OutPort) {
+			removed = append(removed, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	t.entries = kept
+	return removed
+}
+
+// Removes the entries whose timeouts have passed as of now and returns them
+// with the reason for each.
+func (t *FlowTable) Expire(now time.Time) ([]*FlowEntry, []FlowRemovedReason) {
+	var removed []*FlowEntry
+	var reasons []FlowRemovedReason
+	kept := t.entries[:0]
+	for _, e := range t.entries {
+		switch {
+		case e.HardTimeout != 0 && now.Sub(e.Created) >= time.Duration(e.HardTimeout)*time.Second:
+			removed = append(removed, e)
+			reasons = append(reasons, RemovedReasonHardTimeout)
+		case e.IdleTimeout != 0 && now.Sub(e.LastUsed) >= time.Duration(e.IdleTimeout)*time.Second:
+			removed = append(removed, e)
+			reasons = append(reasons, RemovedReasonIdleTimeout)
+		default:
+			kept = append(kept, e)
+		}
+	}
+	t.entries = kept
+	return removed, reasons
+}
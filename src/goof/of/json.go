@@ -0,0 +1,1226 @@
+package of
+
+// JSON representation of messages, matches and actions.
+//
+// Every message is an object whose "type" member holds the OFPT_* name of the
+// message and whose "xid" member holds the transaction id.  Ethernet
+// addresses are written as "00:11:22:33:44:55", IP addresses as "10.0.0.1",
+// 64-bit identifiers (datapath ids and cookies) as hex strings and raw bytes
+// as base64.  A match lists only the fields that are not wildcarded, using
+// the same names as the text syntax.  Actions are objects whose "type" member
+// holds the action name of the text syntax.  Stats bodies are decoded too:
+// a stats request has its body in "request" and a stats reply its entries
+// in "stats", each an object with the member names of openflow.h; only
+// vendor stats and bodies that do not decode are left as base64 in "body".
+//
+// The format is fixed; testdata/messages.jsonl holds one of every message
+// and action in it.  A message encoded and decoded again is the same
+// message, except that a match keeps nothing of what it wildcards.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"goof/packets"
+	"strconv"
+	"strings"
+)
+
+func typeFromString(s string) (Type, error) {
+	for t, name := range typeNames {
+		if name == s {
+			return Type(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown message type %q", s)
+}
+
+func (t Type) MarshalText() ([]byte, error) {
+	if int(t) >= len(typeNames) {
+		return nil, fmt.Errorf("unknown message type %d", uint8(t))
+	}
+	return []byte(typeNames[t]), nil
+}
+
+func (t *Type) UnmarshalText(text []byte) error {
+	var err error
+	*t, err = typeFromString(string(text))
+	return err
+}
+
+// Members common to all messages.
+type jsonHeader struct {
+	Type Type   `json:"type"`
+	Xid  uint32 `json:"xid"`
+}
+
+func (h *jsonHeader) check(want Type) error {
+	if h.Type != want {
+		return fmt.Errorf("expected %v, got %v", want, h.Type)
+	}
+	return nil
+}
+
+// Decodes a JSON message of any type.  The result is a pointer to one of the
+// message structs of this package, selected by the "type" member.
+func UnmarshalMessage(data []byte) (interface{}, error) {
+	var h jsonHeader
+	err := json.Unmarshal(data, &h)
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := NewMessage(h.Type).(json.Unmarshaler)
+	if !ok {
+		return nil, fmt.Errorf("no JSON encoding for %v", h.Type)
+	}
+	err = msg.UnmarshalJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// A MAC address written as a string.
+type jsonMAC [EthAlen]uint8
+
+func (m jsonMAC) MarshalText() ([]byte, error) {
+	return []byte(formatMAC(m)), nil
+}
+
+func (m *jsonMAC) UnmarshalText(text []byte) error {
+	mac, err := parseMAC(string(text))
+	*m = jsonMAC(mac)
+	return err
+}
+
+// An IP address written as a string.
+type jsonIP uint32
+
+func (ip jsonIP) MarshalText() ([]byte, error) {
+	return []byte(formatIP(uint32(ip))), nil
+}
+
+func (ip *jsonIP) UnmarshalText(text []byte) error {
+	addr, err := parseIP(string(text))
+	*ip = jsonIP(addr)
+	return err
+}
+
+// Raw bytes written as base64.  Unlike a plain []byte, a nil slice is written
+// as "" rather than null, so that nil and empty data encode identically.
+type jsonBytes []byte
+
+func (b jsonBytes) MarshalText() ([]byte, error) {
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(text, b)
+	return text, nil
+}
+
+func (b *jsonBytes) UnmarshalText(text []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(string(text))
+	*b = raw
+	return err
+}
+
+// A 64-bit identifier written as a hex string.
+type jsonHex64 uint64
+
+func (n jsonHex64) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("0x%016x", uint64(n))), nil
+}
+
+func (n *jsonHex64) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 0, 64)
+	*n = jsonHex64(v)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Matches
+
+type jsonMatch struct {
+	InPort    *uint16  `json:"in_port,omitempty"`
+	DlVlan    *uint16  `json:"dl_vlan,omitempty"`
+	DlVlanPcp *uint8   `json:"dl_vlan_pcp,omitempty"`
+	DlSrc     *jsonMAC `json:"dl_src,omitempty"`
+	DlDst     *jsonMAC `json:"dl_dst,omitempty"`
+	DlType    *uint16  `json:"dl_type,omitempty"`
+	NwTos     *uint8   `json:"nw_tos,omitempty"`
+	NwProto   *uint8   `json:"nw_proto,omitempty"`
+	NwSrc     string   `json:"nw_src,omitempty"`
+	NwDst     string   `json:"nw_dst,omitempty"`
+	TpSrc     *uint16  `json:"tp_src,omitempty"`
+	TpDst     *uint16  `json:"tp_dst,omitempty"`
+}
+
+func (m Match) MarshalJSON() ([]byte, error) {
+	var j jsonMatch
+	has := func(fw uint32) bool { return m.Wildcards&fw == 0 }
+	if has(FwInPort) {
+		j.InPort = &m.InPort
+	}
+	if has(FwDlVlan) {
+		j.DlVlan = &m.VLanID
+	}
+	if has(FwDlVlanPcp) {
+		j.DlVlanPcp = &m.VLanPCP
+	}
+	if has(FwDlSrc) {
+		j.DlSrc = (*jsonMAC)(&m.DlSrc)
+	}
+	if has(FwDlDst) {
+		j.DlDst = (*jsonMAC)(&m.DlDst)
+	}
+	if has(FwDlType) {
+		j.DlType = &m.EthFrameType
+	}
+	if has(FwNwTos) {
+		j.NwTos = &m.NwTOS
+	}
+	if has(FwNwProto) {
+		j.NwProto = &m.NwProto
+	}
+	if n := m.NwSrcWildcardBits(); n < 32 {
+		j.NwSrc = formatIPPrefix(m.NwSrc, n)
+	}
+	if n := m.NwDstWildcardBits(); n < 32 {
+		j.NwDst = formatIPPrefix(m.NwDst, n)
+	}
+	if has(FwTpSrc) {
+		j.TpSrc = &m.TpSrc
+	}
+	if has(FwTpDst) {
+		j.TpDst = &m.TpDst
+	}
+	return json.Marshal(&j)
+}
+
+// Decodes a match, rejecting members that name no field as ParseMatch does.
+func (m *Match) UnmarshalJSON(data []byte) error {
+	var j jsonMatch
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	err := d.Decode(&j)
+	if err != nil {
+		return err
+	}
+	*m = Match{Wildcards: FwAll}
+	if j.InPort != nil {
+		m.InPort = *j.InPort
+		m.Wildcards &^= FwInPort
+	}
+	if j.DlVlan != nil {
+		m.VLanID = *j.DlVlan
+		m.Wildcards &^= FwDlVlan
+	}
+	if j.DlVlanPcp != nil {
+		m.VLanPCP = *j.DlVlanPcp
+		m.Wildcards &^= FwDlVlanPcp
+	}
+	if j.DlSrc != nil {
+		m.DlSrc = *j.DlSrc
+		m.Wildcards &^= FwDlSrc
+	}
+	if j.DlDst != nil {
+		m.DlDst = *j.DlDst
+		m.Wildcards &^= FwDlDst
+	}
+	if j.DlType != nil {
+		m.EthFrameType = *j.DlType
+		m.Wildcards &^= FwDlType
+	}
+	if j.NwTos != nil {
+		m.NwTOS = *j.NwTos
+		m.Wildcards &^= FwNwTos
+	}
+	if j.NwProto != nil {
+		m.NwProto = *j.NwProto
+		m.Wildcards &^= FwNwProto
+	}
+	if j.NwSrc != "" {
+		_, err = m.setField("nw_src", j.NwSrc)
+		if err != nil {
+			return err
+		}
+	}
+	if j.NwDst != "" {
+		_, err = m.setField("nw_dst", j.NwDst)
+		if err != nil {
+			return err
+		}
+	}
+	if j.TpSrc != nil {
+		m.TpSrc = *j.TpSrc
+		m.Wildcards &^= FwTpSrc
+	}
+	if j.TpDst != nil {
+		m.TpDst = *j.TpDst
+		m.Wildcards &^= FwTpDst
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Actions
+
+// Superset of the members of all actions.  Only the members that belong to
+// the action named by Type are written.
+type jsonAction struct {
+	Type    string   `json:"type"`
+	Port    *uint16  `json:"port,omitempty"`
+	MaxLen  *uint16  `json:"max_len,omitempty"`
+	QueueId *uint32  `json:"queue_id,omitempty"`
+	VlanVid *uint16  `json:"vlan_vid,omitempty"`
+	VlanPcp *uint8   `json:"vlan_pcp,omitempty"`
+	DlAddr  *jsonMAC `json:"dl_addr,omitempty"`
+	NwAddr  *jsonIP  `json:"nw_addr,omitempty"`
+	NwTos   *uint8   `json:"nw_tos,omitempty"`
+	TpPort  *uint16  `json:"tp_port,omitempty"`
+}
+
+func (m *ActionOutput) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "output", Port: &m.Port,
+		MaxLen: &m.MaxLen})
+}
+
+func (m *ActionVlanVid) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_vlan_vid", VlanVid: &m.VlanVid})
+}
+
+func (m *ActionVlanPcp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_vlan_pcp", VlanPcp: &m.VlanPcp})
+}
+
+func (m *ActionStripVlan) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "strip_vlan"})
+}
+
+func (m *ActionSetDlSrc) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_dl_src",
+		DlAddr: (*jsonMAC)(&m.DlAddr)})
+}
+
+func (m *ActionSetDlDst) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_dl_dst",
+		DlAddr: (*jsonMAC)(&m.DlAddr)})
+}
+
+func (m *ActionNwAddrSrc) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_nw_src",
+		NwAddr: (*jsonIP)(&m.NwAddr)})
+}
+
+func (m *ActionNwAddrDst) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_nw_dst",
+		NwAddr: (*jsonIP)(&m.NwAddr)})
+}
+
+func (m *ActionNwTos) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_nw_tos", NwTos: &m.NwTos})
+}
+
+func (m *ActionTpPortSrc) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_tp_src", TpPort: &m.TpPort})
+}
+
+func (m *ActionTpPortDst) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "mod_tp_dst", TpPort: &m.TpPort})
+}
+
+func (m *ActionEnqueue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonAction{Type: "enqueue", Port: &m.Port,
+		QueueId: &m.QueueId})
+}
+
+// Decodes a single JSON action.
+func UnmarshalAction(data []byte) (Action, error) {
+	var j jsonAction
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return nil, err
+	}
+	missing := func(member string) error {
+		return fmt.Errorf("%s action is missing %q", j.Type, member)
+	}
+	switch j.Type {
+	case "output":
+		if j.Port == nil {
+			return nil, missing("port")
+		}
+		a := &ActionOutput{Port: *j.Port}
+		if j.MaxLen != nil {
+			a.MaxLen = *j.MaxLen
+		}
+		return a, nil
+	case "mod_vlan_vid":
+		if j.VlanVid == nil {
+			return nil, missing("vlan_vid")
+		}
+		return &ActionVlanVid{VlanVid: *j.VlanVid}, nil
+	case "mod_vlan_pcp":
+		if j.VlanPcp == nil {
+			return nil, missing("vlan_pcp")
+		}
+		return &ActionVlanPcp{VlanPcp: *j.VlanPcp}, nil
+	case "strip_vlan":
+		return &ActionStripVlan{}, nil
+	case "mod_dl_src", "mod_dl_dst":
+		if j.DlAddr == nil {
+			return nil, missing("dl_addr")
+		}
+		if j.Type == "mod_dl_src" {
+			return &ActionSetDlSrc{DlAddr: *j.DlAddr}, nil
+		}
+		return &ActionSetDlDst{DlAddr: *j.DlAddr}, nil
+	case "mod_nw_src", "mod_nw_dst":
+		if j.NwAddr == nil {
+			return nil, missing("nw_addr")
+		}
+		if j.Type == "mod_nw_src" {
+			return &ActionNwAddrSrc{NwAddr: uint32(*j.NwAddr)}, nil
+		}
+		return &ActionNwAddrDst{NwAddr: uint32(*j.NwAddr)}, nil
+	case "mod_nw_tos":
+		if j.NwTos == nil {
+			return nil, missing("nw_tos")
+		}
+		return &ActionNwTos{NwTos: *j.NwTos}, nil
+	case "mod_tp_src", "mod_tp_dst":
+		if j.TpPort == nil {
+			return nil, missing("tp_port")
+		}
+		if j.Type == "mod_tp_src" {
+			return &ActionTpPortSrc{TpPort: *j.TpPort}, nil
+		}
+		return &ActionTpPortDst{TpPort: *j.TpPort}, nil
+	case "enqueue":
+		if j.Port == nil {
+			return nil, missing("port")
+		}
+		if j.QueueId == nil {
+			return nil, missing("queue_id")
+		}
+		return &ActionEnqueue{Port: *j.Port, QueueId: *j.QueueId}, nil
+	}
+	return nil, fmt.Errorf("unknown action type %q", j.Type)
+}
+
+// A JSON array of actions.
+type jsonActions []Action
+
+func (as jsonActions) MarshalJSON() ([]byte, error) {
+	if as == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]Action(as))
+}
+
+func (as *jsonActions) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*as = make(jsonActions, len(raw))
+	for i, r := range raw {
+		(*as)[i], err = UnmarshalAction(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Messages
+
+type jsonEcho struct {
+	jsonHeader
+	Data jsonBytes `json:"data"`
+}
+
+func (m *Hello) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonHeader{OFPT_HELLO, m.Xid})
+}
+
+func (m *Hello) UnmarshalJSON(data []byte) error {
+	var j jsonHeader
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Header = Header{Version: OFP_VERSION, Type: OFPT_HELLO, Xid: j.Xid}
+	return j.check(OFPT_HELLO)
+}
+
+func (m *EchoRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonEcho{jsonHeader{OFPT_ECHO_REQUEST, m.Xid}, m.Body})
+}
+
+func (m *EchoRequest) UnmarshalJSON(data []byte) error {
+	var j jsonEcho
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Header = Header{Version: OFP_VERSION, Type: OFPT_ECHO_REQUEST, Xid: j.Xid}
+	m.Body = j.Data
+	return j.check(OFPT_ECHO_REQUEST)
+}
+
+func (m *EchoReply) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonEcho{jsonHeader{OFPT_ECHO_REPLY, m.Xid}, m.Body})
+}
+
+func (m *EchoReply) UnmarshalJSON(data []byte) error {
+	var j jsonEcho
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Header = Header{Version: OFP_VERSION, Type: OFPT_ECHO_REPLY, Xid: j.Xid}
+	m.Body = j.Data
+	return j.check(OFPT_ECHO_REPLY)
+}
+
+type jsonSwitchConfig struct {
+	jsonHeader
+	Flags       ConfigFlags `json:"flags"`
+	MissSendLen uint16      `json:"miss_send_len"`
+}
+
+func (m *SwitchConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonSwitchConfig{jsonHeader{OFPT_SET_CONFIG, m.Xid},
+		m.Flags, m.MissSendLen})
+}
+
+func (m *SwitchConfig) UnmarshalJSON(data []byte) error {
+	var j jsonSwitchConfig
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = SwitchConfig{j.Xid, j.Flags, j.MissSendLen}
+	return j.check(OFPT_SET_CONFIG)
+}
+
+func (m *GetConfigRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonHeader{OFPT_GET_CONFIG_REQUEST, m.Xid})
+}
+
+func (m *GetConfigRequest) UnmarshalJSON(data []byte) error {
+	var j jsonHeader
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Xid = j.Xid
+	return j.check(OFPT_GET_CONFIG_REQUEST)
+}
+
+func (m *GetConfigReply) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonSwitchConfig{jsonHeader{OFPT_GET_CONFIG_REPLY, m.Xid},
+		m.Flags, m.MissSendLen})
+}
+
+func (m *GetConfigReply) UnmarshalJSON(data []byte) error {
+	var j jsonSwitchConfig
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = GetConfigReply{j.Xid, j.Flags, j.MissSendLen}
+	return j.check(OFPT_GET_CONFIG_REPLY)
+}
+
+func (m *BarrierRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonHeader{OFPT_BARRIER_REQUEST, m.Xid})
+}
+
+func (m *BarrierRequest) UnmarshalJSON(data []byte) error {
+	var j jsonHeader
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Xid = j.Xid
+	return j.check(OFPT_BARRIER_REQUEST)
+}
+
+func (m *BarrierReply) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonHeader{OFPT_BARRIER_REPLY, m.Xid})
+}
+
+func (m *BarrierReply) UnmarshalJSON(data []byte) error {
+	var j jsonHeader
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Xid = j.Xid
+	return j.check(OFPT_BARRIER_REPLY)
+}
+
+func (m *SwitchFeaturesRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonHeader{OFPT_FEATURES_REQUEST, m.Xid})
+}
+
+func (m *SwitchFeaturesRequest) UnmarshalJSON(data []byte) error {
+	var j jsonHeader
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Xid = j.Xid
+	return j.check(OFPT_FEATURES_REQUEST)
+}
+
+type jsonPhyPort struct {
+	PortNo     uint16  `json:"port_no"`
+	HwAddr     jsonMAC `json:"hw_addr"`
+	Name       string  `json:"name"`
+	Config     uint32  `json:"config"`
+	State      uint32  `json:"state"`
+	Curr       uint32  `json:"curr"`
+	Advertised uint32  `json:"advertised"`
+	Supported  uint32  `json:"supported"`
+	Peer       uint32  `json:"peer"`
+}
+
+func (p PhyPort) MarshalJSON() ([]byte, error) {
+	name := string(p.Name[:])
+	if i := strings.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return json.Marshal(&jsonPhyPort{p.PortNo, p.HwAddr, name, p.Config,
+		p.State, p.Curr, p.Advertised, p.Supported, p.Peer})
+}
+
+func (p *PhyPort) UnmarshalJSON(data []byte) error {
+	var j jsonPhyPort
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	if len(j.Name) >= OFP_MAX_PORT_NAME_LEN {
+		return fmt.Errorf("port name %q too long", j.Name)
+	}
+	*p = PhyPort{PortNo: j.PortNo, HwAddr: j.HwAddr, Config: j.Config,
+		State: j.State, Curr: j.Curr, Advertised: j.Advertised,
+		Supported: j.Supported, Peer: j.Peer}
+	copy(p.Name[:], j.Name)
+	return nil
+}
+
+type jsonSwitchFeatures struct {
+	jsonHeader
+	DatapathId   jsonHex64 `json:"datapath_id"`
+	NBuffers     uint32    `json:"n_buffers"`
+	NTables      uint8     `json:"n_tables"`
+	Capabilities uint32    `json:"capabilities"`
+	Actions      uint32    `json:"actions"`
+	Ports        []PhyPort `json:"ports"`
+}
+
+func (m *SwitchFeatures) MarshalJSON() ([]byte, error) {
+	var xid uint32
+	if m.Header != nil {
+		xid = m.Xid
+	}
+	ports := m.Ports
+	if ports == nil {
+		ports = []PhyPort{}
+	}
+	return json.Marshal(&jsonSwitchFeatures{jsonHeader{OFPT_FEATURES_REPLY, xid},
+		jsonHex64(m.DatapathId), m.NBuffers, m.NTables, m.Capabilities,
+		m.Actions, ports})
+}
+
+func (m *SwitchFeatures) UnmarshalJSON(data []byte) error {
+	var j jsonSwitchFeatures
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = SwitchFeatures{
+		Header:       &Header{Version: OFP_VERSION, Type: OFPT_FEATURES_REPLY, Xid: j.Xid},
+		DatapathId:   uint64(j.DatapathId),
+		NBuffers:     j.NBuffers,
+		NTables:      j.NTables,
+		Capabilities: j.Capabilities,
+		Actions:      j.Actions,
+		Ports:        j.Ports,
+	}
+	return j.check(OFPT_FEATURES_REPLY)
+}
+
+type jsonPortStatus struct {
+	jsonHeader
+	Reason Ppr     `json:"reason"`
+	Desc   PhyPort `json:"desc"`
+}
+
+func (m *PortStatus) MarshalJSON() ([]byte, error) {
+	var xid uint32
+	if m.Header != nil {
+		xid = m.Xid
+	}
+	return json.Marshal(&jsonPortStatus{jsonHeader{OFPT_PORT_STATUS, xid},
+		m.Reason, m.Desc})
+}
+
+func (m *PortStatus) UnmarshalJSON(data []byte) error {
+	var j jsonPortStatus
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = PortStatus{
+		Header: &Header{Version: OFP_VERSION, Type: OFPT_PORT_STATUS, Xid: j.Xid},
+		Reason: j.Reason,
+		Desc:   j.Desc,
+	}
+	return j.check(OFPT_PORT_STATUS)
+}
+
+type jsonPortMod struct {
+	jsonHeader
+	PortNo    uint16  `json:"port_no"`
+	HwAddr    jsonMAC `json:"hw_addr"`
+	Config    uint32  `json:"config"`
+	Mask      uint32  `json:"mask"`
+	Advertise uint32  `json:"advertise"`
+}
+
+func (m *PortMod) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonPortMod{jsonHeader{OFPT_PORT_MOD, m.Xid},
+		m.PortNo, m.HwAddr, m.Config, m.Mask, m.Advertise})
+}
+
+func (m *PortMod) UnmarshalJSON(data []byte) error {
+	var j jsonPortMod
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = PortMod{j.Xid, j.PortNo, j.HwAddr, j.Config, j.Mask, j.Advertise}
+	return j.check(OFPT_PORT_MOD)
+}
+
+type jsonPacketIn struct {
+	jsonHeader
+	BufferId uint32    `json:"buffer_id"`
+	TotalLen uint16    `json:"total_len"`
+	InPort   uint16    `json:"in_port"`
+	Reason   uint8     `json:"reason"`
+	Data     jsonBytes `json:"data"`
+}
+
+func (m *PacketIn) MarshalJSON() ([]byte, error) {
+	var xid uint32
+	if m.Header != nil {
+		xid = m.Xid
+	}
+	return json.Marshal(&jsonPacketIn{jsonHeader{OFPT_PACKET_IN, xid},
+		m.BufferId, m.TotalLen, m.InPort, m.Reason, m.Data})
+}
+
+// The frame is parsed from the "data" member; a frame that fails to parse
+// sets FrameErr and leaves EthFrame holding whatever could be decoded, as
+// PacketIn.Read does.
+func (m *PacketIn) UnmarshalJSON(data []byte) error {
+	var j jsonPacketIn
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = PacketIn{
+		Header:   &Header{Version: OFP_VERSION, Type: OFPT_PACKET_IN, Xid: j.Xid},
+		BufferId: j.BufferId,
+		TotalLen: j.TotalLen,
+		InPort:   j.InPort,
+		Reason:   j.Reason,
+		Data:     j.Data,
+	}
+	err = j.check(OFPT_PACKET_IN)
+	if err != nil {
+		return err
+	}
+	m.Packet = packets.NewPacket(j.Data)
+	if len(j.Data) > 0 {
+		m.EthFrame, m.FrameErr = packets.Parse(j.Data)
+	}
+	return nil
+}
+
+type jsonPacketOut struct {
+	jsonHeader
+	BufferId uint32      `json:"buffer_id"`
+	InPort   uint16      `json:"in_port"`
+	Actions  jsonActions `json:"actions"`
+	Data     jsonBytes   `json:"data"`
+}
+
+func (m *PacketOut) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonPacketOut{jsonHeader{OFPT_PACKET_OUT, m.Xid},
+		m.BufferId, m.InPort, m.Actions, m.Data})
+}
+
+func (m *PacketOut) UnmarshalJSON(data []byte) error {
+	var j jsonPacketOut
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = PacketOut{j.Xid, j.BufferId, j.InPort, j.Actions, j.Data}
+	return j.check(OFPT_PACKET_OUT)
+}
+
+type jsonFlowMod struct {
+	jsonHeader
+	Match       Match          `json:"match"`
+	Cookie      jsonHex64      `json:"cookie"`
+	Command     FlowModCommand `json:"command"`
+	IdleTimeout uint16         `json:"idle_timeout"`
+	HardTimeout uint16         `json:"hard_timeout"`
+	Priority    uint16         `json:"priority"`
+	BufferId    uint32         `json:"buffer_id"`
+	OutPort     uint16         `json:"out_port"`
+	Flags       uint16         `json:"flags"`
+	Actions     jsonActions    `json:"actions"`
+}
+
+func (m *FlowMod) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonFlowMod{jsonHeader{OFPT_FLOW_MOD, m.Xid},
+		m.Match, jsonHex64(m.Cookie), m.Command, m.IdleTimeout, m.HardTimeout,
+		m.Priority, m.BufferId, m.OutPort, m.Flags, m.Actions})
+}
+
+func (m *FlowMod) UnmarshalJSON(data []byte) error {
+	var j jsonFlowMod
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = FlowMod{
+		Xid:         j.Xid,
+		Match:       j.Match,
+		Cookie:      uint64(j.Cookie),
+		Command:     j.Command,
+		IdleTimeout: j.IdleTimeout,
+		HardTimeout: j.HardTimeout,
+		Priority:    j.Priority,
+		BufferId:    j.BufferId,
+		OutPort:     j.OutPort,
+		Flags:       j.Flags,
+		Actions:     j.Actions,
+	}
+	return j.check(OFPT_FLOW_MOD)
+}
+
+type jsonFlowRemoved struct {
+	jsonHeader
+	Match        Match             `json:"match"`
+	Cookie       jsonHex64         `json:"cookie"`
+	Priority     uint16            `json:"priority"`
+	Reason       FlowRemovedReason `json:"reason"`
+	DurationSec  uint32            `json:"duration_sec"`
+	DurationNsec uint32            `json:"duration_nsec"`
+	IdleTimeout  uint16            `json:"idle_timeout"`
+	PacketCount  uint64            `json:"packet_count"`
+	ByteCount    uint64            `json:"byte_count"`
+}
+
+func (m *FlowRemoved) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonFlowRemoved{jsonHeader{OFPT_FLOW_REMOVED, m.Xid},
+		m.Match, jsonHex64(m.Cookie), m.Priority, m.Reason, m.DurationSec,
+		m.DurationNsec, m.IdleTimeout, m.PacketCount, m.ByteCount})
+}
+
+func (m *FlowRemoved) UnmarshalJSON(data []byte) error {
+	var j jsonFlowRemoved
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*m = FlowRemoved{}
+	m.Header = Header{Version: OFP_VERSION, Type: OFPT_FLOW_REMOVED, Xid: j.Xid}
+	m.Match = j.Match
+	m.Cookie = uint64(j.Cookie)
+	m.Priority = j.Priority
+	m.Reason = j.Reason
+	m.DurationSec = j.DurationSec
+	m.DurationNsec = j.DurationNsec
+	m.IdleTimeout = j.IdleTimeout
+	m.PacketCount = j.PacketCount
+	m.ByteCount = j.ByteCount
+	return j.check(OFPT_FLOW_REMOVED)
+}
+
+type jsonError struct {
+	jsonHeader
+	ErrType ErrorType `json:"err_type"`
+	Code    uint16    `json:"code"`
+	Data    jsonBytes `json:"data"`
+}
+
+func (m *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonError{jsonHeader{OFPT_ERROR, m.Xid}, m.Type,
+		m.Code, m.Data})
+}
+
+func (m *Error) UnmarshalJSON(data []byte) error {
+	var j jsonError
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Header = Header{Version: OFP_VERSION, Type: OFPT_ERROR, Xid: j.Xid}
+	m.Type = j.ErrType
+	m.Code = j.Code
+	m.Data = j.Data
+	return j.check(OFPT_ERROR)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Stats
+
+// Copies s into the NUL-terminated string field dst.
+func setCString(dst []byte, s, what string) error {
+	if len(s) >= len(dst) {
+		return fmt.Errorf("%s %q too long", what, s)
+	}
+	copy(dst, s)
+	return nil
+}
+
+// The body of a flow or aggregate stats request.
+type jsonFlowStatsRequest struct {
+	Match   Match  `json:"match"`
+	TableId uint8  `json:"table_id"`
+	OutPort uint16 `json:"out_port"`
+}
+
+type jsonPortStatsRequest struct {
+	PortNo uint16 `json:"port_no"`
+}
+
+type jsonQueueStatsRequest struct {
+	PortNo  uint16 `json:"port_no"`
+	QueueId uint32 `json:"queue_id"`
+}
+
+type jsonDescStats struct {
+	MfrDesc   string `json:"mfr_desc"`
+	HwDesc    string `json:"hw_desc"`
+	SwDesc    string `json:"sw_desc"`
+	SerialNum string `json:"serial_num"`
+	DpDesc    string `json:"dp_desc"`
+}
+
+type jsonFlowStat struct {
+	TableId      uint8       `json:"table_id"`
+	Match        Match       `json:"match"`
+	DurationSec  uint32      `json:"duration_sec"`
+	DurationNsec uint32      `json:"duration_nsec"`
+	Priority     uint16      `json:"priority"`
+	IdleTimeout  uint16      `json:"idle_timeout"`
+	HardTimeout  uint16      `json:"hard_timeout"`
+	Cookie       jsonHex64   `json:"cookie"`
+	PacketCount  uint64      `json:"packet_count"`
+	ByteCount    uint64      `json:"byte_count"`
+	Actions      jsonActions `json:"actions"`
+}
+
+type jsonAggregateStats struct {
+	PacketCount uint64 `json:"packet_count"`
+	ByteCount   uint64 `json:"byte_count"`
+	FlowCount   uint32 `json:"flow_count"`
+}
+
+type jsonTableStat struct {
+	TableId      uint8  `json:"table_id"`
+	Name         string `json:"name"`
+	Wildcards    uint32 `json:"wildcards"`
+	MaxEntries   uint32 `json:"max_entries"`
+	ActiveCount  uint32 `json:"active_count"`
+	LookupCount  uint64 `json:"lookup_count"`
+	MatchedCount uint64 `json:"matched_count"`
+}
+
+type jsonPortStat struct {
+	PortNo     uint16 `json:"port_no"`
+	RxPackets  uint64 `json:"rx_packets"`
+	TxPackets  uint64 `json:"tx_packets"`
+	RxBytes    uint64 `json:"rx_bytes"`
+	TxBytes    uint64 `json:"tx_bytes"`
+	RxDropped  uint64 `json:"rx_dropped"`
+	TxDropped  uint64 `json:"tx_dropped"`
+	RxErrors   uint64 `json:"rx_errors"`
+	TxErrors   uint64 `json:"tx_errors"`
+	RxFrameErr uint64 `json:"rx_frame_err"`
+	RxOverErr  uint64 `json:"rx_over_err"`
+	RxCrcErr   uint64 `json:"rx_crc_err"`
+	Collisions uint64 `json:"collisions"`
+}
+
+type jsonQueueStat struct {
+	PortNo    uint16 `json:"port_no"`
+	QueueId   uint32 `json:"queue_id"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxErrors  uint64 `json:"tx_errors"`
+}
+
+// Returns the JSON form of a stats request body or reply entry, as decoded
+// by StatsRequest.Stat and StatsReply.Stats.
+func statJSON(s Stat) interface{} {
+	switch s := s.(type) {
+	case *FlowStatsRequest:
+		return &jsonFlowStatsRequest{s.Match, s.TableId, s.OutPort}
+	case *AggregateStatsRequest:
+		return &jsonFlowStatsRequest{s.Match, s.TableId, s.OutPort}
+	case *PortStatsRequest:
+		return &jsonPortStatsRequest{s.PortNo}
+	case *QueueStatsRequest:
+		return &jsonQueueStatsRequest{s.PortNo, s.QueueId}
+	case *DescStats:
+		return &jsonDescStats{cString(s.MfrDesc[:]), cString(s.HwDesc[:]),
+			cString(s.SwDesc[:]), cString(s.SerialNum[:]), cString(s.DpDesc[:])}
+	case *FlowStat:
+		return &jsonFlowStat{s.TableId, s.Match, s.DurationSec, s.DurationNsec,
+			s.Priority, s.IdleTimeout, s.HardTimeout, jsonHex64(s.Cookie),
+			s.PacketCount, s.ByteCount, s.Actions}
+	case *AggregateStats:
+		return &jsonAggregateStats{s.PacketCount, s.ByteCount, s.FlowCount}
+	case *TableStat:
+		return &jsonTableStat{s.TableId, cString(s.Name[:]), s.Wildcards,
+			s.MaxEntries, s.ActiveCount, s.LookupCount, s.MatchedCount}
+	case *PortStat:
+		return &jsonPortStat{s.PortNo, s.RxPackets, s.TxPackets, s.RxBytes,
+			s.TxBytes, s.RxDropped, s.TxDropped, s.RxErrors, s.TxErrors,
+			s.RxFrameErr, s.RxOverErr, s.RxCrcErr, s.Collisions}
+	case *QueueStat:
+		return &jsonQueueStat{s.PortNo, s.QueueId, s.TxBytes, s.TxPackets,
+			s.TxErrors}
+	}
+	panic(fmt.Sprintf("no JSON form for %T", s))
+}
+
+// Decodes the JSON form of the body of a stats request of type t.
+func unmarshalStatsRequest(t StatsType, data []byte) (Stat, error) {
+	switch t {
+	case StatsFlow, StatsAggregate:
+		var j jsonFlowStatsRequest
+		err := json.Unmarshal(data, &j)
+		if err != nil {
+			return nil, err
+		}
+		if t == StatsFlow {
+			return &FlowStatsRequest{Match: j.Match, TableId: j.TableId,
+				OutPort: j.OutPort}, nil
+		}
+		return &AggregateStatsRequest{Match: j.Match, TableId: j.TableId,
+			OutPort: j.OutPort}, nil
+	case StatsPort:
+		var j jsonPortStatsRequest
+		err := json.Unmarshal(data, &j)
+		return &PortStatsRequest{PortNo: j.PortNo}, err
+	case StatsQueue:
+		var j jsonQueueStatsRequest
+		err := json.Unmarshal(data, &j)
+		return &QueueStatsRequest{PortNo: j.PortNo, QueueId: j.QueueId}, err
+	}
+	return nil, fmt.Errorf("%v stats request has no body", t)
+}
+
+// Decodes the JSON form of an entry of a stats reply of type t.
+func unmarshalStat(t StatsType, data []byte) (Stat, error) {
+	var err error
+	switch t {
+	case StatsDesc:
+		var j jsonDescStats
+		if err = json.Unmarshal(data, &j); err != nil {
+			return nil, err
+		}
+		s := new(DescStats)
+		for _, f := range []struct {
+			dst       []byte
+			src, what string
+		}{
+			{s.MfrDesc[:], j.MfrDesc, "mfr_desc"},
+			{s.HwDesc[:], j.HwDesc, "hw_desc"},
+			{s.SwDesc[:], j.SwDesc, "sw_desc"},
+			{s.SerialNum[:], j.SerialNum, "serial_num"},
+			{s.DpDesc[:], j.DpDesc, "dp_desc"},
+		} {
+			if err = setCString(f.dst, f.src, f.what); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case StatsFlow:
+		var j jsonFlowStat
+		if err = json.Unmarshal(data, &j); err != nil {
+			return nil, err
+		}
+		return &FlowStat{TableId: j.TableId, Match: j.Match,
+			DurationSec: j.DurationSec, DurationNsec: j.DurationNsec,
+			Priority: j.Priority, IdleTimeout: j.IdleTimeout,
+			HardTimeout: j.HardTimeout, Cookie: uint64(j.Cookie),
+			PacketCount: j.PacketCount, ByteCount: j.ByteCount,
+			Actions: j.Actions}, nil
+	case StatsAggregate:
+		var j jsonAggregateStats
+		err = json.Unmarshal(data, &j)
+		return &AggregateStats{PacketCount: j.PacketCount,
+			ByteCount: j.ByteCount, FlowCount: j.FlowCount}, err
+	case StatsTable:
+		var j jsonTableStat
+		if err = json.Unmarshal(data, &j); err != nil {
+			return nil, err
+		}
+		s := &TableStat{TableId: j.TableId, Wildcards: j.Wildcards,
+			MaxEntries: j.MaxEntries, ActiveCount: j.ActiveCount,
+			LookupCount: j.LookupCount, MatchedCount: j.MatchedCount}
+		return s, setCString(s.Name[:], j.Name, "table name")
+	case StatsPort:
+		var j jsonPortStat
+		err = json.Unmarshal(data, &j)
+		return &PortStat{PortNo: j.PortNo, RxPackets: j.RxPackets,
+			TxPackets: j.TxPackets, RxBytes: j.RxBytes, TxBytes: j.TxBytes,
+			RxDropped: j.RxDropped, TxDropped: j.TxDropped,
+			RxErrors: j.RxErrors, TxErrors: j.TxErrors,
+			RxFrameErr: j.RxFrameErr, RxOverErr: j.RxOverErr,
+			RxCrcErr: j.RxCrcErr, Collisions: j.Collisions}, err
+	case StatsQueue:
+		var j jsonQueueStat
+		err = json.Unmarshal(data, &j)
+		return &QueueStat{PortNo: j.PortNo, QueueId: j.QueueId,
+			TxBytes: j.TxBytes, TxPackets: j.TxPackets, TxErrors: j.TxErrors}, err
+	}
+	return nil, fmt.Errorf("no JSON form for %v stats", t)
+}
+
+// Encodes stats into a message body.
+func statsBody(stats []Stat) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, s := range stats {
+		err := s.WriteStat(&buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// A stats request.  The body is decoded into "request", which is left out
+// for the types whose request has no body.  Vendor requests, and bodies
+// that do not decode, are written as "body" in base64 instead.
+type jsonStatsRequest struct {
+	jsonHeader
+	StatsType StatsType       `json:"stats_type"`
+	Flags     uint16          `json:"flags"`
+	Request   json.RawMessage `json:"request,omitempty"`
+	Body      jsonBytes       `json:"body,omitempty"`
+}
+
+func (m *StatsRequest) MarshalJSON() ([]byte, error) {
+	j := jsonStatsRequest{jsonHeader: jsonHeader{OFPT_STATS_REQUEST, m.Xid},
+		StatsType: m.Type, Flags: m.Flags}
+	s, err := m.Stat()
+	switch {
+	case err == nil && s != nil && int(s.Length()) == len(m.Body):
+		j.Request, err = json.Marshal(statJSON(s))
+		if err != nil {
+			return nil, err
+		}
+	case err == nil && s == nil && m.Type != StatsVendor && len(m.Body) == 0:
+	default:
+		j.Body = m.Body
+	}
+	return json.Marshal(&j)
+}
+
+func (m *StatsRequest) UnmarshalJSON(data []byte) error {
+	var j jsonStatsRequest
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Header = Header{Version: OFP_VERSION, Type: OFPT_STATS_REQUEST, Xid: j.Xid}
+	m.Type = j.StatsType
+	m.Flags = j.Flags
+	m.Body = j.Body
+	if j.Request != nil {
+		s, err := unmarshalStatsRequest(j.StatsType, j.Request)
+		if err != nil {
+			return err
+		}
+		m.Body, err = statsBody([]Stat{s})
+		if err != nil {
+			return err
+		}
+	}
+	return j.check(OFPT_STATS_REQUEST)
+}
+
+// A stats reply.  The body is decoded into the "stats" array, which is left
+// out if there are none.  Vendor replies, and bodies that do not decode,
+// are written as "body" in base64 instead.
+type jsonStatsReply struct {
+	jsonHeader
+	StatsType StatsType         `json:"stats_type"`
+	Flags     uint16            `json:"flags"`
+	Stats     []json.RawMessage `json:"stats,omitempty"`
+	Body      jsonBytes         `json:"body,omitempty"`
+}
+
+func (m *StatsReply) MarshalJSON() ([]byte, error) {
+	j := jsonStatsReply{jsonHeader: jsonHeader{OFPT_STATS_REPLY, m.Xid},
+		StatsType: StatsType(m.Type), Flags: uint16(m.Flags)}
+	stats, err := m.Stats()
+	size := 0
+	for _, s := range stats {
+		size += int(s.Length())
+	}
+	if err != nil || stats == nil || size != len(m.Body) {
+		j.Body = m.Body
+		return json.Marshal(&j)
+	}
+	for _, s := range stats {
+		raw, err := json.Marshal(statJSON(s))
+		if err != nil {
+			return nil, err
+		}
+		j.Stats = append(j.Stats, raw)
+	}
+	return json.Marshal(&j)
+}
+
+func (m *StatsReply) UnmarshalJSON(data []byte) error {
+	var j jsonStatsReply
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	m.Header = Header{Version: OFP_VERSION, Type: OFPT_STATS_REPLY, Xid: j.Xid}
+	m.Type = uint16(j.StatsType)
+	m.Flags = StatsReplyFlags(j.Flags)
+	m.Body = j.Body
+	if j.Stats != nil {
+		stats := make([]Stat, len(j.Stats))
+		for i, raw := range j.Stats {
+			stats[i], err = unmarshalStat(j.StatsType, raw)
+			if err != nil {
+				return err
+			}
+		}
+		m.Body, err = statsBody(stats)
+		if err != nil {
+			return err
+		}
+	}
+	return j.check(OFPT_STATS_REPLY)
+}
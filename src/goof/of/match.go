@@ -0,0 +1,172 @@
+package of
+
+import (
+	"goof/packets"
+)
+
+// Sets the VLAN fields of m from the outermost tag of frame and stops
+// wildcarding them.  An untagged frame matches dl_vlan=OFP_VLAN_NONE, in
+// which case the priority stays wildcarded since there is none to match.
+func (m *Match) SetVLAN(frame *packets.EthFrame) {
+	m.Wildcards &^= FwDlVlan
+	if !frame.Tagged() {
+		m.VLanID = OFP_VLAN_NONE
+		m.VLanPCP = 0
+		m.Wildcards |= FwDlVlanPcp
+		return
+	}
+	m.VLanID = frame.VID()
+	m.VLanPCP = frame.PCP()
+	m.Wildcards &^= FwDlVlanPcp
+}
+
+// Returns the exact match a switch extracts from a frame received on
+// inPort, following the OpenFlow 1.0 specification: dl_vlan is
+// OFP_VLAN_NONE for untagged frames, 802.3 frames have dl_type
+// OFP_DL_TYPE_NOT_ETH_TYPE, ARP packets match their opcode in nw_proto and
+// their protocol addresses in nw_src and nw_dst, ICMP type and code go in
+// tp_src and tp_dst, and fragments carry no transport fields, not even the
+// first, as with the normal fragment handling of OFPC_FRAG_NORMAL.  Fields
+// the frame does not have are zero but still matched.
+func MatchFromPacket(inPort uint16, frame *packets.EthFrame) Match {
+	m := Match{InPort: inPort, DlSrc: frame.SrcMAC, DlDst: frame.DstMAC,
+		VLanID: OFP_VLAN_NONE}
+	if frame.Tagged() {
+		m.VLanID = frame.VID()
+		m.VLanPCP = frame.PCP()
+	}
+	m.EthFrameType = uint16(frame.Type)
+	if m.EthFrameType < OFP_DL_TYPE_ETH2_CUTOFF {
+		m.EthFrameType = OFP_DL_TYPE_NOT_ETH_TYPE
+	}
+	switch body := frame.Body.(type) {
+	case *packets.ARPPacket:
+		if body.Operation <= 0xff {
+			m.NwProto = uint8(body.Operation)
+		}
+		m.NwSrc = body.SenderIP
+		m.NwDst = body.TargetIP
+	case *packets.IPFragment:
+		m.NwTOS = body.TOS & 0xfc
+		m.NwProto = uint8(body.Protocol)
+		m.NwSrc = body.SrcAddr
+		m.NwDst = body.DstAddr
+		if body.IsFragment() {
+			break // even the first fragment's transport fields stay zero
+		}
+		switch l4 := body.Body.(type) {
+		case *packets.TCPHeader:
+			m.TpSrc, m.TpDst = l4.SrcPort, l4.DstPort
+		case *packets.UDPHeader:
+			m.TpSrc, m.TpDst = l4.SrcPort, l4.DstPort
+		case *packets.ICMPHeader:
+			m.TpSrc, m.TpDst = uint16(l4.Type), uint16(l4.Code)
+		}
+	}
+	return m
+}
+
+// Bits of the wildcards that each leave a whole field open, as opposed to
+// the IP prefix lengths.
+const fieldWildcards = FwAll &^ (FwNwSrcMask | FwNwDstMask)
+
+// Returns how many low bits of the address at shift (FwNwSrcShift or
+// FwNwDstShift) are wildcarded, clamped to 32.
+func (m *Match) nwWildBits(shift uint32) uint32 {
+	n := (m.Wildcards >> shift) & (1<<FwNwSrcBits - 1)
+	if n > 32 {
+		n = 32
+	}
+	return n
+}
+
+// Returns the mask of the address bits a match with n wildcarded bits
+// checks.
+func nwMask(n uint32) uint32 {
+	if n >= 32 {
+		return 0
+	}
+	return ^uint32(0) << n
+}
+
+// Returns m with the fields it wildcards and the padding zeroed and the IP
+// prefix lengths clamped, so that matches selecting the same packets are
+// equal.  Switches report their flows in this form.
+func (m Match) Normalized() Match {
+	src, dst := m.nwWildBits(FwNwSrcShift), m.nwWildBits(FwNwDstShift)
+	w := m.Wildcards&fieldWildcards | src<<FwNwSrcShift | dst<<FwNwDstShift
+	n := Match{Wildcards: w, NwSrc: m.NwSrc & nwMask(src), NwDst: m.NwDst & nwMask(dst)}
+	if w&FwInPort == 0 {
+		n.InPort = m.InPort
+	}
+	if w&FwDlVlan == 0 {
+		n.VLanID = m.VLanID
+	}
+	if w&FwDlVlanPcp == 0 {
+		n.VLanPCP = m.VLanPCP
+	}
+	if w&FwDlSrc == 0 {
+		n.DlSrc = m.DlSrc
+	}
+	if w&FwDlDst == 0 {
+		n.DlDst = m.DlDst
+	}
+	if w&FwDlType == 0 {
+		n.EthFrameType = m.EthFrameType
+	}
+	if w&FwNwTos == 0 {
+		n.NwTOS = m.NwTOS
+	}
+	if w&FwNwProto == 0 {
+		n.NwProto = m.NwProto
+	}
+	if w&FwTpSrc == 0 {
+		n.TpSrc = m.TpSrc
+	}
+	if w&FwTpDst == 0 {
+		n.TpDst = m.TpDst
+	}
+	return n
+}
+
+// Reports whether the fields that both a and b fix are equal, and the IP
+// addresses agree on the bits both check.
+func agree(a, b *Match) bool {
+	both := ^(a.Wildcards | b.Wildcards)
+	same := func(f uint32, equal bool) bool { return both&f == 0 || equal }
+	if !same(FwInPort, a.InPort == b.InPort) ||
+		!same(FwDlVlan, a.VLanID == b.VLanID) ||
+		!same(FwDlVlanPcp, a.VLanPCP == b.VLanPCP) ||
+		!same(FwDlSrc, a.DlSrc == b.DlSrc) ||
+		!same(FwDlDst, a.DlDst == b.DlDst) ||
+		!same(FwDlType, a.EthFrameType == b.EthFrameType) ||
+		!same(FwNwTos, a.NwTOS == b.NwTOS) ||
+		!same(FwNwProto, a.NwProto == b.NwProto) ||
+		!same(FwTpSrc, a.TpSrc == b.TpSrc) ||
+		!same(FwTpDst, a.TpDst == b.TpDst) {
+		return false
+	}
+	src := nwMask(a.nwWildBits(FwNwSrcShift)) & nwMask(b.nwWildBits(FwNwSrcShift))
+	dst := nwMask(a.nwWildBits(FwNwDstShift)) & nwMask(b.nwWildBits(FwNwDstShift))
+	return a.NwSrc&src == b.NwSrc&src && a.NwDst&dst == b.NwDst&dst
+}
+
+// Reports whether every packet that o matches is also matched by m, as a
+// non-strict FlowMod or flow stats request with match m selects the flow
+// with match o.  The exact match of a packet is covered by every flow the
+// packet hits.
+func (m *Match) Covers(o *Match) bool {
+	if ^m.Wildcards&fieldWildcards&o.Wildcards != 0 {
+		return false // o leaves open a field m fixes
+	}
+	if m.nwWildBits(FwNwSrcShift) < o.nwWildBits(FwNwSrcShift) ||
+		m.nwWildBits(FwNwDstShift) < o.nwWildBits(FwNwDstShift) {
+		return false // o takes a shorter prefix than m
+	}
+	return agree(m, o)
+}
+
+// Reports whether some packet could match both m and o.
+func (m *Match) Overlaps(o *Match) bool {
+	return agree(m, o)
+}
@@ -19,6 +19,59 @@ type ToSwitch interface {
 	Write(w io.Writer) error
 }
 
+// Messages that can be both decoded and encoded.  Every message type in this
+// package is one.
+type Message interface {
+	FromSwitch
+	ToSwitch
+}
+
+// Returns an empty message of type t, ready for Read, or nil if this package
+// has no representation for t.
+func NewMessage(t Type) Message {
+	switch t {
+	case OFPT_HELLO:
+		return new(Hello)
+	case OFPT_ERROR:
+		return new(Error)
+	case OFPT_ECHO_REQUEST:
+		return new(EchoRequest)
+	case OFPT_ECHO_REPLY:
+		return new(EchoReply)
+	case OFPT_FEATURES_REQUEST:
+		return new(SwitchFeaturesRequest)
+	case OFPT_FEATURES_REPLY:
+		return new(SwitchFeatures)
+	case OFPT_GET_CONFIG_REQUEST:
+		return new(GetConfigRequest)
+	case OFPT_GET_CONFIG_REPLY:
+		return new(GetConfigReply)
+	case OFPT_SET_CONFIG:
+		return new(SwitchConfig)
+	case OFPT_PACKET_IN:
+		return new(PacketIn)
+	case OFPT_FLOW_REMOVED:
+		return new(FlowRemoved)
+	case OFPT_PORT_STATUS:
+		return new(PortStatus)
+	case OFPT_PACKET_OUT:
+		return new(PacketOut)
+	case OFPT_FLOW_MOD:
+		return new(FlowMod)
+	case OFPT_PORT_MOD:
+		return new(PortMod)
+	case OFPT_STATS_REQUEST:
+		return new(StatsRequest)
+	case OFPT_STATS_REPLY:
+		return new(StatsReply)
+	case OFPT_BARRIER_REQUEST:
+		return new(BarrierRequest)
+	case OFPT_BARRIER_REPLY:
+		return new(BarrierReply)
+	}
+	return nil
+}
+
 type Action interface {
 	WriteAction(w io.Writer) error
 }
@@ -27,6 +80,38 @@ var pad64 = make([]byte, 8, 8)
 
 type Type uint8
 
+var typeNames = []string{
+	OFPT_HELLO:                    "OFPT_HELLO",
+	OFPT_ERROR:                    "OFPT_ERROR",
+	OFPT_ECHO_REQUEST:             "OFPT_ECHO_REQUEST",
+	OFPT_ECHO_REPLY:               "OFPT_ECHO_REPLY",
+	OFPT_VENDOR:                   "OFPT_VENDOR",
+	OFPT_FEATURES_REQUEST:         "OFPT_FEATURES_REQUEST",
+	OFPT_FEATURES_REPLY:           "OFPT_FEATURES_REPLY",
+	OFPT_GET_CONFIG_REQUEST:       "OFPT_GET_CONFIG_REQUEST",
+	OFPT_GET_CONFIG_REPLY:         "OFPT_GET_CONFIG_REPLY",
+	OFPT_SET_CONFIG:               "OFPT_SET_CONFIG",
+	OFPT_PACKET_IN:                "OFPT_PACKET_IN",
+	OFPT_FLOW_REMOVED:             "OFPT_FLOW_REMOVED",
+	OFPT_PORT_STATUS:              "OFPT_PORT_STATUS",
+	OFPT_PACKET_OUT:               "OFPT_PACKET_OUT",
+	OFPT_FLOW_MOD:                 "OFPT_FLOW_MOD",
+	OFPT_PORT_MOD:                 "OFPT_PORT_MOD",
+	OFPT_STATS_REQUEST:            "OFPT_STATS_REQUEST",
+	OFPT_STATS_REPLY:              "OFPT_STATS_REPLY",
+	OFPT_BARRIER_REQUEST:          "OFPT_BARRIER_REQUEST",
+	OFPT_BARRIER_REPLY:            "OFPT_BARRIER_REPLY",
+	OFPT_QUEUE_GET_CONFIG_REQUEST: "OFPT_QUEUE_GET_CONFIG_REQUEST",
+	OFPT_QUEUE_GET_CONFIG_REPLY:   "OFPT_QUEUE_GET_CONFIG_REPLY",
+}
+
+func (t Type) String() string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("unknown type (%d)", uint8(t))
+}
+
 /* Header on all OpenFlow packets. */
 type Header struct {
 	Version uint8  /* OFP_VERSION. */
@@ -46,6 +131,25 @@ func (h *Header) String() string {
 
 const HeaderSize = 8
 
+// Largest message that fits in the 16-bit Length field.
+const maxMsgLen = 0xffff
+
+// Writes a complete message of type t whose body is in body.  The header and
+// body go out in a single Write so that messages are never interleaved.
+func writeMsg(w io.Writer, t Type, xid uint32, body []byte) error {
+	length := HeaderSize + len(body)
+	if length > maxMsgLen {
+		return fmt.Errorf("%v too long (%d bytes)", t, length)
+	}
+	buf := make([]byte, HeaderSize, length)
+	buf[0] = OFP_VERSION
+	buf[1] = uint8(t)
+	binary.BigEndian.PutUint16(buf[2:], uint16(length))
+	binary.BigEndian.PutUint32(buf[4:], xid)
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
 /* OFPT_HELLO.  This message has an empty body but implementations must
  * ignore any data included in the body to allow for future extensions. */
 type Hello struct {
@@ -73,7 +177,7 @@ func (m *EchoRequest) Write(w io.Writer) error {
 	m.Length = uint16(HeaderSize + len(m.Body))
 	m.Type = OFPT_ECHO_REQUEST
 	m.Version = OFP_VERSION
-	return binary.Write(w, binary.BigEndian, m)
+	return writeMsg(w, m.Type, m.Xid, m.Body)
 }
 
 func (m *EchoRequest) Read(h *Header, body []byte) error {
@@ -91,9 +195,7 @@ func (m *EchoReply) Write(w io.Writer) error {
 	m.Length = uint16(HeaderSize + len(m.Body))
 	m.Type = OFPT_ECHO_REPLY
 	m.Version = OFP_VERSION
-	binary.Write(w, binary.BigEndian, &m.Header)
-	_, err := w.Write(m.Body)
-	return err
+	return writeMsg(w, m.Type, m.Xid, m.Body)
 }
 
 func (m *EchoReply) Read(h *Header, body []byte) error {
@@ -115,13 +217,61 @@ type SwitchConfig struct {
 const switchConfigSize uint16 = 12
 
 func (m *SwitchConfig) Write(w io.Writer) error {
-	h := Header{OFP_VERSION, OFPT_FLOW_MOD, switchConfigSize, m.Xid}
-	binary.Write(w, binary.BigEndian, &h)
-	binary.Write(w, binary.BigEndian, m.Flags)
-	return binary.Write(w, binary.BigEndian, m.MissSendLen)
+	body := make([]byte, switchConfigSize-HeaderSize)
+	binary.BigEndian.PutUint16(body[0:], uint16(m.Flags))
+	binary.BigEndian.PutUint16(body[2:], m.MissSendLen)
+	return writeMsg(w, OFPT_SET_CONFIG, m.Xid, body)
+}
+
+func (m *SwitchConfig) Read(h *Header, body []byte) error {
+	if len(body) < int(switchConfigSize-HeaderSize) {
+		return errors.New("SET_CONFIG too short")
+	}
+	m.Xid = h.Xid
+	m.Flags = ConfigFlags(binary.BigEndian.Uint16(body[0:]))
+	m.MissSendLen = binary.BigEndian.Uint16(body[2:])
+	return nil
 }
 
 
+/* OFPT_GET_CONFIG_REQUEST.  The body is empty. */
+type GetConfigRequest struct {
+	Xid uint32
+}
+
+func (m *GetConfigRequest) Write(w io.Writer) error {
+	return writeMsg(w, OFPT_GET_CONFIG_REQUEST, m.Xid, nil)
+}
+
+func (m *GetConfigRequest) Read(h *Header, body []byte) error {
+	m.Xid = h.Xid
+	return nil
+}
+
+/* OFPT_GET_CONFIG_REPLY.  Same body as OFPT_SET_CONFIG. */
+type GetConfigReply struct {
+	Xid         uint32
+	Flags       ConfigFlags // OFPC_* flags
+	MissSendLen uint16      // Max bytes of new flow to send to the controller
+}
+
+func (m *GetConfigReply) Write(w io.Writer) error {
+	body := make([]byte, switchConfigSize-HeaderSize)
+	binary.BigEndian.PutUint16(body[0:], uint16(m.Flags))
+	binary.BigEndian.PutUint16(body[2:], m.MissSendLen)
+	return writeMsg(w, OFPT_GET_CONFIG_REPLY, m.Xid, body)
+}
+
+func (m *GetConfigReply) Read(h *Header, body []byte) error {
+	if len(body) < int(switchConfigSize-HeaderSize) {
+		return errors.New("GET_CONFIG_REPLY too short")
+	}
+	m.Xid = h.Xid
+	m.Flags = ConfigFlags(binary.BigEndian.Uint16(body[0:]))
+	m.MissSendLen = binary.BigEndian.Uint16(body[2:])
+	return nil
+}
+
 /* Description of a physical port */
 type PhyPort struct {
 	PortNo uint16
@@ -141,6 +291,19 @@ type PhyPort struct {
 
 const phyPortSize = 48
 
+// Decodes a port from b, which must hold at least phyPortSize bytes.
+func (p *PhyPort) decode(b []byte) {
+	p.PortNo = binary.BigEndian.Uint16(b[0:])
+	copy(p.HwAddr[:], b[2:8])
+	copy(p.Name[:], b[8:24])
+	p.Config = binary.BigEndian.Uint32(b[24:])
+	p.State = binary.BigEndian.Uint32(b[28:])
+	p.Curr = binary.BigEndian.Uint32(b[32:])
+	p.Advertised = binary.BigEndian.Uint32(b[36:])
+	p.Supported = binary.BigEndian.Uint32(b[40:])
+	p.Peer = binary.BigEndian.Uint32(b[44:])
+}
+
 type SwitchFeaturesRequest struct {
 	Xid uint32
 }
@@ -150,6 +313,11 @@ func (m *SwitchFeaturesRequest) Write(w io.Writer) error {
 	return binary.Write(w, binary.BigEndian, &h)
 }
 
+func (m *SwitchFeaturesRequest) Read(h *Header, body []byte) error {
+	m.Xid = h.Xid
+	return nil
+}
+
 type SwitchFeatures struct {
 	*Header
 	DatapathId uint64 /* Datapath unique ID.  The lower 48-bits are for
@@ -158,15 +326,18 @@ type SwitchFeatures struct {
 	NBuffers     uint32 /* Max packets buffered at once. */
 	NTables      uint8  /* Number of tables supported by datapath. */
 	Pad          [3]byte
-	Capabilities uint32     /* Bitmap of support "Capabilities". */
-	Actions      ActionType /* Bitmap of supported "ActionType"s. */
-	Ports        []PhyPort  // Port definitions.
+	Capabilities uint32    /* Bitmap of support "Capabilities". */
+	Actions      uint32    /* Bitmap of supported "ActionType"s. */
+	Ports        []PhyPort // Port definitions.
 }
 
 const switchFeaturesPartSize = 24
 
 func (m *SwitchFeatures) Read(h *Header, body []byte) error {
 	m.Header = h
+	if len(body) < switchFeaturesPartSize {
+		return errors.New("FEATURES_REPLY too short")
+	}
 	buf := bytes.NewBuffer(body)
 	binary.Read(buf, binary.BigEndian, &m.DatapathId)
 	binary.Read(buf, binary.BigEndian, &m.NBuffers)
@@ -174,7 +345,7 @@ func (m *SwitchFeatures) Read(h *Header, body []byte) error {
 	binary.Read(buf, binary.BigEndian, &m.Pad)
 	binary.Read(buf, binary.BigEndian, &m.Capabilities)
 	binary.Read(buf, binary.BigEndian, &m.Actions)
-	portsSize := h.Length - HeaderSize - switchFeaturesPartSize
+	portsSize := len(body) - switchFeaturesPartSize
 	if portsSize%phyPortSize != 0 {
 		return errors.New(fmt.Sprintf("FEATURES_REPLY misaligned (%d port size)",
 			portsSize))
@@ -184,6 +355,22 @@ func (m *SwitchFeatures) Read(h *Header, body []byte) error {
 	return binary.Read(buf, binary.BigEndian, m.Ports)
 }
 
+func (m *SwitchFeatures) Write(w io.Writer) error {
+	var xid uint32
+	if m.Header != nil {
+		xid = m.Xid
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, m.DatapathId)
+	binary.Write(buf, binary.BigEndian, m.NBuffers)
+	binary.Write(buf, binary.BigEndian, m.NTables)
+	binary.Write(buf, binary.BigEndian, m.Pad)
+	binary.Write(buf, binary.BigEndian, m.Capabilities)
+	binary.Write(buf, binary.BigEndian, m.Actions)
+	binary.Write(buf, binary.BigEndian, m.Ports)
+	return writeMsg(w, OFPT_FEATURES_REPLY, xid, buf.Bytes())
+}
+
 
 /* A physical port has changed in the datapath */
 type PortStatus struct {
@@ -194,11 +381,26 @@ type PortStatus struct {
 }
 
 func (m *PortStatus) Read(h *Header, body []byte) error {
-	buf := bytes.NewBuffer(body)
 	m.Header = h
-	binary.Read(buf, binary.BigEndian, &m.Reason)
-	binary.Read(buf, binary.BigEndian, &m.Pad)
-	return binary.Read(buf, binary.BigEndian, &m.Desc)
+	if len(body) < 8+phyPortSize {
+		return errors.New("PORT_STATUS too short")
+	}
+	m.Reason = Ppr(body[0])
+	copy(m.Pad[:], body[1:8])
+	m.Desc.decode(body[8:])
+	return nil
+}
+
+func (m *PortStatus) Write(w io.Writer) error {
+	var xid uint32
+	if m.Header != nil {
+		xid = m.Xid
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, m.Reason)
+	binary.Write(buf, binary.BigEndian, m.Pad)
+	binary.Write(buf, binary.BigEndian, &m.Desc)
+	return writeMsg(w, OFPT_PORT_STATUS, xid, buf.Bytes())
 }
 
 // Modify behavior of the physical port.
@@ -221,10 +423,23 @@ func (m *PortMod) Write(w io.Writer) error {
 	binary.Write(w, binary.BigEndian, m.Config)
 	binary.Write(w, binary.BigEndian, m.Mask)
 	binary.Write(w, binary.BigEndian, m.Advertise)
-	_, err := w.Write(pad64)
+	_, err := w.Write(pad64[:4])
 	return err
 }
 
+func (m *PortMod) Read(h *Header, body []byte) error {
+	if len(body) < 24 {
+		return errors.New("PORT_MOD too short")
+	}
+	m.Xid = h.Xid
+	m.PortNo = binary.BigEndian.Uint16(body[0:])
+	copy(m.HwAddr[:], body[2:8])
+	m.Config = binary.BigEndian.Uint32(body[8:])
+	m.Mask = binary.BigEndian.Uint32(body[12:])
+	m.Advertise = binary.BigEndian.Uint32(body[16:])
+	return nil
+}
+
 
 /* Packet received on port (datapath -> controller). */
 type PacketIn struct {
@@ -239,54 +454,119 @@ type PacketIn struct {
 	   header.  Because of padding offsetof(struct PacketIn data) == 
 	   sizeof(struct PacketIn) - 2. */
 	EthFrame *packets.EthFrame
+	// Why the frame did not parse, when it did not.  The message itself is
+	// still whole: the frame is only what the switch chose to send, and
+	// EthFrame links the layers decoded before the error, or is nil if not
+	// even the Ethernet header was there.  Always nil for lazily parsed
+	// frames, whose errors come from the accessors of Packet.
+	FrameErr error
+	Data     []byte // The raw frame that EthFrame was parsed from.
+	// A lazily decoded view of Data.  Unlike EthFrame it is always set,
+	// even when the frame is not parsed eagerly (see Decoder.Lazy).
+	Packet *packets.Packet
 }
 
 func (m *PacketIn) PacketNotMatched() bool {
 	return m.Reason == ReasonNoMatch
 }
 
+// Size of the PacketIn body up to the frame.
+const packetInPartSize = 10
+
 func (m *PacketIn) Read(h *Header, body []byte) error {
-	m.Header = h
+	return m.read(h, body, nil, nil, false)
+}
+
+// Decodes the message, parsing the frame into d and viewing it through pkt
+// if they are not nil.  If lazy is set, EthFrame is left nil and the frame is
+// only decoded as far as Packet is asked to.  A frame that fails to parse
+// does not fail the message; see FrameErr.
+func (m *PacketIn) read(h *Header, body []byte, d *packets.Decoded,
+	pkt *packets.Packet, lazy bool) error {
+	// A Decoder reads every PacketIn into the same message, so nothing of
+	// the last one may survive a body too short to overwrite it.
+	*m = PacketIn{Header: h}
+	if len(body) < packetInPartSize {
+		return errors.New("PACKET_IN too short")
+	}
 	m.BufferId = binary.BigEndian.Uint32(body[0:])
 	m.TotalLen = binary.BigEndian.Uint16(body[4:])
 	m.InPort = binary.BigEndian.Uint16(body[6:])
-	m.Reason = body[9]
-	frm, err := packets.Parse(body[10:])
-  m.EthFrame = frm
-	if err != nil {
-		return err
+	m.Reason = body[8]
+	m.Data = body[10:]
+	if pkt == nil {
+		pkt = new(packets.Packet)
+	}
+	pkt.Reset(m.Data)
+	m.Packet = pkt
+	if len(m.Data) == 0 || lazy {
+		return nil // miss_send_len of 0, or decoded on demand
 	}
+	if d == nil {
+		d = new(packets.Decoded)
+	}
+	m.EthFrame, m.FrameErr = d.Parse(m.Data)
 	return nil
 }
 
+// Writes the message with Data as the frame.  EthFrame is not consulted.
+func (m *PacketIn) Write(w io.Writer) error {
+	var xid uint32
+	if m.Header != nil {
+		xid = m.Xid
+	}
+	body := make([]byte, 10, 10+len(m.Data))
+	binary.BigEndian.PutUint32(body[0:], m.BufferId)
+	binary.BigEndian.PutUint16(body[4:], m.TotalLen)
+	binary.BigEndian.PutUint16(body[6:], m.InPort)
+	body[8] = m.Reason
+	return writeMsg(w, OFPT_PACKET_IN, xid, append(body, m.Data...))
+}
+
 type PacketOut struct {
 	Xid      uint32   // Transaction ID
-	BufferId int32    // ID assigned by datapath (-1 if none)
+	BufferId uint32   // ID assigned by datapath (0xffffffff if none)
 	InPort   uint16   // Packet's input port (OFPP_NONE if none)
 	Actions  []Action // Actions 
 	Data     []byte   // Only meaningful if BufferId is -1
 }
 
-func (m *PacketOut) actionsLen() uint16 {
-	size := uint16(0)
-	for _, a := range m.Actions {
-		size = size + ActionLen(a)
-	}
-	return size
-}
-
 func (m *PacketOut) Write(w io.Writer) error {
-	actionsLen := m.actionsLen()
-	dataLen := uint16(len(m.Data))
-	h := Header{OFP_VERSION, OFPT_PACKET_OUT, actionsLen + dataLen + 16, m.Xid}
-	binary.Write(w, binary.BigEndian, &h)
-	binary.Write(w, binary.BigEndian, m.BufferId)
-	binary.Write(w, binary.BigEndian, m.InPort)
-	binary.Write(w, binary.BigEndian, actionsLen)
+	var actions bytes.Buffer
 	for _, a := range m.Actions {
-		a.WriteAction(w)
+		err := a.WriteAction(&actions)
+		if err != nil {
+			return err
+		}
+	}
+	body := make([]byte, 8, 8+actions.Len()+len(m.Data))
+	binary.BigEndian.PutUint32(body[0:], m.BufferId)
+	binary.BigEndian.PutUint16(body[4:], m.InPort)
+	// Too many actions for this field make the message too long as well,
+	// which writeMsg refuses.
+	binary.BigEndian.PutUint16(body[6:], uint16(actions.Len()))
+	body = append(append(body, actions.Bytes()...), m.Data...)
+	return writeMsg(w, OFPT_PACKET_OUT, m.Xid, body)
+}
+
+func (m *PacketOut) Read(h *Header, body []byte) error {
+	if len(body) < 8 {
+		return errors.New("PACKET_OUT too short")
+	}
+	m.Xid = h.Xid
+	m.BufferId = binary.BigEndian.Uint32(body[0:])
+	m.InPort = binary.BigEndian.Uint16(body[4:])
+	actionsLen := int(binary.BigEndian.Uint16(body[6:]))
+	if 8+actionsLen > len(body) {
+		return errors.New("PACKET_OUT actions overrun message")
 	}
-	return binary.Write(w, binary.BigEndian, m.Data)
+	var err error
+	m.Actions, err = ReadActions(body[8 : 8+actionsLen])
+	if err != nil {
+		return err
+	}
+	m.Data = body[8+actionsLen:]
+	return nil
 }
 
 type FlowModCommand uint16
@@ -375,6 +655,29 @@ func (m *FlowMod) Write(w io.Writer) error {
 	return nil
 }
 
+// Size of the FlowMod body up to the actions.
+const flowModPartSize = 64
+
+func (m *FlowMod) Read(h *Header, body []byte) error {
+	if len(body) < flowModPartSize {
+		return errors.New("FLOW_MOD too short")
+	}
+	buf := bytes.NewBuffer(body)
+	m.Xid = h.Xid
+	binary.Read(buf, binary.BigEndian, &m.Match)
+	binary.Read(buf, binary.BigEndian, &m.Cookie)
+	binary.Read(buf, binary.BigEndian, &m.Command)
+	binary.Read(buf, binary.BigEndian, &m.IdleTimeout)
+	binary.Read(buf, binary.BigEndian, &m.HardTimeout)
+	binary.Read(buf, binary.BigEndian, &m.Priority)
+	binary.Read(buf, binary.BigEndian, &m.BufferId)
+	binary.Read(buf, binary.BigEndian, &m.OutPort)
+	binary.Read(buf, binary.BigEndian, &m.Flags)
+	var err error
+	m.Actions, err = ReadActions(body[flowModPartSize:])
+	return err
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // Flow removed message
 
@@ -399,12 +702,12 @@ type FlowRemovedPart struct {
 	Cookie       uint64            /* Opaque controller-issued identifier. */
 	Priority     uint16            /* Priority level of flow entry. */
 	Reason       FlowRemovedReason /* One of OFPRR_*. */
-	uint8                          /* Align to 32-bits. */
+	_            uint8             /* Align to 32-bits. */
 	DurationSec  uint32            /* Time flow was alive in seconds. */
 	DurationNsec uint32            /* Time flow was alive in nanoseconds beyond
 	   duration_sec. */
 	IdleTimeout uint16 /* Idle timeout from original flow mod. */
-	uint16             /* Align to 64-bits. */
+	_           uint16 /* Align to 64-bits. */
 	PacketCount uint64
 	ByteCount   uint64
 }
@@ -419,6 +722,13 @@ func (m *FlowRemoved) Read(h *Header, body []byte) error {
 	return nil
 }
 
+func (m *FlowRemoved) Write(w io.Writer) error {
+	m.Length = uint16(HeaderSize + binary.Size(&m.FlowRemovedPart))
+	m.Type = OFPT_FLOW_REMOVED
+	m.Version = OFP_VERSION
+	return binary.Write(w, binary.BigEndian, m)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // Error messages
 
@@ -436,6 +746,48 @@ const (
 	QueueOpFailed                  /* Queue operation failed. */
 )
 
+// Codes of BadRequest errors.
+const (
+	BadRequestBadVersion    uint16 = iota /* Header.Version not supported. */
+	BadRequestBadType                     /* Header.Type not supported. */
+	BadRequestBadStat                     /* StatsRequest.Type not supported. */
+	BadRequestBadVendor                   /* Vendor not supported. */
+	BadRequestBadSubtype                  /* Vendor subtype not supported. */
+	BadRequestEPerm                       /* Permissions error. */
+	BadRequestBadLen                      /* Wrong request length for type. */
+	BadRequestBufferEmpty                 /* Specified buffer has already been used. */
+	BadRequestBufferUnknown               /* Specified buffer does not exist. */
+)
+
+// Codes of BadAction errors.
+const (
+	BadActionBadType       uint16 = iota /* Unknown action type. */
+	BadActionBadLen                      /* Length problem in actions. */
+	BadActionBadVendor                   /* Unknown vendor id specified. */
+	BadActionBadVendorType               /* Unknown action type for vendor id. */
+	BadActionBadOutPort                  /* Problem validating output action. */
+	BadActionBadArgument                 /* Bad action argument. */
+	BadActionEPerm                       /* Permissions error. */
+	BadActionTooMany                     /* Can't handle this many actions. */
+	BadActionBadQueue                    /* Problem validating output queue. */
+)
+
+// Codes of FlowModFailed errors.
+const (
+	FlowModAllTablesFull    uint16 = iota /* Flow not added because of full tables. */
+	FlowModOverlap                        /* Attempted to add overlapping flow with CheckOverlap set. */
+	FlowModEPerm                          /* Permissions error. */
+	FlowModBadEmergTimeout                /* Emergency flows can't have timeouts. */
+	FlowModBadCommand                     /* Unknown command. */
+	FlowModUnsupported                    /* Unsupported action list. */
+)
+
+// Codes of PortModFailed errors.
+const (
+	PortModBadPort   uint16 = iota /* Specified port does not exist. */
+	PortModBadHwAddr               /* Specified hardware address is wrong. */
+)
+
 type Error struct {
 	Header
 	Type ErrorType
@@ -445,20 +797,23 @@ type Error struct {
 }
 
 func (m *Error) Read(h *Header, body []byte) error {
-	buf := bytes.NewBuffer(body)
 	m.Header = *h
-	err := binary.Read(buf, binary.BigEndian, &m.Type)
-	if err != nil {
-		return err
-	}
-	err = binary.Read(buf, binary.BigEndian, &m.Code)
-	if err != nil {
-		return err
+	if len(body) < 4 {
+		return errors.New("ERROR too short")
 	}
+	m.Type = ErrorType(binary.BigEndian.Uint16(body[0:]))
+	m.Code = binary.BigEndian.Uint16(body[2:])
 	m.Data = body[4:] // rest of body
 	return nil
 }
 
+func (m *Error) Write(w io.Writer) error {
+	body := make([]byte, 4, 4+len(m.Data))
+	binary.BigEndian.PutUint16(body[0:], uint16(m.Type))
+	binary.BigEndian.PutUint16(body[2:], m.Code)
+	return writeMsg(w, OFPT_ERROR, m.Xid, append(body, m.Data...))
+}
+
 func errorTypeToString(t ErrorType) string {
 	switch (t) {
 	case HelloFailed:
@@ -470,7 +825,7 @@ func errorTypeToString(t ErrorType) string {
 	case FlowModFailed:
 		return "OFPET_FLOW_MOD_FAILED"
 	case PortModFailed:
-		return "OFPET_FLOW_MOD_FAILED"
+		return "OFPET_PORT_MOD_FAILED"
 	case QueueOpFailed:
 		return "OFPET_QUEUE_OP_FAILED"
 	}
@@ -481,6 +836,38 @@ func (m *Error) String() string {
   return fmt.Sprintf("Type=%v", errorTypeToString(m.Type))
 }
 
+///////////////////////////////////////////////////////////////////////////////
+// Barriers
+
+/* OFPT_BARRIER_REQUEST.  The switch answers once it has finished with every
+ * message received before the request. */
+type BarrierRequest struct {
+	Xid uint32
+}
+
+func (m *BarrierRequest) Write(w io.Writer) error {
+	return writeMsg(w, OFPT_BARRIER_REQUEST, m.Xid, nil)
+}
+
+func (m *BarrierRequest) Read(h *Header, body []byte) error {
+	m.Xid = h.Xid
+	return nil
+}
+
+/* OFPT_BARRIER_REPLY, with the xid of the request. */
+type BarrierReply struct {
+	Xid uint32
+}
+
+func (m *BarrierReply) Write(w io.Writer) error {
+	return writeMsg(w, OFPT_BARRIER_REPLY, m.Xid, nil)
+}
+
+func (m *BarrierReply) Read(h *Header, body []byte) error {
+	m.Xid = h.Xid
+	return nil
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // Statistics
 
@@ -536,6 +923,24 @@ type StatsRequest struct {
 	Body  []byte    /* Body of the request. */
 }
 
+func (m *StatsRequest) Write(w io.Writer) error {
+	body := make([]byte, 4, 4+len(m.Body))
+	binary.BigEndian.PutUint16(body[0:], uint16(m.Type))
+	binary.BigEndian.PutUint16(body[2:], m.Flags)
+	return writeMsg(w, OFPT_STATS_REQUEST, m.Xid, append(body, m.Body...))
+}
+
+func (m *StatsRequest) Read(h *Header, body []byte) error {
+	if len(body) < 4 {
+		return errors.New("STATS_REQUEST too short")
+	}
+	m.Header = *h
+	m.Type = StatsType(binary.BigEndian.Uint16(body[0:]))
+	m.Flags = binary.BigEndian.Uint16(body[2:])
+	m.Body = body[4:]
+	return nil
+}
+
 type StatsReplyFlags uint16
 
 const (
@@ -549,6 +954,24 @@ type StatsReply struct {
 	Body  []byte          /* Body of the reply. */
 }
 
+func (m *StatsReply) Write(w io.Writer) error {
+	body := make([]byte, 4, 4+len(m.Body))
+	binary.BigEndian.PutUint16(body[0:], m.Type)
+	binary.BigEndian.PutUint16(body[2:], uint16(m.Flags))
+	return writeMsg(w, OFPT_STATS_REPLY, m.Xid, append(body, m.Body...))
+}
+
+func (m *StatsReply) Read(h *Header, body []byte) error {
+	if len(body) < 4 {
+		return errors.New("STATS_REPLY too short")
+	}
+	m.Header = *h
+	m.Type = binary.BigEndian.Uint16(body[0:])
+	m.Flags = StatsReplyFlags(binary.BigEndian.Uint16(body[2:]))
+	m.Body = body[4:]
+	return nil
+}
+
 const DescStrLen = 256
 const SerialNumLen = 32
 
@@ -567,7 +990,7 @@ type FlowStatsRequest struct {
 	Match         /* Fields to match. */
 	TableId uint8 /* ID of table to read (from ofpTableStats)
 	   0xff for all tables or 0xfe for emergency. */
-	uint8          /* Align to 32 bits. */
+	_       uint8  /* Align to 32 bits. */
 	OutPort uint16 /* Require matching entries to include this
 	   as an output port.  A value of OFPP_NONE
 	  indicates no restriction. */
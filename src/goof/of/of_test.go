@@ -0,0 +1,940 @@
+package of
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"goof/packets"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reads a fixture from testdata.  Fixtures are hex dumps; everything after a
+// '#' on a line is a comment.
+func readHex(t testing.TB, name string) []byte {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", name+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digits []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		digits = append(digits, strings.Fields(line)...)
+	}
+	b, err := hex.DecodeString(strings.Join(digits, ""))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return b
+}
+
+// Decodes a complete message the way the controller does.
+func decode(t *testing.T, b []byte) Message {
+	var h Header
+	err := binary.Read(bytes.NewReader(b), binary.BigEndian, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(h.Length) != len(b) {
+		t.Fatalf("%v: header length %d, have %d bytes", h.Type, h.Length, len(b))
+	}
+	msg := NewMessage(h.Type)
+	if msg == nil {
+		t.Fatalf("no message for %v", h.Type)
+	}
+	err = msg.Read(&h, b[HeaderSize:])
+	if err != nil {
+		t.Fatalf("%v: %v", h.Type, err)
+	}
+	return msg
+}
+
+func encode(t *testing.T, msg ToSwitch) []byte {
+	var buf bytes.Buffer
+	err := msg.Write(&buf)
+	if err != nil {
+		t.Fatalf("%T: %v", msg, err)
+	}
+	return buf.Bytes()
+}
+
+// Messages are compared through their JSON form, which covers every field
+// but ignores header bookkeeping such as Length.
+func sameMessage(t *testing.T, want, got Message) {
+	w, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w, g) {
+		t.Errorf("%T differs\nwant %s\n got %s", want, w, g)
+	}
+}
+
+func port(no uint16, name string, curr uint32) PhyPort {
+	p := PhyPort{PortNo: no, HwAddr: [EthAlen]uint8{0, 0, 0, 0, 0, uint8(no)},
+		Curr: curr}
+	copy(p.Name[:], name)
+	return p
+}
+
+var arpRequest, _ = hex.DecodeString("ffffffffffff0000000000010806" +
+	"0001080006040001000000000001" + "0a000001" + "000000000000" + "0a000002")
+
+// The messages in testdata.  The fixtures were written by hand from the
+// structure layouts of the OpenFlow 1.0.0 specification, not captured from
+// a switch, so they check the encoders against that reading of the
+// specification and against each other, not against a reference
+// implementation.
+var fixtureTests = []struct {
+	fixture string
+	msg     Message
+}{
+	{"hello", &Hello{Header{Xid: 1}}},
+	{"echo_request", &EchoRequest{Header{Xid: 2}, []byte("abcd")}},
+	{"echo_reply", &EchoReply{Header{Xid: 2}, []byte("abcd")}},
+	{"features_request", &SwitchFeaturesRequest{3}},
+	{"features_reply", &SwitchFeatures{
+		Header:       &Header{Xid: 4},
+		DatapathId:   0x2a,
+		NBuffers:     256,
+		NTables:      1,
+		Capabilities: FlowStats | TableStats | PortStats | ArpMatchIp,
+		Actions:      0xfff,
+		Ports:        []PhyPort{port(1, "s1-eth1", Ppf1GBFd|PpfCopper)},
+	}},
+	{"set_config", &SwitchConfig{5, FragNormal, OFP_DEFAULT_MISS_SEND_LEN}},
+	{"packet_in", &PacketIn{Header: &Header{}, BufferId: 256, TotalLen: 42,
+		InPort: 1, Reason: ReasonNoMatch, Data: arpRequest}},
+	{"flow_removed", func() Message {
+		m := &FlowRemoved{}
+		m.Match = Match{Wildcards: FwAll ^ FwInPort ^ FwDlSrc ^ FwDlDst,
+			InPort: 1,
+			DlSrc:  [EthAlen]uint8{0, 0, 0, 0, 0, 1},
+			DlDst:  [EthAlen]uint8{0, 0, 0, 0, 0, 2}}
+		m.Cookie = 0x1234
+		m.Priority = 0x8000
+		m.Reason = RemovedReasonIdleTimeout
+		m.DurationSec = 12
+		m.DurationNsec = 500000000
+		m.IdleTimeout = 10
+		m.PacketCount = 3
+		m.ByteCount = 294
+		return m
+	}()},
+	{"port_status", &PortStatus{Header: &Header{}, Reason: PortModified,
+		Desc: port(1, "s1-eth1", Ppf1GBFd|PpfCopper)}},
+	{"packet_out", &PacketOut{Xid: 6, BufferId: 0xffffffff, InPort: OFPP_NONE,
+		Actions: []Action{&ActionOutput{Port: 2}},
+		Data:    []byte{0xde, 0xad, 0xbe, 0xef}}},
+	{"flow_mod", &FlowMod{
+		Xid: 7,
+		Match: Match{
+			Wildcards: (FwAll&^(FwDlType|FwNwProto|FwTpDst))&^FwNwDstMask |
+				24<<FwNwDstShift,
+			EthFrameType: 0x0800,
+			NwProto:      6,
+			NwDst:        0x0a000000,
+			TpDst:        80,
+		},
+		Cookie:      1,
+		Command:     FCAdd,
+		IdleTimeout: 10,
+		HardTimeout: 30,
+		Priority:    0x8000,
+		BufferId:    0xffffffff,
+		OutPort:     OFPP_NONE,
+		Flags:       SendFlowRem,
+		Actions: []Action{&ActionOutput{Port: 2},
+			&ActionSetDlDst{DlAddr: [EthAlen]uint8{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}}},
+	}},
+	{"port_mod", &PortMod{Xid: 8, PortNo: 3,
+		HwAddr: [EthAlen]uint8{0, 0, 0, 0, 0, 3},
+		Config: OfppcPortDown, Mask: OfppcPortDown}},
+	{"error", &Error{Header: Header{Xid: 9}, Type: FlowModFailed, Code: 2,
+		Data: []byte{1, 0x0e, 0, 0x48, 0, 0, 0, 7}}},
+	{"stats_request", &StatsRequest{Header: Header{Xid: 10}, Type: StatsFlow,
+		Body: append([]byte{0, 0x3f, 0xff, 0xff}, append(make([]byte, 36),
+			0xff, 0, 0xff, 0xff)...)}},
+	{"stats_reply", &StatsReply{Header: Header{Xid: 10}, Type: uint16(StatsAggregate),
+		Body: []byte{0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0x03, 0xd4,
+			0, 0, 0, 2, 0, 0, 0, 0}}},
+}
+
+func TestFixtureWrite(t *testing.T) {
+	for _, test := range fixtureTests {
+		want := readHex(t, test.fixture)
+		got := encode(t, test.msg)
+		if !bytes.Equal(want, got) {
+			t.Errorf("%s: wrote\n%x\nwant\n%x", test.fixture, got, want)
+		}
+	}
+}
+
+func TestFixtureRead(t *testing.T) {
+	for _, test := range fixtureTests {
+		b := readHex(t, test.fixture)
+		got := decode(t, b)
+		sameMessage(t, test.msg, got)
+		if again := encode(t, got); !bytes.Equal(b, again) {
+			t.Errorf("%s: re-encoded as\n%x\nwant\n%x", test.fixture, again, b)
+		}
+	}
+}
+
+func TestFixturePacketIn(t *testing.T) {
+	m := decode(t, readHex(t, "packet_in")).(*PacketIn)
+	if m.EthFrame == nil {
+		t.Fatal("frame not parsed")
+	}
+	if m.EthFrame.SrcMAC != [6]byte{0, 0, 0, 0, 0, 1} || m.EthFrame.Type != 0x0806 {
+		t.Errorf("bad frame %+v", m.EthFrame.EthernetHeader)
+	}
+}
+
+// A Decoder reuses one PacketIn, so a truncated one must not show the
+// fields of the message before it.
+func TestDecoderTruncatedPacketIn(t *testing.T) {
+	var d Decoder
+	valid := encode(t, &PacketIn{Header: &Header{Xid: 1}, BufferId: 7, InPort: 3,
+		Data: arpRequest})
+	h := &Header{Version: OFP_VERSION, Type: OFPT_PACKET_IN, Xid: 1}
+	if _, err := d.Decode(h, valid[HeaderSize:]); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.Decode(h, valid[HeaderSize:HeaderSize+4])
+	if err == nil {
+		t.Fatal("truncated PACKET_IN decoded")
+	}
+	m := msg.(*PacketIn)
+	if m.BufferId != 0 || m.InPort != 0 || m.Data != nil || m.EthFrame != nil {
+		t.Errorf("truncated PACKET_IN kept %+v", m)
+	}
+}
+
+// A frame the switch clipped or mangled leaves the message whole, with the
+// frame's error apart.
+func TestPacketInFrameErr(t *testing.T) {
+	clipped := &PacketIn{Header: &Header{Xid: 2}, BufferId: 7, TotalLen: 42, InPort: 3,
+		Data: arpRequest[:20]}
+	var d Decoder
+	h := &Header{Version: OFP_VERSION, Type: OFPT_PACKET_IN, Xid: 2}
+	msg, err := d.Decode(h, encode(t, clipped)[HeaderSize:])
+	if err != nil {
+		t.Fatalf("clipped frame failed the message: %v", err)
+	}
+	m := msg.(*PacketIn)
+	if m.FrameErr == nil || m.EthFrame == nil || m.EthFrame.Type != packets.EthTypeARP ||
+		m.InPort != 3 || len(m.Data) != 20 {
+		t.Errorf("clipped frame decoded as %+v", m)
+	}
+	whole := encode(t, &PacketIn{Header: &Header{Xid: 3}, Data: arpRequest})
+	if msg, _ = d.Decode(h, whole[HeaderSize:]); msg.(*PacketIn).FrameErr != nil {
+		t.Error("frame error kept from the last PacketIn")
+	}
+
+	b, err := json.Marshal(clipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatalf("clipped frame failed the JSON message: %v", err)
+	}
+	if m := got.(*PacketIn); m.FrameErr == nil || m.EthFrame == nil || m.InPort != 3 {
+		t.Errorf("clipped frame decoded from JSON as %+v", m)
+	}
+}
+
+var allActions = []Action{
+	&ActionOutput{Port: OFPP_CONTROLLER, MaxLen: 128},
+	&ActionVlanVid{VlanVid: 10},
+	&ActionVlanPcp{VlanPcp: 5},
+	&ActionStripVlan{},
+	&ActionSetDlSrc{DlAddr: [EthAlen]uint8{1, 2, 3, 4, 5, 6}},
+	&ActionSetDlDst{DlAddr: [EthAlen]uint8{6, 5, 4, 3, 2, 1}},
+	&ActionNwAddrSrc{NwAddr: 0x0a000001},
+	&ActionNwAddrDst{NwAddr: 0x0a000002},
+	&ActionNwTos{NwTos: 0x20},
+	&ActionTpPortSrc{TpPort: 1024},
+	&ActionTpPortDst{TpPort: 80},
+	&ActionEnqueue{Port: 3, QueueId: 7},
+}
+
+func TestRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&Hello{},
+		&EchoRequest{Header{Xid: 1}, []byte{}},
+		&EchoReply{Header{Xid: 1}, make([]byte, 1000)},
+		&SwitchFeatures{Header: &Header{}, Ports: []PhyPort{}},
+		&SwitchFeatures{Header: &Header{}, Ports: []PhyPort{port(1, "a", 0),
+			port(2, "b", 0), port(OFPP_LOCAL, "s1", 0)}},
+		&PacketIn{Header: &Header{Xid: 3}, BufferId: 0xffffffff, Reason: ReasonAction},
+		&PacketOut{BufferId: 7, InPort: 1},
+		&PacketOut{BufferId: 0xffffffff, InPort: 1, Actions: allActions,
+			Data: arpRequest},
+		&PacketOut{BufferId: 0xffffffff, InPort: 1, Data: make([]byte, maxMsgLen-16)},
+		&FlowMod{Match: Match{Wildcards: FwAll}, Command: FCDeleteStrict,
+			OutPort: 3},
+		&FlowMod{Match: Match{Wildcards: FwAll}, Actions: allActions},
+		&Error{Type: BadAction, Code: 4},
+		&StatsRequest{Type: StatsDesc},
+		&GetConfigRequest{Xid: 4},
+		&GetConfigReply{Xid: 4, Flags: FragDrop, MissSendLen: 128},
+		&BarrierRequest{Xid: 5},
+		&BarrierReply{Xid: 5},
+		&StatsReply{Type: uint16(StatsTable), Flags: StatsReplyMore,
+			Body: make([]byte, 64)},
+	}
+	for _, msg := range msgs {
+		b := encode(t, msg)
+		got := decode(t, b)
+		sameMessage(t, msg, got)
+		if again := encode(t, got); !bytes.Equal(b, again) {
+			t.Errorf("%T: re-encoded as\n%x\nwant\n%x", msg, again, b)
+		}
+	}
+
+	// A PacketOut longer than the length field can count, by one byte or by
+	// many, is refused rather than wrapped, and nothing of it is written.
+	for _, msg := range []ToSwitch{
+		&PacketOut{BufferId: 0xffffffff, InPort: 1, Data: make([]byte, maxMsgLen-15)},
+		&PacketOut{BufferId: 0xffffffff, InPort: 1, Actions: allActions,
+			Data: make([]byte, 70000)},
+	} {
+		var buf bytes.Buffer
+		if err := msg.Write(&buf); err == nil || buf.Len() != 0 {
+			t.Errorf("%d byte PacketOut: err %v, wrote %d bytes", len(msg.(*PacketOut).Data),
+				err, buf.Len())
+		}
+	}
+}
+
+func TestReadActionsRejectsBadLength(t *testing.T) {
+	var buf bytes.Buffer
+	(&ActionOutput{Port: 1}).WriteAction(&buf)
+	b := buf.Bytes()
+	b[3] = 16 // claims to be longer than it is
+	_, err := ReadActions(b)
+	if err == nil {
+		t.Error("accepted an action overrunning its list")
+	}
+}
+
+func TestMatchSetVLAN(t *testing.T) {
+	tagged := arpRequest[:12:12]
+	tagged = append(tagged, 0x81, 0x00, 0xa0, 0x0a)
+	tagged = append(tagged, arpRequest[12:]...)
+	frame, err := packets.Parse(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Match{Wildcards: FwAll}
+	m.SetVLAN(frame)
+	if m.VLanID != 10 || m.VLanPCP != 5 || m.Wildcards&(FwDlVlan|FwDlVlanPcp) != 0 {
+		t.Errorf("tagged frame gave %v", m)
+	}
+	frame, _ = packets.Parse(arpRequest)
+	m.SetVLAN(frame)
+	if m.VLanID != OFP_VLAN_NONE || m.Wildcards&FwDlVlan != 0 ||
+		m.Wildcards&FwDlVlanPcp == 0 {
+		t.Errorf("untagged frame gave %v", m)
+	}
+}
+
+func TestMatchFromPacket(t *testing.T) {
+	frame, err := packets.Parse(arpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := MatchFromPacket(3, frame).String()
+	want := "in_port=3,dl_vlan=0xffff,dl_vlan_pcp=0,dl_src=00:00:00:00:00:01," +
+		"dl_dst=ff:ff:ff:ff:ff:ff,arp,nw_src=10.0.0.1,nw_dst=10.0.0.2,nw_proto=1," +
+		"nw_tos=0,tp_src=0,tp_dst=0"
+	if got != want {
+		t.Errorf("ARP match\n%s\nwant\n%s", got, want)
+	}
+
+	icmp := &packets.ICMPHeader{Type: packets.ICMPEchoRequest, ID: 1}
+	ip := packets.NewIPv4(0x0a000001, 0x0a000002, icmp)
+	ip.TOS = 0x2b
+	b, _ := packets.NewEthFrame([6]byte{0, 0, 0, 0, 0, 1}, [6]byte{0, 0, 0, 0, 0, 2},
+		ip).Serialize()
+	frame, _ = packets.Parse(b)
+	m := MatchFromPacket(1, frame)
+	if m.Wildcards != 0 || m.NwTOS != 0x28 || m.NwProto != 1 || m.TpSrc != 8 ||
+		m.TpDst != 0 {
+		t.Errorf("ICMP match %v", m)
+	}
+
+	for _, fragoff := range []uint16{
+		packets.IPMoreFragments, // the first fragment
+		185,                     // the last
+	} {
+		ip.FlagsFragoffset = fragoff
+		b, _ = packets.NewEthFrame([6]byte{}, [6]byte{}, ip).Serialize()
+		frame, _ = packets.Parse(b)
+		if m = MatchFromPacket(1, frame); m.TpSrc != 0 || m.NwProto != 1 {
+			t.Errorf("fragment %#x match %v", fragoff, m)
+		}
+	}
+
+	llc := append(make([]byte, 12), 0, 3, 0x42, 0x42, 0x03)
+	frame, _ = packets.Parse(llc)
+	if m = MatchFromPacket(1, frame); m.EthFrameType != OFP_DL_TYPE_NOT_ETH_TYPE {
+		t.Errorf("802.3 frame has dl_type %#x", m.EthFrameType)
+	}
+}
+
+func sameStat(t *testing.T, want, got Stat) {
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("%T differs\nwant %+v\n got %+v", want, want, got)
+	}
+}
+
+func TestStatsFixture(t *testing.T) {
+	reply := decode(t, readHex(t, "stats_reply")).(*StatsReply)
+	stats, err := reply.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "packet_count=10,byte_count=980,flow_count=2"
+	if len(stats) != 1 || stats[0].(*AggregateStats).String() != want {
+		t.Errorf("got %v, want %s", stats, want)
+	}
+}
+
+func TestStatsRoundTrip(t *testing.T) {
+	match := Match{Wildcards: FwAll ^ FwInPort, InPort: 2}
+	requests := []Stat{
+		&FlowStatsRequest{Match: match, TableId: 0xff, OutPort: OFPP_NONE},
+		&AggregateStatsRequest{Match: match, TableId: 0xff, OutPort: 3},
+		&PortStatsRequest{PortNo: OFPP_NONE},
+		&QueueStatsRequest{PortNo: OFPP_ALL, QueueId: QueueAll},
+	}
+	types := []StatsType{StatsFlow, StatsAggregate, StatsPort, StatsQueue}
+	for i, s := range requests {
+		m, err := NewStatsRequest(9, types[i], s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decode(t, encode(t, m)).(*StatsRequest).Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameStat(t, s, got)
+	}
+
+	replies := [][]Stat{
+		{NewDescStats("goof", "none", "emulator", "1", "s1")},
+		{&FlowStat{Match: match, DurationSec: 3, Priority: 0x8000, Cookie: 7,
+			PacketCount: 2, ByteCount: 120, Actions: allActions},
+			&FlowStat{Match: Match{Wildcards: FwAll}, Actions: []Action{}}},
+		{&AggregateStats{PacketCount: 1, ByteCount: 2, FlowCount: 3}},
+		{&TableStat{TableId: 0, Wildcards: FwAll, MaxEntries: 1024, ActiveCount: 2}},
+		{&PortStat{PortNo: 1, RxPackets: 5}, &PortStat{PortNo: 2, TxBytes: 6}},
+		{},
+	}
+	types = []StatsType{StatsDesc, StatsFlow, StatsAggregate, StatsTable, StatsPort, StatsQueue}
+	for i, stats := range replies {
+		m, err := NewStatsReply(9, types[i], stats...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decode(t, encode(t, m)).(*StatsReply).Stats()
+		if err != nil {
+			t.Fatalf("%v: %v", types[i], err)
+		}
+		if len(got) != len(stats) {
+			t.Fatalf("%v: %d entries, want %d", types[i], len(got), len(stats))
+		}
+		for j := range stats {
+			sameStat(t, stats[j], got[j])
+		}
+	}
+}
+
+func TestFlowStatString(t *testing.T) {
+	s := &FlowStat{Match: Match{Wildcards: FwAll ^ FwInPort, InPort: 1},
+		DurationSec: 2, DurationNsec: 500000000, Priority: 10, IdleTimeout: 5,
+		PacketCount: 3, ByteCount: 180, Actions: []Action{&ActionOutput{Port: 2}}}
+	want := "cookie=0x0,duration=2.500s,table=0,n_packets=3,n_bytes=180," +
+		"idle_timeout=5,priority=10,in_port=1,actions=output:2"
+	if got := s.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMatchCovers(t *testing.T) {
+	all := Match{Wildcards: FwAll}
+	net24 := Match{Wildcards: FwAll&^FwNwSrcMask | 8<<FwNwSrcShift, NwSrc: 0x0a0000ff}
+	host := Match{Wildcards: FwAll&^FwNwSrcMask | 0<<FwNwSrcShift, NwSrc: 0x0a000001}
+	dns := Match{Wildcards: FwAll &^ FwTpDst, TpDst: 53}
+	for _, c := range []struct {
+		name     string
+		a, b     Match
+		covers   bool
+		overlaps bool
+	}{
+		{"all, /24", all, net24, true, true},
+		{"/24, all", net24, all, false, true},
+		{"/24, host", net24, host, true, true},
+		{"host, /24", host, net24, false, true},
+		{"/24, dns", net24, dns, false, true},
+		{"host, other host", host, Match{Wildcards: host.Wildcards, NwSrc: 0x0a000101}, false, false},
+		{"dns, http", dns, Match{Wildcards: dns.Wildcards, TpDst: 80}, false, false},
+	} {
+		a, b := c.a.Normalized(), c.b.Normalized()
+		if got := a.Covers(&b); got != c.covers {
+			t.Errorf("%s: covers is %v", c.name, got)
+		}
+		if got := a.Overlaps(&b); got != c.overlaps {
+			t.Errorf("%s: overlaps is %v", c.name, got)
+		}
+	}
+	if n := net24.Normalized(); n.NwSrc != 0x0a000000 || n.nwWildBits(FwNwSrcShift) != 8 {
+		t.Errorf("normalized /24 is %v", n)
+	}
+	// Prefix lengths past 32 all mean the whole address.
+	want := Match{Wildcards: fieldWildcards | 32<<FwNwSrcShift | 32<<FwNwDstShift}
+	if n := (Match{Wildcards: FwAll, TpDst: 80}).Normalized(); n != want {
+		t.Errorf("normalized wildcard is %+v", n)
+	}
+}
+
+func TestFlowTable(t *testing.T) {
+	var table FlowTable
+	now := time.Now()
+	apply := func(fm *FlowMod) []*FlowEntry {
+		removed, err := table.Apply(fm, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return removed
+	}
+	add := func(m Match, prio uint16, port uint16) {
+		apply(&FlowMod{Match: m, Priority: prio, Actions: []Action{&ActionOutput{Port: port}}})
+	}
+	add(Match{Wildcards: FwAll}, 0, 1)
+	add(Match{Wildcards: FwAll&^(FwDlType|FwNwSrcMask) | 8<<FwNwSrcShift,
+		EthFrameType: 0x0800, NwSrc: 0x0a0000ff}, 100, 2)
+	add(Match{Wildcards: FwAll &^ FwTpDst, TpDst: 53}, 200, 3)
+
+	m := Match{InPort: 1, EthFrameType: 0x0800, NwProto: 17, NwSrc: 0x0a000001,
+		NwDst: 0x0a000002, TpSrc: 1024, TpDst: 53}
+	port := func() uint16 {
+		e := table.Lookup(&m)
+		if e == nil {
+			return 0
+		}
+		return e.Actions[0].(*ActionOutput).Port
+	}
+	if got := port(); got != 3 {
+		t.Errorf("port %d, want 3 from the highest priority", got)
+	}
+	m.TpDst = 80
+	if got := port(); got != 2 {
+		t.Errorf("port %d, want 2 from the 10.0.0.0/24 flow", got)
+	}
+	m.NwSrc = 0x0a000101
+	if got := port(); got != 1 {
+		t.Errorf("port %d, want 1 from the catch-all", got)
+	}
+
+	// An exact match beats any wildcarded flow, whatever its priority.
+	add(m, 0, 4)
+	if got := port(); got != 4 {
+		t.Errorf("port %d, want 4 from the exact match", got)
+	}
+
+	// Adding the same match and priority again replaces the entry.
+	add(m, 0, 5)
+	if got := port(); got != 5 || table.Len() != 4 {
+		t.Errorf("port %d with %d flows after re-adding, want 5 with 4", got, table.Len())
+	}
+
+	// A non-strict modify changes the actions of every flow it covers.
+	apply(&FlowMod{Match: Match{Wildcards: FwAll &^ FwTpDst, TpDst: 80}, Command: FCModify,
+		Actions: []Action{&ActionOutput{Port: 6}}})
+	if got := port(); got != 6 {
+		t.Errorf("port %d after modify, want 6", got)
+	}
+	// A strict one that selects nothing adds the flow.
+	apply(&FlowMod{Match: Match{Wildcards: FwAll &^ FwTpDst, TpDst: 22}, Priority: 300,
+		Command: FCModifyStrict, Actions: []Action{&ActionOutput{Port: 7}}})
+	if table.Len() != 5 {
+		t.Errorf("%d flows after strict modify, want 5", table.Len())
+	}
+
+	_, err := table.Apply(&FlowMod{Match: Match{Wildcards: FwAll &^ FwTpSrc, TpSrc: 1024},
+		Priority: 200, Flags: CheckOverlap}, now)
+	if err != ErrFlowOverlap {
+		t.Errorf("overlapping add: %v, want %v", err, ErrFlowOverlap)
+	}
+	apply(&FlowMod{Match: Match{Wildcards: FwAll &^ FwTpSrc, TpSrc: 1024},
+		Priority: 150, Flags: CheckOverlap})
+	if _, err := table.Apply(&FlowMod{Command: 9}, now); err != ErrBadCommand {
+		t.Errorf("bad command: %v, want %v", err, ErrBadCommand)
+	}
+
+	if n := len(table.Select(Match{Wildcards: FwAll}, 2)); n != 1 {
+		t.Errorf("select out_port=2 found %d flows, want 1", n)
+	}
+	removed := apply(&FlowMod{Match: Match{Wildcards: FwAll}, Command: FCDelete, OutPort: 2})
+	if len(removed) != 1 || table.Len() != 5 {
+		t.Errorf("delete out_port=2 removed %d, left %d", len(removed), table.Len())
+	}
+	removed = apply(&FlowMod{Match: Match{Wildcards: FwAll &^ FwTpDst, TpDst: 53}, Priority: 100,
+		Command: FCDeleteStrict, OutPort: OFPP_NONE})
+	if len(removed) != 0 {
+		t.Error("strict delete ignored the priority")
+	}
+	removed = apply(&FlowMod{Match: Match{Wildcards: FwAll &^ FwTpDst, TpDst: 53},
+		Command: FCDelete, OutPort: OFPP_NONE})
+	if len(removed) != 1 {
+		t.Errorf("delete tp_dst=53 removed %d flows, want 1", len(removed))
+	}
+}
+
+func TestFlowTableExpire(t *testing.T) {
+	var table FlowTable
+	start := time.Now()
+	table.Apply(&FlowMod{Match: Match{Wildcards: FwAll &^ FwInPort, InPort: 1}, HardTimeout: 10}, start)
+	table.Apply(&FlowMod{Match: Match{Wildcards: FwAll &^ FwInPort, InPort: 2}, IdleTimeout: 5}, start)
+	table.Apply(&FlowMod{Match: Match{Wildcards: FwAll}}, start)
+
+	table.Lookup(&Match{InPort: 2}).LastUsed = start.Add(4 * time.Second)
+	if removed, _ := table.Expire(start.Add(8 * time.Second)); len(removed) != 0 {
+		t.Errorf("%d flows expired early", len(removed))
+	}
+	removed, reasons := table.Expire(start.Add(10 * time.Second))
+	if len(removed) != 2 || reasons[0] != RemovedReasonHardTimeout ||
+		reasons[1] != RemovedReasonIdleTimeout || table.Len() != 1 {
+		t.Errorf("expired %d flows for %v, left %d", len(removed), reasons, table.Len())
+	}
+}
+
+func TestMatchText(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want Match
+	}{
+		{"", Match{Wildcards: FwAll}},
+		{"in_port=3", Match{Wildcards: FwAll &^ FwInPort, InPort: 3}},
+		{"in_port=LOCAL", Match{Wildcards: FwAll &^ FwInPort, InPort: OFPP_LOCAL}},
+		{"dl_vlan=10,dl_vlan_pcp=5", Match{Wildcards: FwAll &^ (FwDlVlan | FwDlVlanPcp),
+			VLanID: 10, VLanPCP: 5}},
+		{"dl_vlan=0xffff", Match{Wildcards: FwAll &^ FwDlVlan, VLanID: OFP_VLAN_NONE}},
+		{"dl_src=00:11:22:33:44:55,dl_dst=ff:ff:ff:ff:ff:ff", Match{
+			Wildcards: FwAll &^ (FwDlSrc | FwDlDst),
+			DlSrc:     [EthAlen]uint8{0, 0x11, 0x22, 0x33, 0x44, 0x55},
+			DlDst:     [EthAlen]uint8{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}},
+		{"dl_type=0x86dd", Match{Wildcards: FwAll &^ FwDlType, EthFrameType: 0x86dd}},
+		{"ip", Match{Wildcards: FwAll &^ FwDlType, EthFrameType: 0x0800}},
+		{"arp,nw_proto=1", Match{Wildcards: FwAll &^ (FwDlType | FwNwProto),
+			EthFrameType: 0x0806, NwProto: 1}},
+		{"udp", Match{Wildcards: FwAll &^ (FwDlType | FwNwProto), EthFrameType: 0x0800,
+			NwProto: 17}},
+		{"ip,nw_src=10.0.0.0/8,nw_dst=192.168.1.1", Match{
+			Wildcards:    FwAll&^(FwDlType|FwNwSrcMask|FwNwDstMask) | 24<<FwNwSrcShift,
+			EthFrameType: 0x0800, NwSrc: 0x0a000000, NwDst: 0xc0a80101}},
+		{"ip,nw_proto=47,nw_tos=184", Match{Wildcards: FwAll &^ (FwDlType | FwNwProto | FwNwTos),
+			EthFrameType: 0x0800, NwProto: 47, NwTOS: 184}},
+		{"tcp,tp_src=1024,tp_dst=80", Match{
+			Wildcards:    FwAll &^ (FwDlType | FwNwProto | FwTpSrc | FwTpDst),
+			EthFrameType: 0x0800, NwProto: 6, TpSrc: 1024, TpDst: 80}},
+		{"icmp,icmp_type=8,icmp_code=0", Match{
+			Wildcards:    FwAll &^ (FwDlType | FwNwProto | FwTpSrc | FwTpDst),
+			EthFrameType: 0x0800, NwProto: 1, TpSrc: 8}},
+	} {
+		m, err := ParseMatch(c.text)
+		if err != nil {
+			t.Errorf("%q: %v", c.text, err)
+			continue
+		}
+		if m != c.want {
+			t.Errorf("%q parsed as %+v, want %+v", c.text, m, c.want)
+		}
+		if got := m.String(); got != c.text {
+			t.Errorf("%q formatted as %q", c.text, got)
+		}
+	}
+
+	// Host bits past the prefix are dropped, as ovs-ofctl does.
+	if m, _ := ParseMatch("nw_src=10.1.2.3/16"); m.NwSrc != 0x0a010000 ||
+		m.String() != "nw_src=10.1.0.0/16" {
+		t.Errorf("nw_src=10.1.2.3/16 parsed as %v", m)
+	}
+}
+
+func TestActionsText(t *testing.T) {
+	text := FormatActions(allActions)
+	want := "CONTROLLER:128,mod_vlan_vid:10,mod_vlan_pcp:5,strip_vlan," +
+		"mod_dl_src:01:02:03:04:05:06,mod_dl_dst:06:05:04:03:02:01," +
+		"mod_nw_src:10.0.0.1,mod_nw_dst:10.0.0.2,mod_nw_tos:32,mod_tp_src:1024," +
+		"mod_tp_dst:80,enqueue:3:7"
+	if text != want {
+		t.Errorf("formatted as\n%s\nwant\n%s", text, want)
+	}
+	actions, err := ParseActions(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actions, allActions) {
+		t.Errorf("parsed as %v", actions)
+	}
+
+	for text, want := range map[string]string{
+		"":                      "drop",
+		"drop":                  "drop",
+		"2":                     "output:2",
+		"output:FLOOD,in_port":  "FLOOD,IN_PORT",
+		"normal,local,all":      "NORMAL,LOCAL,ALL",
+		"controller,table":      "CONTROLLER:65535,TABLE",
+		"enqueue:LOCAL:1":       "enqueue:LOCAL:1",
+		"output:controller":     "CONTROLLER:65535",
+		"mod_vlan_vid:4095,3,4": "mod_vlan_vid:4095,output:3,output:4",
+	} {
+		actions, err := ParseActions(text)
+		if err != nil {
+			t.Errorf("%q: %v", text, err)
+			continue
+		}
+		if got := FormatActions(actions); got != want {
+			t.Errorf("%q formatted as %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestFlowModText(t *testing.T) {
+	text := "cookie=0x2a,idle_timeout=10,hard_timeout=30,priority=100,send_flow_rem," +
+		"check_overlap,in_port=1,tcp,nw_dst=10.0.0.0/8,tp_dst=80,actions=output:2"
+	m, err := ParseFlowMod(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Cookie != 0x2a || m.IdleTimeout != 10 || m.HardTimeout != 30 || m.Priority != 100 ||
+		m.Flags != SendFlowRem|CheckOverlap || m.Command != FCAdd ||
+		m.BufferId != 0xffffffff || m.OutPort != OFPP_NONE {
+		t.Errorf("parsed as %+v", m)
+	}
+	if got := m.String(); got != text {
+		t.Errorf("formatted as\n%s\nwant\n%s", got, text)
+	}
+	if m, _ := ParseFlowMod("actions=drop"); m.Priority != 0x8000 || len(m.Actions) != 0 {
+		t.Errorf("defaults are %+v", m)
+	}
+}
+
+func TestTextRejects(t *testing.T) {
+	for _, s := range []string{
+		"in_port=1,color=red",       // unknown field
+		"dl_src=00:11:22:33:44",     // MAC too short
+		"dl_dst=00:11:22:33:44:5g",  // not hex
+		"dl_src=00:11:22:33:44:555", // octet too long
+		"in_port=65536",             // port out of range
+		"dl_vlan_pcp=256",
+		"nw_src=10.0.0.0/33",
+		"nw_dst=10.0.0.256",
+		"tcp=6",
+	} {
+		if _, err := ParseMatch(s); err == nil {
+			t.Errorf("ParseMatch accepted %q", s)
+		}
+	}
+	for _, s := range []string{
+		"output:65536", "fly", "enqueue:1", "flood:1", "mod_dl_src:1:2:3", "mod_nw_dst:1.2.3",
+	} {
+		if _, err := ParseActions(s); err == nil {
+			t.Errorf("ParseActions accepted %q", s)
+		}
+	}
+	for _, s := range []string{
+		"priority=1,in_port=1", // no actions
+		"priority=70000,actions=drop",
+		"wings=2,actions=drop",
+		"in_port=x,actions=drop",
+	} {
+		if _, err := ParseFlowMod(s); err == nil {
+			t.Errorf("ParseFlowMod accepted %q", s)
+		}
+	}
+}
+
+func mustStatsRequest(t *testing.T, xid uint32, st StatsType, s Stat) *StatsRequest {
+	m, err := NewStatsRequest(xid, st, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func mustStatsReply(t *testing.T, xid uint32, st StatsType, stats ...Stat) *StatsReply {
+	m, err := NewStatsReply(xid, st, stats...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// One of every message, action and stats body, in the order of
+// testdata/messages.jsonl.
+func jsonMessages(t *testing.T) []Message {
+	match := Match{Wildcards: FwAll&^(FwInPort|FwDlType|FwNwProto|FwNwDstMask) |
+		8<<FwNwDstShift, InPort: 1, EthFrameType: 0x0800, NwProto: 6,
+		NwDst: 0x0a000100}
+	table := &TableStat{TableId: 0, Wildcards: FwAll, MaxEntries: 1000,
+		ActiveCount: 3, LookupCount: 100, MatchedCount: 90}
+	copy(table.Name[:], "classifier")
+	var mac [EthAlen]uint8
+	copy(mac[:], []byte{0, 1, 2, 3, 4, 5})
+	return []Message{
+		&Hello{Header{Xid: 1}},
+		&Error{Header: Header{Xid: 2}, Type: FlowModFailed, Code: FlowModOverlap,
+			Data: []byte{1, 14, 0, 72}},
+		&EchoRequest{Header{Xid: 3}, []byte("ping")},
+		&EchoReply{Header{Xid: 3}, []byte("ping")},
+		&SwitchFeaturesRequest{Xid: 4},
+		&SwitchFeatures{Header: &Header{Xid: 4}, DatapathId: 0xabcdef,
+			NBuffers: 256, NTables: 1, Capabilities: 0xc7, Actions: 0xfff,
+			Ports: []PhyPort{port(1, "eth1", PpfCopper), port(OFPP_LOCAL, "s1", 0)}},
+		&GetConfigRequest{Xid: 5},
+		&GetConfigReply{Xid: 5, Flags: FragDrop, MissSendLen: 128},
+		&SwitchConfig{Xid: 6, Flags: FragReasm, MissSendLen: 0xffff},
+		&PacketIn{Header: &Header{Xid: 7}, BufferId: 0x100, TotalLen: 42,
+			InPort: 2, Reason: ReasonNoMatch, Data: arpRequest},
+		&FlowRemoved{Header: Header{Xid: 8}, FlowRemovedPart: FlowRemovedPart{
+			Match: match, Cookie: 0x1234, Priority: 100,
+			Reason: RemovedReasonIdleTimeout, DurationSec: 61,
+			DurationNsec: 500, IdleTimeout: 60, PacketCount: 10, ByteCount: 1000}},
+		&PortStatus{Header: &Header{Xid: 9}, Reason: PortModified,
+			Desc: port(3, "eth3", PpfCopper)},
+		&PacketOut{Xid: 10, BufferId: 0xffffffff, InPort: OFPP_NONE,
+			Actions: []Action{&ActionOutput{Port: PortFlood}}, Data: arpRequest},
+		&FlowMod{Xid: 11, Match: match, Cookie: 0x6c6561726e696e67,
+			Command: FCModifyStrict, IdleTimeout: 60, HardTimeout: 600,
+			Priority: 100, BufferId: 0x100, OutPort: OFPP_NONE,
+			Flags: SendFlowRem | CheckOverlap, Actions: allActions},
+		&PortMod{Xid: 12, PortNo: 1, HwAddr: mac, Config: 1, Mask: 1, Advertise: 0},
+		mustStatsRequest(t, 13, StatsDesc, nil),
+		mustStatsRequest(t, 14, StatsFlow, &FlowStatsRequest{Match: match,
+			TableId: 0xff, OutPort: OFPP_NONE}),
+		mustStatsRequest(t, 15, StatsAggregate, &AggregateStatsRequest{
+			Match: Match{Wildcards: FwAll}, TableId: 0, OutPort: 2}),
+		mustStatsRequest(t, 16, StatsTable, nil),
+		mustStatsRequest(t, 17, StatsPort, &PortStatsRequest{PortNo: OFPP_NONE}),
+		mustStatsRequest(t, 18, StatsQueue, &QueueStatsRequest{PortNo: 1,
+			QueueId: 0xffffffff}),
+		&StatsRequest{Header: Header{Xid: 19}, Type: StatsVendor,
+			Body: []byte{0, 0, 0x23, 0x20, 0, 0, 0, 1}},
+		mustStatsReply(t, 13, StatsDesc,
+			NewDescStats("goof", "soft", "0.1", "1", "s1")),
+		mustStatsReply(t, 14, StatsFlow, &FlowStat{TableId: 0, Match: match,
+			DurationSec: 5, DurationNsec: 7, Priority: 100, IdleTimeout: 60,
+			HardTimeout: 600, Cookie: 0x1234, PacketCount: 2, ByteCount: 128,
+			Actions: allActions}, &FlowStat{Match: Match{Wildcards: FwAll}}),
+		mustStatsReply(t, 15, StatsAggregate, &AggregateStats{PacketCount: 2,
+			ByteCount: 128, FlowCount: 1}),
+		mustStatsReply(t, 16, StatsTable, table),
+		mustStatsReply(t, 17, StatsPort, &PortStat{PortNo: 1, RxPackets: 1,
+			TxPackets: 2, RxBytes: 3, TxBytes: 4, RxDropped: 5, TxDropped: 6,
+			RxErrors: 7, TxErrors: 8, RxFrameErr: 9, RxOverErr: 10,
+			RxCrcErr: 11, Collisions: 12}),
+		mustStatsReply(t, 18, StatsQueue, &QueueStat{PortNo: 1, QueueId: 2,
+			TxBytes: 3, TxPackets: 4, TxErrors: 5}),
+		mustStatsReply(t, 19, StatsFlow),
+		&StatsReply{Header: Header{Xid: 20}, Type: uint16(StatsVendor),
+			Body: []byte{0, 0, 0x23, 0x20, 0, 0, 0, 1}},
+		&StatsReply{Header: Header{Xid: 21}, Type: uint16(StatsPort),
+			Flags: StatsReplyMore, Body: []byte{0, 1}},
+		&BarrierRequest{Xid: 22},
+		&BarrierReply{Xid: 22},
+	}
+}
+
+// Every message encodes to its line of testdata/messages.jsonl, and the line
+// decodes back to a message that encodes to the same bytes on the wire.
+func TestJSON(t *testing.T) {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "messages.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	msgs := jsonMessages(t)
+	if len(lines) != len(msgs) {
+		t.Fatalf("%d lines for %d messages", len(lines), len(msgs))
+	}
+	types := make(map[Type]bool)
+	for i, msg := range msgs {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%T: %v", msg, err)
+		}
+		if string(b) != lines[i] {
+			t.Errorf("%T encoded as\n%s\nwant\n%s", msg, b, lines[i])
+		}
+		got, err := UnmarshalMessage([]byte(lines[i]))
+		if err != nil {
+			t.Errorf("line %d: %v", i+1, err)
+			continue
+		}
+		wire := encode(t, msg)
+		if again := encode(t, got.(ToSwitch)); !bytes.Equal(again, wire) {
+			t.Errorf("line %d: decoded to\n%x\nwant\n%x", i+1, again, wire)
+		}
+		types[Type(wire[1])] = true
+	}
+	for ty := range typeNames {
+		if NewMessage(Type(ty)) != nil && !types[Type(ty)] {
+			t.Errorf("no %v in testdata/messages.jsonl", Type(ty))
+		}
+	}
+}
+
+func TestUnmarshalAction(t *testing.T) {
+	for _, a := range allActions {
+		b, err := json.Marshal(jsonActions{a})
+		if err != nil {
+			t.Fatalf("%T: %v", a, err)
+		}
+		var j []json.RawMessage
+		if err = json.Unmarshal(b, &j); err != nil {
+			t.Fatal(err)
+		}
+		got, err := UnmarshalAction(j[0])
+		if err != nil {
+			t.Errorf("%s: %v", j[0], err)
+		} else if !reflect.DeepEqual(got, a) {
+			t.Errorf("%s decoded as %#v", j[0], got)
+		}
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	for _, s := range []string{
+		`{"type":"OFPT_BOGUS","xid":1}`,
+		`{"type":"OFPT_VENDOR","xid":1}`,
+		`{"type":"OFPT_FLOW_MOD","match":{"dl_src":"00:11"}}`,
+		`{"type":"OFPT_FLOW_MOD","match":{"bogus":1}}`,
+		`{"type":"OFPT_FLOW_MOD","actions":[{"type":"output"}]}`,
+		`{"type":"OFPT_FLOW_MOD","actions":[{"type":"bogus"}]}`,
+		`{"type":"OFPT_STATS_REQUEST","stats_type":0,"request":{}}`,
+		`{"type":"OFPT_STATS_REPLY","stats_type":3,"stats":[{"name":"` +
+			strings.Repeat("x", 32) + `"}]}`,
+		`{"type":"OFPT_STATS_REPLY","stats_type":65535,"stats":[{}]}`,
+	} {
+		if msg, err := UnmarshalMessage([]byte(s)); err == nil {
+			t.Errorf("%s: accepted as %#v", s, msg)
+		}
+	}
+}
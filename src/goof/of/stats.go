@@ -0,0 +1,444 @@
+package of
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Bodies of stats requests and replies.  Each type implements Stat, so it
+// can be put in a request or reply with NewStatsRequest and NewStatsReply,
+// and StatsRequest.Stat and StatsReply.Stats decode them again.  The
+// entries of flow, table, port and queue replies have singular names, as the
+// capability bits took the plural ones.
+
+var statsTypeNames = map[StatsType]string{
+	StatsDesc:      "desc",
+	StatsFlow:      "flow",
+	StatsAggregate: "aggregate",
+	StatsTable:     "table",
+	StatsPort:      "port",
+	StatsQueue:     "queue",
+	StatsVendor:    "vendor",
+}
+
+func (t StatsType) String() string {
+	if name, ok := statsTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown stats type (%d)", uint16(t))
+}
+
+// Returns a request of type t whose body is s, or empty if s is nil.
+func NewStatsRequest(xid uint32, t StatsType, s Stat) (*StatsRequest, error) {
+	m := &StatsRequest{Header: Header{Xid: xid}, Type: t}
+	if s != nil {
+		var buf bytes.Buffer
+		err := s.WriteStat(&buf)
+		if err != nil {
+			return nil, err
+		}
+		m.Body = buf.Bytes()
+	}
+	return m, nil
+}
+
+// Returns a reply of type t holding stats, which must all be of the type
+// that t calls for.
+func NewStatsReply(xid uint32, t StatsType, stats ...Stat) (*StatsReply, error) {
+	var buf bytes.Buffer
+	for _, s := range stats {
+		err := s.WriteStat(&buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &StatsReply{Header: Header{Xid: xid}, Type: uint16(t), Body: buf.Bytes()}, nil
+}
+
+// Decodes the body of the request.  The result is nil for the types whose
+// request has no body (desc and table) and for vendor requests.
+func (m *StatsRequest) Stat() (Stat, error) {
+	var s Stat
+	switch m.Type {
+	case StatsDesc, StatsTable, StatsVendor:
+		return nil, nil
+	case StatsFlow:
+		s = new(FlowStatsRequest)
+	case StatsAggregate:
+		s = new(AggregateStatsRequest)
+	case StatsPort:
+		s = new(PortStatsRequest)
+	case StatsQueue:
+		s = new(QueueStatsRequest)
+	default:
+		return nil, fmt.Errorf("unknown stats type %d", m.Type)
+	}
+	if len(m.Body) < int(s.Length()) {
+		return nil, fmt.Errorf("%v stats request too short", m.Type)
+	}
+	return s, binary.Read(bytes.NewReader(m.Body), binary.BigEndian, s)
+}
+
+// Decodes the body of the reply into its entries.  Desc and aggregate
+// replies hold exactly one; vendor replies decode to nil.
+func (m *StatsReply) Stats() ([]Stat, error) {
+	t := StatsType(m.Type)
+	var newStat func() Stat
+	switch t {
+	case StatsDesc:
+		newStat = func() Stat { return new(DescStats) }
+	case StatsFlow:
+		return readFlowStats(m.Body)
+	case StatsAggregate:
+		newStat = func() Stat { return new(AggregateStats) }
+	case StatsTable:
+		newStat = func() Stat { return new(TableStat) }
+	case StatsPort:
+		newStat = func() Stat { return new(PortStat) }
+	case StatsQueue:
+		newStat = func() Stat { return new(QueueStat) }
+	case StatsVendor:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown stats type %d", m.Type)
+	}
+	stats := []Stat{}
+	for body := m.Body; len(body) > 0; {
+		s := newStat()
+		n := int(s.Length())
+		if len(body) < n {
+			return nil, fmt.Errorf("%v stats reply misaligned (%d bytes left)", t, len(body))
+		}
+		binary.Read(bytes.NewReader(body[:n]), binary.BigEndian, s)
+		stats = append(stats, s)
+		body = body[n:]
+	}
+	if (t == StatsDesc || t == StatsAggregate) && len(stats) != 1 {
+		return nil, fmt.Errorf("%v stats reply has %d entries", t, len(stats))
+	}
+	return stats, nil
+}
+
+// Writes fixed size stats, which are laid out as on the wire.
+func writeStat(w io.Writer, s Stat) error {
+	return binary.Write(w, binary.BigEndian, s)
+}
+
+func (s *DescStats) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *DescStats) Length() uint16              { return uint16(binary.Size(s)) }
+
+// Returns desc stats holding the given strings, cut short if too long.
+func NewDescStats(mfr, hw, sw, serial, dp string) *DescStats {
+	s := new(DescStats)
+	copy(s.MfrDesc[:DescStrLen-1], mfr)
+	copy(s.HwDesc[:DescStrLen-1], hw)
+	copy(s.SwDesc[:DescStrLen-1], sw)
+	copy(s.SerialNum[:SerialNumLen-1], serial)
+	copy(s.DpDesc[:DescStrLen-1], dp)
+	return s
+}
+
+// Returns the text of a NUL-terminated string field.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func (s *DescStats) String() string {
+	return fmt.Sprintf("mfr=%q,hw=%q,sw=%q,serial=%q,dp=%q", cString(s.MfrDesc[:]),
+		cString(s.HwDesc[:]), cString(s.SwDesc[:]), cString(s.SerialNum[:]), cString(s.DpDesc[:]))
+}
+
+func (s *FlowStatsRequest) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *FlowStatsRequest) Length() uint16              { return uint16(binary.Size(s)) }
+
+func formatTable(id uint8) string {
+	switch id {
+	case 0xff:
+		return "all"
+	case 0xfe:
+		return "emergency"
+	}
+	return fmt.Sprint(id)
+}
+
+func formatStatsRequest(match Match, table uint8, outPort uint16) string {
+	fields := []string{"table=" + formatTable(table)}
+	if outPort != OFPP_NONE {
+		fields = append(fields, "out_port="+formatPort(outPort))
+	}
+	if s := match.String(); s != "" {
+		fields = append(fields, s)
+	}
+	return strings.Join(fields, ",")
+}
+
+func (s *FlowStatsRequest) String() string {
+	return formatStatsRequest(s.Match, s.TableId, s.OutPort)
+}
+
+/* Body for ofpStatsRequest of type OFPST_AGGREGATE. */
+type AggregateStatsRequest struct {
+	Match         /* Fields to match. */
+	TableId uint8 /* ID of table to read (from ofpTableStats)
+	   0xff for all tables or 0xfe for emergency. */
+	_       uint8  /* Align to 32 bits. */
+	OutPort uint16 /* Require matching entries to include this
+	   as an output port.  A value of OFPP_NONE
+	   indicates no restriction. */
+}
+
+func (s *AggregateStatsRequest) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *AggregateStatsRequest) Length() uint16              { return uint16(binary.Size(s)) }
+
+func (s *AggregateStatsRequest) String() string {
+	return formatStatsRequest(s.Match, s.TableId, s.OutPort)
+}
+
+/* One entry of the reply to an OFPST_FLOW request. */
+type FlowStat struct {
+	TableId      uint8  /* ID of table flow came from. */
+	Match        Match  /* Description of fields. */
+	DurationSec  uint32 /* Time flow has been alive in seconds. */
+	DurationNsec uint32 /* Time flow has been alive in nanoseconds beyond
+	   DurationSec. */
+	Priority    uint16   /* Priority of the entry. */
+	IdleTimeout uint16   /* Number of seconds idle before expiration. */
+	HardTimeout uint16   /* Number of seconds before expiration. */
+	Cookie      uint64   /* Opaque controller-issued identifier. */
+	PacketCount uint64   /* Number of packets in flow. */
+	ByteCount   uint64   /* Number of bytes in flow. */
+	Actions     []Action // Actions.
+}
+
+// The fixed part of a FlowStat entry as laid out on the wire.
+type flowStatsPart struct {
+	Length       uint16
+	TableId      uint8
+	_            uint8
+	Match        Match
+	DurationSec  uint32
+	DurationNsec uint32
+	Priority     uint16
+	IdleTimeout  uint16
+	HardTimeout  uint16
+	_            [6]uint8
+	Cookie       uint64
+	PacketCount  uint64
+	ByteCount    uint64
+}
+
+const flowStatsPartSize = 88
+
+func (s *FlowStat) Length() uint16 {
+	size := uint16(flowStatsPartSize)
+	for _, a := range s.Actions {
+		size += ActionLen(a)
+	}
+	return size
+}
+
+func (s *FlowStat) WriteStat(w io.Writer) error {
+	part := flowStatsPart{
+		Length:       s.Length(),
+		TableId:      s.TableId,
+		Match:        s.Match,
+		DurationSec:  s.DurationSec,
+		DurationNsec: s.DurationNsec,
+		Priority:     s.Priority,
+		IdleTimeout:  s.IdleTimeout,
+		HardTimeout:  s.HardTimeout,
+		Cookie:       s.Cookie,
+		PacketCount:  s.PacketCount,
+		ByteCount:    s.ByteCount,
+	}
+	err := binary.Write(w, binary.BigEndian, &part)
+	if err != nil {
+		return err
+	}
+	for _, a := range s.Actions {
+		err = a.WriteAction(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFlowStats(body []byte) ([]Stat, error) {
+	stats := []Stat{}
+	for len(body) > 0 {
+		if len(body) < flowStatsPartSize {
+			return nil, errors.New("truncated flow stats")
+		}
+		var part flowStatsPart
+		binary.Read(bytes.NewReader(body), binary.BigEndian, &part)
+		if int(part.Length) < flowStatsPartSize || int(part.Length) > len(body) {
+			return nil, fmt.Errorf("bad flow stats length %d", part.Length)
+		}
+		actions, err := ReadActions(body[flowStatsPartSize:part.Length])
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, &FlowStat{
+			TableId:      part.TableId,
+			Match:        part.Match,
+			DurationSec:  part.DurationSec,
+			DurationNsec: part.DurationNsec,
+			Priority:     part.Priority,
+			IdleTimeout:  part.IdleTimeout,
+			HardTimeout:  part.HardTimeout,
+			Cookie:       part.Cookie,
+			PacketCount:  part.PacketCount,
+			ByteCount:    part.ByteCount,
+			Actions:      actions,
+		})
+		body = body[part.Length:]
+	}
+	return stats, nil
+}
+
+// Formats the entry like ovs-ofctl dump-flows.
+func (s *FlowStat) String() string {
+	fields := []string{
+		fmt.Sprintf("cookie=0x%x", s.Cookie),
+		fmt.Sprintf("duration=%d.%03ds", s.DurationSec, s.DurationNsec/1000000),
+		fmt.Sprintf("table=%d", s.TableId),
+		fmt.Sprintf("n_packets=%d", s.PacketCount),
+		fmt.Sprintf("n_bytes=%d", s.ByteCount),
+	}
+	if s.IdleTimeout != 0 {
+		fields = append(fields, fmt.Sprintf("idle_timeout=%d", s.IdleTimeout))
+	}
+	if s.HardTimeout != 0 {
+		fields = append(fields, fmt.Sprintf("hard_timeout=%d", s.HardTimeout))
+	}
+	fields = append(fields, fmt.Sprintf("priority=%d", s.Priority))
+	if match := s.Match.String(); match != "" {
+		fields = append(fields, match)
+	}
+	fields = append(fields, "actions="+FormatActions(s.Actions))
+	return strings.Join(fields, ",")
+}
+
+/* Body of reply to OFPST_AGGREGATE request. */
+type AggregateStats struct {
+	PacketCount uint64   /* Number of packets in flows. */
+	ByteCount   uint64   /* Number of bytes in flows. */
+	FlowCount   uint32   /* Number of flows. */
+	_           [4]uint8 /* Align to 64 bits. */
+}
+
+func (s *AggregateStats) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *AggregateStats) Length() uint16              { return uint16(binary.Size(s)) }
+
+func (s *AggregateStats) String() string {
+	return fmt.Sprintf("packet_count=%d,byte_count=%d,flow_count=%d",
+		s.PacketCount, s.ByteCount, s.FlowCount)
+}
+
+/* Body of reply to OFPST_TABLE request. */
+type TableStat struct {
+	TableId uint8 /* Identifier of table.  Lower numbered tables
+	   are consulted first. */
+	_         [3]uint8 /* Align to 32-bits. */
+	Name      [OFP_MAX_TABLE_NAME_LEN]byte
+	Wildcards uint32 /* Bitmap of OFPFW_* wildcards that are
+	   supported by the table. */
+	MaxEntries   uint32 /* Max number of entries supported. */
+	ActiveCount  uint32 /* Number of active entries. */
+	LookupCount  uint64 /* Number of packets looked up in table. */
+	MatchedCount uint64 /* Number of packets that hit table. */
+}
+
+func (s *TableStat) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *TableStat) Length() uint16              { return uint16(binary.Size(s)) }
+
+func (s *TableStat) String() string {
+	return fmt.Sprintf("table=%d,name=%q,wildcards=0x%x,max=%d,active=%d,lookup=%d,matched=%d",
+		s.TableId, cString(s.Name[:]), s.Wildcards, s.MaxEntries, s.ActiveCount,
+		s.LookupCount, s.MatchedCount)
+}
+
+/* Body for ofpStatsRequest of type OFPST_PORT. */
+type PortStatsRequest struct {
+	PortNo uint16 /* A single port, or OFPP_NONE for all ports. */
+	_      [6]uint8
+}
+
+func (s *PortStatsRequest) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *PortStatsRequest) Length() uint16              { return uint16(binary.Size(s)) }
+
+func (s *PortStatsRequest) String() string {
+	return "port=" + formatPort(s.PortNo)
+}
+
+/* Body of reply to OFPST_PORT request.  If a counter is unsupported set
+ * the field to all ones. */
+type PortStat struct {
+	PortNo     uint16
+	_          [6]uint8 /* Align to 64-bits. */
+	RxPackets  uint64   /* Number of received packets. */
+	TxPackets  uint64   /* Number of transmitted packets. */
+	RxBytes    uint64   /* Number of received bytes. */
+	TxBytes    uint64   /* Number of transmitted bytes. */
+	RxDropped  uint64   /* Number of packets dropped by RX. */
+	TxDropped  uint64   /* Number of packets dropped by TX. */
+	RxErrors   uint64   /* Number of receive errors. */
+	TxErrors   uint64   /* Number of transmit errors. */
+	RxFrameErr uint64   /* Number of frame alignment errors. */
+	RxOverErr  uint64   /* Number of packets with RX overrun. */
+	RxCrcErr   uint64   /* Number of CRC errors. */
+	Collisions uint64   /* Number of collisions. */
+}
+
+func (s *PortStat) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *PortStat) Length() uint16              { return uint16(binary.Size(s)) }
+
+func (s *PortStat) String() string {
+	return fmt.Sprintf("port=%s,rx_packets=%d,rx_bytes=%d,rx_dropped=%d,rx_errors=%d,"+
+		"tx_packets=%d,tx_bytes=%d,tx_dropped=%d,tx_errors=%d,collisions=%d",
+		formatPort(s.PortNo), s.RxPackets, s.RxBytes, s.RxDropped, s.RxErrors,
+		s.TxPackets, s.TxBytes, s.TxDropped, s.TxErrors, s.Collisions)
+}
+
+// Used in QueueStatsRequest.QueueId for all the queues of a port.
+const QueueAll = 0xffffffff
+
+/* Body for ofpStatsRequest of type OFPST_QUEUE. */
+type QueueStatsRequest struct {
+	PortNo  uint16   /* All ports if OFPP_ALL. */
+	_       [2]uint8 /* Align to 32-bits. */
+	QueueId uint32   /* All queues if QueueAll. */
+}
+
+func (s *QueueStatsRequest) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *QueueStatsRequest) Length() uint16              { return uint16(binary.Size(s)) }
+
+func (s *QueueStatsRequest) String() string {
+	return fmt.Sprintf("port=%s,queue=%d", formatPort(s.PortNo), s.QueueId)
+}
+
+/* Body of reply to OFPST_QUEUE request. */
+type QueueStat struct {
+	PortNo    uint16
+	_         [2]uint8 /* Align to 32-bits. */
+	QueueId   uint32   /* Queue id. */
+	TxBytes   uint64   /* Number of transmitted bytes. */
+	TxPackets uint64   /* Number of transmitted packets. */
+	TxErrors  uint64   /* Number of packets dropped due to overrun. */
+}
+
+func (s *QueueStat) WriteStat(w io.Writer) error { return writeStat(w, s) }
+func (s *QueueStat) Length() uint16              { return uint16(binary.Size(s)) }
+
+func (s *QueueStat) String() string {
+	return fmt.Sprintf("port=%s,queue=%d,tx_packets=%d,tx_bytes=%d,tx_errors=%d",
+		formatPort(s.PortNo), s.QueueId, s.TxPackets, s.TxBytes, s.TxErrors)
+}
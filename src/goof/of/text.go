@@ -0,0 +1,611 @@
+package of
+
+// Text syntax for matches, actions and flows.  The syntax is the one accepted
+// by ovs-ofctl add-flow, e.g.
+//
+//   priority=100,in_port=1,dl_type=0x0800,nw_src=10.0.0.0/8,actions=output:2
+//
+// Formatting and parsing are inverses of each other for every field that
+// OpenFlow 1.0 can express.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var portNames = map[uint16]string{
+	OFPP_IN_PORT:    "IN_PORT",
+	OFPP_TABLE:      "TABLE",
+	OFPP_NORMAL:     "NORMAL",
+	PortFlood:       "FLOOD",
+	OFPP_ALL:        "ALL",
+	OFPP_CONTROLLER: "CONTROLLER",
+	OFPP_LOCAL:      "LOCAL",
+	OFPP_NONE:       "NONE",
+}
+
+func formatPort(port uint16) string {
+	if name, ok := portNames[port]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(port), 10)
+}
+
+func parsePort(s string) (uint16, error) {
+	for port, name := range portNames {
+		if strings.EqualFold(s, name) {
+			return port, nil
+		}
+	}
+	return parseUint16(s)
+}
+
+func formatMAC(mac [EthAlen]uint8) string {
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x",
+		mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+}
+
+func parseMAC(s string) (mac [EthAlen]uint8, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != EthAlen {
+		return mac, fmt.Errorf("bad MAC address %q", s)
+	}
+	for i, p := range parts {
+		b, err := strconv.ParseUint(p, 16, 8)
+		if err != nil || len(p) == 0 || len(p) > 2 {
+			return mac, fmt.Errorf("bad MAC address %q", s)
+		}
+		mac[i] = uint8(b)
+	}
+	return mac, nil
+}
+
+func formatIP(ip uint32) string {
+	return fmt.Sprintf("%d.%d.%d.%d", ip>>24, (ip>>16)&0xff, (ip>>8)&0xff,
+		ip&0xff)
+}
+
+func parseIP(s string) (uint32, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return 0, fmt.Errorf("bad IP address %q", s)
+	}
+	var ip uint32
+	for _, p := range parts {
+		b, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("bad IP address %q", s)
+		}
+		ip = ip<<8 | uint32(b)
+	}
+	return ip, nil
+}
+
+// Parses "a.b.c.d" or "a.b.c.d/n" and returns the address together with the
+// number of wildcarded low-order bits, as used by the Fw*Shift fields.
+func parseIPPrefix(s string) (ip uint32, wild uint32, err error) {
+	addr, prefix := s, "32"
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		addr, prefix = s[:i], s[i+1:]
+	}
+	ip, err = parseIP(addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := strconv.ParseUint(prefix, 10, 8)
+	if err != nil || n > 32 {
+		return 0, 0, fmt.Errorf("bad prefix length in %q", s)
+	}
+	wild = 32 - uint32(n)
+	if wild < 32 {
+		ip &^= (1 << wild) - 1
+	} else {
+		ip = 0
+	}
+	return ip, wild, nil
+}
+
+func formatIPPrefix(ip uint32, wild uint32) string {
+	if wild == 0 {
+		return formatIP(ip)
+	}
+	return fmt.Sprintf("%s/%d", formatIP(ip), 32-wild)
+}
+
+func parseUint(s string, bits int) (uint64, error) {
+	return strconv.ParseUint(s, 0, bits)
+}
+
+func parseUint8(s string) (uint8, error) {
+	n, err := parseUint(s, 8)
+	return uint8(n), err
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := parseUint(s, 16)
+	return uint16(n), err
+}
+
+func parseUint32(s string) (uint32, error) {
+	n, err := parseUint(s, 32)
+	return uint32(n), err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Matches
+
+// Number of wildcarded bits of the IP source address (0 to 32).
+func (m Match) NwSrcWildcardBits() uint32 {
+	n := (m.Wildcards & FwNwSrcMask) >> FwNwSrcShift
+	if n > 32 {
+		n = 32
+	}
+	return n
+}
+
+// Number of wildcarded bits of the IP destination address (0 to 32).
+func (m Match) NwDstWildcardBits() uint32 {
+	n := (m.Wildcards & FwNwDstMask) >> FwNwDstShift
+	if n > 32 {
+		n = 32
+	}
+	return n
+}
+
+// Abbreviations for common dl_type and nw_proto combinations.
+var matchShorthands = []struct {
+	name    string
+	dlType  uint16
+	nwProto uint8
+	proto   bool // whether nwProto is part of the abbreviation
+}{
+	{"ip", 0x0800, 0, false},
+	{"arp", 0x0806, 0, false},
+	{"icmp", 0x0800, 1, true},
+	{"tcp", 0x0800, 6, true},
+	{"udp", 0x0800, 17, true},
+}
+
+func (m Match) String() string {
+	var fields []string
+	add := func(format string, args ...interface{}) {
+		fields = append(fields, fmt.Sprintf(format, args...))
+	}
+	has := func(fw uint32) bool { return m.Wildcards&fw == 0 }
+
+	if has(FwInPort) {
+		add("in_port=%s", formatPort(m.InPort))
+	}
+	if has(FwDlVlan) {
+		if m.VLanID == OFP_VLAN_NONE {
+			add("dl_vlan=0xffff")
+		} else {
+			add("dl_vlan=%d", m.VLanID)
+		}
+	}
+	if has(FwDlVlanPcp) {
+		add("dl_vlan_pcp=%d", m.VLanPCP)
+	}
+	if has(FwDlSrc) {
+		add("dl_src=%s", formatMAC(m.DlSrc))
+	}
+	if has(FwDlDst) {
+		add("dl_dst=%s", formatMAC(m.DlDst))
+	}
+
+	icmp := false
+	protoDone := false
+	if has(FwDlType) {
+		short := ""
+		for _, s := range matchShorthands {
+			if s.dlType != m.EthFrameType {
+				continue
+			}
+			if !s.proto {
+				short = s.name
+			} else if has(FwNwProto) && s.nwProto == m.NwProto {
+				short = s.name
+				protoDone = true
+				icmp = s.nwProto == 1
+				break
+			}
+		}
+		if short != "" {
+			add("%s", short)
+		} else {
+			add("dl_type=0x%04x", m.EthFrameType)
+		}
+	}
+	if n := m.NwSrcWildcardBits(); n < 32 {
+		add("nw_src=%s", formatIPPrefix(m.NwSrc, n))
+	}
+	if n := m.NwDstWildcardBits(); n < 32 {
+		add("nw_dst=%s", formatIPPrefix(m.NwDst, n))
+	}
+	if has(FwNwProto) && !protoDone {
+		add("nw_proto=%d", m.NwProto)
+	}
+	if has(FwNwTos) {
+		add("nw_tos=%d", m.NwTOS)
+	}
+	if has(FwTpSrc) {
+		if icmp {
+			add("icmp_type=%d", m.TpSrc)
+		} else {
+			add("tp_src=%d", m.TpSrc)
+		}
+	}
+	if has(FwTpDst) {
+		if icmp {
+			add("icmp_code=%d", m.TpDst)
+		} else {
+			add("tp_dst=%d", m.TpDst)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// Applies a single "key" or "key=value" match field to m.  Returns false if
+// key does not name a match field.
+func (m *Match) setField(key, value string) (bool, error) {
+	var err error
+	for _, s := range matchShorthands {
+		if key == s.name {
+			if value != "" {
+				return true, fmt.Errorf("%s does not take a value", key)
+			}
+			m.EthFrameType = s.dlType
+			m.Wildcards &^= FwDlType
+			if s.proto {
+				m.NwProto = s.nwProto
+				m.Wildcards &^= FwNwProto
+			}
+			return true, nil
+		}
+	}
+
+	switch key {
+	case "in_port":
+		m.InPort, err = parsePort(value)
+		m.Wildcards &^= FwInPort
+	case "dl_vlan":
+		m.VLanID, err = parseUint16(value)
+		m.Wildcards &^= FwDlVlan
+	case "dl_vlan_pcp":
+		m.VLanPCP, err = parseUint8(value)
+		m.Wildcards &^= FwDlVlanPcp
+	case "dl_src":
+		m.DlSrc, err = parseMAC(value)
+		m.Wildcards &^= FwDlSrc
+	case "dl_dst":
+		m.DlDst, err = parseMAC(value)
+		m.Wildcards &^= FwDlDst
+	case "dl_type":
+		m.EthFrameType, err = parseUint16(value)
+		m.Wildcards &^= FwDlType
+	case "nw_src":
+		var wild uint32
+		m.NwSrc, wild, err = parseIPPrefix(value)
+		m.Wildcards = m.Wildcards&^FwNwSrcMask | wild<<FwNwSrcShift
+	case "nw_dst":
+		var wild uint32
+		m.NwDst, wild, err = parseIPPrefix(value)
+		m.Wildcards = m.Wildcards&^FwNwDstMask | wild<<FwNwDstShift
+	case "nw_proto":
+		m.NwProto, err = parseUint8(value)
+		m.Wildcards &^= FwNwProto
+	case "nw_tos":
+		m.NwTOS, err = parseUint8(value)
+		m.Wildcards &^= FwNwTos
+	case "tp_src", "icmp_type":
+		m.TpSrc, err = parseUint16(value)
+		m.Wildcards &^= FwTpSrc
+	case "tp_dst", "icmp_code":
+		m.TpDst, err = parseUint16(value)
+		m.Wildcards &^= FwTpDst
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("bad value for %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// Splits "key=value" into its parts.  The value is empty for a bare key.
+func splitField(field string) (string, string) {
+	if i := strings.IndexByte(field, '='); i >= 0 {
+		return strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:])
+	}
+	return strings.TrimSpace(field), ""
+}
+
+// Splits a list of fields separated by commas and/or whitespace.
+func splitFields(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// Parses a match in ovs-ofctl syntax, e.g. "in_port=1,tcp,tp_dst=80".  Fields
+// that are not mentioned are wildcarded.
+func ParseMatch(s string) (Match, error) {
+	m := Match{Wildcards: FwAll}
+	for _, field := range splitFields(s) {
+		key, value := splitField(field)
+		ok, err := m.setField(key, value)
+		if err != nil {
+			return m, err
+		}
+		if !ok {
+			return m, fmt.Errorf("unknown match field %q", key)
+		}
+	}
+	return m, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Actions
+
+func (m *ActionOutput) String() string {
+	if m.Port == OFPP_CONTROLLER {
+		return fmt.Sprintf("CONTROLLER:%d", m.MaxLen)
+	}
+	switch m.Port {
+	case OFPP_IN_PORT, OFPP_TABLE, OFPP_NORMAL, PortFlood, OFPP_ALL, OFPP_LOCAL:
+		return portNames[m.Port]
+	}
+	return "output:" + formatPort(m.Port)
+}
+
+func (m *ActionVlanVid) String() string {
+	return fmt.Sprintf("mod_vlan_vid:%d", m.VlanVid)
+}
+
+func (m *ActionVlanPcp) String() string {
+	return fmt.Sprintf("mod_vlan_pcp:%d", m.VlanPcp)
+}
+
+func (m *ActionStripVlan) String() string {
+	return "strip_vlan"
+}
+
+func (m *ActionSetDlSrc) String() string {
+	return "mod_dl_src:" + formatMAC(m.DlAddr)
+}
+
+func (m *ActionSetDlDst) String() string {
+	return "mod_dl_dst:" + formatMAC(m.DlAddr)
+}
+
+func (m *ActionNwAddrSrc) String() string {
+	return "mod_nw_src:" + formatIP(m.NwAddr)
+}
+
+func (m *ActionNwAddrDst) String() string {
+	return "mod_nw_dst:" + formatIP(m.NwAddr)
+}
+
+func (m *ActionNwTos) String() string {
+	return fmt.Sprintf("mod_nw_tos:%d", m.NwTos)
+}
+
+func (m *ActionTpPortSrc) String() string {
+	return fmt.Sprintf("mod_tp_src:%d", m.TpPort)
+}
+
+func (m *ActionTpPortDst) String() string {
+	return fmt.Sprintf("mod_tp_dst:%d", m.TpPort)
+}
+
+func (m *ActionEnqueue) String() string {
+	return fmt.Sprintf("enqueue:%s:%d", formatPort(m.Port), m.QueueId)
+}
+
+// Formats an action list as the value of an "actions=" field.  An empty list
+// is written as "drop".
+func FormatActions(actions []Action) string {
+	if len(actions) == 0 {
+		return "drop"
+	}
+	strs := make([]string, len(actions))
+	for i, a := range actions {
+		strs[i] = fmt.Sprint(a)
+	}
+	return strings.Join(strs, ",")
+}
+
+func parseAction(s string) (Action, error) {
+	name, arg := s, ""
+	if i := strings.IndexAny(s, ":="); i >= 0 {
+		name, arg = s[:i], s[i+1:]
+	}
+	name = strings.ToLower(name)
+
+	var err error
+	switch name {
+	case "output":
+		a := &ActionOutput{}
+		a.Port, err = parsePort(arg)
+		if a.Port == OFPP_CONTROLLER {
+			a.MaxLen = 0xffff
+		}
+		return a, err
+	case "controller":
+		a := &ActionOutput{Port: OFPP_CONTROLLER, MaxLen: 0xffff}
+		if arg != "" {
+			a.MaxLen, err = parseUint16(arg)
+		}
+		return a, err
+	case "in_port", "table", "normal", "flood", "all", "local":
+		if arg != "" {
+			return nil, fmt.Errorf("%s does not take an argument", name)
+		}
+		port, _ := parsePort(name)
+		return &ActionOutput{Port: port}, nil
+	case "mod_vlan_vid":
+		a := &ActionVlanVid{}
+		a.VlanVid, err = parseUint16(arg)
+		return a, err
+	case "mod_vlan_pcp":
+		a := &ActionVlanPcp{}
+		a.VlanPcp, err = parseUint8(arg)
+		return a, err
+	case "strip_vlan":
+		return &ActionStripVlan{}, nil
+	case "mod_dl_src":
+		a := &ActionSetDlSrc{}
+		a.DlAddr, err = parseMAC(arg)
+		return a, err
+	case "mod_dl_dst":
+		a := &ActionSetDlDst{}
+		a.DlAddr, err = parseMAC(arg)
+		return a, err
+	case "mod_nw_src":
+		a := &ActionNwAddrSrc{}
+		a.NwAddr, err = parseIP(arg)
+		return a, err
+	case "mod_nw_dst":
+		a := &ActionNwAddrDst{}
+		a.NwAddr, err = parseIP(arg)
+		return a, err
+	case "mod_nw_tos":
+		a := &ActionNwTos{}
+		a.NwTos, err = parseUint8(arg)
+		return a, err
+	case "mod_tp_src":
+		a := &ActionTpPortSrc{}
+		a.TpPort, err = parseUint16(arg)
+		return a, err
+	case "mod_tp_dst":
+		a := &ActionTpPortDst{}
+		a.TpPort, err = parseUint16(arg)
+		return a, err
+	case "enqueue":
+		parts := strings.Split(arg, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("enqueue needs port:queue, got %q", arg)
+		}
+		a := &ActionEnqueue{}
+		a.Port, err = parsePort(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		a.QueueId, err = parseUint32(parts[1])
+		return a, err
+	}
+
+	// A bare port number is shorthand for output.
+	if port, err := parseUint16(s); err == nil {
+		return &ActionOutput{Port: port}, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", s)
+}
+
+// Parses the value of an "actions=" field, e.g. "mod_vlan_vid:10,output:2".
+// "drop" and the empty string both denote an empty action list.
+func ParseActions(s string) ([]Action, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.EqualFold(s, "drop") {
+		return []Action{}, nil
+	}
+	var actions []Action
+	for _, field := range strings.Split(s, ",") {
+		a, err := parseAction(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Flows
+
+// Formats the match, flow parameters and actions of a flow modification.  The
+// Command, BufferId and OutPort fields are not part of the flow syntax.
+func (m *FlowMod) String() string {
+	var fields []string
+	if m.Cookie != 0 {
+		fields = append(fields, fmt.Sprintf("cookie=0x%x", m.Cookie))
+	}
+	if m.IdleTimeout != 0 {
+		fields = append(fields, fmt.Sprintf("idle_timeout=%d", m.IdleTimeout))
+	}
+	if m.HardTimeout != 0 {
+		fields = append(fields, fmt.Sprintf("hard_timeout=%d", m.HardTimeout))
+	}
+	fields = append(fields, fmt.Sprintf("priority=%d", m.Priority))
+	if m.Flags&SendFlowRem != 0 {
+		fields = append(fields, "send_flow_rem")
+	}
+	if m.Flags&CheckOverlap != 0 {
+		fields = append(fields, "check_overlap")
+	}
+	if m.Flags&Emergency != 0 {
+		fields = append(fields, "emergency")
+	}
+	if match := m.Match.String(); match != "" {
+		fields = append(fields, match)
+	}
+	fields = append(fields, "actions="+FormatActions(m.Actions))
+	return strings.Join(fields, ",")
+}
+
+// Parses a flow in ovs-ofctl add-flow syntax.  The "actions=" field must come
+// last.  The result is an FCAdd with no buffer and no output port
+// restriction; callers may change the command before sending it.
+func ParseFlowMod(s string) (*FlowMod, error) {
+	m := &FlowMod{
+		Match:    Match{Wildcards: FwAll},
+		Command:  FCAdd,
+		BufferId: 0xffffffff,
+		OutPort:  OFPP_NONE,
+		Priority: 0x8000,
+	}
+
+	i := strings.Index(s, "actions=")
+	if i < 0 {
+		return nil, fmt.Errorf("flow %q has no actions", s)
+	}
+	actions, err := ParseActions(s[i+len("actions="):])
+	if err != nil {
+		return nil, err
+	}
+	m.Actions = actions
+
+	for _, field := range splitFields(s[:i]) {
+		key, value := splitField(field)
+		ok, err := m.Match.setField(key, value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		switch key {
+		case "cookie":
+			m.Cookie, err = parseUint(value, 64)
+		case "idle_timeout":
+			m.IdleTimeout, err = parseUint16(value)
+		case "hard_timeout":
+			m.HardTimeout, err = parseUint16(value)
+		case "priority":
+			m.Priority, err = parseUint16(value)
+		case "send_flow_rem":
+			m.Flags |= SendFlowRem
+		case "check_overlap":
+			m.Flags |= CheckOverlap
+		case "emergency":
+			m.Flags |= Emergency
+		default:
+			return nil, fmt.Errorf("unknown flow field %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad value for %s: %v", key, err)
+		}
+	}
+	return m, nil
+}
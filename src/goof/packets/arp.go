@@ -0,0 +1,133 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const EthTypeARP EthType = 0x0806
+
+// ARP operations.
+const (
+	ARPRequest uint16 = 1
+	ARPReply   uint16 = 2
+)
+
+// Values of HardwareType and ProtocolType for Ethernet and IPv4, the only
+// combination that is decoded.
+const (
+	ARPHardwareEthernet uint16 = 1
+	arpProtocolIP       uint16 = uint16(EthTypeIP)
+)
+
+const ARPPacketSize = 28
+
+// An ARP packet for IPv4 over Ethernet (RFC 826).
+type ARPPacket struct {
+	HardwareType uint16
+	ProtocolType uint16
+	HardwareLen  uint8
+	ProtocolLen  uint8
+	Operation    uint16 // ARPRequest or ARPReply
+	SenderHW     [6]byte
+	SenderIP     uint32
+	TargetHW     [6]byte
+	TargetIP     uint32
+}
+
+var BroadcastMAC = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func (p *ARPPacket) decode(b []byte) error {
+	if len(b) < ARPPacketSize {
+		return io.ErrUnexpectedEOF
+	}
+	p.HardwareType = binary.BigEndian.Uint16(b[0:])
+	p.ProtocolType = binary.BigEndian.Uint16(b[2:])
+	p.HardwareLen = b[4]
+	p.ProtocolLen = b[5]
+	p.Operation = binary.BigEndian.Uint16(b[6:])
+	if p.HardwareType != ARPHardwareEthernet || p.ProtocolType != arpProtocolIP ||
+		p.HardwareLen != 6 || p.ProtocolLen != 4 {
+		return fmt.Errorf("unsupported ARP hardware/protocol %d/%#04x",
+			p.HardwareType, p.ProtocolType)
+	}
+	copy(p.SenderHW[:], b[8:14])
+	p.SenderIP = binary.BigEndian.Uint32(b[14:])
+	copy(p.TargetHW[:], b[18:24])
+	p.TargetIP = binary.BigEndian.Uint32(b[24:])
+	return nil
+}
+
+// Decodes an ARP packet, i.e. the payload of a frame of type EthTypeARP.
+func ParseARP(b []byte) (*ARPPacket, error) {
+	var p ARPPacket
+	err := p.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *ARPPacket) appendTo(b []byte) []byte {
+	b = appendUint16(b, p.HardwareType)
+	b = appendUint16(b, p.ProtocolType)
+	b = append(b, p.HardwareLen, p.ProtocolLen)
+	b = appendUint16(b, p.Operation)
+	b = append(b, p.SenderHW[:]...)
+	b = appendUint32(b, p.SenderIP)
+	b = append(b, p.TargetHW[:]...)
+	return appendUint32(b, p.TargetIP)
+}
+
+func (p *ARPPacket) Write(w io.Writer) error {
+	_, err := w.Write(p.appendTo(make([]byte, 0, ARPPacketSize)))
+	return err
+}
+
+// Builds a request asking for the hardware address of targetIP.
+func NewARPRequest(senderHW [6]byte, senderIP, targetIP uint32) *ARPPacket {
+	return &ARPPacket{
+		HardwareType: ARPHardwareEthernet,
+		ProtocolType: arpProtocolIP,
+		HardwareLen:  6,
+		ProtocolLen:  4,
+		Operation:    ARPRequest,
+		SenderHW:     senderHW,
+		SenderIP:     senderIP,
+		TargetIP:     targetIP,
+	}
+}
+
+// Builds the reply to req announcing that req.TargetIP is at hw.
+func NewARPReply(req *ARPPacket, hw [6]byte) *ARPPacket {
+	return &ARPPacket{
+		HardwareType: ARPHardwareEthernet,
+		ProtocolType: arpProtocolIP,
+		HardwareLen:  6,
+		ProtocolLen:  4,
+		Operation:    ARPReply,
+		SenderHW:     hw,
+		SenderIP:     req.TargetIP,
+		TargetHW:     req.SenderHW,
+		TargetIP:     req.SenderIP,
+	}
+}
+
+// Returns the Ethernet frame carrying p: requests are broadcast and replies
+// are sent to the target.
+func (p *ARPPacket) Frame() *EthFrame {
+	dst := p.TargetHW
+	if p.Operation == ARPRequest {
+		dst = BroadcastMAC
+	}
+	return &EthFrame{EthernetHeader: &EthernetHeader{dst, p.SenderHW, EthTypeARP},
+		Body: p}
+}
+
+// Returns the bytes of the frame returned by Frame, ready to be sent as the
+// data of a PacketOut.
+func (p *ARPPacket) FrameBytes() []byte {
+	b, _ := p.Frame().Serialize() // cannot fail for ARP
+	return b
+}
@@ -0,0 +1,175 @@
+package packets
+
+import (
+	"fmt"
+)
+
+// Adds the 16-bit big-endian words of b to the one's complement sum s.  An
+// odd trailing byte is padded with zero.
+func sum(b []byte, s uint32) uint32 {
+	n := len(b) &^ 1
+	for i := 0; i < n; i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n < len(b) {
+		s += uint32(b[n]) << 8
+	}
+	return s
+}
+
+// Folds a one's complement sum into 16 bits and complements it.
+func fold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// Returns the Internet checksum (RFC 1071) of b.  Computed over data that
+// includes a correct checksum, the result is zero.
+func Checksum(b []byte) uint16 {
+	return fold(sum(b, 0))
+}
+
+// Returns the checksum that replaces old after a 16-bit word of the checked
+// data changes from from to to, without going over the data again
+// (RFC 1624, equation 3).
+func UpdateChecksum(old uint16, from, to uint16) uint16 {
+	return fold(uint32(^old) + uint32(^from) + uint32(to))
+}
+
+// Like UpdateChecksum for a 32-bit field such as an IPv4 address.  The
+// address is part of both the IP header checksum and the pseudo header of
+// the TCP and UDP checksums, so NAT updates all of them.
+func UpdateChecksum32(old uint16, from, to uint32) uint16 {
+	old = UpdateChecksum(old, uint16(from>>16), uint16(to>>16))
+	return UpdateChecksum(old, uint16(from), uint16(to))
+}
+
+func ipv4Pseudo(h *IPHeader, p Protocol, length int) uint32 {
+	return uint32(h.SrcAddr>>16) + uint32(h.SrcAddr&0xffff) +
+		uint32(h.DstAddr>>16) + uint32(h.DstAddr&0xffff) +
+		uint32(p) + uint32(length)
+}
+
+func ipv6Pseudo(h *IPv6Header, p Protocol, length int) uint32 {
+	s := sum(h.SrcAddr[:], 0)
+	s = sum(h.DstAddr[:], s)
+	return s + uint32(p) + uint32(length>>16) + uint32(length&0xffff)
+}
+
+// Computes the checksum of the header as it would be encoded, ignoring the
+// current value of HeaderChecksum.
+func (h *IPHeader) ComputeChecksum() uint16 {
+	b := h.appendTo(make([]byte, 0, IPHeaderSize+len(h.Options)+3))
+	b[10], b[11] = 0, 0
+	return Checksum(b)
+}
+
+func (h *IPHeader) ChecksumValid() bool {
+	return h.ComputeChecksum() == h.HeaderChecksum
+}
+
+// Returns the checksum of a transport segment (header with a zero checksum
+// field, and payload) carried in an IPv4 datagram with header h.
+func TransportChecksum(h *IPHeader, p Protocol, seg []byte) uint16 {
+	return fold(sum(seg, ipv4Pseudo(h, p, len(seg))))
+}
+
+// Like TransportChecksum for a segment carried over IPv6.
+func TransportChecksumIPv6(h *IPv6Header, p Protocol, seg []byte) uint16 {
+	return fold(sum(seg, ipv6Pseudo(h, p, len(seg))))
+}
+
+// Re-encodes a decoded transport layer with a zero checksum.  Returns the
+// segment, the checksum found in the layer and whether the layer holds a
+// checksum that can be verified.
+func segment(layer interface{}) ([]byte, uint16, Protocol, bool) {
+	switch l := layer.(type) {
+	case *TCPHeader:
+		seg := l.appendTo(nil)
+		seg[16], seg[17] = 0, 0
+		return seg, l.Checksum, ProtocolTCP, true
+	case *UDPHeader:
+		if int(l.Length) != UDPHeaderSize+len(l.Payload) {
+			return nil, 0, 0, false // truncated
+		}
+		seg := l.appendTo(nil)
+		seg[6], seg[7] = 0, 0
+		return seg, l.Checksum, ProtocolUDP, true
+	case *ICMPHeader:
+		seg := l.appendTo(nil)
+		seg[2], seg[3] = 0, 0
+		return seg, l.Checksum, ProtocolICMP, true
+	case *ICMPv6Header:
+		seg := l.appendTo(nil)
+		seg[2], seg[3] = 0, 0
+		return seg, l.Checksum, ProtocolICMPv6, true
+	}
+	return nil, 0, 0, false
+}
+
+func checksumError(layer string, have, want uint16) error {
+	return fmt.Errorf("bad %s checksum %#04x, want %#04x", layer, have, want)
+}
+
+// Verifies the IPv4 header checksum and the checksum of the transport layer
+// linked from f.  Transport checksums are skipped when the datagram was
+// truncated, for example by the miss_send_len of a PacketIn, and for UDP
+// over IPv4 when the sender left the checksum out.
+func (f *IPFragment) VerifyChecksums() error {
+	if want := f.ComputeChecksum(); want != f.HeaderChecksum {
+		return checksumError("IP header", f.HeaderChecksum, want)
+	}
+	seg, have, p, ok := segment(f.Body)
+	headerLen := IPHeaderSize + paddedLen(f.Options)
+	if !ok || int(f.TotalLength) != headerLen+len(seg) {
+		return nil
+	}
+	if p == ProtocolUDP && have == 0 {
+		return nil
+	}
+	want := fold(sum(seg, ipv4Pseudo(f.IPHeader, p, len(seg))))
+	if p == ProtocolICMP {
+		want = Checksum(seg)
+	}
+	if p == ProtocolUDP && want == 0 {
+		want = 0xffff
+	}
+	if want != have {
+		return checksumError(p.String(), have, want)
+	}
+	return nil
+}
+
+// Verifies the checksum of the transport layer linked from p.
+func (p *IPv6Packet) VerifyChecksums() error {
+	seg, have, proto, ok := segment(p.Body)
+	extLen := 0
+	for _, ext := range p.Extensions {
+		extLen += len(ext.Data)
+	}
+	if !ok || int(p.PayloadLength) != extLen+len(seg) {
+		return nil
+	}
+	want := fold(sum(seg, ipv6Pseudo(p.IPv6Header, proto, len(seg))))
+	if proto == ProtocolUDP && want == 0 {
+		want = 0xffff
+	}
+	if want != have {
+		return checksumError(proto.String(), have, want)
+	}
+	return nil
+}
+
+// Verifies every checksum in the frame; a non-nil error means the frame is
+// corrupt.
+func (f *EthFrame) VerifyChecksums() error {
+	switch body := f.Body.(type) {
+	case *IPFragment:
+		return body.VerifyChecksums()
+	case *IPv6Packet:
+		return body.VerifyChecksums()
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// UDP ports of DHCP servers and clients.
+const (
+	DHCPServerPort = 67
+	DHCPClientPort = 68
+)
+
+// BOOTP operations.
+const (
+	BootRequest uint8 = 1
+	BootReply   uint8 = 2
+)
+
+// DHCP message types, the value of option DHCPOptMessageType.
+const (
+	DHCPDiscover uint8 = 1
+	DHCPOffer    uint8 = 2
+	DHCPRequest  uint8 = 3
+	DHCPDecline  uint8 = 4
+	DHCPAck      uint8 = 5
+	DHCPNak      uint8 = 6
+	DHCPRelease  uint8 = 7
+	DHCPInform   uint8 = 8
+)
+
+// DHCP option codes (RFC 2132).
+const (
+	DHCPOptPad              uint8 = 0
+	DHCPOptSubnetMask       uint8 = 1
+	DHCPOptRouter           uint8 = 3
+	DHCPOptDNS              uint8 = 6
+	DHCPOptHostname         uint8 = 12
+	DHCPOptDomainName       uint8 = 15
+	DHCPOptRequestedIP      uint8 = 50
+	DHCPOptLeaseTime        uint8 = 51
+	DHCPOptMessageType      uint8 = 53
+	DHCPOptServerID         uint8 = 54
+	DHCPOptParamRequestList uint8 = 55
+	DHCPOptMessage          uint8 = 56
+	DHCPOptRenewalTime      uint8 = 58
+	DHCPOptRebindingTime    uint8 = 59
+	DHCPOptClientID         uint8 = 61
+	DHCPOptEnd              uint8 = 255
+)
+
+// Set in DHCPPacket.Flags by clients that cannot receive unicast before
+// they are configured.
+const DHCPFlagBroadcast uint16 = 0x8000
+
+const (
+	dhcpMagicCookie = 0x63825363
+	dhcpHeaderSize  = 236 // BOOTP header up to the options
+)
+
+// A DHCP message: the BOOTP header followed by options.
+type DHCPPacket struct {
+	Op      uint8 // BootRequest or BootReply
+	HType   uint8 // 1 for Ethernet
+	HLen    uint8
+	Hops    uint8
+	Xid     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  uint32 // client address, if it has one
+	YIAddr  uint32 // address offered to the client
+	SIAddr  uint32 // next server
+	GIAddr  uint32 // relay agent
+	CHAddr  [16]byte
+	SName   [64]byte
+	File    [128]byte
+	Options []DHCPOption
+}
+
+// A DHCP option other than Pad and End.  Data refers to the decoded
+// message.
+type DHCPOption struct {
+	Code uint8
+	Data []byte
+}
+
+func (p *DHCPPacket) decode(b []byte) error {
+	if len(b) < dhcpHeaderSize+4 {
+		return io.ErrUnexpectedEOF
+	}
+	p.Op, p.HType, p.HLen, p.Hops = b[0], b[1], b[2], b[3]
+	p.Xid = binary.BigEndian.Uint32(b[4:])
+	p.Secs = binary.BigEndian.Uint16(b[8:])
+	p.Flags = binary.BigEndian.Uint16(b[10:])
+	p.CIAddr = binary.BigEndian.Uint32(b[12:])
+	p.YIAddr = binary.BigEndian.Uint32(b[16:])
+	p.SIAddr = binary.BigEndian.Uint32(b[20:])
+	p.GIAddr = binary.BigEndian.Uint32(b[24:])
+	copy(p.CHAddr[:], b[28:44])
+	copy(p.SName[:], b[44:108])
+	copy(p.File[:], b[108:236])
+	if binary.BigEndian.Uint32(b[236:]) != dhcpMagicCookie {
+		return errors.New("no DHCP magic cookie")
+	}
+	p.Options = nil
+	for b = b[dhcpHeaderSize+4:]; len(b) > 0; {
+		code := b[0]
+		switch code {
+		case DHCPOptEnd:
+			return nil
+		case DHCPOptPad:
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || 2+int(b[1]) > len(b) {
+			return fmt.Errorf("DHCP option %d overruns the message", code)
+		}
+		p.Options = append(p.Options, DHCPOption{code, b[2 : 2+b[1]]})
+		b = b[2+b[1]:]
+	}
+	return errors.New("DHCP options not terminated")
+}
+
+// Decodes a DHCP message, i.e. the payload of a UDP datagram to or from
+// port DHCPServerPort.
+func ParseDHCP(b []byte) (*DHCPPacket, error) {
+	var p DHCPPacket
+	err := p.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Returns the data of the first option with the given code.
+func (p *DHCPPacket) Option(code uint8) ([]byte, bool) {
+	for _, opt := range p.Options {
+		if opt.Code == code {
+			return opt.Data, true
+		}
+	}
+	return nil, false
+}
+
+// Returns an option holding an IPv4 address, such as the requested address
+// or the server identifier, or 0.
+func (p *DHCPPacket) OptionIP(code uint8) uint32 {
+	d, ok := p.Option(code)
+	if !ok || len(d) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(d)
+}
+
+// Returns the message type, or 0 for a plain BOOTP message.
+func (p *DHCPPacket) MessageType() uint8 {
+	d, ok := p.Option(DHCPOptMessageType)
+	if !ok || len(d) != 1 {
+		return 0
+	}
+	return d[0]
+}
+
+// Returns the client hardware address of an Ethernet client.
+func (p *DHCPPacket) ClientMAC() (mac [6]byte) {
+	copy(mac[:], p.CHAddr[:6])
+	return mac
+}
+
+func (p *DHCPPacket) AddOption(code uint8, data []byte) {
+	p.Options = append(p.Options, DHCPOption{code, data})
+}
+
+func (p *DHCPPacket) AddOptionIP(code uint8, addrs ...uint32) {
+	data := make([]byte, 0, 4*len(addrs))
+	for _, a := range addrs {
+		data = appendUint32(data, a)
+	}
+	p.AddOption(code, data)
+}
+
+func (p *DHCPPacket) AddOptionUint32(code uint8, v uint32) {
+	p.AddOption(code, appendUint32(nil, v))
+}
+
+func (p *DHCPPacket) appendTo(b []byte) ([]byte, error) {
+	b = append(b, p.Op, p.HType, p.HLen, p.Hops)
+	b = appendUint32(b, p.Xid)
+	b = appendUint16(b, p.Secs)
+	b = appendUint16(b, p.Flags)
+	b = appendUint32(b, p.CIAddr)
+	b = appendUint32(b, p.YIAddr)
+	b = appendUint32(b, p.SIAddr)
+	b = appendUint32(b, p.GIAddr)
+	b = append(b, p.CHAddr[:]...)
+	b = append(b, p.SName[:]...)
+	b = append(b, p.File[:]...)
+	b = appendUint32(b, dhcpMagicCookie)
+	for _, opt := range p.Options {
+		if len(opt.Data) > 255 {
+			return nil, fmt.Errorf("DHCP option %d longer than 255 bytes", opt.Code)
+		}
+		b = append(b, opt.Code, uint8(len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	return append(b, DHCPOptEnd), nil
+}
+
+// Returns the encoded message, for use as the payload of a UDPHeader.
+func (p *DHCPPacket) Bytes() ([]byte, error) {
+	return p.appendTo(make([]byte, 0, 300))
+}
+
+func (p *DHCPPacket) Write(w io.Writer) error {
+	b, err := p.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Returns a reply to p with the fields a server copies from the request.
+// The caller sets YIAddr and the options, starting with the message type.
+func (p *DHCPPacket) Reply() *DHCPPacket {
+	return &DHCPPacket{Op: BootReply, HType: p.HType, HLen: p.HLen, Xid: p.Xid,
+		Flags: p.Flags, GIAddr: p.GIAddr, CHAddr: p.CHAddr}
+}
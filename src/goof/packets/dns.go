@@ -0,0 +1,260 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const DNSPort = 53
+
+// DNS record types.
+const (
+	DNSTypeA     uint16 = 1
+	DNSTypeNS    uint16 = 2
+	DNSTypeCNAME uint16 = 5
+	DNSTypeSOA   uint16 = 6
+	DNSTypePTR   uint16 = 12
+	DNSTypeMX    uint16 = 15
+	DNSTypeTXT   uint16 = 16
+	DNSTypeAAAA  uint16 = 28
+	DNSTypeSRV   uint16 = 33
+	DNSTypeOPT   uint16 = 41
+	DNSTypeANY   uint16 = 255
+)
+
+const DNSClassIN uint16 = 1
+
+// Bits of DNSMessage.Flags.
+const (
+	DNSFlagResponse           uint16 = 0x8000
+	DNSFlagAuthoritative      uint16 = 0x0400
+	DNSFlagTruncated          uint16 = 0x0200
+	DNSFlagRecursionDesired   uint16 = 0x0100
+	DNSFlagRecursionAvailable uint16 = 0x0080
+)
+
+const dnsHeaderSize = 12
+
+// A DNS query or response (RFC 1035).
+type DNSMessage struct {
+	ID          uint16
+	Flags       uint16 // including the opcode and response code
+	Questions   []DNSQuestion
+	Answers     []DNSRecord
+	Authorities []DNSRecord
+	Additionals []DNSRecord
+}
+
+type DNSQuestion struct {
+	Name  string // without the trailing dot; "" for the root
+	Type  uint16
+	Class uint16
+}
+
+type DNSRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte // raw RDATA, referring to the decoded message
+	// The name in the RDATA of NS, CNAME, PTR and MX records, with
+	// compression resolved.
+	Target string
+}
+
+func (m *DNSMessage) IsResponse() bool {
+	return m.Flags&DNSFlagResponse != 0
+}
+
+func (m *DNSMessage) Opcode() uint8 {
+	return uint8(m.Flags>>11) & 0xf
+}
+
+// The response code; 0 means no error and 3 that the name does not exist.
+func (m *DNSMessage) RCode() uint8 {
+	return uint8(m.Flags & 0xf)
+}
+
+// Returns the address of an A record.
+func (r *DNSRecord) IPv4() (uint32, bool) {
+	if r.Type != DNSTypeA || len(r.Data) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(r.Data), true
+}
+
+// Returns the address of an AAAA record.
+func (r *DNSRecord) IPv6() (ip [16]byte, ok bool) {
+	if r.Type != DNSTypeAAAA || len(r.Data) != 16 {
+		return ip, false
+	}
+	copy(ip[:], r.Data)
+	return ip, true
+}
+
+// Decodes the possibly compressed name at offset off of msg.  Returns the
+// name and the offset following it where it appears, not where pointers
+// lead.
+func dnsName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	length := 0
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		n := int(msg[off])
+		switch n & 0xc0 {
+		case 0x00:
+			off++
+			if n == 0 {
+				if end < 0 {
+					end = off
+				}
+				return strings.Join(labels, "."), end, nil
+			}
+			if off+n > len(msg) {
+				return "", 0, io.ErrUnexpectedEOF
+			}
+			length += n + 1
+			if length > 255 {
+				return "", 0, errors.New("DNS name longer than 255 bytes")
+			}
+			labels = append(labels, string(msg[off:off+n]))
+			off += n
+		case 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, io.ErrUnexpectedEOF
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			// Every jump must go backwards, which rules out loops; the
+			// count is a second line of defense.
+			ptr := int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			if ptr >= off || jumps == 127 {
+				return "", 0, errors.New("bad DNS name compression pointer")
+			}
+			jumps++
+			off = ptr
+		default:
+			return "", 0, fmt.Errorf("bad DNS label type %#x", n&0xc0)
+		}
+	}
+}
+
+func dnsQuestion(msg []byte, off int) (DNSQuestion, int, error) {
+	var q DNSQuestion
+	var err error
+	q.Name, off, err = dnsName(msg, off)
+	if err != nil {
+		return q, 0, err
+	}
+	if off+4 > len(msg) {
+		return q, 0, io.ErrUnexpectedEOF
+	}
+	q.Type = binary.BigEndian.Uint16(msg[off:])
+	q.Class = binary.BigEndian.Uint16(msg[off+2:])
+	return q, off + 4, nil
+}
+
+func dnsRecord(msg []byte, off int) (DNSRecord, int, error) {
+	var r DNSRecord
+	q, off, err := dnsQuestion(msg, off)
+	if err != nil {
+		return r, 0, err
+	}
+	r.Name, r.Type, r.Class = q.Name, q.Type, q.Class
+	if off+6 > len(msg) {
+		return r, 0, io.ErrUnexpectedEOF
+	}
+	r.TTL = binary.BigEndian.Uint32(msg[off:])
+	length := int(binary.BigEndian.Uint16(msg[off+4:]))
+	off += 6
+	if off+length > len(msg) {
+		return r, 0, io.ErrUnexpectedEOF
+	}
+	r.Data = msg[off : off+length]
+	switch r.Type {
+	case DNSTypeNS, DNSTypeCNAME, DNSTypePTR:
+		r.Target, _, err = dnsName(msg, off)
+	case DNSTypeMX:
+		if length < 3 {
+			return r, 0, errors.New("DNS MX record too short")
+		}
+		r.Target, _, err = dnsName(msg, off+2)
+	}
+	if err != nil {
+		return r, 0, err
+	}
+	return r, off + length, nil
+}
+
+// Decodes a DNS message, i.e. the payload of a UDP datagram to or from
+// port DNSPort.
+func ParseDNS(b []byte) (*DNSMessage, error) {
+	if len(b) < dnsHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	m := &DNSMessage{ID: binary.BigEndian.Uint16(b[0:]),
+		Flags: binary.BigEndian.Uint16(b[2:])}
+	var counts [4]int
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(b[4+2*i:]))
+		// Every entry takes at least a byte, so larger counts are lies
+		// that would only make us allocate.
+		if counts[i] > len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	off := dnsHeaderSize
+	var err error
+	m.Questions = make([]DNSQuestion, counts[0])
+	for i := range m.Questions {
+		m.Questions[i], off, err = dnsQuestion(b, off)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, section := range []*[]DNSRecord{&m.Answers, &m.Authorities,
+		&m.Additionals} {
+		*section = make([]DNSRecord, counts[i+1])
+		for j := range *section {
+			(*section)[j], off, err = dnsRecord(b, off)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// Decodes a DNS message sent over TCP, where it is preceded by its length.
+func ParseDNSTCP(b []byte) (*DNSMessage, error) {
+	if len(b) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	length := int(binary.BigEndian.Uint16(b))
+	if 2+length > len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return ParseDNS(b[2 : 2+length])
+}
+
+// Decodes the DNS message carried by the frame, if it is UDP or TCP to or
+// from port DNSPort.  A TCP segment must hold a whole message.
+func (p *Packet) DNS() (*DNSMessage, error) {
+	udp, err := p.UDP()
+	if udp != nil && (udp.SrcPort == DNSPort || udp.DstPort == DNSPort) {
+		return ParseDNS(udp.Payload)
+	}
+	tcp, _ := p.TCP()
+	if tcp != nil && (tcp.SrcPort == DNSPort || tcp.DstPort == DNSPort) &&
+		len(tcp.Payload) > 0 {
+		return ParseDNSTCP(tcp.Payload)
+	}
+	return nil, err
+}
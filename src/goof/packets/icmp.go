@@ -0,0 +1,110 @@
+package packets
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// ICMP message types.
+const (
+	ICMPEchoReply        uint8 = 0
+	ICMPDestUnreachable  uint8 = 3
+	ICMPSourceQuench     uint8 = 4
+	ICMPRedirect         uint8 = 5
+	ICMPEchoRequest      uint8 = 8
+	ICMPTimeExceeded     uint8 = 11
+	ICMPParameterProblem uint8 = 12
+)
+
+// ICMPv6 message types.
+const (
+	ICMPv6DestUnreachable       uint8 = 1
+	ICMPv6PacketTooBig          uint8 = 2
+	ICMPv6TimeExceeded          uint8 = 3
+	ICMPv6ParameterProblem      uint8 = 4
+	ICMPv6EchoRequest           uint8 = 128
+	ICMPv6EchoReply             uint8 = 129
+	ICMPv6RouterSolicitation    uint8 = 133
+	ICMPv6RouterAdvertisement   uint8 = 134
+	ICMPv6NeighborSolicitation  uint8 = 135
+	ICMPv6NeighborAdvertisement uint8 = 136
+	ICMPv6Redirect              uint8 = 137
+)
+
+const ICMPHeaderSize = 8
+
+type ICMPHeader struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	ID       uint16 // echo request and reply only
+	Seq      uint16 // echo request and reply only
+	Payload  []byte // everything after the first 8 bytes
+}
+
+// ICMPv6 shares the layout of ICMP; only the type numbers differ.
+type ICMPv6Header struct {
+	ICMPHeader
+}
+
+// Decodes an ICMP message.  Payload refers to b.
+func (h *ICMPHeader) decode(b []byte) error {
+	if len(b) < ICMPHeaderSize {
+		return io.ErrUnexpectedEOF
+	}
+	h.Type = b[0]
+	h.Code = b[1]
+	h.Checksum = binary.BigEndian.Uint16(b[2:])
+	h.ID = binary.BigEndian.Uint16(b[4:])
+	h.Seq = binary.BigEndian.Uint16(b[6:])
+	h.Payload = b[ICMPHeaderSize:]
+	return nil
+}
+
+// Decodes an ICMP message, i.e. the body of an IP datagram with protocol
+// ProtocolICMP.  The returned header refers to b.
+func ParseICMP(b []byte) (*ICMPHeader, error) {
+	var h ICMPHeader
+	err := h.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Decodes an ICMPv6 message.  The returned header refers to b.
+func ParseICMPv6(b []byte) (*ICMPv6Header, error) {
+	var h ICMPv6Header
+	err := h.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Reports whether the message quotes the datagram that caused it.
+func (h *ICMPHeader) IsError() bool {
+	switch h.Type {
+	case ICMPDestUnreachable, ICMPSourceQuench, ICMPRedirect,
+		ICMPTimeExceeded, ICMPParameterProblem:
+		return true
+	}
+	return false
+}
+
+func (h *ICMPv6Header) IsError() bool {
+	return h.Type < 128
+}
+
+// Decodes the datagram quoted by an error message such as destination
+// unreachable.  Only the first 8 bytes of the original payload are quoted,
+// so the transport layer is linked from the result only when it fits (UDP
+// and ICMP do; TCP does not).
+func (h *ICMPHeader) Original() (*IPFragment, error) {
+	d := new(Decoded)
+	frag, err := d.parseIP(h.Payload)
+	if frag == nil {
+		return nil, err
+	}
+	return frag, nil
+}
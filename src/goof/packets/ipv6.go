@@ -0,0 +1,150 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const EthTypeIPv6 EthType = 0x86dd
+
+// IPv6 extension headers share the protocol number space.
+const (
+	ProtocolIPv6HopByHop Protocol = 0
+	ProtocolIPv6Route    Protocol = 43
+	ProtocolIPv6Frag     Protocol = 44
+	ProtocolIPv6NoNext   Protocol = 59
+	ProtocolIPv6DestOpts Protocol = 60
+)
+
+const IPv6HeaderSize = 40
+
+// At most this many extension headers are walked; a datagram with more is
+// rejected.
+const maxIPv6Extensions = 8
+
+type IPv6Header struct {
+	TrafficClass  uint8
+	FlowLabel     uint32
+	PayloadLength uint16
+	NextHeader    Protocol
+	HopLimit      uint8
+	SrcAddr       [16]byte
+	DstAddr       [16]byte
+}
+
+// An extension header.  Data holds the whole header, including the next
+// header and length bytes.
+type IPv6Extension struct {
+	Type Protocol
+	Data []byte
+}
+
+// An IPv6 datagram.  Body is the upper layer (*TCPHeader, *UDPHeader or
+// *ICMPv6Header), or nil if it is not decoded.
+type IPv6Packet struct {
+	*IPv6Header
+	Extensions []IPv6Extension
+	Protocol   Protocol // upper layer protocol, after the extensions
+	Body       interface{}
+}
+
+func (h *IPv6Header) decode(b []byte) error {
+	if len(b) < IPv6HeaderSize {
+		return io.ErrUnexpectedEOF
+	}
+	v := binary.BigEndian.Uint32(b[0:])
+	if v>>28 != 6 {
+		return fmt.Errorf("bad IP version %d", v>>28)
+	}
+	h.TrafficClass = uint8(v >> 20)
+	h.FlowLabel = v & 0xfffff
+	h.PayloadLength = binary.BigEndian.Uint16(b[4:])
+	h.NextHeader = Protocol(b[6])
+	h.HopLimit = b[7]
+	copy(h.SrcAddr[:], b[8:24])
+	copy(h.DstAddr[:], b[24:40])
+	return nil
+}
+
+func isIPv6Extension(p Protocol) bool {
+	switch p {
+	case ProtocolIPv6HopByHop, ProtocolIPv6Route, ProtocolIPv6Frag,
+		ProtocolIPv6DestOpts:
+		return true
+	}
+	return false
+}
+
+// Returns the fragment header fields if the datagram is a fragment.  The
+// offset is in bytes.
+func (p *IPv6Packet) Fragment() (offset uint16, more bool, id uint32, ok bool) {
+	for _, ext := range p.Extensions {
+		if ext.Type == ProtocolIPv6Frag {
+			v := binary.BigEndian.Uint16(ext.Data[2:])
+			return v &^ 7, v&1 != 0, binary.BigEndian.Uint32(ext.Data[4:]), true
+		}
+	}
+	return 0, false, 0, false
+}
+
+func (d *Decoded) parseIPv6(b []byte) (*IPv6Packet, error) {
+	rest, upper, err := d.walkIPv6(b)
+	if err != nil || !upper {
+		if d.IPv6Packet.IPv6Header == nil {
+			return nil, err
+		}
+		return &d.IPv6Packet, err
+	}
+	d.IPv6Packet.Body, err = d.parseTransport(d.IPv6Packet.Protocol, rest)
+	return &d.IPv6Packet, err
+}
+
+// Decodes an IPv6 header and its extension headers into d.  Returns the
+// upper layer bytes and whether they hold the start of the upper layer,
+// which only the first fragment does.
+func (d *Decoded) walkIPv6(b []byte) ([]byte, bool, error) {
+	d.IPv6Packet = IPv6Packet{}
+	err := d.IPv6.decode(b)
+	if err != nil {
+		return nil, false, err
+	}
+	d.IPv6Packet = IPv6Packet{IPv6Header: &d.IPv6,
+		Extensions: d.ipv6Extensions[:0]}
+	if end := IPv6HeaderSize + int(d.IPv6.PayloadLength); end <= len(b) {
+		b = b[:end]
+	}
+	rest := b[IPv6HeaderSize:]
+	next := d.IPv6.NextHeader
+	firstFragment := true
+	for isIPv6Extension(next) {
+		if len(d.IPv6Packet.Extensions) == maxIPv6Extensions {
+			return nil, false, fmt.Errorf("more than %d IPv6 extension headers",
+				maxIPv6Extensions)
+		}
+		if len(rest) < 8 {
+			return nil, false, io.ErrUnexpectedEOF
+		}
+		length := 8
+		if next != ProtocolIPv6Frag {
+			length += int(rest[1]) * 8
+		} else if binary.BigEndian.Uint16(rest[2:])&^7 != 0 {
+			firstFragment = false
+		}
+		if length > len(rest) {
+			return nil, false, io.ErrUnexpectedEOF
+		}
+		d.IPv6Packet.Extensions = append(d.IPv6Packet.Extensions,
+			IPv6Extension{next, rest[:length]})
+		next = Protocol(rest[0])
+		rest = rest[length:]
+	}
+	d.IPv6Packet.Protocol = next
+	return rest, firstFragment, nil
+}
+
+// Decodes an IPv6 datagram, i.e. the body of a frame of type EthTypeIPv6.
+// The returned packet refers to b.
+func ParseIPv6(b []byte) (*IPv6Packet, error) {
+	return new(Decoded).parseIPv6(b)
+}
@@ -0,0 +1,203 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const EthTypeLLDP EthType = 0x88cc
+
+// The nearest-bridge multicast address LLDP frames are sent to.
+var LLDPMulticastMAC = [6]byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// LLDP TLV types.
+const (
+	LLDPTLVEnd                uint8 = 0
+	LLDPTLVChassisID          uint8 = 1
+	LLDPTLVPortID             uint8 = 2
+	LLDPTLVTTL                uint8 = 3
+	LLDPTLVPortDescription    uint8 = 4
+	LLDPTLVSystemName         uint8 = 5
+	LLDPTLVSystemDescription  uint8 = 6
+	LLDPTLVSystemCapabilities uint8 = 7
+	LLDPTLVManagementAddress  uint8 = 8
+	LLDPTLVOrgSpecific        uint8 = 127
+)
+
+// Chassis ID subtypes.
+const (
+	LLDPChassisComponent      uint8 = 1
+	LLDPChassisInterfaceAlias uint8 = 2
+	LLDPChassisPortComponent  uint8 = 3
+	LLDPChassisMAC            uint8 = 4
+	LLDPChassisNetworkAddr    uint8 = 5
+	LLDPChassisInterfaceName  uint8 = 6
+	LLDPChassisLocal          uint8 = 7
+)
+
+// Port ID subtypes.
+const (
+	LLDPPortInterfaceAlias uint8 = 1
+	LLDPPortComponent      uint8 = 2
+	LLDPPortMAC            uint8 = 3
+	LLDPPortNetworkAddr    uint8 = 4
+	LLDPPortInterfaceName  uint8 = 5
+	LLDPPortAgentCircuitID uint8 = 6
+	LLDPPortLocal          uint8 = 7
+)
+
+// An LLDP data unit (IEEE 802.1AB).  Value slices refer to the decoded
+// frame.
+type LLDPPacket struct {
+	ChassisIDSubtype  uint8
+	ChassisID         []byte
+	PortIDSubtype     uint8
+	PortID            []byte
+	TTL               uint16 // seconds
+	PortDescription   string
+	SystemName        string
+	SystemDescription string
+	OrgSpecific       []LLDPOrgTLV
+	Other             []LLDPTLV // TLVs of any other type, in order
+}
+
+type LLDPTLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// An organizationally specific TLV.
+type LLDPOrgTLV struct {
+	OUI     [3]byte
+	Subtype uint8
+	Info    []byte
+}
+
+func (p *LLDPPacket) decode(b []byte) error {
+	*p = LLDPPacket{}
+	for i := 0; ; i++ {
+		if len(b) < 2 {
+			return io.ErrUnexpectedEOF
+		}
+		t := b[0] >> 1
+		length := int(b[0]&1)<<8 | int(b[1])
+		if 2+length > len(b) {
+			return io.ErrUnexpectedEOF
+		}
+		v := b[2 : 2+length]
+		b = b[2+length:]
+		// The first three TLVs are mandatory and in order.
+		want := [...]uint8{LLDPTLVChassisID, LLDPTLVPortID, LLDPTLVTTL}
+		if i < len(want) && t != want[i] {
+			return fmt.Errorf("LLDP TLV %d is of type %d, want %d", i, t, want[i])
+		}
+		switch t {
+		case LLDPTLVEnd:
+			return nil
+		case LLDPTLVChassisID, LLDPTLVPortID:
+			if len(v) < 2 {
+				return fmt.Errorf("LLDP TLV %d too short", t)
+			}
+			if t == LLDPTLVChassisID {
+				p.ChassisIDSubtype, p.ChassisID = v[0], v[1:]
+			} else {
+				p.PortIDSubtype, p.PortID = v[0], v[1:]
+			}
+		case LLDPTLVTTL:
+			if len(v) < 2 {
+				return errors.New("LLDP TTL too short")
+			}
+			p.TTL = uint16(v[0])<<8 | uint16(v[1])
+		case LLDPTLVPortDescription:
+			p.PortDescription = string(v)
+		case LLDPTLVSystemName:
+			p.SystemName = string(v)
+		case LLDPTLVSystemDescription:
+			p.SystemDescription = string(v)
+		case LLDPTLVOrgSpecific:
+			if len(v) < 4 {
+				return errors.New("LLDP organizationally specific TLV too short")
+			}
+			p.OrgSpecific = append(p.OrgSpecific,
+				LLDPOrgTLV{[3]byte{v[0], v[1], v[2]}, v[3], v[4:]})
+		default:
+			p.Other = append(p.Other, LLDPTLV{t, v})
+		}
+	}
+}
+
+// Decodes an LLDP data unit, i.e. the body of a frame of type EthTypeLLDP.
+func ParseLLDP(b []byte) (*LLDPPacket, error) {
+	var p LLDPPacket
+	err := p.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func appendTLV(b []byte, t uint8, values ...[]byte) []byte {
+	length := 0
+	for _, v := range values {
+		length += len(v)
+	}
+	b = append(b, t<<1|uint8(length>>8), uint8(length))
+	for _, v := range values {
+		b = append(b, v...)
+	}
+	return b
+}
+
+func (p *LLDPPacket) appendTo(b []byte) ([]byte, error) {
+	if len(p.ChassisID) == 0 || len(p.PortID) == 0 {
+		return nil, errors.New("LLDP chassis and port IDs are mandatory")
+	}
+	// TLV values are at most 511 bytes; IDs have a subtype byte and
+	// organizationally specific TLVs four bytes in front.
+	long := len(p.ChassisID) > 510 || len(p.PortID) > 510 ||
+		len(p.PortDescription) > 511 || len(p.SystemName) > 511 ||
+		len(p.SystemDescription) > 511
+	for _, tlv := range p.OrgSpecific {
+		long = long || len(tlv.Info) > 507
+	}
+	for _, tlv := range p.Other {
+		long = long || len(tlv.Value) > 511
+	}
+	if long {
+		return nil, errors.New("LLDP TLV longer than 511 bytes")
+	}
+	b = appendTLV(b, LLDPTLVChassisID, []byte{p.ChassisIDSubtype}, p.ChassisID)
+	b = appendTLV(b, LLDPTLVPortID, []byte{p.PortIDSubtype}, p.PortID)
+	b = appendTLV(b, LLDPTLVTTL, []byte{byte(p.TTL >> 8), byte(p.TTL)})
+	if p.PortDescription != "" {
+		b = appendTLV(b, LLDPTLVPortDescription, []byte(p.PortDescription))
+	}
+	if p.SystemName != "" {
+		b = appendTLV(b, LLDPTLVSystemName, []byte(p.SystemName))
+	}
+	if p.SystemDescription != "" {
+		b = appendTLV(b, LLDPTLVSystemDescription, []byte(p.SystemDescription))
+	}
+	for _, tlv := range p.Other {
+		b = appendTLV(b, tlv.Type, tlv.Value)
+	}
+	for _, tlv := range p.OrgSpecific {
+		b = appendTLV(b, LLDPTLVOrgSpecific, tlv.OUI[:], []byte{tlv.Subtype}, tlv.Info)
+	}
+	return appendTLV(b, LLDPTLVEnd), nil
+}
+
+func (p *LLDPPacket) Write(w io.Writer) error {
+	b, err := p.appendTo(nil)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Returns the frame carrying p from src to the LLDP multicast address.
+func (p *LLDPPacket) Frame(src [6]byte) *EthFrame {
+	return NewEthFrame(src, LLDPMulticastMAC, p)
+}
@@ -0,0 +1,128 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Neighbor discovery option types (RFC 4861).
+const (
+	NDOptionSourceLinkAddr   uint8 = 1
+	NDOptionTargetLinkAddr   uint8 = 2
+	NDOptionPrefixInfo       uint8 = 3
+	NDOptionRedirectedHeader uint8 = 4
+	NDOptionMTU              uint8 = 5
+)
+
+// Flags of router and neighbor advertisements, as found in NDMessage.Flags.
+const (
+	NDRouterManaged    uint8 = 0x80 // router advertisement
+	NDRouterOther      uint8 = 0x40 // router advertisement
+	NDNeighborRouter   uint8 = 0x80 // neighbor advertisement
+	NDNeighborSolicit  uint8 = 0x40 // neighbor advertisement
+	NDNeighborOverride uint8 = 0x20 // neighbor advertisement
+)
+
+// A neighbor discovery message: router solicitation or advertisement,
+// neighbor solicitation or advertisement, or redirect.  Fields that the
+// message type does not carry are zero.
+type NDMessage struct {
+	Type           uint8
+	Flags          uint8
+	CurHopLimit    uint8    // router advertisement
+	RouterLifetime uint16   // router advertisement, seconds
+	ReachableTime  uint32   // router advertisement, milliseconds
+	RetransTimer   uint32   // router advertisement, milliseconds
+	Target         [16]byte // neighbor messages and redirect
+	Destination    [16]byte // redirect
+	Options        []NDOption
+}
+
+// Data excludes the type and length bytes.
+type NDOption struct {
+	Type uint8
+	Data []byte
+}
+
+// Decodes the neighbor discovery message carried by h.  Options refer to
+// the payload of h.
+func ParseND(h *ICMPv6Header) (*NDMessage, error) {
+	m := &NDMessage{Type: h.Type}
+	b := h.Payload
+	var fixed int
+	switch h.Type {
+	case ICMPv6RouterSolicitation:
+	case ICMPv6RouterAdvertisement:
+		m.CurHopLimit = uint8(h.ID >> 8)
+		m.Flags = uint8(h.ID)
+		m.RouterLifetime = h.Seq
+		fixed = 8
+	case ICMPv6NeighborSolicitation:
+		fixed = 16
+	case ICMPv6NeighborAdvertisement:
+		m.Flags = uint8(h.ID >> 8)
+		fixed = 16
+	case ICMPv6Redirect:
+		fixed = 32
+	default:
+		return nil, fmt.Errorf("ICMPv6 type %d is not neighbor discovery", h.Type)
+	}
+	if len(b) < fixed {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch h.Type {
+	case ICMPv6RouterAdvertisement:
+		m.ReachableTime = binary.BigEndian.Uint32(b[0:])
+		m.RetransTimer = binary.BigEndian.Uint32(b[4:])
+	case ICMPv6NeighborSolicitation, ICMPv6NeighborAdvertisement:
+		copy(m.Target[:], b[0:16])
+	case ICMPv6Redirect:
+		copy(m.Target[:], b[0:16])
+		copy(m.Destination[:], b[16:32])
+	}
+	for b = b[fixed:]; len(b) > 0; {
+		if len(b) < 2 || b[1] == 0 || int(b[1])*8 > len(b) {
+			return nil, fmt.Errorf("bad neighbor discovery option")
+		}
+		length := int(b[1]) * 8
+		m.Options = append(m.Options, NDOption{b[0], b[2:length]})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+func (m *NDMessage) option(t uint8) ([]byte, bool) {
+	for _, opt := range m.Options {
+		if opt.Type == t {
+			return opt.Data, true
+		}
+	}
+	return nil, false
+}
+
+func (m *NDMessage) linkAddr(t uint8) ([6]byte, bool) {
+	var mac [6]byte
+	d, ok := m.option(t)
+	if !ok || len(d) < 6 {
+		return mac, false
+	}
+	copy(mac[:], d)
+	return mac, true
+}
+
+func (m *NDMessage) SourceLinkAddr() ([6]byte, bool) {
+	return m.linkAddr(NDOptionSourceLinkAddr)
+}
+
+func (m *NDMessage) TargetLinkAddr() ([6]byte, bool) {
+	return m.linkAddr(NDOptionTargetLinkAddr)
+}
+
+func (m *NDMessage) MTU() (uint32, bool) {
+	d, ok := m.option(NDOptionMTU)
+	if !ok || len(d) < 6 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(d[2:]), true
+}
@@ -0,0 +1,219 @@
+package packets
+
+// Layers of a Packet that have been decoded.
+const (
+	layerEthernet = 1 << iota
+	layerNetwork
+	layerTransport
+)
+
+// A Packet is a view of a frame that decodes each layer only when it is
+// first asked for.  Payloads returned by its accessors refer to the frame
+// rather than copies of it.  A Packet is reused by calling Reset, after
+// which nothing returned by it before is valid; a long-lived Packet decodes
+// frames without allocating.
+//
+// Accessors for a layer the frame does not carry return nil and no error.
+type Packet struct {
+	data    []byte
+	decoded uint8
+
+	d        Decoded
+	tags     []VLANTag
+	l3Offset int
+	ethErr   error
+
+	network interface{} // *IPHeader, *IPv6Packet, *ARPPacket or *LLDPPacket
+	l4      []byte
+	l4Proto Protocol
+	hasL4   bool
+	netErr  error
+
+	transport interface{}
+	l4Err     error
+}
+
+// Returns a view of data.
+func NewPacket(data []byte) *Packet {
+	p := new(Packet)
+	p.Reset(data)
+	return p
+}
+
+// Makes p a view of data, discarding everything decoded so far.
+func (p *Packet) Reset(data []byte) {
+	p.data = data
+	p.decoded = 0
+	p.tags = nil
+	p.l3Offset = 0
+	p.ethErr = nil
+	p.network = nil
+	p.l4 = nil
+	p.l4Proto = 0
+	p.hasL4 = false
+	p.netErr = nil
+	p.transport = nil
+	p.l4Err = nil
+}
+
+// Returns the frame p is a view of.
+func (p *Packet) Data() []byte {
+	return p.data
+}
+
+// Returns the destination MAC address without decoding anything, or the
+// zero address if the frame is too short.
+func (p *Packet) DstMAC() (mac [6]byte) {
+	if len(p.data) >= 6 {
+		copy(mac[:], p.data[0:6])
+	}
+	return mac
+}
+
+// Returns the source MAC address without decoding anything, or the zero
+// address if the frame is too short.
+func (p *Packet) SrcMAC() (mac [6]byte) {
+	if len(p.data) >= 12 {
+		copy(mac[:], p.data[6:12])
+	}
+	return mac
+}
+
+// Returns the Ethernet header, whose Type is that of the payload after any
+// VLAN tags.
+func (p *Packet) Ethernet() (*EthernetHeader, error) {
+	if p.decoded&layerEthernet == 0 {
+		p.decoded |= layerEthernet
+		p.tags, p.l3Offset, p.ethErr = p.d.Ethernet.decode(p.data, p.d.tags[:0])
+		if len(p.tags) == 0 {
+			p.tags = nil
+		}
+	}
+	if p.l3Offset == 0 {
+		return nil, p.ethErr
+	}
+	return &p.d.Ethernet, p.ethErr
+}
+
+// Returns the VLAN tags of the frame, outermost first.
+func (p *Packet) Tags() ([]VLANTag, error) {
+	_, err := p.Ethernet()
+	return p.tags, err
+}
+
+// Returns the bytes following the Ethernet header and VLAN tags.
+func (p *Packet) Payload() ([]byte, error) {
+	_, err := p.Ethernet()
+	if err != nil {
+		return nil, err
+	}
+	return p.data[p.l3Offset:], nil
+}
+
+func (p *Packet) decodeNetwork() error {
+	if p.decoded&layerNetwork != 0 {
+		return p.netErr
+	}
+	p.decoded |= layerNetwork
+	b, err := p.Payload()
+	if err != nil {
+		p.netErr = err
+		return err
+	}
+	switch p.d.Ethernet.Type {
+	case EthTypeIP:
+		p.l4, p.netErr = p.d.decodeIP(b)
+		if p.netErr == nil {
+			p.network = &p.d.IP
+			p.l4Proto = p.d.IP.Protocol
+			p.hasL4 = p.d.IP.FragmentOffset() == 0
+		}
+	case EthTypeIPv6:
+		p.l4, p.hasL4, p.netErr = p.d.walkIPv6(b)
+		if p.d.IPv6Packet.IPv6Header != nil {
+			p.network = &p.d.IPv6Packet
+			p.l4Proto = p.d.IPv6Packet.Protocol
+		}
+	case EthTypeARP:
+		p.netErr = p.d.ARP.decode(b)
+		if p.netErr == nil {
+			p.network = &p.d.ARP
+		}
+	case EthTypeLLDP:
+		p.netErr = p.d.LLDP.decode(b)
+		if p.netErr == nil {
+			p.network = &p.d.LLDP
+		}
+	}
+	return p.netErr
+}
+
+// Returns the IPv4 header, options included.
+func (p *Packet) IPv4() (*IPHeader, error) {
+	err := p.decodeNetwork()
+	h, _ := p.network.(*IPHeader)
+	return h, err
+}
+
+// Returns the IPv6 header and extension headers.  The Body of the result is
+// not filled in; use the transport accessors.
+func (p *Packet) IPv6() (*IPv6Packet, error) {
+	err := p.decodeNetwork()
+	h, _ := p.network.(*IPv6Packet)
+	return h, err
+}
+
+func (p *Packet) ARP() (*ARPPacket, error) {
+	err := p.decodeNetwork()
+	h, _ := p.network.(*ARPPacket)
+	return h, err
+}
+
+func (p *Packet) LLDP() (*LLDPPacket, error) {
+	err := p.decodeNetwork()
+	h, _ := p.network.(*LLDPPacket)
+	return h, err
+}
+
+func (p *Packet) decodeTransport() error {
+	if p.decoded&layerTransport != 0 {
+		return p.l4Err
+	}
+	p.decoded |= layerTransport
+	p.l4Err = p.decodeNetwork()
+	if p.l4Err != nil || !p.hasL4 {
+		return p.l4Err
+	}
+	p.transport, p.l4Err = p.d.parseTransport(p.l4Proto, p.l4)
+	return p.l4Err
+}
+
+func (p *Packet) TCP() (*TCPHeader, error) {
+	err := p.decodeTransport()
+	h, _ := p.transport.(*TCPHeader)
+	return h, err
+}
+
+func (p *Packet) UDP() (*UDPHeader, error) {
+	err := p.decodeTransport()
+	h, _ := p.transport.(*UDPHeader)
+	return h, err
+}
+
+func (p *Packet) ICMP() (*ICMPHeader, error) {
+	err := p.decodeTransport()
+	h, _ := p.transport.(*ICMPHeader)
+	return h, err
+}
+
+func (p *Packet) ICMPv6() (*ICMPv6Header, error) {
+	err := p.decodeTransport()
+	h, _ := p.transport.(*ICMPv6Header)
+	return h, err
+}
+
+// Decodes every layer and returns them as a frame, as Parse does.  The
+// result shares storage with p.
+func (p *Packet) Frame() (*EthFrame, error) {
+	return p.d.Parse(p.data)
+}
@@ -3,14 +3,38 @@ package packets
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
   "io"
 )
 
 type EthType uint16
 const EthTypeIP EthType = 0x0800
 
+// IP protocol numbers, as found in IPHeader.Protocol.
 type Protocol uint8
-const ProtocolTCP = 8
+const (
+	ProtocolICMP   Protocol = 1
+	ProtocolTCP    Protocol = 6
+	ProtocolUDP    Protocol = 17
+	ProtocolGRE    Protocol = 47
+	ProtocolICMPv6 Protocol = 58
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolICMP:
+		return "ICMP"
+	case ProtocolTCP:
+		return "TCP"
+	case ProtocolUDP:
+		return "UDP"
+	case ProtocolGRE:
+		return "GRE"
+	case ProtocolICMPv6:
+		return "ICMPv6"
+	}
+	return fmt.Sprintf("protocol %d", uint8(p))
+}
 
 type IPHeader struct {
 	VersionIHL      uint8 // version and IHL fields
@@ -23,19 +47,33 @@ type IPHeader struct {
 	HeaderChecksum  uint16
 	SrcAddr         uint32
 	DstAddr         uint32
+	Options         []byte
 }
 
 const IPHeaderSize = 20
 
+// Flags in IPHeader.FlagsFragoffset.
+const (
+	IPDontFragment  uint16 = 0x4000
+	IPMoreFragments uint16 = 0x2000
+)
+
+// Returns the offset of the fragment's data in the original datagram, in
+// bytes.
+func (h *IPHeader) FragmentOffset() int {
+	return int(h.FlagsFragoffset&0x1fff) * 8
+}
+
+// Reports whether the datagram is a piece of a larger one.  Only the first
+// fragment, at offset 0, carries the transport header.
+func (h *IPHeader) IsFragment() bool {
+	return h.FlagsFragoffset&IPMoreFragments != 0 || h.FragmentOffset() != 0
+}
+
 type EthernetHeader struct {
 	DstMAC [6]byte
 	SrcMAC [6]byte
-	Type   EthType
-}
-
-type TCPHeader struct {
-	SrcPort uint16
-	DstPort uint16
+	Type   EthType // of the payload, after any VLAN tags
 }
 
 type IPFragment struct {
@@ -43,53 +81,220 @@ type IPFragment struct {
   Body interface{}
 }
 
+// A frame and its VLAN tags, outermost first.
 type EthFrame struct {
 	*EthernetHeader
+	Tags []VLANTag
   Body interface{}
 }
 
-func ParseTCPHeader(buf io.Reader, h *IPHeader) (*TCPHeader, error) {
-  switch h.Protocol {
-  case ProtocolTCP:
-		var tcp TCPHeader
-		err := binary.Read(buf, binary.BigEndian, &tcp)
-		if err != nil {
-			return nil, err
-		}
-		return &tcp, nil
-  }
-  
-  return nil, nil
+const ethernetHeaderSize = 14
+
+// Decodes the MAC addresses and VLAN tags of a frame, appending the tags to
+// tags.  Returns the tags and the length of the header.
+func (h *EthernetHeader) decode(b []byte, tags []VLANTag) ([]VLANTag, int, error) {
+	if len(b) < ethernetHeaderSize {
+		return tags, 0, io.ErrUnexpectedEOF
+	}
+	copy(h.DstMAC[:], b[0:6])
+	copy(h.SrcMAC[:], b[6:12])
+	tags, t, headerLen, err := decodeVLANTags(b, tags)
+	h.Type = t
+	return tags, headerLen, err
 }
 
-func ParseIPFragment(buf io.Reader, h *EthernetHeader) (*IPFragment, error) {
-	switch h.Type {
+// Decodes the fixed part of an IPv4 header and returns the length of the
+// header including options.
+func (h *IPHeader) decode(b []byte) (int, error) {
+	if len(b) < IPHeaderSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	h.VersionIHL = b[0]
+	h.TOS = b[1]
+	h.TotalLength = binary.BigEndian.Uint16(b[2:])
+	h.Identification = binary.BigEndian.Uint16(b[4:])
+	h.FlagsFragoffset = binary.BigEndian.Uint16(b[6:])
+	h.TTL = b[8]
+	h.Protocol = Protocol(b[9])
+	h.HeaderChecksum = binary.BigEndian.Uint16(b[10:])
+	h.SrcAddr = binary.BigEndian.Uint32(b[12:])
+	h.DstAddr = binary.BigEndian.Uint32(b[16:])
+	if h.VersionIHL>>4 != 4 {
+		return 0, fmt.Errorf("bad IP version %d", h.VersionIHL>>4)
+	}
+	headerLen := int(h.VersionIHL&0xf) << 2
+	if headerLen < IPHeaderSize {
+		return 0, fmt.Errorf("bad IP header length %d", headerLen)
+	}
+	if headerLen > len(b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	h.Options = b[IPHeaderSize:headerLen]
+	return headerLen, nil
+}
+
+// Storage for every layer of one frame.  Parsing into a Decoded reuses its
+// storage, so a long-lived Decoded parses frames without allocating; the
+// result of Parse is only valid until the next call.
+type Decoded struct {
+	Frame    EthFrame
+	Ethernet EthernetHeader
+	Fragment IPFragment
+	IP       IPHeader
+	TCP      TCPHeader
+	UDP      UDPHeader
+	ICMP     ICMPHeader
+	ARP      ARPPacket
+	LLDP     LLDPPacket
+
+	tags [maxVLANTags]VLANTag
+
+	IPv6           IPv6Header
+	IPv6Packet     IPv6Packet
+	ICMPv6         ICMPv6Header
+	ipv6Extensions [maxIPv6Extensions]IPv6Extension
+
+	GRE   GREHeader
+	VXLAN VXLANHeader
+	inner *Decoded // the encapsulated frame or datagram of a tunnel
+	depth int      // of tunnels around the frame d holds
+}
+
+// Parses an Ethernet frame into d.  On error, the layers that were decoded
+// before the error are still linked from the returned frame.
+func (d *Decoded) Parse(body []byte) (*EthFrame, error) {
+	tags, headerLen, err := d.Ethernet.decode(body, d.tags[:0])
+	if headerLen == 0 {
+		return nil, err
+	}
+	d.Frame = EthFrame{EthernetHeader: &d.Ethernet, Tags: tags}
+	if len(tags) == 0 {
+		d.Frame.Tags = nil
+	}
+	if err != nil {
+		return &d.Frame, err
+	}
+	rest := body[headerLen:]
+	switch d.Ethernet.Type {
 	case EthTypeIP:
-		var ip IPHeader
-		err := binary.Read(buf, binary.BigEndian, &ip)
-		if err != nil {
-			return nil, err
+		var frag *IPFragment
+		frag, err = d.parseIP(rest)
+		if frag != nil {
+			d.Frame.Body = frag
+		}
+	case EthTypeIPv6:
+		var pkt *IPv6Packet
+		pkt, err = d.parseIPv6(rest)
+		if pkt != nil {
+			d.Frame.Body = pkt
+		}
+	case EthTypeARP:
+		err = d.ARP.decode(rest)
+		if err == nil {
+			d.Frame.Body = &d.ARP
+		}
+	case EthTypeLLDP:
+		err = d.LLDP.decode(rest)
+		if err == nil {
+			d.Frame.Body = &d.LLDP
 		}
-		optionsLen := ((ip.VersionIHL & 0xf) << 2) - IPHeaderSize
-		options := make([]byte, optionsLen)
-		buf.Read(options) // TODO: error checking?
-    
-    frag := &IPFragment{&ip, nil}
-    frag.Body, err = ParseTCPHeader(buf, &ip)
-    return frag, err
 	}
+	return &d.Frame, err
+}
 
-  return nil, nil
+func (d *Decoded) parseIP(b []byte) (*IPFragment, error) {
+	rest, err := d.decodeIP(b)
+	if err != nil {
+		return nil, err
+	}
+	if d.IP.FragmentOffset() != 0 {
+		return &d.Fragment, nil // only the first fragment has the transport header
+	}
+	d.Fragment.Body, err = d.parseTransport(d.IP.Protocol, rest)
+	return &d.Fragment, err
 }
 
-func Parse(body []byte) (frame *EthFrame, err error) {
-	buf := bytes.NewBuffer(body)
-	var eth EthernetHeader
-	err = binary.Read(buf, binary.BigEndian, &eth)
+// Decodes an IPv4 header into d and returns the payload of the datagram.
+func (d *Decoded) decodeIP(b []byte) ([]byte, error) {
+	headerLen, err := d.IP.decode(b)
 	if err != nil {
-		return
+		return nil, err
+	}
+	d.Fragment = IPFragment{&d.IP, nil}
+	// Frames shorter than the Ethernet minimum are padded; the padding is
+	// not part of the datagram.
+	if int(d.IP.TotalLength) >= headerLen && int(d.IP.TotalLength) <= len(b) {
+		b = b[:d.IP.TotalLength]
 	}
-  frame = &EthFrame{&eth, nil}
-  frame.Body, err = ParseIPFragment(buf, &eth)
-  return frame, err
+	return b[headerLen:], nil
+}
+
+// Decodes the transport layer of an IPv4 or IPv6 datagram.  The result is
+// nil if the protocol is not decoded or on error.  b may be cut short, by
+// fragmentation or by the switch, in which case so is a UDP payload.
+func (d *Decoded) parseTransport(p Protocol, b []byte) (interface{}, error) {
+	var err error
+	switch p {
+	case ProtocolTCP:
+		if err = d.TCP.decode(b); err == nil {
+			return &d.TCP, nil
+		}
+	case ProtocolUDP:
+		if err = d.UDP.decode(b); err == nil {
+			if d.UDP.DstPort == VXLANPort {
+				d.parseVXLAN()
+			}
+			return &d.UDP, nil
+		}
+	case ProtocolGRE:
+		return d.parseGRE(b)
+	case ProtocolICMP:
+		if err = d.ICMP.decode(b); err == nil {
+			return &d.ICMP, nil
+		}
+	case ProtocolICMPv6:
+		if err = d.ICMPv6.decode(b); err == nil {
+			return &d.ICMPv6, nil
+		}
+	}
+	return nil, err
+}
+
+// Reads the rest of buf for the io.Reader based parsers below.
+func readAll(buf io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	_, err := b.ReadFrom(buf)
+	return b.Bytes(), err
+}
+
+func ParseTCPHeader(buf io.Reader, h *IPHeader) (*TCPHeader, error) {
+	if h.Protocol != ProtocolTCP {
+		return nil, nil
+	}
+	b, err := readAll(buf)
+	if err != nil {
+		return nil, err
+	}
+	var tcp TCPHeader
+	err = tcp.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &tcp, nil
+}
+
+func ParseIPFragment(buf io.Reader, h *EthernetHeader) (*IPFragment, error) {
+	if h.Type != EthTypeIP {
+		return nil, nil
+	}
+	b, err := readAll(buf)
+	if err != nil {
+		return nil, err
+	}
+	return new(Decoded).parseIP(b)
+}
+
+// Parses an Ethernet frame and the layers it carries.
+func Parse(body []byte) (frame *EthFrame, err error) {
+	return new(Decoded).Parse(body)
 }
@@ -0,0 +1,790 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var (
+	arpFrame = mustHex("ffffffffffff0000000000010806" +
+		"00010800060400010000000000010a000001" + "0000000000000a000002")
+	tcpFrame = mustHex("000000000002000000000001" + "0800" +
+		"450000280001000040060000" + "0a000001" + "0a000002" +
+		"04000050" + "00000000" + "00000000" + "50022000" + "00000000")
+)
+
+func TestParseTCP(t *testing.T) {
+	frame, err := Parse(tcpFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frag, ok := frame.Body.(*IPFragment)
+	if !ok || frag.SrcAddr != 0x0a000001 || frag.DstAddr != 0x0a000002 {
+		t.Fatalf("bad IP layer %+v", frame.Body)
+	}
+	tcp, ok := frag.Body.(*TCPHeader)
+	if !ok || tcp.SrcPort != 1024 || tcp.DstPort != 80 || tcp.Flags != TCPSyn {
+		t.Fatalf("bad TCP layer %+v", frag.Body)
+	}
+}
+
+func TestParseRejectsBadIHL(t *testing.T) {
+	b := append([]byte(nil), tcpFrame...)
+	b[14] = 0x44 // IHL below the minimum header size
+	_, err := Parse(b)
+	if err == nil {
+		t.Error("accepted an IP header shorter than 20 bytes")
+	}
+	b[14] = 0x4f // options running past the end of the frame
+	_, err = Parse(b[:40])
+	if err == nil {
+		t.Error("accepted IP options past the end of the frame")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(arpFrame)
+	f.Add(tcpFrame)
+	f.Add(tcpFrame[:20])
+	f.Add(udpFrame)
+	f.Add(icmpFrame)
+	f.Add(nsFrame)
+	f.Add(lldpFrame)
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Parse(data)
+	})
+}
+
+func TestParseARP(t *testing.T) {
+	frame, err := Parse(arpFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arp, ok := frame.Body.(*ARPPacket)
+	if !ok {
+		t.Fatalf("body is %T, want *ARPPacket", frame.Body)
+	}
+	want := NewARPRequest([6]byte{0, 0, 0, 0, 0, 1}, 0x0a000001, 0x0a000002)
+	if *arp != *want {
+		t.Errorf("parsed %+v, want %+v", arp, want)
+	}
+	if b := want.FrameBytes(); !bytes.Equal(b, arpFrame) {
+		t.Errorf("serialized as %x, want %x", b, arpFrame)
+	}
+}
+
+func TestARPReply(t *testing.T) {
+	req := NewARPRequest([6]byte{0, 0, 0, 0, 0, 1}, 0x0a000001, 0x0a000002)
+	mac := [6]byte{0, 0, 0, 0, 0, 2}
+	frame, err := Parse(NewARPReply(req, mac).FrameBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := frame.Body.(*ARPPacket)
+	if frame.DstMAC != req.SenderHW || frame.SrcMAC != mac {
+		t.Errorf("reply addressed %v -> %v", frame.SrcMAC, frame.DstMAC)
+	}
+	if reply.Operation != ARPReply || reply.SenderIP != 0x0a000002 ||
+		reply.TargetIP != 0x0a000001 || reply.TargetHW != req.SenderHW {
+		t.Errorf("bad reply %+v", reply)
+	}
+}
+
+func TestParseTCPOptions(t *testing.T) {
+	// A SYN with MSS, SACK permitted, timestamps, NOP and window scale.
+	syn := mustHex("c00000500000006400000000" + "a0022000" + "00000000" +
+		"020405b4" + "0402" + "080a0000000100000000" + "01" + "030307" + "6869")
+	tcp, err := ParseTCP(syn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcp.SrcPort != 0xc000 || tcp.DstPort != 80 || tcp.Seq != 100 ||
+		tcp.Flags != TCPSyn || tcp.Window != 0x2000 {
+		t.Errorf("bad header %+v", tcp)
+	}
+	if !tcp.HasFlags(TCPSyn) || tcp.HasFlags(TCPSyn|TCPAck) {
+		t.Errorf("flags %v", tcp.Flags)
+	}
+	if mss, ok := tcp.MSS(); !ok || mss != 1460 {
+		t.Errorf("MSS %d, %v", mss, ok)
+	}
+	if ws, ok := tcp.WindowScale(); !ok || ws != 7 {
+		t.Errorf("window scale %d, %v", ws, ok)
+	}
+	if val, echo, ok := tcp.Timestamps(); !ok || val != 1 || echo != 0 {
+		t.Errorf("timestamps %d %d %v", val, echo, ok)
+	}
+	if !tcp.SACKPermitted() || tcp.SACK() != nil {
+		t.Error("bad SACK options")
+	}
+	if string(tcp.Payload) != "hi" {
+		t.Errorf("payload %q", tcp.Payload)
+	}
+	opts, err := ParseTCPOptions(tcp.Options)
+	if err != nil || len(opts) != 4 {
+		t.Errorf("options %v, %v", opts, err)
+	}
+	syn[12] = 0x40 // data offset below the minimum
+	if _, err = ParseTCP(syn); err == nil {
+		t.Error("accepted a data offset of 4")
+	}
+}
+
+var (
+	udpFrame = mustHex("000000000002000000000001" + "0800" +
+		"4500001f0002000040110000" + "0a000001" + "0a000002" +
+		"d4310035000b0000" + "787878" + "0000000000000000000000000000")
+	// Port unreachable for the datagram in udpFrame.
+	icmpFrame = mustHex("000000000001000000000002" + "0800" +
+		"450000380003000040010000" + "0a000002" + "0a000001" +
+		"0303000000000000" + "4500001f0002000040110000" + "0a000001" +
+		"0a000002" + "d4310035000b0000")
+)
+
+func TestParseUDP(t *testing.T) {
+	frame, err := Parse(udpFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, ok := frame.Body.(*IPFragment).Body.(*UDPHeader)
+	if !ok {
+		t.Fatalf("body is %T, want *UDPHeader", frame.Body.(*IPFragment).Body)
+	}
+	if udp.SrcPort != 0xd431 || udp.DstPort != 53 || string(udp.Payload) != "xxx" {
+		t.Errorf("bad UDP layer %+v", udp)
+	}
+}
+
+func TestParseICMPUnreachable(t *testing.T) {
+	frame, err := Parse(icmpFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	icmp, ok := frame.Body.(*IPFragment).Body.(*ICMPHeader)
+	if !ok {
+		t.Fatalf("body is %T, want *ICMPHeader", frame.Body.(*IPFragment).Body)
+	}
+	if icmp.Type != ICMPDestUnreachable || icmp.Code != 3 || !icmp.IsError() {
+		t.Errorf("bad ICMP layer %+v", icmp)
+	}
+	orig, err := icmp.Original()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, ok := orig.Body.(*UDPHeader)
+	if orig.DstAddr != 0x0a000002 || !ok || udp.DstPort != 53 {
+		t.Errorf("bad quoted datagram %+v", orig)
+	}
+}
+
+func TestParseICMPEcho(t *testing.T) {
+	icmp, err := ParseICMP(mustHex("0800000012340001" + "6162"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if icmp.Type != ICMPEchoRequest || icmp.ID != 0x1234 || icmp.Seq != 1 ||
+		string(icmp.Payload) != "ab" || icmp.IsError() {
+		t.Errorf("bad echo request %+v", icmp)
+	}
+}
+
+// A neighbor solicitation for fe80::2 from fe80::1, behind a hop-by-hop
+// options header.
+var nsFrame = mustHex("333300000002000000000001" + "86dd" +
+	"60000000002800ff" + "fe800000000000000000000000000001" +
+	"ff020000000000000000000000000002" +
+	"3a00010000000000" + // hop-by-hop: next ICMPv6, padding
+	"8700000000000000" + "fe800000000000000000000000000002" +
+	"0101000000000001")
+
+func TestParseIPv6ND(t *testing.T) {
+	frame, err := Parse(nsFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, ok := frame.Body.(*IPv6Packet)
+	if !ok {
+		t.Fatalf("body is %T, want *IPv6Packet", frame.Body)
+	}
+	if pkt.HopLimit != 255 || pkt.SrcAddr[15] != 1 || pkt.Protocol != ProtocolICMPv6 ||
+		len(pkt.Extensions) != 1 || pkt.Extensions[0].Type != ProtocolIPv6HopByHop {
+		t.Errorf("bad IPv6 layer %+v", pkt)
+	}
+	icmp, ok := pkt.Body.(*ICMPv6Header)
+	if !ok {
+		t.Fatalf("upper layer is %T, want *ICMPv6Header", pkt.Body)
+	}
+	nd, err := ParseND(icmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, ok := nd.SourceLinkAddr()
+	if nd.Type != ICMPv6NeighborSolicitation || nd.Target[15] != 2 || !ok ||
+		mac != [6]byte{0, 0, 0, 0, 0, 1} {
+		t.Errorf("bad solicitation %+v", nd)
+	}
+}
+
+func TestParseIPv6Fragment(t *testing.T) {
+	// A UDP datagram's second fragment, at offset 1232.
+	b := mustHex("6000000000102c40" + "fe800000000000000000000000000001" +
+		"fe800000000000000000000000000002" +
+		"110004d100000007" + "0000000000000000")
+	pkt, err := ParseIPv6(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, more, id, ok := pkt.Fragment()
+	if !ok || offset != 1232 || !more || id != 7 {
+		t.Errorf("fragment %d %v %d %v", offset, more, id, ok)
+	}
+	if pkt.Protocol != ProtocolUDP || pkt.Body != nil {
+		t.Errorf("decoded the upper layer of a later fragment: %+v", pkt)
+	}
+}
+
+func TestParseQinQ(t *testing.T) {
+	// The UDP frame inside a service tag (VID 100) and a customer tag
+	// (VID 10, PCP 5, DEI).
+	b := append(append([]byte(nil), udpFrame[:12]...),
+		mustHex("88a80064"+"8100b00a")...)
+	b = append(b, udpFrame[12:]...)
+	frame, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Tags) != 2 || frame.Tags[0].TPID != EthTypeQinQ ||
+		frame.Tags[1] != (VLANTag{EthTypeVLAN, 5, true, 10}) {
+		t.Errorf("bad tags %+v", frame.Tags)
+	}
+	if frame.VID() != 100 || frame.PCP() != 0 || frame.Type != EthTypeIP {
+		t.Errorf("bad frame %+v", frame)
+	}
+	if frame.Tags[1].TCI() != 0xb00a {
+		t.Errorf("TCI %#x", frame.Tags[1].TCI())
+	}
+	if _, ok := frame.Body.(*IPFragment).Body.(*UDPHeader); !ok {
+		t.Errorf("payload not decoded")
+	}
+	untagged, _ := Parse(udpFrame)
+	if untagged.Tagged() || untagged.Tags != nil {
+		t.Errorf("untagged frame has tags %v", untagged.Tags)
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	for _, b := range [][]byte{arpFrame, udpFrame[:45], nsFrame} {
+		frame, err := Parse(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := frame.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The fixtures leave checksums zero, so only the layout can be
+		// compared.
+		again, err := Parse(got)
+		if err != nil {
+			t.Fatalf("%x: %v", got, err)
+		}
+		if len(got) != len(b) || again.Type != frame.Type {
+			t.Errorf("serialized %x as %x", b, got)
+		}
+	}
+}
+
+func TestBuildUDP(t *testing.T) {
+	udp := &UDPHeader{SrcPort: 0xd431, DstPort: 53, Payload: []byte("xxx")}
+	ip := NewIPv4(0x0a000001, 0x0a000002, udp)
+	ip.Identification = 2
+	frame := NewEthFrame([6]byte{0, 0, 0, 0, 0, 1}, [6]byte{0, 0, 0, 0, 0, 2}, ip)
+	b, err := frame.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustHex("000000000002000000000001" + "0800" +
+		"4500001f000200004011" + "66ca" + "0a000001" + "0a000002" +
+		"d4310035000b" + "26f6" + "787878")
+	if !bytes.Equal(b, want) {
+		t.Errorf("built\n%x\nwant\n%x", b, want)
+	}
+	if ip.TotalLength != 31 || udp.Length != 11 || ip.Protocol != ProtocolUDP {
+		t.Errorf("lengths not filled in: %+v %+v", ip.IPHeader, udp)
+	}
+}
+
+func TestBuildTCPv6(t *testing.T) {
+	var src, dst [16]byte
+	src[15], dst[15] = 1, 2
+	tcp := &TCPHeader{SrcPort: 1, DstPort: 2, Flags: TCPSyn,
+		Options: []byte{TCPOptionMSS, 4, 0x05, 0xa0}}
+	frame := NewEthFrame([6]byte{}, [6]byte{}, NewIPv6(src, dst, tcp))
+	frame.Tags = []VLANTag{{VID: 10}}
+	b, err := frame.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := parsed.Body.(*IPv6Packet)
+	got := pkt.Body.(*TCPHeader)
+	if parsed.VID() != 10 || pkt.PayloadLength != 24 || got.DataOffset != 6 {
+		t.Errorf("bad frame %x", b)
+	}
+	if mss, _ := got.MSS(); mss != 1440 {
+		t.Errorf("MSS %d", mss)
+	}
+	if tcp.Checksum == 0 {
+		t.Error("checksum not computed")
+	}
+}
+
+func TestBuildIPv6RawBody(t *testing.T) {
+	var src, dst [16]byte
+	pkt := NewIPv6(src, dst, []byte{1, 2, 3, 4})
+	_, err := NewEthFrame([6]byte{}, [6]byte{}, pkt).Serialize()
+	if err == nil {
+		t.Error("serialized a raw body of no protocol as hop-by-hop options")
+	}
+	pkt.Protocol = ProtocolGRE
+	b, err := NewEthFrame([6]byte{}, [6]byte{}, pkt).Serialize()
+	if err != nil || b[14+6] != uint8(ProtocolGRE) {
+		t.Errorf("raw GRE body gave %x, %v", b, err)
+	}
+
+	for _, body := range []interface{}{nil, []byte{}} {
+		pkt = NewIPv6(src, dst, body)
+		b, err = NewEthFrame([6]byte{}, [6]byte{}, pkt).Serialize()
+		if err != nil || b[14+6] != uint8(ProtocolIPv6NoNext) || pkt.PayloadLength != 0 {
+			t.Errorf("empty body %#v gave %x, %v", body, b, err)
+		}
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	tcp := &TCPHeader{SrcPort: 1024, DstPort: 80, Flags: TCPAck, Payload: []byte("hello")}
+	b, err := NewEthFrame([6]byte{}, [6]byte{}, NewIPv4(0x0a000001, 0x0a000002, tcp)).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = frame.VerifyChecksums(); err != nil {
+		t.Error(err)
+	}
+	if Checksum(b[14:34]) != 0 {
+		t.Error("IP header does not sum to zero")
+	}
+	b[len(b)-1] ^= 1
+	frame, _ = Parse(b)
+	if err = frame.VerifyChecksums(); err == nil {
+		t.Error("corrupt payload not detected")
+	}
+	b[18] ^= 1 // identification
+	frame, _ = Parse(b)
+	if err = frame.VerifyChecksums(); err == nil {
+		t.Error("corrupt IP header not detected")
+	}
+	b[18] ^= 1
+	frame, _ = Parse(b[:len(b)-2]) // truncated like a PacketIn
+	if err = frame.VerifyChecksums(); err != nil {
+		t.Errorf("truncated frame: %v", err)
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	udp := &UDPHeader{SrcPort: 5000, DstPort: 53, Payload: []byte("query")}
+	ip := NewIPv4(0x0a000001, 0xc0a80001, udp)
+	NewEthFrame([6]byte{}, [6]byte{}, ip).Serialize()
+	ipSum, udpSum := ip.HeaderChecksum, udp.Checksum
+
+	// Rewrite the source address and port as NAT would.
+	ipSum = UpdateChecksum32(ipSum, ip.SrcAddr, 0xcb007107)
+	udpSum = UpdateChecksum32(udpSum, ip.SrcAddr, 0xcb007107)
+	udpSum = UpdateChecksum(udpSum, udp.SrcPort, 40000)
+	ip.SrcAddr, udp.SrcPort = 0xcb007107, 40000
+
+	NewEthFrame([6]byte{}, [6]byte{}, ip).Serialize()
+	if ipSum != ip.HeaderChecksum || udpSum != udp.Checksum {
+		t.Errorf("updated checksums %#x %#x, recomputed %#x %#x",
+			ipSum, udpSum, ip.HeaderChecksum, udp.Checksum)
+	}
+}
+
+func TestPacketLazy(t *testing.T) {
+	p := NewPacket(udpFrame)
+	if p.SrcMAC() != [6]byte{0, 0, 0, 0, 0, 1} || p.DstMAC() != [6]byte{0, 0, 0, 0, 0, 2} {
+		t.Errorf("bad MACs %x %x", p.SrcMAC(), p.DstMAC())
+	}
+	if p.decoded != 0 {
+		t.Error("reading the MACs decoded a layer")
+	}
+	if tcp, err := p.TCP(); tcp != nil || err != nil {
+		t.Errorf("UDP frame has TCP layer %v, %v", tcp, err)
+	}
+	udp, err := p.UDP()
+	if err != nil || udp == nil || udp.DstPort != 53 {
+		t.Fatalf("bad UDP layer %+v, %v", udp, err)
+	}
+	if &udp.Payload[0] != &udpFrame[42] {
+		t.Error("payload was copied")
+	}
+	ip, _ := p.IPv4()
+	if ip == nil || ip.DstAddr != 0x0a000002 {
+		t.Errorf("bad IP layer %+v", ip)
+	}
+
+	p.Reset(nsFrame)
+	if ip, _ = p.IPv4(); ip != nil {
+		t.Error("IPv6 frame has an IPv4 layer")
+	}
+	icmp, err := p.ICMPv6()
+	if err != nil || icmp == nil || icmp.Type != ICMPv6NeighborSolicitation {
+		t.Errorf("bad ICMPv6 layer %+v, %v", icmp, err)
+	}
+
+	p.Reset(tcpFrame[:20])
+	if _, err = p.IPv4(); err == nil {
+		t.Error("truncated frame decoded")
+	}
+	if _, err = p.TCP(); err == nil {
+		t.Error("error not carried to the transport layer")
+	}
+}
+
+func TestPacketAllocs(t *testing.T) {
+	var p Packet
+	allocs := testing.AllocsPerRun(100, func() {
+		p.Reset(tcpFrame)
+		p.TCP()
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per packet, want 0", allocs)
+	}
+}
+
+func BenchmarkPacketMACs(b *testing.B) {
+	var p Packet
+	for i := 0; i < b.N; i++ {
+		p.Reset(tcpFrame)
+		p.SrcMAC()
+		p.DstMAC()
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	var d Decoded
+	for i := 0; i < b.N; i++ {
+		d.Parse(tcpFrame)
+	}
+}
+
+// An LLDP frame as sent by a topology discovery app: chassis MAC, port
+// "2", TTL 120, system name and an OpenFlow datapath ID TLV.
+var lldpFrame = mustHex("0180c200000e000000000001" + "88cc" +
+	"0207040000000000" + "01" + // chassis MAC 00:00:00:00:00:01
+	"0402" + "0732" + // port, locally assigned "2"
+	"0602" + "0078" + // TTL 120
+	"0a02" + "7331" + // system name "s1"
+	"fe0c" + "0026e1" + "00" + "0000000000000001" + // datapath 1
+	"0000")
+
+func TestParseLLDP(t *testing.T) {
+	frame, err := Parse(lldpFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lldp, ok := frame.Body.(*LLDPPacket)
+	if !ok {
+		t.Fatalf("body is %T, want *LLDPPacket", frame.Body)
+	}
+	if lldp.ChassisIDSubtype != LLDPChassisMAC || len(lldp.ChassisID) != 6 ||
+		lldp.PortIDSubtype != LLDPPortLocal || string(lldp.PortID) != "2" ||
+		lldp.TTL != 120 || lldp.SystemName != "s1" {
+		t.Errorf("bad LLDP %+v", lldp)
+	}
+	if len(lldp.OrgSpecific) != 1 || lldp.OrgSpecific[0].OUI != [3]byte{0, 0x26, 0xe1} ||
+		len(lldp.OrgSpecific[0].Info) != 8 {
+		t.Errorf("bad organizationally specific TLVs %+v", lldp.OrgSpecific)
+	}
+	b, err := lldp.Frame(frame.SrcMAC).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, lldpFrame) {
+		t.Errorf("serialized as\n%x\nwant\n%x", b, lldpFrame)
+	}
+	if _, err = ParseLLDP(lldpFrame[14:20]); err == nil {
+		t.Error("accepted a truncated LLDP frame")
+	}
+	if _, err = ParseLLDP(lldpFrame[23:]); err == nil {
+		t.Error("accepted LLDP without a chassis ID")
+	}
+}
+
+func TestDHCPRoundTrip(t *testing.T) {
+	discover := &DHCPPacket{Op: BootRequest, HType: 1, HLen: 6, Xid: 0x3903f326,
+		Flags: DHCPFlagBroadcast}
+	copy(discover.CHAddr[:], []byte{0, 0, 0, 0, 0, 1})
+	discover.AddOption(DHCPOptMessageType, []byte{DHCPDiscover})
+	discover.AddOptionIP(DHCPOptRequestedIP, 0x0a00000a)
+	payload, err := discover.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &UDPHeader{SrcPort: DHCPClientPort, DstPort: DHCPServerPort, Payload: payload}
+	b, err := NewEthFrame(discover.ClientMAC(), BroadcastMAC,
+		NewIPv4(0, 0xffffffff, udp)).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPacket(b)
+	got, _ := p.UDP()
+	if got == nil {
+		t.Fatal("no UDP layer")
+	}
+	dhcp, err := ParseDHCP(got.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dhcp.MessageType() != DHCPDiscover || dhcp.Xid != 0x3903f326 ||
+		dhcp.OptionIP(DHCPOptRequestedIP) != 0x0a00000a ||
+		dhcp.ClientMAC() != [6]byte{0, 0, 0, 0, 0, 1} {
+		t.Errorf("bad DHCP message %+v", dhcp)
+	}
+	if _, err = ParseDHCP(payload[:len(payload)-1]); err == nil {
+		t.Error("accepted options without an end")
+	}
+	payload[236] = 0
+	if _, err = ParseDHCP(payload); err == nil {
+		t.Error("accepted a message without the magic cookie")
+	}
+}
+
+// A response for www.example.com: a CNAME to example.com and its address,
+// both using name compression.
+var dnsResponse = mustHex("1234818000010002" + "00000000" +
+	"03777777076578616d706c6503636f6d00" + "00010001" +
+	"c00c" + "0005" + "0001" + "0000012c" + "0002" + "c010" +
+	"c010" + "0001" + "0001" + "0000012c" + "0004" + "5db8d822")
+
+func TestParseDNS(t *testing.T) {
+	udp := &UDPHeader{SrcPort: DNSPort, DstPort: 40000, Payload: dnsResponse}
+	b, _ := NewEthFrame([6]byte{}, [6]byte{}, NewIPv4(1, 2, udp)).Serialize()
+	m, err := NewPacket(b).DNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsResponse() || m.ID != 0x1234 || m.RCode() != 0 || len(m.Questions) != 1 ||
+		m.Questions[0] != (DNSQuestion{"www.example.com", DNSTypeA, DNSClassIN}) {
+		t.Fatalf("bad message %+v", m)
+	}
+	if len(m.Answers) != 2 || m.Answers[0].Target != "example.com" ||
+		m.Answers[1].Name != "example.com" || m.Answers[1].TTL != 300 {
+		t.Fatalf("bad answers %+v", m.Answers)
+	}
+	if ip, ok := m.Answers[1].IPv4(); !ok || ip != 0x5db8d822 {
+		t.Errorf("address %x", ip)
+	}
+
+	tcp := append([]byte{0, byte(len(dnsResponse))}, dnsResponse...)
+	if m, err = ParseDNSTCP(tcp); err != nil || len(m.Answers) != 2 {
+		t.Errorf("over TCP: %+v, %v", m, err)
+	}
+
+	loop := append([]byte(nil), dnsResponse...)
+	loop[len(loop)-15] = 0x50 // the second answer's name points forward
+	if _, err = ParseDNS(loop); err == nil {
+		t.Error("accepted a forward compression pointer")
+	}
+}
+
+func FuzzParseDNS(f *testing.F) {
+	f.Add(dnsResponse)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ParseDNS(data)
+	})
+}
+
+// A switch sends the controller only the first miss_send_len bytes of a
+// frame, 128 by default.  The UDP header is still there to be decoded.
+func TestParseTruncatedUDP(t *testing.T) {
+	udp := &UDPHeader{SrcPort: 68, DstPort: 67, Payload: bytes.Repeat([]byte{1}, 300)}
+	whole, err := NewEthFrame([6]byte{0, 0, 0, 0, 0, 1}, [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		NewIPv4(0, 0xffffffff, udp)).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := whole[:128]
+	frame, err := Parse(cut)
+	if err != nil {
+		t.Fatalf("truncated frame: %v", err)
+	}
+	got, ok := frame.Body.(*IPFragment).Body.(*UDPHeader)
+	if !ok || got.DstPort != 67 || got.Length != 308 || len(got.Payload) != 128-14-20-8 ||
+		!got.Truncated() {
+		t.Errorf("truncated datagram decoded as %+v", frame.Body.(*IPFragment).Body)
+	}
+	lazy, err := NewPacket(cut).UDP()
+	if err != nil || lazy == nil || lazy.SrcPort != 68 || !lazy.Truncated() {
+		t.Errorf("lazy view gave %+v, %v", lazy, err)
+	}
+	if err = frame.VerifyChecksums(); err != nil {
+		t.Errorf("checked the checksum of a truncated datagram: %v", err)
+	}
+
+	frame, _ = Parse(whole)
+	if udp := frame.Body.(*IPFragment).Body.(*UDPHeader); udp.Truncated() {
+		t.Error("whole datagram reported truncated")
+	}
+}
+
+// Splits the IP datagram of frame into fragments carrying at most size
+// bytes of payload each.
+func fragment(t *testing.T, frame []byte, size int) [][]byte {
+	parsed, err := Parse(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := parsed.Body.(*IPFragment)
+	payload := frame[14+IPHeaderSize : 14+int(ip.TotalLength)]
+	var frags [][]byte
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		flags := IPMoreFragments
+		if end >= len(payload) {
+			end, flags = len(payload), 0
+		}
+		h := *ip.IPHeader
+		h.FlagsFragoffset = flags | uint16(off/8)
+		b, err := NewEthFrame(parsed.SrcMAC, parsed.DstMAC,
+			&IPFragment{&h, payload[off:end]}).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frags = append(frags, b)
+	}
+	return frags
+}
+
+func TestFragments(t *testing.T) {
+	udp := &UDPHeader{SrcPort: 1, DstPort: 2, Payload: bytes.Repeat([]byte("x"), 100)}
+	whole, _ := NewEthFrame([6]byte{}, [6]byte{}, NewIPv4(1, 2, udp)).Serialize()
+	frags := fragment(t, whole, 48)
+	if len(frags) != 3 {
+		t.Fatalf("%d fragments", len(frags))
+	}
+	first, _ := Parse(frags[0])
+	if ip := first.Body.(*IPFragment); !ip.IsFragment() || ip.Body == nil {
+		t.Errorf("first fragment %+v", ip)
+	}
+	later, _ := Parse(frags[1])
+	if ip := later.Body.(*IPFragment); ip.FragmentOffset() != 48 || ip.Body != nil {
+		t.Errorf("later fragment decoded as %+v", ip.Body)
+	}
+	if udp, _ := NewPacket(frags[2]).UDP(); udp != nil {
+		t.Error("lazy view decoded UDP in a later fragment")
+	}
+
+	r := NewReassembler(time.Second)
+	for _, i := range []int{2, 0, 1} {
+		got, err := r.Add(frags[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 1 {
+			if got != nil {
+				t.Fatalf("reassembled after fragment %d", i)
+			}
+			continue
+		}
+		if !bytes.Equal(got, whole) {
+			t.Errorf("reassembled\n%x\nwant\n%x", got, whole)
+		}
+	}
+	if got, _ := r.Add(whole); !bytes.Equal(got, whole) {
+		t.Error("whole datagram not passed through")
+	}
+	r.Add(frags[0])
+	r.now = func() time.Time { return time.Now().Add(time.Minute) }
+	if got, _ := r.Add(frags[2]); got != nil || len(r.pending) != 1 {
+		t.Error("expired fragments used")
+	}
+}
+
+// A fragment past the end the last fragment gives, whichever comes first,
+// drops the datagram.
+func TestFragmentPastEnd(t *testing.T) {
+	udp := &UDPHeader{SrcPort: 1, DstPort: 2, Payload: bytes.Repeat([]byte("x"), 100)}
+	short, _ := NewEthFrame([6]byte{}, [6]byte{}, NewIPv4(1, 2, udp)).Serialize()
+	udp.Payload = bytes.Repeat([]byte("x"), 200)
+	long, _ := NewEthFrame([6]byte{}, [6]byte{}, NewIPv4(1, 2, udp)).Serialize()
+	shortFrags := fragment(t, short, 48) // the last at 96, ending at 108
+	longFrags := fragment(t, long, 48)   // the third at 96, ending at 144
+	for _, order := range [][][]byte{
+		{shortFrags[2], longFrags[2]},
+		{longFrags[2], shortFrags[2]},
+		{shortFrags[2], longFrags[4]},
+	} {
+		r := NewReassembler(time.Second)
+		r.Add(order[0])
+		if _, err := r.Add(order[1]); err == nil || len(r.pending) != 0 {
+			t.Errorf("kept a datagram with a fragment past its end: %v", err)
+		}
+		for _, frag := range shortFrags[:2] {
+			if got, _ := r.Add(frag); got != nil {
+				t.Errorf("reassembled %x", got)
+			}
+		}
+	}
+}
+
+func TestTunnels(t *testing.T) {
+	// VXLAN carrying the ARP request.
+	vxlan := append(mustHex("0800000000002a00"), arpFrame...)
+	b, _ := NewEthFrame([6]byte{}, [6]byte{}, NewIPv4(1, 2,
+		&UDPHeader{SrcPort: 50000, DstPort: VXLANPort, Payload: vxlan})).Serialize()
+	frame, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, ok := frame.Body.(*IPFragment).Body.(*UDPHeader).Body.(*VXLANHeader)
+	if !ok || v.VNI != 42 {
+		t.Fatalf("VXLAN not decoded")
+	}
+	if _, ok = v.Frame.Body.(*ARPPacket); !ok {
+		t.Errorf("inner frame %+v", v.Frame)
+	}
+
+	// GRE with a key carrying the UDP datagram.
+	gre := append(mustHex("20000800"+"00000007"), udpFrame[14:45]...)
+	b, _ = NewEthFrame([6]byte{}, [6]byte{}, NewIPv4(1, 2, gre)).Serialize()
+	b[23] = uint8(ProtocolGRE)
+	frame, err = Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, ok := frame.Body.(*IPFragment).Body.(*GREHeader)
+	if !ok || g.Key != 7 || g.Protocol != EthTypeIP {
+		t.Fatalf("GRE not decoded: %+v", frame.Body.(*IPFragment).Body)
+	}
+	if _, ok = g.Body.(*IPFragment).Body.(*UDPHeader); !ok {
+		t.Errorf("inner datagram %+v", g.Body)
+	}
+}
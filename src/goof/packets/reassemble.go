@@ -0,0 +1,161 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// Limits on the fragments a Reassembler holds, so a flood of fragments
+// that never complete cannot exhaust memory.
+const (
+	maxPendingDatagrams = 1024
+	maxDatagramSize     = 0xffff
+)
+
+type fragmentKey struct {
+	src, dst uint32
+	id       uint16
+	protocol Protocol
+}
+
+type fragmentPiece struct {
+	offset int
+	data   []byte
+}
+
+type pendingDatagram struct {
+	first   []byte // frame up to the IP payload, from the first fragment
+	pieces  []fragmentPiece
+	size    int // of the IP payload, once the last fragment is seen
+	expires time.Time
+}
+
+// A Reassembler puts IPv4 fragments sent to the controller back together.
+// Fragments must arrive whole: a PacketIn truncated by miss_send_len cannot
+// be reassembled.  A Reassembler is not safe for concurrent use.
+type Reassembler struct {
+	Timeout time.Duration // after which incomplete datagrams are dropped
+	pending map[fragmentKey]*pendingDatagram
+	now     func() time.Time
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{Timeout: timeout,
+		pending: make(map[fragmentKey]*pendingDatagram), now: time.Now}
+}
+
+// Adds the Ethernet frame data.  Frames that are not IPv4 fragments are
+// returned as they are.  For a fragment, the result is nil until the last
+// missing piece arrives, and then a new frame holding the whole datagram:
+// the Ethernet header and IP header of the first fragment with the length,
+// fragment fields and checksum fixed up, and the reassembled payload.  A
+// fragment reaching past the end that the last fragment gives drops the
+// whole datagram with an error.  data is not retained.
+func (r *Reassembler) Add(data []byte) ([]byte, error) {
+	var d Decoded
+	_, headerLen, err := d.Ethernet.decode(data, d.tags[:0])
+	if err != nil {
+		return nil, err
+	}
+	if d.Ethernet.Type != EthTypeIP {
+		return data, nil
+	}
+	b := data[headerLen:]
+	payload, err := d.decodeIP(b)
+	if err != nil {
+		return nil, err
+	}
+	if !d.IP.IsFragment() {
+		return data, nil
+	}
+	if int(d.IP.TotalLength) > len(b) {
+		return nil, io.ErrUnexpectedEOF // truncated
+	}
+
+	now := r.now()
+	r.expire(now)
+	key := fragmentKey{d.IP.SrcAddr, d.IP.DstAddr, d.IP.Identification, d.IP.Protocol}
+	p := r.pending[key]
+	if p == nil {
+		if len(r.pending) == maxPendingDatagrams {
+			return nil, errors.New("too many datagrams being reassembled")
+		}
+		p = &pendingDatagram{expires: now.Add(r.Timeout)}
+		r.pending[key] = p
+	}
+	offset := d.IP.FragmentOffset()
+	end := offset + len(payload)
+	if end > maxDatagramSize-IPHeaderSize {
+		delete(r.pending, key)
+		return nil, errors.New("fragment past the maximum datagram size")
+	}
+	if offset == 0 {
+		ihl := int(d.IP.VersionIHL&0xf) * 4
+		p.first = append([]byte(nil), data[:headerLen+ihl]...)
+	}
+	if d.IP.FlagsFragoffset&IPMoreFragments == 0 {
+		if p.size != 0 && p.size != end {
+			delete(r.pending, key)
+			return nil, errors.New("last fragments disagree on the datagram size")
+		}
+		p.size = end
+	} else if len(payload)%8 != 0 {
+		delete(r.pending, key)
+		return nil, errors.New("fragment length not a multiple of 8")
+	}
+	p.pieces = append(p.pieces, fragmentPiece{offset, append([]byte(nil), payload...)})
+	if p.size == 0 {
+		return nil, nil
+	}
+	for _, piece := range p.pieces {
+		if piece.offset+len(piece.data) > p.size {
+			delete(r.pending, key)
+			return nil, errors.New("fragment past the end of the datagram")
+		}
+	}
+	if p.first == nil {
+		return nil, nil
+	}
+
+	// Check that the pieces cover the whole payload.
+	sort.Slice(p.pieces, func(i, j int) bool {
+		return p.pieces[i].offset < p.pieces[j].offset
+	})
+	covered := 0
+	for _, piece := range p.pieces {
+		if piece.offset > covered {
+			return nil, nil // a hole
+		}
+		if e := piece.offset + len(piece.data); e > covered {
+			covered = e
+		}
+	}
+	if covered < p.size {
+		return nil, nil
+	}
+	delete(r.pending, key)
+
+	out := make([]byte, len(p.first)+p.size)
+	copy(out, p.first)
+	for _, piece := range p.pieces {
+		copy(out[len(p.first)+piece.offset:], piece.data)
+	}
+	ip := out[headerLen:]
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+	binary.BigEndian.PutUint16(ip[6:], binary.BigEndian.Uint16(ip[6:])&IPDontFragment)
+	binary.BigEndian.PutUint16(ip[10:], 0)
+	ihl := int(ip[0]&0xf) * 4
+	binary.BigEndian.PutUint16(ip[10:], Checksum(ip[:ihl]))
+	return out, nil
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for key, p := range r.pending {
+		if now.After(p.expires) {
+			delete(r.pending, key)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Appends options padded with zeros to a multiple of 4 bytes.
+func appendOptions(b, options []byte) []byte {
+	b = append(b, options...)
+	for i := len(options); i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func paddedLen(options []byte) int {
+	return (len(options) + 3) &^ 3
+}
+
+func (h *EthernetHeader) appendTo(b []byte, tags []VLANTag) []byte {
+	b = append(b, h.DstMAC[:]...)
+	b = append(b, h.SrcMAC[:]...)
+	for i := range tags {
+		tpid := tags[i].TPID
+		if tpid == 0 {
+			tpid = EthTypeVLAN
+		}
+		b = appendUint16(b, uint16(tpid))
+		b = appendUint16(b, tags[i].TCI())
+	}
+	return appendUint16(b, uint16(h.Type))
+}
+
+func (h *IPHeader) appendTo(b []byte) []byte {
+	b = append(b, h.VersionIHL, h.TOS)
+	b = appendUint16(b, h.TotalLength)
+	b = appendUint16(b, h.Identification)
+	b = appendUint16(b, h.FlagsFragoffset)
+	b = append(b, h.TTL, uint8(h.Protocol))
+	b = appendUint16(b, h.HeaderChecksum)
+	b = appendUint32(b, h.SrcAddr)
+	b = appendUint32(b, h.DstAddr)
+	return appendOptions(b, h.Options)
+}
+
+func (h *IPv6Header) appendTo(b []byte) []byte {
+	b = appendUint32(b, 6<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0xfffff)
+	b = appendUint16(b, h.PayloadLength)
+	b = append(b, uint8(h.NextHeader), h.HopLimit)
+	b = append(b, h.SrcAddr[:]...)
+	return append(b, h.DstAddr[:]...)
+}
+
+func (h *TCPHeader) appendTo(b []byte) []byte {
+	b = appendUint16(b, h.SrcPort)
+	b = appendUint16(b, h.DstPort)
+	b = appendUint32(b, h.Seq)
+	b = appendUint32(b, h.Ack)
+	b = appendUint16(b, uint16(h.DataOffset)<<12|uint16(h.Flags)&0x1ff)
+	b = appendUint16(b, h.Window)
+	b = appendUint16(b, h.Checksum)
+	b = appendUint16(b, h.Urgent)
+	b = appendOptions(b, h.Options)
+	return append(b, h.Payload...)
+}
+
+func (h *UDPHeader) appendTo(b []byte) []byte {
+	b = appendUint16(b, h.SrcPort)
+	b = appendUint16(b, h.DstPort)
+	b = appendUint16(b, h.Length)
+	b = appendUint16(b, h.Checksum)
+	return append(b, h.Payload...)
+}
+
+func (h *ICMPHeader) appendTo(b []byte) []byte {
+	b = append(b, h.Type, h.Code)
+	b = appendUint16(b, h.Checksum)
+	b = appendUint16(b, h.ID)
+	b = appendUint16(b, h.Seq)
+	return append(b, h.Payload...)
+}
+
+// The Write methods below encode a single layer with its fields as they
+// are; use EthFrame.Serialize to have lengths and checksums filled in.
+
+// Writes the MAC addresses and type, without VLAN tags.
+func (h *EthernetHeader) Write(w io.Writer) error {
+	_, err := w.Write(h.appendTo(nil, nil))
+	return err
+}
+
+func (h *IPHeader) Write(w io.Writer) error {
+	_, err := w.Write(h.appendTo(nil))
+	return err
+}
+
+func (h *IPv6Header) Write(w io.Writer) error {
+	_, err := w.Write(h.appendTo(nil))
+	return err
+}
+
+// Writes the header, options and payload.
+func (h *TCPHeader) Write(w io.Writer) error {
+	_, err := w.Write(h.appendTo(nil))
+	return err
+}
+
+// Writes the header and payload.
+func (h *UDPHeader) Write(w io.Writer) error {
+	_, err := w.Write(h.appendTo(nil))
+	return err
+}
+
+// Writes the header and payload.
+func (h *ICMPHeader) Write(w io.Writer) error {
+	_, err := w.Write(h.appendTo(nil))
+	return err
+}
+
+// Returns a frame carrying body, which is one of *IPFragment, *IPv6Packet,
+// *ARPPacket, *LLDPPacket or raw []byte.  The type is filled in by Serialize.
+func NewEthFrame(src, dst [6]byte, body interface{}) *EthFrame {
+	return &EthFrame{EthernetHeader: &EthernetHeader{DstMAC: dst, SrcMAC: src},
+		Body: body}
+}
+
+// Returns an IPv4 datagram carrying body, which is one of *TCPHeader,
+// *UDPHeader, *ICMPHeader or raw []byte.
+func NewIPv4(src, dst uint32, body interface{}) *IPFragment {
+	return &IPFragment{&IPHeader{TTL: 64, SrcAddr: src, DstAddr: dst}, body}
+}
+
+// Returns an IPv6 datagram carrying body, which is one of *TCPHeader,
+// *UDPHeader, *ICMPv6Header or raw []byte.  A raw body needs its Protocol
+// set before Serialize; without a body the datagram has no next header.
+func NewIPv6(src, dst [16]byte, body interface{}) *IPv6Packet {
+	return &IPv6Packet{IPv6Header: &IPv6Header{HopLimit: 64, SrcAddr: src,
+		DstAddr: dst}, Body: body}
+}
+
+// Encodes the frame and every layer linked from it.  Lengths, the types
+// and protocols naming the next layer, the IPv4 header checksum and the
+// TCP, UDP, ICMP and ICMPv6 checksums are computed and stored back in the
+// layers before encoding.  A raw []byte body is copied as is.
+func (f *EthFrame) Serialize() ([]byte, error) {
+	switch f.Body.(type) {
+	case *IPFragment:
+		f.Type = EthTypeIP
+	case *IPv6Packet:
+		f.Type = EthTypeIPv6
+	case *ARPPacket:
+		f.Type = EthTypeARP
+	case *LLDPPacket:
+		f.Type = EthTypeLLDP
+	}
+	b := f.EthernetHeader.appendTo(make([]byte, 0, 128), f.Tags)
+	return appendLayer(b, f.Body, nil)
+}
+
+// Writes the frame as encoded by Serialize.
+func (f *EthFrame) Write(w io.Writer) error {
+	b, err := f.Serialize()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Returns the checksum of the pseudo header of a transport layer with the
+// given protocol and length, before folding.
+type pseudoHeader func(p Protocol, length int) uint32
+
+// Returns the protocol number of a transport layer, or false for raw bytes
+// and unknown layers.
+func protocolOf(layer interface{}) (Protocol, bool) {
+	switch layer.(type) {
+	case *TCPHeader:
+		return ProtocolTCP, true
+	case *UDPHeader:
+		return ProtocolUDP, true
+	case *ICMPHeader:
+		return ProtocolICMP, true
+	case *ICMPv6Header:
+		return ProtocolICMPv6, true
+	}
+	return 0, false
+}
+
+func appendLayer(b []byte, layer interface{}, pseudo pseudoHeader) ([]byte, error) {
+	start := len(b)
+	switch l := layer.(type) {
+	case nil:
+	case []byte:
+		b = append(b, l...)
+	case *ARPPacket:
+		b = l.appendTo(b)
+	case *LLDPPacket:
+		return l.appendTo(b)
+	case *IPFragment:
+		return l.appendTo(b)
+	case *IPv6Packet:
+		return l.appendTo(b)
+	case *TCPHeader:
+		l.DataOffset = uint8((TCPHeaderSize + paddedLen(l.Options)) / 4)
+		l.Checksum = 0
+		b = l.appendTo(b)
+		l.Checksum = transportChecksum(b[start:], ProtocolTCP, pseudo)
+		binary.BigEndian.PutUint16(b[start+16:], l.Checksum)
+	case *UDPHeader:
+		if UDPHeaderSize+len(l.Payload) > 0xffff {
+			return nil, fmt.Errorf("UDP payload of %d bytes too long", len(l.Payload))
+		}
+		l.Length = uint16(UDPHeaderSize + len(l.Payload))
+		l.Checksum = 0
+		b = l.appendTo(b)
+		l.Checksum = transportChecksum(b[start:], ProtocolUDP, pseudo)
+		if l.Checksum == 0 && pseudo != nil {
+			l.Checksum = 0xffff // zero means no checksum
+		}
+		binary.BigEndian.PutUint16(b[start+6:], l.Checksum)
+	case *ICMPHeader:
+		l.Checksum = 0
+		b = l.appendTo(b)
+		l.Checksum = Checksum(b[start:])
+		binary.BigEndian.PutUint16(b[start+2:], l.Checksum)
+	case *ICMPv6Header:
+		l.Checksum = 0
+		b = l.appendTo(b)
+		l.Checksum = transportChecksum(b[start:], ProtocolICMPv6, pseudo)
+		binary.BigEndian.PutUint16(b[start+2:], l.Checksum)
+	default:
+		return nil, fmt.Errorf("cannot serialize %T", layer)
+	}
+	return b, nil
+}
+
+// Computes the checksum of a transport segment, or 0 if there is no IP
+// layer to provide a pseudo header.
+func transportChecksum(seg []byte, p Protocol, pseudo pseudoHeader) uint16 {
+	if pseudo == nil {
+		return 0
+	}
+	return fold(sum(seg, pseudo(p, len(seg))))
+}
+
+func (f *IPFragment) appendTo(b []byte) ([]byte, error) {
+	h := f.IPHeader
+	if p, ok := protocolOf(f.Body); ok {
+		h.Protocol = p
+	}
+	headerLen := IPHeaderSize + paddedLen(h.Options)
+	if headerLen > 60 {
+		return nil, fmt.Errorf("%d bytes of IP options", len(h.Options))
+	}
+	h.VersionIHL = 4<<4 | uint8(headerLen/4)
+	start := len(b)
+	b = h.appendTo(b)
+	b, err := appendLayer(b, f.Body, func(p Protocol, length int) uint32 {
+		return ipv4Pseudo(h, p, length)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b)-start > 0xffff {
+		return nil, fmt.Errorf("IP datagram of %d bytes too long", len(b)-start)
+	}
+	h.TotalLength = uint16(len(b) - start)
+	binary.BigEndian.PutUint16(b[start+2:], h.TotalLength)
+	binary.BigEndian.PutUint16(b[start+10:], 0)
+	h.HeaderChecksum = Checksum(b[start : start+headerLen])
+	binary.BigEndian.PutUint16(b[start+10:], h.HeaderChecksum)
+	return b, nil
+}
+
+func (p *IPv6Packet) appendTo(b []byte) ([]byte, error) {
+	h := p.IPv6Header
+	if proto, ok := protocolOf(p.Body); ok {
+		p.Protocol = proto
+	}
+	if p.Protocol == ProtocolIPv6HopByHop {
+		// Hop-by-hop options may only follow the IPv6 header directly, as an
+		// extension, so the protocol of the body was left unset.
+		if raw, ok := p.Body.([]byte); p.Body != nil && (!ok || len(raw) > 0) {
+			return nil, fmt.Errorf("IPv6 payload of %T has no protocol", p.Body)
+		}
+		p.Protocol = ProtocolIPv6NoNext
+	}
+	start := len(b)
+	b = h.appendTo(b)
+	// Chain the extension headers: each names the one after it.
+	next := start + 6
+	for _, ext := range p.Extensions {
+		if len(ext.Data) < 8 || len(ext.Data)%8 != 0 || len(ext.Data) > 2048 {
+			return nil, fmt.Errorf("bad length %d for IPv6 extension %d",
+				len(ext.Data), ext.Type)
+		}
+		b[next] = uint8(ext.Type)
+		next = len(b)
+		b = append(b, ext.Data...)
+		if ext.Type != ProtocolIPv6Frag {
+			b[next+1] = uint8(len(ext.Data)/8 - 1)
+		}
+	}
+	b[next] = uint8(p.Protocol)
+	h.NextHeader = Protocol(b[start+6])
+	b, err := appendLayer(b, p.Body, func(proto Protocol, length int) uint32 {
+		return ipv6Pseudo(h, proto, length)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b)-start-IPv6HeaderSize > 0xffff {
+		return nil, fmt.Errorf("IPv6 payload of %d bytes too long",
+			len(b)-start-IPv6HeaderSize)
+	}
+	h.PayloadLength = uint16(len(b) - start - IPv6HeaderSize)
+	binary.BigEndian.PutUint16(b[start+4:], h.PayloadLength)
+	return b, nil
+}
@@ -0,0 +1,206 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// TCP control flags, as found in TCPHeader.Flags.
+type TCPFlags uint16
+
+const (
+	TCPFin TCPFlags = 1 << iota
+	TCPSyn
+	TCPRst
+	TCPPsh
+	TCPAck
+	TCPUrg
+	TCPEce
+	TCPCwr
+	TCPNs
+)
+
+var tcpFlagNames = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR", "NS"}
+
+func (f TCPFlags) String() string {
+	s := ""
+	for i, name := range tcpFlagNames {
+		if f&(1<<uint(i)) != 0 {
+			if s != "" {
+				s += "|"
+			}
+			s += name
+		}
+	}
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+// TCP option kinds.
+const (
+	TCPOptionEnd           uint8 = 0
+	TCPOptionNop           uint8 = 1
+	TCPOptionMSS           uint8 = 2
+	TCPOptionWindowScale   uint8 = 3
+	TCPOptionSACKPermitted uint8 = 4
+	TCPOptionSACK          uint8 = 5
+	TCPOptionTimestamps    uint8 = 8
+)
+
+const TCPHeaderSize = 20
+
+type TCPHeader struct {
+	SrcPort    uint16
+	DstPort    uint16
+	Seq        uint32
+	Ack        uint32
+	DataOffset uint8 // header length in 32-bit words
+	Flags      TCPFlags
+	Window     uint16
+	Checksum   uint16
+	Urgent     uint16
+	Options    []byte // raw options, see ParseTCPOptions
+	Payload    []byte
+}
+
+// A TCP option other than End and Nop.  Data excludes the kind and length
+// bytes.
+type TCPOption struct {
+	Kind uint8
+	Data []byte
+}
+
+// A block of a selective acknowledgment.
+type SACKBlock struct {
+	Left  uint32
+	Right uint32
+}
+
+// Decodes a TCP segment.  Options and Payload refer to b.
+func (h *TCPHeader) decode(b []byte) error {
+	if len(b) < TCPHeaderSize {
+		return io.ErrUnexpectedEOF
+	}
+	h.SrcPort = binary.BigEndian.Uint16(b[0:])
+	h.DstPort = binary.BigEndian.Uint16(b[2:])
+	h.Seq = binary.BigEndian.Uint32(b[4:])
+	h.Ack = binary.BigEndian.Uint32(b[8:])
+	h.DataOffset = b[12] >> 4
+	h.Flags = TCPFlags(binary.BigEndian.Uint16(b[12:]) & 0x1ff)
+	h.Window = binary.BigEndian.Uint16(b[14:])
+	h.Checksum = binary.BigEndian.Uint16(b[16:])
+	h.Urgent = binary.BigEndian.Uint16(b[18:])
+	headerLen := int(h.DataOffset) << 2
+	if headerLen < TCPHeaderSize {
+		return fmt.Errorf("bad TCP data offset %d", h.DataOffset)
+	}
+	if headerLen > len(b) {
+		return io.ErrUnexpectedEOF
+	}
+	h.Options = b[TCPHeaderSize:headerLen]
+	h.Payload = b[headerLen:]
+	return nil
+}
+
+// Decodes a TCP segment, i.e. the body of an IP datagram with protocol
+// ProtocolTCP.  The returned header refers to b.
+func ParseTCP(b []byte) (*TCPHeader, error) {
+	var h TCPHeader
+	err := h.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (h *TCPHeader) HasFlags(f TCPFlags) bool {
+	return h.Flags&f == f
+}
+
+// Splits raw TCP options into a list.  The Data of each option refers to b.
+func ParseTCPOptions(b []byte) ([]TCPOption, error) {
+	var opts []TCPOption
+	err := walkTCPOptions(b, func(kind uint8, data []byte) {
+		opts = append(opts, TCPOption{kind, data})
+	})
+	return opts, err
+}
+
+func walkTCPOptions(b []byte, f func(kind uint8, data []byte)) error {
+	for len(b) > 0 {
+		kind := b[0]
+		switch kind {
+		case TCPOptionEnd:
+			return nil
+		case TCPOptionNop:
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || int(b[1]) < 2 || int(b[1]) > len(b) {
+			return fmt.Errorf("bad length for TCP option %d", kind)
+		}
+		f(kind, b[2:b[1]])
+		b = b[b[1]:]
+	}
+	return nil
+}
+
+// Returns the data of the first option of the given kind.  Malformed
+// options are ignored.
+func (h *TCPHeader) option(kind uint8) ([]byte, bool) {
+	var data []byte
+	found := false
+	walkTCPOptions(h.Options, func(k uint8, d []byte) {
+		if k == kind && !found {
+			data, found = d, true
+		}
+	})
+	return data, found
+}
+
+// Returns the maximum segment size announced in a SYN.
+func (h *TCPHeader) MSS() (uint16, bool) {
+	d, ok := h.option(TCPOptionMSS)
+	if !ok || len(d) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(d), true
+}
+
+func (h *TCPHeader) WindowScale() (uint8, bool) {
+	d, ok := h.option(TCPOptionWindowScale)
+	if !ok || len(d) != 1 {
+		return 0, false
+	}
+	return d[0], true
+}
+
+func (h *TCPHeader) SACKPermitted() bool {
+	_, ok := h.option(TCPOptionSACKPermitted)
+	return ok
+}
+
+func (h *TCPHeader) SACK() []SACKBlock {
+	d, ok := h.option(TCPOptionSACK)
+	if !ok {
+		return nil
+	}
+	var blocks []SACKBlock
+	for ; len(d) >= 8; d = d[8:] {
+		blocks = append(blocks, SACKBlock{binary.BigEndian.Uint32(d[0:]),
+			binary.BigEndian.Uint32(d[4:])})
+	}
+	return blocks
+}
+
+// Returns the timestamp value and echo reply of the timestamps option.
+func (h *TCPHeader) Timestamps() (val, echo uint32, ok bool) {
+	d, ok := h.option(TCPOptionTimestamps)
+	if !ok || len(d) != 8 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(d[0:]), binary.BigEndian.Uint32(d[4:]), true
+}
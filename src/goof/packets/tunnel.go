@@ -0,0 +1,146 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// GRE protocol type of bridged Ethernet frames (NVGRE and Linux gretap).
+const EthTypeTransparentBridging EthType = 0x6558
+
+const VXLANPort = 4789
+
+// Tunnels nested deeper than this are not decoded.
+const maxTunnelDepth = 4
+
+// Bits of GREHeader.Flags.
+const (
+	GREChecksumPresent uint16 = 0x8000
+	GREKeyPresent      uint16 = 0x2000
+	GRESeqPresent      uint16 = 0x1000
+)
+
+// A GRE header (RFC 2784 and 2890).  Body is the encapsulated *EthFrame,
+// *IPFragment or *IPv6Packet, or nil if the protocol is not decoded.
+type GREHeader struct {
+	Flags    uint16 // flags and version
+	Protocol EthType
+	Checksum uint16 // valid if Flags has GREChecksumPresent
+	Key      uint32 // valid if Flags has GREKeyPresent
+	Seq      uint32 // valid if Flags has GRESeqPresent
+	Payload  []byte
+	Body     interface{}
+}
+
+// A VXLAN header (RFC 7348).  Frame is the encapsulated frame.
+type VXLANHeader struct {
+	Flags uint8
+	VNI   uint32 // 24-bit network identifier
+	Frame *EthFrame
+}
+
+func (h *GREHeader) decode(b []byte) error {
+	if len(b) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	h.Flags = binary.BigEndian.Uint16(b[0:])
+	h.Protocol = EthType(binary.BigEndian.Uint16(b[2:]))
+	h.Checksum, h.Key, h.Seq = 0, 0, 0
+	h.Body = nil
+	if v := h.Flags & 7; v != 0 {
+		return fmt.Errorf("unsupported GRE version %d", v)
+	}
+	off := 4
+	for _, f := range []uint16{GREChecksumPresent, GREKeyPresent, GRESeqPresent} {
+		if h.Flags&f == 0 {
+			continue
+		}
+		if len(b) < off+4 {
+			return io.ErrUnexpectedEOF
+		}
+		switch f {
+		case GREChecksumPresent:
+			h.Checksum = binary.BigEndian.Uint16(b[off:])
+		case GREKeyPresent:
+			h.Key = binary.BigEndian.Uint32(b[off:])
+		case GRESeqPresent:
+			h.Seq = binary.BigEndian.Uint32(b[off:])
+		}
+		off += 4
+	}
+	h.Payload = b[off:]
+	return nil
+}
+
+func (h *VXLANHeader) decode(b []byte) error {
+	if len(b) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	h.Flags = b[0]
+	if h.Flags&0x08 == 0 {
+		return fmt.Errorf("VXLAN header without a valid VNI")
+	}
+	h.VNI = binary.BigEndian.Uint32(b[4:]) >> 8
+	h.Frame = nil
+	return nil
+}
+
+// Returns the storage for the layers inside a tunnel, or nil if tunnels
+// are nested too deeply.
+func (d *Decoded) innerDecoded() *Decoded {
+	if d.depth == maxTunnelDepth {
+		return nil
+	}
+	if d.inner == nil {
+		d.inner = &Decoded{depth: d.depth + 1}
+	}
+	return d.inner
+}
+
+func (d *Decoded) parseGRE(b []byte) (interface{}, error) {
+	err := d.GRE.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	inner := d.innerDecoded()
+	if inner == nil {
+		return &d.GRE, nil
+	}
+	switch d.GRE.Protocol {
+	case EthTypeTransparentBridging:
+		var frame *EthFrame
+		frame, err = inner.Parse(d.GRE.Payload)
+		if frame != nil {
+			d.GRE.Body = frame
+		}
+	case EthTypeIP:
+		var frag *IPFragment
+		frag, err = inner.parseIP(d.GRE.Payload)
+		if frag != nil {
+			d.GRE.Body = frag
+		}
+	case EthTypeIPv6:
+		var pkt *IPv6Packet
+		pkt, err = inner.parseIPv6(d.GRE.Payload)
+		if pkt != nil {
+			d.GRE.Body = pkt
+		}
+	}
+	return &d.GRE, err
+}
+
+// Decodes the payload of d.UDP as VXLAN.  Other traffic may use the VXLAN
+// port, so a payload that does not decode leaves d.UDP.Body nil and is not
+// an error.
+func (d *Decoded) parseVXLAN() {
+	inner := d.innerDecoded()
+	if inner == nil || d.VXLAN.decode(d.UDP.Payload) != nil {
+		return
+	}
+	frame, err := inner.Parse(d.UDP.Payload[8:])
+	if err == nil {
+		d.VXLAN.Frame = frame
+		d.UDP.Body = &d.VXLAN
+	}
+}
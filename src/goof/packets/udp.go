@@ -0,0 +1,57 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const UDPHeaderSize = 8
+
+type UDPHeader struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Length   uint16 // header and payload
+	Checksum uint16
+	Payload  []byte
+	Body     interface{} // *VXLANHeader for VXLAN, otherwise nil
+}
+
+// Decodes a UDP datagram.  Payload refers to b.  A datagram cut short, as
+// by the miss_send_len of a PacketIn or by fragmentation, is not an error:
+// the header is filled in and Payload holds what there is (see Truncated).
+func (h *UDPHeader) decode(b []byte) error {
+	if len(b) < UDPHeaderSize {
+		return io.ErrUnexpectedEOF
+	}
+	h.SrcPort = binary.BigEndian.Uint16(b[0:])
+	h.DstPort = binary.BigEndian.Uint16(b[2:])
+	h.Length = binary.BigEndian.Uint16(b[4:])
+	h.Checksum = binary.BigEndian.Uint16(b[6:])
+	h.Body = nil
+	if h.Length < UDPHeaderSize {
+		return fmt.Errorf("bad UDP length %d", h.Length)
+	}
+	if int(h.Length) > len(b) {
+		h.Payload = b[UDPHeaderSize:]
+		return nil
+	}
+	h.Payload = b[UDPHeaderSize:h.Length]
+	return nil
+}
+
+// Reports whether Payload holds less than the Length of the datagram.
+func (h *UDPHeader) Truncated() bool {
+	return UDPHeaderSize+len(h.Payload) < int(h.Length)
+}
+
+// Decodes a UDP datagram, i.e. the body of an IP datagram with protocol
+// ProtocolUDP.  The returned header refers to b.
+func ParseUDP(b []byte) (*UDPHeader, error) {
+	var h UDPHeader
+	err := h.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
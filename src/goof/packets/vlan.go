@@ -0,0 +1,91 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Tag protocol identifiers.
+const (
+	EthTypeVLAN EthType = 0x8100 // 802.1Q customer tag
+	EthTypeQinQ EthType = 0x88a8 // 802.1ad service tag
+	vlanTagSize         = 4
+	maxVLANTags         = 4
+)
+
+// An 802.1Q tag.
+type VLANTag struct {
+	TPID EthType
+	PCP  uint8  // priority code point, 3 bits
+	DEI  bool   // drop eligible indicator
+	VID  uint16 // VLAN identifier, 12 bits
+}
+
+func isVLANType(t EthType) bool {
+	return t == EthTypeVLAN || t == EthTypeQinQ
+}
+
+func (t *VLANTag) decode(tpid EthType, b []byte) {
+	tci := binary.BigEndian.Uint16(b)
+	t.TPID = tpid
+	t.PCP = uint8(tci >> 13)
+	t.DEI = tci&0x1000 != 0
+	t.VID = tci & 0xfff
+}
+
+// Returns the tag control information of t.
+func (t *VLANTag) TCI() uint16 {
+	tci := uint16(t.PCP&7)<<13 | t.VID&0xfff
+	if t.DEI {
+		tci |= 0x1000
+	}
+	return tci
+}
+
+// Decodes the VLAN tags following the MAC addresses of a frame, appending
+// them to tags.  Returns the tags, the EtherType of the payload and the
+// offset of the payload in b.
+func decodeVLANTags(b []byte, tags []VLANTag) ([]VLANTag, EthType, int, error) {
+	offset := 12
+	t := EthType(binary.BigEndian.Uint16(b[offset:]))
+	for isVLANType(t) {
+		if len(tags) == maxVLANTags {
+			return tags, t, offset, fmt.Errorf("more than %d VLAN tags", maxVLANTags)
+		}
+		if len(b) < offset+2+vlanTagSize {
+			return tags, t, offset, io.ErrUnexpectedEOF
+		}
+		tags = append(tags, VLANTag{})
+		tags[len(tags)-1].decode(t, b[offset+2:])
+		offset += vlanTagSize
+		t = EthType(binary.BigEndian.Uint16(b[offset:]))
+	}
+	return tags, t, offset + 2, nil
+}
+
+// Reports whether the frame carries at least one VLAN tag.
+func (f *EthFrame) Tagged() bool {
+	return len(f.Tags) > 0
+}
+
+// The VLAN id of the outermost tag, or 0 if the frame is untagged.
+func (f *EthFrame) VID() uint16 {
+	if len(f.Tags) == 0 {
+		return 0
+	}
+	return f.Tags[0].VID
+}
+
+// The priority of the outermost tag, or 0 if the frame is untagged.
+func (f *EthFrame) PCP() uint8 {
+	if len(f.Tags) == 0 {
+		return 0
+	}
+	return f.Tags[0].PCP
+}
+
+// The drop eligible indicator of the outermost tag.
+func (f *EthFrame) DEI() bool {
+	return len(f.Tags) > 0 && f.Tags[0].DEI
+}
@@ -0,0 +1,224 @@
+// Package pcap reads and writes the capture files of Wireshark and tcpdump,
+// in either the classic pcap format or pcapng.  Only pcapng has room
+// for the per-packet comments that carry OpenFlow metadata.
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"goof/of"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	PCAP Format = iota
+	PCAPNG
+)
+
+// Link types.
+const (
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101 // IP packets without a link layer header
+)
+
+const snapLen = 0xffff
+
+// pcapng block types.
+const (
+	blockSectionHeader    = 0x0a0d0d0a
+	blockInterface        = 0x00000001
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1a2b3c4d
+	optEndOfOpt           = 0
+	optComment            = 1
+	pcapMagicMicroseconds = 0xa1b2c3d4
+)
+
+// Describes one captured packet.
+type CaptureInfo struct {
+	Timestamp time.Time
+	Length    int    // of the packet on the wire; the data may be shorter
+	Comment   string // written in pcapng files only
+}
+
+// A Writer writes packets to a capture file.  It is safe for concurrent
+// use, so one Writer can capture the traffic of many switches.
+type Writer struct {
+	w      io.Writer
+	format Format
+	closer io.Closer
+	mu     sync.Mutex
+	now    func() time.Time
+}
+
+// Returns a Writer writing Ethernet frames to w, after writing the file
+// header.
+func NewWriter(w io.Writer, format Format) (*Writer, error) {
+	return NewWriterLinkType(w, format, LinkTypeEthernet)
+}
+
+// Like NewWriter for packets of another link type.
+func NewWriterLinkType(w io.Writer, format Format, linkType uint16) (*Writer, error) {
+	wr := &Writer{w: w, format: format, now: time.Now}
+	var err error
+	switch format {
+	case PCAP:
+		b := make([]byte, 24)
+		binary.LittleEndian.PutUint32(b[0:], pcapMagicMicroseconds)
+		binary.LittleEndian.PutUint16(b[4:], 2)
+		binary.LittleEndian.PutUint16(b[6:], 4)
+		binary.LittleEndian.PutUint32(b[16:], snapLen)
+		binary.LittleEndian.PutUint32(b[20:], uint32(linkType))
+		_, err = w.Write(b)
+	case PCAPNG:
+		shb := make([]byte, 16)
+		binary.LittleEndian.PutUint32(shb[0:], byteOrderMagic)
+		binary.LittleEndian.PutUint16(shb[4:], 1)
+		binary.LittleEndian.PutUint64(shb[8:], ^uint64(0)) // section length unknown
+		idb := make([]byte, 8)
+		binary.LittleEndian.PutUint16(idb[0:], linkType)
+		binary.LittleEndian.PutUint32(idb[4:], snapLen)
+		err = wr.writeBlock(blockSectionHeader, shb)
+		if err == nil {
+			err = wr.writeBlock(blockInterface, idb)
+		}
+	default:
+		return nil, fmt.Errorf("unknown capture format %d", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wr, nil
+}
+
+// Creates the file path and returns a Writer of Ethernet frames to it.  The
+// format is pcapng if the name ends in ".pcapng" and pcap otherwise.
+func Create(path string) (*Writer, error) {
+	format := PCAP
+	if filepath.Ext(path) == ".pcapng" {
+		format = PCAPNG
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f, format)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.closer = f
+	return w, nil
+}
+
+// Closes the file if the Writer was made by Create.
+func (w *Writer) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// Writes a pcapng block with the given body, which must be a multiple of
+// four bytes long.
+func (w *Writer) writeBlock(t uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	b := make([]byte, 0, length)
+	b = appendUint32(b, t)
+	b = appendUint32(b, length)
+	b = append(b, body...)
+	b = appendUint32(b, length)
+	_, err := w.w.Write(b)
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+// Writes a packet.  Data longer than the snap length is cut short.
+func (w *Writer) WritePacket(ci CaptureInfo, data []byte) error {
+	if len(data) > snapLen {
+		data = data[:snapLen]
+	}
+	if ci.Length < len(data) {
+		ci.Length = len(data)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.format == PCAP {
+		usec := ci.Timestamp.UnixNano() / 1000
+		b := make([]byte, 0, 16+len(data))
+		b = appendUint32(b, uint32(usec/1000000))
+		b = appendUint32(b, uint32(usec%1000000))
+		b = appendUint32(b, uint32(len(data)))
+		b = appendUint32(b, uint32(ci.Length))
+		_, err := w.w.Write(append(b, data...))
+		return err
+	}
+	usec := uint64(ci.Timestamp.UnixNano() / 1000)
+	body := make([]byte, 0, 28+pad4(len(data))+pad4(len(ci.Comment)))
+	body = appendUint32(body, 0) // interface
+	body = appendUint32(body, uint32(usec>>32))
+	body = appendUint32(body, uint32(usec))
+	body = appendUint32(body, uint32(len(data)))
+	body = appendUint32(body, uint32(ci.Length))
+	body = append(body, data...)
+	body = append(body, make([]byte, pad4(len(data))-len(data))...)
+	if ci.Comment != "" && len(ci.Comment) <= 0xffff {
+		body = appendUint16(body, optComment)
+		body = appendUint16(body, uint16(len(ci.Comment)))
+		body = append(body, ci.Comment...)
+		body = append(body, make([]byte, pad4(len(ci.Comment))-len(ci.Comment))...)
+		body = appendUint32(body, optEndOfOpt)
+	}
+	return w.writeBlock(blockEnhancedPacket, body)
+}
+
+func reasonName(reason uint8) string {
+	switch reason {
+	case of.ReasonNoMatch:
+		return "no_match"
+	case of.ReasonAction:
+		return "action"
+	}
+	return fmt.Sprint(reason)
+}
+
+// Writes the frame of a PacketIn received from datapath dpid.
+func (w *Writer) WritePacketIn(dpid uint64, msg *of.PacketIn) error {
+	return w.WritePacket(CaptureInfo{
+		Timestamp: w.now(),
+		Length:    int(msg.TotalLen),
+		Comment: fmt.Sprintf("packet_in dpid=%016x in_port=%d reason=%s buffer_id=0x%x",
+			dpid, msg.InPort, reasonName(msg.Reason), msg.BufferId),
+	}, msg.Data)
+}
+
+// Writes the payload of a PacketOut sent to datapath dpid.  PacketOuts of
+// buffered packets carry no payload and are skipped.
+func (w *Writer) WritePacketOut(dpid uint64, msg *of.PacketOut) error {
+	if len(msg.Data) == 0 {
+		return nil
+	}
+	return w.WritePacket(CaptureInfo{
+		Timestamp: w.now(),
+		Length:    len(msg.Data),
+		Comment: fmt.Sprintf("packet_out dpid=%016x in_port=%d buffer_id=0x%x actions=%s",
+			dpid, msg.InPort, msg.BufferId, of.FormatActions(msg.Actions)),
+	}, msg.Data)
+}
@@ -0,0 +1,184 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"goof/of"
+	"io"
+	"testing"
+	"time"
+)
+
+var stamp = time.Unix(1300000000, 123456000)
+
+func TestPCAP(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, PCAP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.now = func() time.Time { return stamp }
+	frame := []byte{0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 1, 8, 6}
+	err = w.WritePacketIn(1, &of.PacketIn{BufferId: 7, TotalLen: 60, InPort: 3, Data: frame})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if len(b) != 24+16+len(frame) {
+		t.Fatalf("wrote %d bytes", len(b))
+	}
+	if binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != LinkTypeEthernet {
+		t.Errorf("bad file header % x", b[:24])
+	}
+	rec := b[24:]
+	want := []uint32{1300000000, 123456, uint32(len(frame)), 60}
+	for i, v := range want {
+		if got := binary.LittleEndian.Uint32(rec[4*i:]); got != v {
+			t.Errorf("record field %d is %d, want %d", i, got, v)
+		}
+	}
+	if !bytes.Equal(rec[16:], frame) {
+		t.Errorf("frame % x", rec[16:])
+	}
+}
+
+// Splits a pcapng file into blocks, checking the lengths at both ends.
+func blocks(t *testing.T, b []byte) map[uint32][][]byte {
+	m := make(map[uint32][][]byte)
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("short block % x", b)
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if n%4 != 0 || n > len(b) || binary.LittleEndian.Uint32(b[n-4:]) != uint32(n) {
+			t.Fatalf("bad block length %d", n)
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		m[typ] = append(m[typ], b[8:n-4])
+		b = b[n:]
+	}
+	return m
+}
+
+func TestPCAPNG(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, PCAPNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.now = func() time.Time { return stamp }
+	frame := []byte{0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 1, 8, 6, 0}
+	w.WritePacketIn(0x2a, &of.PacketIn{BufferId: 0x100, TotalLen: 15, InPort: 3,
+		Reason: of.ReasonAction, Data: frame})
+	w.WritePacketOut(0x2a, &of.PacketOut{BufferId: 0xffffffff, InPort: of.OFPP_NONE,
+		Actions: []of.Action{&of.ActionOutput{Port: 2}}, Data: frame})
+	w.WritePacketOut(0x2a, &of.PacketOut{BufferId: 0x100, InPort: 3}) // no payload
+
+	m := blocks(t, buf.Bytes())
+	if len(m[blockSectionHeader]) != 1 || len(m[blockInterface]) != 1 {
+		t.Fatalf("want one section and interface, got %d and %d",
+			len(m[blockSectionHeader]), len(m[blockInterface]))
+	}
+	if binary.LittleEndian.Uint32(m[blockSectionHeader][0]) != byteOrderMagic {
+		t.Errorf("bad byte order magic")
+	}
+	packets := m[blockEnhancedPacket]
+	if len(packets) != 2 {
+		t.Fatalf("%d packets, want 2", len(packets))
+	}
+	comments := []string{
+		"packet_in dpid=000000000000002a in_port=3 reason=action buffer_id=0x100",
+		"packet_out dpid=000000000000002a in_port=65535 buffer_id=0xffffffff actions=output:2",
+	}
+	for i, p := range packets {
+		usec := uint64(binary.LittleEndian.Uint32(p[4:]))<<32 | uint64(binary.LittleEndian.Uint32(p[8:]))
+		if usec != uint64(stamp.UnixNano()/1000) {
+			t.Errorf("packet %d: timestamp %d", i, usec)
+		}
+		if n := binary.LittleEndian.Uint32(p[12:]); n != uint32(len(frame)) {
+			t.Errorf("packet %d: captured length %d", i, n)
+		}
+		if !bytes.Equal(p[20:20+len(frame)], frame) {
+			t.Errorf("packet %d: frame % x", i, p[20:20+len(frame)])
+		}
+		opts := p[20+pad4(len(frame)):]
+		code, n := binary.LittleEndian.Uint16(opts), int(binary.LittleEndian.Uint16(opts[2:]))
+		if code != optComment || string(opts[4:4+n]) != comments[i] {
+			t.Errorf("packet %d: option %d %q, want comment %q", i, code, opts[4:4+n], comments[i])
+		}
+		if end := opts[4+pad4(n):]; !bytes.Equal(end, []byte{0, 0, 0, 0}) {
+			t.Errorf("packet %d: options end with % x", i, end)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	frame := []byte{0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 1, 8, 6, 0, 1, 2}
+	for _, format := range []Format{PCAP, PCAPNG} {
+		var buf bytes.Buffer
+		w, _ := NewWriter(&buf, format)
+		w.WritePacket(CaptureInfo{Timestamp: stamp, Length: 60, Comment: "hi"}, frame)
+		w.WritePacket(CaptureInfo{Timestamp: stamp.Add(time.Second)}, frame[:14])
+
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Format() != format {
+			t.Errorf("format %d read as %d", format, r.Format())
+		}
+		data, ci, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantComment := "hi"
+		if format == PCAP {
+			wantComment = ""
+		}
+		if !bytes.Equal(data, frame) || !ci.Timestamp.Equal(stamp) || ci.Length != 60 ||
+			ci.Comment != wantComment || r.LinkType() != LinkTypeEthernet {
+			t.Errorf("format %d: read % x %+v", format, data, ci)
+		}
+		data, ci, err = r.ReadPacket()
+		if err != nil || len(data) != 14 || !ci.Timestamp.Equal(stamp.Add(time.Second)) {
+			t.Errorf("format %d: second packet % x %+v %v", format, data, ci, err)
+		}
+		if _, _, err = r.ReadPacket(); err != io.EOF {
+			t.Errorf("format %d: got %v at the end, want EOF", format, err)
+		}
+	}
+}
+
+func TestTicksToTime(t *testing.T) {
+	tests := []struct {
+		ticks   uint64
+		tsresol uint8
+		want    time.Time
+	}{
+		{1300000000123456, 6, time.Unix(1300000000, 123456000)},
+		{1300000000123456789, 9, time.Unix(1300000000, 123456789)},
+		{13000000001, 1, time.Unix(1300000000, 100000000)},
+		{3<<30 | 1<<29, 0x80 | 30, time.Unix(3, 500000000)},
+	}
+	for _, test := range tests {
+		if got := ticksToTime(test.ticks, test.tsresol); !got.Equal(test.want) {
+			t.Errorf("ticksToTime(%d, %#x) = %v, want %v", test.ticks, test.tsresol, got, test.want)
+		}
+	}
+}
+
+// A big-endian pcap file with nanosecond timestamps, as written on other hosts.
+func TestReaderBigEndianNanoseconds(t *testing.T) {
+	b := []byte{0xa1, 0xb2, 0x3c, 0x4d, 0, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0xff, 0xff, 0, 0, 0, 101,
+		0, 0, 0, 5, 0, 0, 0, 7, 0, 0, 0, 2, 0, 0, 0, 2, 0x45, 0}
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ci, err := r.ReadPacket()
+	if err != nil || !bytes.Equal(data, []byte{0x45, 0}) || !ci.Timestamp.Equal(time.Unix(5, 7)) ||
+		r.LinkType() != LinkTypeRaw {
+		t.Errorf("read % x %+v %v, link type %d", data, ci, err, r.LinkType())
+	}
+}
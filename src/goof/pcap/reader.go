@@ -0,0 +1,298 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	blockPacket          = 0x00000002 // obsolete, but still written by old tools
+	blockSimplePacket    = 0x00000003
+	pcapMagicNanoseconds = 0xa1b23c4d
+	optTimestampRes      = 9
+
+	// Longest block or record a Reader accepts, so a corrupt length cannot
+	// make it allocate without bound.
+	maxBlockLen = 1 << 24
+)
+
+type pcapngInterface struct {
+	linkType uint16
+	tsresol  uint8 // if_tsresol; 6 (microseconds) unless the file says otherwise
+}
+
+// A Reader reads packets from a pcap or pcapng file, telling the two apart
+// by their magic numbers.  Files written on hosts of either byte order are
+// read, as are nanosecond pcap files.
+type Reader struct {
+	r        io.Reader
+	format   Format
+	order    binary.ByteOrder
+	nano     bool // pcap timestamps are in nanoseconds
+	linkType uint16
+	ifaces   []pcapngInterface
+	buf      []byte
+}
+
+// Returns a Reader from r, after reading the file header.
+func NewReader(r io.Reader) (*Reader, error) {
+	rd := &Reader{r: r}
+	var magic [4]byte
+	err := rd.readFull(magic[:])
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(magic[:]) == blockSectionHeader {
+		rd.format = PCAPNG
+		err = rd.readSectionHeader()
+		if err != nil {
+			return nil, err
+		}
+		return rd, nil
+	}
+	rd.format = PCAP
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic[:]) {
+		case pcapMagicMicroseconds:
+			rd.order = order
+		case pcapMagicNanoseconds:
+			rd.order = order
+			rd.nano = true
+		}
+	}
+	if rd.order == nil {
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+	header := make([]byte, 20)
+	err = rd.readFull(header)
+	if err != nil {
+		return nil, err
+	}
+	rd.linkType = uint16(rd.order.Uint32(header[16:]))
+	return rd, nil
+}
+
+func (r *Reader) readFull(b []byte) error {
+	_, err := io.ReadFull(r.r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Returns a buffer of n bytes, reusing the last one if it is big enough.
+func (r *Reader) buffer(n int) []byte {
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	return r.buf[:n]
+}
+
+// Returns the format of the file.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Returns the link type of the last packet read, or of the whole file if it
+// is a pcap file.
+func (r *Reader) LinkType() uint16 {
+	return r.linkType
+}
+
+// Reads the next packet.  The data is only valid until the next call.  The
+// error is io.EOF at the end of the file.
+func (r *Reader) ReadPacket() ([]byte, CaptureInfo, error) {
+	if r.format == PCAP {
+		return r.readRecord()
+	}
+	for {
+		data, ci, ok, err := r.readBlock()
+		if err != nil || ok {
+			return data, ci, err
+		}
+	}
+}
+
+func (r *Reader) readRecord() ([]byte, CaptureInfo, error) {
+	var ci CaptureInfo
+	var h [16]byte
+	_, err := io.ReadFull(r.r, h[:])
+	if err != nil {
+		return nil, ci, err
+	}
+	sec := int64(r.order.Uint32(h[0:]))
+	frac := int64(r.order.Uint32(h[4:]))
+	if !r.nano {
+		frac *= 1000
+	}
+	ci.Timestamp = time.Unix(sec, frac)
+	n := r.order.Uint32(h[8:])
+	ci.Length = int(r.order.Uint32(h[12:]))
+	if n > maxBlockLen {
+		return nil, ci, fmt.Errorf("bad record length %d", n)
+	}
+	data := r.buffer(int(n))
+	return data, ci, r.readFull(data)
+}
+
+// Reads the rest of a section header block, whose type has been read, and
+// starts a new section.
+func (r *Reader) readSectionHeader() error {
+	var h [8]byte
+	err := r.readFull(h[:])
+	if err != nil {
+		return err
+	}
+	switch binary.BigEndian.Uint32(h[4:]) {
+	case byteOrderMagic:
+		r.order = binary.BigEndian
+	case 0x4d3c2b1a:
+		r.order = binary.LittleEndian
+	default:
+		return errors.New("bad pcapng byte order magic")
+	}
+	length := r.order.Uint32(h[0:])
+	if length < 28 || length%4 != 0 || length > maxBlockLen {
+		return fmt.Errorf("bad pcapng block length %d", length)
+	}
+	r.ifaces = r.ifaces[:0]
+	return r.readFull(r.buffer(int(length) - 12))
+}
+
+// Reads one pcapng block.  ok is set if it held a packet.
+func (r *Reader) readBlock() (data []byte, ci CaptureInfo, ok bool, err error) {
+	var h [8]byte
+	_, err = io.ReadFull(r.r, h[:4])
+	if err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(h[:4]) == blockSectionHeader {
+		err = r.readSectionHeader()
+		return
+	}
+	err = r.readFull(h[4:])
+	if err != nil {
+		return
+	}
+	t := r.order.Uint32(h[0:])
+	length := r.order.Uint32(h[4:])
+	if length < 12 || length%4 != 0 || length > maxBlockLen {
+		err = fmt.Errorf("bad pcapng block length %d", length)
+		return
+	}
+	body := r.buffer(int(length) - 8)
+	err = r.readFull(body)
+	if err != nil {
+		return
+	}
+	body = body[:len(body)-4] // the trailing copy of the length
+
+	switch t {
+	case blockInterface:
+		if len(body) < 8 {
+			err = errors.New("short pcapng interface block")
+			return
+		}
+		iface := pcapngInterface{linkType: r.order.Uint16(body[0:]), tsresol: 6}
+		r.walkOptions(body[8:], func(code uint16, value []byte) {
+			if code == optTimestampRes && len(value) == 1 {
+				iface.tsresol = value[0]
+			}
+		})
+		r.ifaces = append(r.ifaces, iface)
+	case blockEnhancedPacket, blockPacket:
+		if len(body) < 20 {
+			err = errors.New("short pcapng packet block")
+			return
+		}
+		id := r.order.Uint32(body[0:])
+		if t == blockPacket {
+			id = uint32(r.order.Uint16(body[0:]))
+		}
+		if int(id) >= len(r.ifaces) {
+			err = fmt.Errorf("packet on undescribed interface %d", id)
+			return
+		}
+		iface := r.ifaces[id]
+		ticks := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+		n := int(r.order.Uint32(body[12:]))
+		if n > len(body)-20 {
+			err = errors.New("pcapng packet overruns its block")
+			return
+		}
+		data = body[20 : 20+n]
+		ci.Timestamp = ticksToTime(ticks, iface.tsresol)
+		ci.Length = int(r.order.Uint32(body[16:]))
+		r.walkOptions(body[20+pad4(n):], func(code uint16, value []byte) {
+			if code == optComment {
+				ci.Comment = string(value)
+			}
+		})
+		r.linkType = iface.linkType
+		ok = true
+	case blockSimplePacket:
+		if len(body) < 4 || len(r.ifaces) == 0 {
+			err = errors.New("bad pcapng simple packet block")
+			return
+		}
+		ci.Length = int(r.order.Uint32(body[0:]))
+		data = body[4:]
+		if ci.Length < len(data) {
+			data = data[:ci.Length]
+		}
+		r.linkType = r.ifaces[0].linkType
+		ok = true
+	}
+	return
+}
+
+// Calls f with each option in b, stopping at the end of options or at a
+// malformed one.
+func (r *Reader) walkOptions(b []byte, f func(code uint16, value []byte)) {
+	for len(b) >= 4 {
+		code := r.order.Uint16(b[0:])
+		n := int(r.order.Uint16(b[2:]))
+		if code == optEndOfOpt || 4+n > len(b) {
+			return
+		}
+		f(code, b[4:4+n])
+		if 4+pad4(n) > len(b) {
+			return
+		}
+		b = b[4+pad4(n):]
+	}
+}
+
+// Converts a pcapng timestamp in units given by an if_tsresol value: a
+// negative power of ten, or of two if the top bit is set.
+func ticksToTime(ticks uint64, tsresol uint8) time.Time {
+	if tsresol&0x80 != 0 {
+		shift := uint(tsresol & 0x7f)
+		if shift > 63 {
+			return time.Unix(0, 0)
+		}
+		sec := ticks >> shift
+		frac := float64(ticks&(1<<shift-1)) / math.Exp2(float64(shift))
+		return time.Unix(int64(sec), int64(frac*1e9))
+	}
+	if tsresol > 19 {
+		return time.Unix(0, 0)
+	}
+	perSecond := uint64(1)
+	for i := uint8(0); i < tsresol; i++ {
+		perSecond *= 10
+	}
+	sec := ticks / perSecond
+	frac := ticks % perSecond
+	var nsec uint64
+	if tsresol <= 9 {
+		nsec = frac * (1000000000 / perSecond)
+	} else {
+		nsec = frac / (perSecond / 1000000000)
+	}
+	return time.Unix(int64(sec), int64(nsec))
+}
@@ -0,0 +1,156 @@
+// Package record stores the raw OpenFlow messages of a switch connection,
+// in both directions and with the time each one passed, so the switch side
+// can be replayed into a controller app later (see controller.Replay).
+//
+// A recording starts with an eight byte magic string.  Each message
+// follows as a record header of a big-endian nanosecond Unix time, a
+// direction byte and a 32-bit length, then the message itself.
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const magic = "goofrec1"
+
+const recordHeaderSize = 13
+
+// Longest message a record may hold, as the OpenFlow length field is 16 bits.
+const maxDataLen = 0xffff
+
+type Direction uint8
+
+const (
+	FromSwitch Direction = iota
+	ToSwitch
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FromSwitch:
+		return "switch->controller"
+	case ToSwitch:
+		return "controller->switch"
+	}
+	return fmt.Sprintf("direction %d", uint8(d))
+}
+
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	Data      []byte // one OpenFlow message, header included
+}
+
+// A Writer appends records to a recording.  It is safe for concurrent use,
+// since apps send from goroutines other than the one reading the switch.
+type Writer struct {
+	w      io.Writer
+	closer io.Closer
+	mu     sync.Mutex
+	buf    []byte
+	now    func() time.Time
+}
+
+// Returns a Writer to w, after writing the magic string.
+func NewWriter(w io.Writer) (*Writer, error) {
+	_, err := io.WriteString(w, magic)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, now: time.Now}, nil
+}
+
+// Creates the file path and returns a Writer to it.
+func Create(path string) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.closer = f
+	return w, nil
+}
+
+// Closes the file if the Writer was made by Create.
+func (w *Writer) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+// Records a message passing now in direction d.
+func (w *Writer) Write(d Direction, data []byte) error {
+	if len(data) > maxDataLen {
+		return fmt.Errorf("message of %d bytes is too long to record", len(data))
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := w.buf[:0]
+	var h [recordHeaderSize]byte
+	binary.BigEndian.PutUint64(h[0:], uint64(w.now().UnixNano()))
+	h[8] = byte(d)
+	binary.BigEndian.PutUint32(h[9:], uint32(len(data)))
+	b = append(append(b, h[:]...), data...)
+	w.buf = b
+	_, err := w.w.Write(b)
+	return err
+}
+
+// A Reader reads the records of a recording in order.
+type Reader struct {
+	r      io.Reader
+	header [recordHeaderSize]byte
+}
+
+// Returns a Reader from r, after checking the magic string.
+func NewReader(r io.Reader) (*Reader, error) {
+	var m [len(magic)]byte
+	_, err := io.ReadFull(r, m[:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(m[:]) != magic {
+		return nil, errors.New("not an OpenFlow recording")
+	}
+	return &Reader{r: r}, nil
+}
+
+// Reads the next record.  The error is io.EOF at the end of the recording
+// and io.ErrUnexpectedEOF if it ends inside a record.
+func (r *Reader) Next() (*Record, error) {
+	_, err := io.ReadFull(r.r, r.header[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(r.header[9:])
+	if n > maxDataLen {
+		return nil, fmt.Errorf("bad record length %d", n)
+	}
+	rec := &Record{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(r.header[0:]))),
+		Direction: Direction(r.header[8]),
+		Data:      make([]byte, n),
+	}
+	_, err = io.ReadFull(r.r, rec.Data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
@@ -0,0 +1,54 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := time.Unix(1300000000, 5)
+	w.now = func() time.Time { return stamp }
+	hello := []byte{1, 0, 0, 8, 0, 0, 0, 1}
+	echo := []byte{1, 3, 0, 12, 0, 0, 0, 2, 'p', 'i', 'n', 'g'}
+	w.Write(FromSwitch, hello)
+	w.Write(ToSwitch, echo)
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []Record{{stamp, FromSwitch, hello}, {stamp, ToSwitch, echo}} {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rec.Time.Equal(want.Time) || rec.Direction != want.Direction || !bytes.Equal(rec.Data, want.Data) {
+			t.Errorf("got %+v, want %+v", rec, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("got %v at the end, want EOF", err)
+	}
+
+	r, _ = NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	r.Next()
+	if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v for a truncated record, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestBadMagic(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("goofrec9"))); err == nil {
+		t.Error("accepted a bad magic string")
+	}
+	if _, err := NewReader(bytes.NewReader(nil)); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v for an empty file", err)
+	}
+}
@@ -0,0 +1,153 @@
+package softswitch
+
+import (
+	"encoding/binary"
+	"goof/of"
+	"goof/packets"
+)
+
+// Applies a set-field or VLAN action to frame and returns the result, which
+// may be frame itself or, when a tag was added or removed, a new slice.
+// Actions on headers the frame does not have leave it alone.
+func modify(frame []byte, a of.Action) []byte {
+	if len(frame) < 14 {
+		return frame
+	}
+	switch a := a.(type) {
+	case *of.ActionSetDlSrc:
+		copy(frame[6:12], a.DlAddr[:])
+	case *of.ActionSetDlDst:
+		copy(frame[0:6], a.DlAddr[:])
+	case *of.ActionVlanVid:
+		frame = setTCI(frame, 0x0fff, a.VlanVid&0x0fff)
+	case *of.ActionVlanPcp:
+		frame = setTCI(frame, 0xe000, uint16(a.VlanPcp&7)<<13)
+	case *of.ActionStripVlan:
+		if tagged(frame) {
+			frame = append(frame[:12], frame[16:]...)
+		}
+	case *of.ActionNwAddrSrc:
+		setNwAddr(frame, 12, a.NwAddr)
+	case *of.ActionNwAddrDst:
+		setNwAddr(frame, 16, a.NwAddr)
+	case *of.ActionNwTos:
+		setNwTos(frame, a.NwTos)
+	case *of.ActionTpPortSrc:
+		setTpPort(frame, 0, a.TpPort)
+	case *of.ActionTpPortDst:
+		setTpPort(frame, 2, a.TpPort)
+	}
+	return frame
+}
+
+func tagged(frame []byte) bool {
+	t := packets.EthType(binary.BigEndian.Uint16(frame[12:]))
+	return len(frame) >= 18 && (t == packets.EthTypeVLAN || t == packets.EthTypeQinQ)
+}
+
+// Sets the bits of the outermost tag's TCI that mask selects, pushing an
+// 802.1Q tag with VID and PCP 0 onto an untagged frame first.
+func setTCI(frame []byte, mask, bits uint16) []byte {
+	if !tagged(frame) {
+		tag := []byte{0x81, 0x00, 0, 0}
+		frame = append(frame[:12], append(tag, frame[12:]...)...)
+	}
+	tci := binary.BigEndian.Uint16(frame[14:])
+	binary.BigEndian.PutUint16(frame[14:], tci&^mask|bits)
+	return frame
+}
+
+// Returns the offset of the IPv4 header in frame and its length, or 0 if
+// the frame does not carry a whole one.
+func ipv4(frame []byte) (int, int) {
+	t, off := etherType(frame)
+	if t != packets.EthTypeIP || off+packets.IPHeaderSize > len(frame) {
+		return 0, 0
+	}
+	ihl := int(frame[off]&0xf) << 2
+	if frame[off]>>4 != 4 || ihl < packets.IPHeaderSize || off+ihl > len(frame) {
+		return 0, 0
+	}
+	return off, ihl
+}
+
+// Returns the offset of the TCP or UDP header that follows the IPv4 header
+// at ip and the offset of its checksum.  Both are 0 for fragments after the
+// first and for other protocols.
+func transport(frame []byte, ip, ihl int) (int, int) {
+	if binary.BigEndian.Uint16(frame[ip+6:])&0x1fff != 0 {
+		return 0, 0
+	}
+	l4 := ip + ihl
+	switch packets.Protocol(frame[ip+9]) {
+	case packets.ProtocolTCP:
+		if l4+packets.TCPHeaderSize <= len(frame) {
+			return l4, l4 + 16
+		}
+	case packets.ProtocolUDP:
+		if l4+packets.UDPHeaderSize <= len(frame) {
+			return l4, l4 + 6
+		}
+	}
+	return 0, 0
+}
+
+// Updates the checksum at off for a 16-bit word changing from from to to.
+// A zero UDP checksum means none was computed and stays zero.
+func fixChecksum(frame []byte, off int, from, to uint16, udp bool) {
+	old := binary.BigEndian.Uint16(frame[off:])
+	if udp && old == 0 {
+		return
+	}
+	sum := packets.UpdateChecksum(old, from, to)
+	if udp && sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(frame[off:], sum)
+}
+
+// Rewrites the IPv4 source (field 12) or destination (field 16) address,
+// fixing the IP checksum and the TCP or UDP one, whose pseudo header
+// covers the address too.
+func setNwAddr(frame []byte, field int, addr uint32) {
+	ip, ihl := ipv4(frame)
+	if ip == 0 {
+		return
+	}
+	old := binary.BigEndian.Uint32(frame[ip+field:])
+	binary.BigEndian.PutUint32(frame[ip+field:], addr)
+	for _, half := range []int{0, 2} {
+		from := uint16(old >> uint(16-8*half))
+		to := binary.BigEndian.Uint16(frame[ip+field+half:])
+		fixChecksum(frame, ip+10, from, to, false)
+		if l4, sum := transport(frame, ip, ihl); l4 != 0 {
+			fixChecksum(frame, sum, from, to, frame[ip+9] == byte(packets.ProtocolUDP))
+		}
+	}
+}
+
+// Sets the DSCP bits of the IPv4 ToS field, keeping the ECN bits.
+func setNwTos(frame []byte, tos uint8) {
+	ip, _ := ipv4(frame)
+	if ip == 0 {
+		return
+	}
+	from := binary.BigEndian.Uint16(frame[ip:])
+	frame[ip+1] = frame[ip+1]&3 | tos&0xfc
+	fixChecksum(frame, ip+10, from, binary.BigEndian.Uint16(frame[ip:]), false)
+}
+
+// Sets the TCP or UDP source (field 0) or destination (field 2) port.
+func setTpPort(frame []byte, field int, port uint16) {
+	ip, ihl := ipv4(frame)
+	if ip == 0 {
+		return
+	}
+	l4, sum := transport(frame, ip, ihl)
+	if l4 == 0 {
+		return
+	}
+	from := binary.BigEndian.Uint16(frame[l4+field:])
+	binary.BigEndian.PutUint16(frame[l4+field:], port)
+	fixChecksum(frame, sum, from, port, frame[ip+9] == byte(packets.ProtocolUDP))
+}
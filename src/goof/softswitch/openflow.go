@@ -0,0 +1,442 @@
+package softswitch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"goof/of"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Messages waiting to be written to the controller.  Queueing them lets the
+// switch answer while holding its lock, however slowly the controller
+// reads.
+type outbox struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	queue  [][]byte
+	closed bool
+}
+
+func newOutbox() *outbox {
+	o := &outbox{}
+	o.cond.L = &o.mu
+	return o
+}
+
+func (o *outbox) put(b []byte) {
+	o.mu.Lock()
+	o.queue = append(o.queue, b)
+	o.mu.Unlock()
+	o.cond.Signal()
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+	o.cond.Signal()
+}
+
+// Writes queued messages to w in order until the outbox is closed or a
+// write fails.
+func (o *outbox) drain(w io.Writer) error {
+	for {
+		o.mu.Lock()
+		for len(o.queue) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if o.closed {
+			o.mu.Unlock()
+			return nil
+		}
+		b := o.queue[0]
+		o.queue = o.queue[1:]
+		o.mu.Unlock()
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+}
+
+// Queues a message for the controller.  Messages are dropped while the
+// switch is not connected.
+func (s *Switch) send(msg of.ToSwitch) {
+	if s.out == nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := msg.Write(&buf); err != nil {
+		return
+	}
+	s.out.put(buf.Bytes())
+}
+
+// Connects to a controller listening on addr and serves it.
+func (s *Switch) Dial(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Speaks OpenFlow to the controller at the other end of conn until the
+// connection fails or Close is called.  The switch keeps its flows and
+// ports across connections.  Returns nil if the controller hung up.
+func (s *Switch) Serve(conn net.Conn) error {
+	out := newOutbox()
+	s.mu.Lock()
+	if s.conn != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("switch %016x already connected", s.DatapathId)
+	}
+	s.conn, s.out = conn, out
+	s.send(&of.Hello{})
+	s.mu.Unlock()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		err := out.drain(conn)
+		if err != nil {
+			conn.Close()
+		}
+		writeErr <- err
+	}()
+	stop := make(chan bool)
+	go func() {
+		tick := time.NewTicker(expireInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				s.expire()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err := s.readLoop(conn)
+	close(stop)
+	s.mu.Lock()
+	s.conn, s.out = nil, nil
+	select {
+	case <-s.ready:
+		s.ready = make(chan bool)
+	default:
+	}
+	s.mu.Unlock()
+	out.close()
+	conn.Close()
+	if werr := <-writeErr; err == nil {
+		err = werr
+	}
+	return err
+}
+
+// Waits until the switch is connected and has told the controller its
+// features, which is when a controller takes a switch to be up.  Reports
+// whether that happened within timeout.
+func (s *Switch) WaitReady(timeout time.Duration) bool {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+	select {
+	case <-ready:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Disconnects from the controller.
+func (s *Switch) Close() {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (s *Switch) readLoop(conn net.Conn) error {
+	rb := bufio.NewReader(conn)
+	header := make([]byte, of.HeaderSize)
+	for {
+		if _, err := io.ReadFull(rb, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var h of.Header
+		binary.Read(bytes.NewReader(header), binary.BigEndian, &h)
+		if h.Length < of.HeaderSize {
+			return fmt.Errorf("bad message length %d", h.Length)
+		}
+		raw := make([]byte, h.Length)
+		copy(raw, header)
+		if _, err := io.ReadFull(rb, raw[of.HeaderSize:]); err != nil {
+			return err
+		}
+		var d []delivery
+		s.mu.Lock()
+		s.handle(&h, raw, &d)
+		s.mu.Unlock()
+		deliver(d)
+	}
+}
+
+// Answers a request with an error carrying the start of the request.
+func (s *Switch) error(h *of.Header, raw []byte, t of.ErrorType, code uint16) {
+	if len(raw) > 64 {
+		raw = raw[:64]
+	}
+	s.send(&of.Error{Header: of.Header{Xid: h.Xid}, Type: t, Code: code, Data: raw})
+}
+
+func (s *Switch) handle(h *of.Header, raw []byte, d *[]delivery) {
+	if h.Version != of.OFP_VERSION {
+		s.error(h, raw, of.BadRequest, of.BadRequestBadVersion)
+		return
+	}
+	if h.Type == of.OFPT_VENDOR {
+		s.error(h, raw, of.BadRequest, of.BadRequestBadVendor)
+		return
+	}
+	msg := of.NewMessage(h.Type)
+	if msg == nil {
+		s.error(h, raw, of.BadRequest, of.BadRequestBadType)
+		return
+	}
+	if err := msg.Read(h, raw[of.HeaderSize:]); err != nil {
+		s.error(h, raw, of.BadRequest, of.BadRequestBadLen)
+		return
+	}
+	switch m := msg.(type) {
+	case *of.Hello, *of.EchoReply, *of.Error:
+	case *of.EchoRequest:
+		s.send(&of.EchoReply{Header: of.Header{Xid: h.Xid}, Body: m.Body})
+	case *of.SwitchFeaturesRequest:
+		s.send(s.features(h.Xid))
+		select {
+		case <-s.ready:
+		default:
+			close(s.ready)
+		}
+	case *of.GetConfigRequest:
+		s.send(&of.GetConfigReply{Xid: h.Xid, Flags: s.flags, MissSendLen: s.missSendLen})
+	case *of.SwitchConfig:
+		s.flags, s.missSendLen = m.Flags, m.MissSendLen
+	case *of.PacketOut:
+		s.packetOut(h, raw, m, d)
+	case *of.FlowMod:
+		s.flowMod(h, raw, m, d)
+	case *of.PortMod:
+		s.portMod(h, raw, m)
+	case *of.StatsRequest:
+		s.stats(h, raw, m)
+	case *of.BarrierRequest:
+		// Every earlier message has been handled and answered.
+		s.send(&of.BarrierReply{Xid: h.Xid})
+	default:
+		// Messages only a switch sends.
+		s.error(h, raw, of.BadRequest, of.BadRequestBadType)
+	}
+}
+
+func (s *Switch) features(xid uint32) *of.SwitchFeatures {
+	m := &of.SwitchFeatures{Header: &of.Header{Xid: xid}, DatapathId: s.DatapathId,
+		NBuffers: uint32(s.NBuffers), NTables: 1,
+		Capabilities: of.FlowStats | of.TableStats | of.PortStats,
+		Actions:      1<<(of.OFPAT_ENQUEUE+1) - 1}
+	for _, no := range s.portNumbers() {
+		m.Ports = append(m.Ports, s.ports[no].desc)
+	}
+	return m
+}
+
+// Reports whether the output ports of actions are valid in a flow, which
+// unlike a PacketOut cannot output to OFPP_TABLE.
+func validOutputs(actions []of.Action, flow bool) bool {
+	for _, a := range actions {
+		var port uint16
+		switch a := a.(type) {
+		case *of.ActionOutput:
+			port = a.Port
+		case *of.ActionEnqueue:
+			port = a.Port
+		default:
+			continue
+		}
+		switch {
+		case port == 0 || port == of.OFPP_NONE:
+			return false
+		case port == of.OFPP_TABLE:
+			if flow {
+				return false
+			}
+		case port > of.OFPP_MAX && port < of.OFPP_IN_PORT:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Switch) packetOut(h *of.Header, raw []byte, m *of.PacketOut, d *[]delivery) {
+	if !validOutputs(m.Actions, false) {
+		s.error(h, raw, of.BadAction, of.BadActionBadOutPort)
+		return
+	}
+	in, frame := m.InPort, append([]byte(nil), m.Data...)
+	if m.BufferId != NoBuffer {
+		var code uint16
+		var ok bool
+		_, frame, code, ok = s.takeBuffer(m.BufferId)
+		if !ok {
+			s.error(h, raw, of.BadRequest, code)
+			return
+		}
+	}
+	s.execute(in, frame, m.Actions, d)
+}
+
+func (s *Switch) flowMod(h *of.Header, raw []byte, m *of.FlowMod, d *[]delivery) {
+	switch m.Command {
+	case of.FCAdd, of.FCModify, of.FCModifyStrict:
+		if !validOutputs(m.Actions, true) {
+			s.error(h, raw, of.BadAction, of.BadActionBadOutPort)
+			return
+		}
+	}
+	removed, err := s.table.Apply(m, s.now())
+	if err != nil {
+		code := of.FlowModBadCommand
+		if err == of.ErrFlowOverlap {
+			code = of.FlowModOverlap
+		}
+		s.error(h, raw, of.FlowModFailed, code)
+		return
+	}
+	if m.Command == of.FCDelete || m.Command == of.FCDeleteStrict {
+		for _, e := range removed {
+			s.flowRemoved(e, of.RemovedReasonDelete)
+		}
+		return
+	}
+	if m.BufferId == NoBuffer {
+		return
+	}
+	in, frame, code, ok := s.takeBuffer(m.BufferId)
+	if !ok {
+		s.error(h, raw, of.BadRequest, code)
+		return
+	}
+	// The buffered packet takes the path it would have taken had the flow
+	// been there when it arrived.
+	s.lookup(in, frame, d)
+}
+
+func (s *Switch) portMod(h *of.Header, raw []byte, m *of.PortMod) {
+	p, ok := s.ports[m.PortNo]
+	if !ok {
+		s.error(h, raw, of.PortModFailed, of.PortModBadPort)
+		return
+	}
+	if p.desc.HwAddr != m.HwAddr {
+		s.error(h, raw, of.PortModFailed, of.PortModBadHwAddr)
+		return
+	}
+	p.desc.Config = p.desc.Config&^m.Mask | m.Config&m.Mask
+	if m.Advertise != 0 {
+		p.desc.Advertised = m.Advertise
+	}
+}
+
+// Largest stats reply body that fits in a message.
+const maxStatsBody = 0xffff - of.HeaderSize - 4
+
+func (s *Switch) stats(h *of.Header, raw []byte, m *of.StatsRequest) {
+	req, err := m.Stat()
+	if err != nil {
+		s.error(h, raw, of.BadRequest, of.BadRequestBadStat)
+		return
+	}
+	var stats []of.Stat
+	switch m.Type {
+	case of.StatsDesc:
+		stats = append(stats, s.Desc)
+	case of.StatsFlow:
+		r := req.(*of.FlowStatsRequest)
+		now := s.now()
+		for _, e := range s.selectFlows(r.Match, r.TableId, r.OutPort) {
+			stats = append(stats, e.Stat(now))
+		}
+	case of.StatsAggregate:
+		r := req.(*of.AggregateStatsRequest)
+		agg := &of.AggregateStats{}
+		for _, e := range s.selectFlows(r.Match, r.TableId, r.OutPort) {
+			agg.PacketCount += e.PacketCount
+			agg.ByteCount += e.ByteCount
+			agg.FlowCount++
+		}
+		stats = append(stats, agg)
+	case of.StatsTable:
+		t := &of.TableStat{Wildcards: of.FwAll, MaxEntries: 1 << 20,
+			ActiveCount: uint32(s.table.Len()), LookupCount: s.lookups,
+			MatchedCount: s.matched}
+		copy(t.Name[:], "classifier")
+		stats = append(stats, t)
+	case of.StatsPort:
+		r := req.(*of.PortStatsRequest)
+		for _, no := range s.portNumbers() {
+			if r.PortNo == of.OFPP_NONE || r.PortNo == no {
+				p := s.ports[no].stats
+				stats = append(stats, &p)
+			}
+		}
+	case of.StatsQueue:
+		// There are no queues.
+	default:
+		s.error(h, raw, of.BadRequest, of.BadRequestBadStat)
+		return
+	}
+	s.sendStats(h.Xid, m.Type, stats)
+}
+
+// Selects the flows a flow or aggregate stats request asks for.
+func (s *Switch) selectFlows(match of.Match, table uint8, outPort uint16) []*of.FlowEntry {
+	if table != 0 && table != 0xff {
+		return nil
+	}
+	return s.table.Select(match, outPort)
+}
+
+// Sends stats in as many replies as they need, flagging all but the last
+// with StatsReplyMore.
+func (s *Switch) sendStats(xid uint32, t of.StatsType, stats []of.Stat) {
+	for {
+		n, size := 0, 0
+		for n < len(stats) && size+int(stats[n].Length()) <= maxStatsBody {
+			size += int(stats[n].Length())
+			n++
+		}
+		reply, err := of.NewStatsReply(xid, t, stats[:n]...)
+		if err != nil {
+			return
+		}
+		stats = stats[n:]
+		if len(stats) > 0 {
+			reply.Flags = of.StatsReplyMore
+		}
+		s.send(reply)
+		if len(stats) == 0 || n == 0 {
+			return
+		}
+	}
+}
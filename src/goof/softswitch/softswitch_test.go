@@ -0,0 +1,431 @@
+package softswitch
+
+import (
+	"bufio"
+	"goof/controller"
+	"goof/of"
+	"goof/packets"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The controller end of a connection to a switch, read and written by hand.
+type peer struct {
+	t    *testing.T
+	conn net.Conn
+	rb   *bufio.Reader
+	done chan error
+}
+
+func connect(t *testing.T, sw *Switch) *peer {
+	ctrlEnd, swEnd := net.Pipe()
+	p := &peer{t: t, conn: ctrlEnd, rb: bufio.NewReader(ctrlEnd), done: make(chan error, 1)}
+	go func() { p.done <- sw.Serve(swEnd) }()
+	if _, ok := p.recv().(*of.Hello); !ok {
+		t.Fatal("switch did not say hello")
+	}
+	return p
+}
+
+func (p *peer) send(msg of.ToSwitch) {
+	if err := msg.Write(p.conn); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *peer) recv() interface{} {
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := controller.ReadMsg(p.rb)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return msg
+}
+
+// Sends a barrier and returns the messages that arrive before its reply.
+func (p *peer) sync() []interface{} {
+	p.send(&of.BarrierRequest{Xid: 99})
+	var msgs []interface{}
+	for {
+		msg := p.recv()
+		if r, ok := msg.(*of.BarrierReply); ok && r.Xid == 99 {
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func (p *peer) close() {
+	p.conn.Close()
+	if err := <-p.done; err != nil {
+		p.t.Errorf("Serve: %v", err)
+	}
+}
+
+// Collects the frames a port sends.
+type wire struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (w *wire) out(frame []byte) {
+	w.mu.Lock()
+	w.frames = append(w.frames, frame)
+	w.mu.Unlock()
+}
+
+func (w *wire) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.frames)
+}
+
+func (w *wire) take() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f := w.frames
+	w.frames = nil
+	return f
+}
+
+func newSwitch(nports int) (*Switch, []*wire) {
+	sw := New(0x42)
+	wires := make([]*wire, nports+1)
+	for i := 1; i <= nports; i++ {
+		wires[i] = new(wire)
+		sw.AddPort(uint16(i), "eth", wires[i].out)
+	}
+	return sw, wires
+}
+
+var (
+	mac1 = [6]byte{0, 0, 0, 0, 0, 1}
+	mac2 = [6]byte{0, 0, 0, 0, 0, 2}
+)
+
+func udpFrame(t *testing.T, src, dst [6]byte, srcIP, dstIP uint32, dport uint16) []byte {
+	udp := &packets.UDPHeader{SrcPort: 1000, DstPort: dport, Payload: []byte("hello")}
+	b, err := packets.NewEthFrame(src, dst, packets.NewIPv4(srcIP, dstIP, udp)).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func output(port uint16) []of.Action {
+	return []of.Action{&of.ActionOutput{Port: port}}
+}
+
+func TestMissThenFlow(t *testing.T) {
+	sw, wires := newSwitch(3)
+	p := connect(t, sw)
+	defer p.close()
+
+	p.send(&of.SwitchFeaturesRequest{Xid: 1})
+	f, ok := p.recv().(*of.SwitchFeatures)
+	if !ok || f.DatapathId != 0x42 || len(f.Ports) != 3 || f.Ports[2].PortNo != 3 {
+		t.Fatalf("bad features reply %+v", f)
+	}
+
+	frame := udpFrame(t, mac1, mac2, 0x0a000001, 0x0a000002, 53)
+	sw.Receive(1, frame)
+	in, ok := p.recv().(*of.PacketIn)
+	if !ok || in.Reason != of.ReasonNoMatch || in.InPort != 1 || in.BufferId == NoBuffer ||
+		string(in.Data) != string(frame) {
+		t.Fatalf("bad PacketIn %+v", in)
+	}
+
+	p.send(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll &^ of.FwDlDst, DlDst: mac2},
+		Priority: 10, BufferId: in.BufferId, OutPort: of.OFPP_NONE, Actions: output(2)})
+	if msgs := p.sync(); len(msgs) != 0 {
+		t.Fatalf("unexpected messages %v", msgs)
+	}
+	if got := wires[2].take(); len(got) != 1 || string(got[0]) != string(frame) {
+		t.Fatalf("buffered packet not released to port 2: %v", got)
+	}
+
+	sw.Receive(3, frame)
+	if msgs := p.sync(); len(msgs) != 0 {
+		t.Fatalf("unexpected messages %v", msgs)
+	}
+	if len(wires[2].take()) != 1 || len(wires[1].take())+len(wires[3].take()) != 0 {
+		t.Error("flow did not forward to port 2 only")
+	}
+
+	// The buffer was used up by the FlowMod.
+	p.send(&of.PacketOut{Xid: 5, BufferId: in.BufferId, InPort: 1, Actions: output(3)})
+	e, ok := p.recv().(*of.Error)
+	if !ok || e.Xid != 5 || e.Type != of.BadRequest || e.Code != of.BadRequestBufferEmpty {
+		t.Fatalf("want buffer empty error, got %+v", e)
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	sw, _ := newSwitch(2)
+	p := connect(t, sw)
+	defer p.close()
+
+	p.send(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll &^ of.FwDlDst, DlDst: mac2},
+		Priority: 10, BufferId: NoBuffer, Actions: output(2)})
+	p.send(&of.FlowMod{Xid: 7, Match: of.Match{Wildcards: of.FwAll &^ of.FwInPort, InPort: 1},
+		Priority: 10, BufferId: NoBuffer, Flags: of.CheckOverlap, Actions: output(2)})
+	e, ok := p.recv().(*of.Error)
+	if !ok || e.Xid != 7 || e.Type != of.FlowModFailed || e.Code != of.FlowModOverlap {
+		t.Fatalf("want overlap error, got %+v", e)
+	}
+	if n := sw.FlowCount(); n != 1 {
+		t.Errorf("%d flows after the refused add, want 1", n)
+	}
+}
+
+func TestPacketOut(t *testing.T) {
+	sw, wires := newSwitch(3)
+	p := connect(t, sw)
+	defer p.close()
+
+	frame := udpFrame(t, mac1, mac2, 0x0a000001, 0x0a000002, 53)
+	p.send(&of.PacketOut{BufferId: NoBuffer, InPort: 1, Actions: output(of.PortFlood), Data: frame})
+	p.sync()
+	if len(wires[1].take()) != 0 || len(wires[2].take()) != 1 || len(wires[3].take()) != 1 {
+		t.Error("flood did not reach exactly ports 2 and 3")
+	}
+
+	p.send(&of.PortMod{PortNo: 3, HwAddr: sw.portAddr(3), Config: of.OfppcNoFlood, Mask: of.OfppcNoFlood})
+	p.send(&of.PacketOut{BufferId: NoBuffer, InPort: 1, Actions: output(of.PortFlood), Data: frame})
+	p.send(&of.PacketOut{BufferId: NoBuffer, InPort: 1, Actions: output(of.OFPP_ALL), Data: frame})
+	p.sync()
+	if len(wires[2].take()) != 2 || len(wires[3].take()) != 1 {
+		t.Error("port 3 was flooded despite NoFlood")
+	}
+
+	p.send(&of.PacketOut{BufferId: NoBuffer, InPort: 1, Actions: output(1), Data: frame})
+	p.send(&of.PacketOut{BufferId: NoBuffer, InPort: 1, Actions: output(of.OFPP_IN_PORT), Data: frame})
+	p.sync()
+	if got := len(wires[1].take()); got != 1 {
+		t.Errorf("in_port got %d frames, want 1 through OFPP_IN_PORT only", got)
+	}
+
+	// OFPP_TABLE runs the packet through the flows.
+	p.send(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll &^ of.FwInPort, InPort: 2},
+		Actions: output(3), BufferId: NoBuffer})
+	p.send(&of.PacketOut{BufferId: NoBuffer, InPort: 2, Actions: output(of.OFPP_TABLE), Data: frame})
+	p.sync()
+	if len(wires[3].take()) != 1 {
+		t.Error("OFPP_TABLE did not use the flow table")
+	}
+
+	p.send(&of.PacketOut{Xid: 7, BufferId: 12345, InPort: 1, Actions: output(2)})
+	if e, ok := p.recv().(*of.Error); !ok || e.Code != of.BadRequestBufferUnknown {
+		t.Errorf("want unknown buffer error, got %+v", e)
+	}
+}
+
+func TestActions(t *testing.T) {
+	sw, wires := newSwitch(2)
+	p := connect(t, sw)
+	defer p.close()
+
+	frame := udpFrame(t, mac1, mac2, 0x0a000001, 0x0a000002, 53)
+	p.send(&of.PacketOut{BufferId: NoBuffer, InPort: 1, Data: frame, Actions: []of.Action{
+		&of.ActionNwAddrSrc{NwAddr: 0xc0a80001},
+		&of.ActionTpPortDst{TpPort: 5353},
+		&of.ActionNwTos{NwTos: 0xb8},
+		&of.ActionSetDlDst{DlAddr: [6]byte{2, 0, 0, 0, 0, 9}},
+		&of.ActionVlanVid{VlanVid: 10},
+		&of.ActionOutput{Port: 2},
+		&of.ActionStripVlan{},
+		&of.ActionOutput{Port: 2},
+	}})
+	p.sync()
+	got := wires[2].take()
+	if len(got) != 2 {
+		t.Fatalf("%d frames, want 2", len(got))
+	}
+	for i, b := range got {
+		f, err := packets.Parse(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.VerifyChecksums(); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+		m := of.MatchFromPacket(2, f)
+		if m.NwSrc != 0xc0a80001 || m.TpDst != 5353 || m.NwTOS != 0xb8 ||
+			m.DlDst != [6]byte{2, 0, 0, 0, 0, 9} {
+			t.Errorf("frame %d not rewritten: %+v", i, m)
+		}
+		if wantVLAN := []uint16{10, of.OFP_VLAN_NONE}[i]; m.VLanID != wantVLAN {
+			t.Errorf("frame %d has VLAN %d, want %d", i, m.VLanID, wantVLAN)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	sw, _ := newSwitch(2)
+	p := connect(t, sw)
+	defer p.close()
+
+	// Enough flows that the reply needs two messages.
+	const n = 1000
+	for i := 0; i < n; i++ {
+		p.send(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll &^ of.FwTpDst, TpDst: uint16(i)},
+			Cookie: uint64(i), BufferId: NoBuffer, Actions: output(uint16(1 + i%2))})
+	}
+	sw.Receive(1, udpFrame(t, mac1, mac2, 1, 2, 7))
+
+	req, _ := of.NewStatsRequest(1, of.StatsFlow,
+		&of.FlowStatsRequest{Match: of.Match{Wildcards: of.FwAll}, TableId: 0xff, OutPort: of.OFPP_NONE})
+	p.send(req)
+	var flows []of.Stat
+	for more := true; more; {
+		reply := p.recv().(*of.StatsReply)
+		stats, err := reply.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flows = append(flows, stats...)
+		more = reply.Flags&of.StatsReplyMore != 0
+	}
+	if len(flows) != n {
+		t.Fatalf("%d flow stats, want %d", len(flows), n)
+	}
+	if s := flows[7].(*of.FlowStat); s.Cookie != 7 || s.PacketCount != 1 {
+		t.Errorf("bad stats for the flow that matched: %v", s)
+	}
+
+	req, _ = of.NewStatsRequest(2, of.StatsAggregate,
+		&of.AggregateStatsRequest{Match: of.Match{Wildcards: of.FwAll}, TableId: 0xff, OutPort: 2})
+	p.send(req)
+	stats, _ := p.recv().(*of.StatsReply).Stats()
+	if agg := stats[0].(*of.AggregateStats); agg.FlowCount != n/2 || agg.PacketCount != 1 {
+		t.Errorf("bad aggregate for out_port=2: %v", agg)
+	}
+
+	req, _ = of.NewStatsRequest(3, of.StatsTable, nil)
+	p.send(req)
+	stats, _ = p.recv().(*of.StatsReply).Stats()
+	if ts := stats[0].(*of.TableStat); ts.ActiveCount != n || ts.LookupCount != 1 || ts.MatchedCount != 1 {
+		t.Errorf("bad table stats: %v", ts)
+	}
+
+	req, _ = of.NewStatsRequest(4, of.StatsPort, &of.PortStatsRequest{PortNo: of.OFPP_NONE})
+	p.send(req)
+	stats, _ = p.recv().(*of.StatsReply).Stats()
+	if len(stats) != 2 || stats[0].(*of.PortStat).RxPackets != 1 || stats[1].(*of.PortStat).TxPackets != 1 {
+		t.Errorf("bad port stats: %v", stats)
+	}
+
+	req, _ = of.NewStatsRequest(5, of.StatsDesc, nil)
+	p.send(req)
+	stats, _ = p.recv().(*of.StatsReply).Stats()
+	if d := stats[0].(*of.DescStats); cString(d.HwDesc[:]) != "softswitch" {
+		t.Errorf("bad desc: %v", d)
+	}
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+func TestTimeouts(t *testing.T) {
+	sw, _ := newSwitch(2)
+	now := time.Unix(1000, 0)
+	sw.now = func() time.Time { return now }
+	p := connect(t, sw)
+	defer p.close()
+
+	p.send(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll &^ of.FwInPort, InPort: 1},
+		IdleTimeout: 10, Flags: of.SendFlowRem, Cookie: 1, BufferId: NoBuffer, Actions: output(2)})
+	p.send(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll &^ of.FwInPort, InPort: 2},
+		HardTimeout: 30, Flags: of.SendFlowRem, Cookie: 2, BufferId: NoBuffer, Actions: output(1)})
+	p.send(&of.FlowMod{Match: of.Match{Wildcards: of.FwAll}, HardTimeout: 5,
+		BufferId: NoBuffer, Actions: output(1)})
+	p.sync()
+
+	frame := udpFrame(t, mac1, mac2, 1, 2, 7)
+	for i := 0; i < 3; i++ {
+		now = now.Add(8 * time.Second)
+		sw.Receive(1, frame) // keeps the idle flow alive
+		sw.Receive(2, frame)
+		sw.expire()
+	}
+	if got := sw.FlowCount(); got != 2 {
+		t.Fatalf("%d flows at 24s, want the 2 with longer timeouts", got)
+	}
+	now = now.Add(10 * time.Second)
+	sw.expire()
+	for _, cookie := range []uint64{1, 2} {
+		msg, ok := p.recv().(*of.FlowRemoved)
+		if !ok || msg.Cookie != cookie || msg.PacketCount != 3 {
+			t.Fatalf("bad FlowRemoved %+v", msg)
+		}
+		reason := map[uint64]of.FlowRemovedReason{1: of.RemovedReasonIdleTimeout,
+			2: of.RemovedReasonHardTimeout}[cookie]
+		if msg.Reason != reason || msg.DurationSec != 34 {
+			t.Errorf("flow %d removed for %d after %ds", cookie, msg.Reason, msg.DurationSec)
+		}
+	}
+}
+
+func TestPortStatus(t *testing.T) {
+	sw, wires := newSwitch(2)
+	p := connect(t, sw)
+	defer p.close()
+
+	w := new(wire)
+	sw.AddPort(3, "eth3", w.out)
+	if m, ok := p.recv().(*of.PortStatus); !ok || m.Reason != of.PortAdd || m.Desc.PortNo != 3 {
+		t.Fatalf("bad PortStatus %+v", m)
+	}
+	sw.SetLinkDown(2, true)
+	if m, ok := p.recv().(*of.PortStatus); !ok || m.Reason != of.PortModified ||
+		m.Desc.State&of.OfppsLinkDown == 0 {
+		t.Fatalf("bad PortStatus %+v", m)
+	}
+	p.send(&of.PacketOut{BufferId: NoBuffer, InPort: 1, Actions: output(of.PortFlood),
+		Data: udpFrame(t, mac1, mac2, 1, 2, 7)})
+	p.sync()
+	if len(wires[2].take()) != 0 || len(w.take()) != 1 {
+		t.Error("flood went out of a port whose link is down")
+	}
+	sw.RemovePort(3)
+	if m, ok := p.recv().(*of.PortStatus); !ok || m.Reason != of.PortDeleted {
+		t.Fatalf("bad PortStatus %+v", m)
+	}
+}
+
+// A hub written against package controller drives the switch.
+func TestController(t *testing.T) {
+	sw, wires := newSwitch(3)
+	ctrlEnd, swEnd := net.Pipe()
+	c := controller.NewSwitch(ctrlEnd)
+	online := make(chan uint64, 1)
+	c.HandleSwitchFeatures = func(msg *of.SwitchFeatures) { online <- msg.DatapathId }
+	c.HandlePacketIn = func(msg *of.PacketIn) {
+		c.Send(&of.PacketOut{BufferId: msg.BufferId, InPort: msg.InPort, Actions: output(of.PortFlood)})
+	}
+	go c.Serve()
+	done := make(chan error)
+	go func() { done <- sw.Serve(swEnd) }()
+	if dpid := <-online; dpid != 0x42 {
+		t.Errorf("datapath %x online, want 42", dpid)
+	}
+
+	sw.Receive(2, udpFrame(t, mac1, mac2, 1, 2, 7))
+	deadline := time.Now().Add(5 * time.Second)
+	for wires[1].count()+wires[3].count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(wires[1].take()) != 1 || len(wires[2].take()) != 0 || len(wires[3].take()) != 1 {
+		t.Error("hub did not flood the packet")
+	}
+	c.Close()
+	<-done
+}
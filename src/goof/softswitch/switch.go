@@ -0,0 +1,369 @@
+// Package softswitch emulates an OpenFlow 1.0 switch in memory, so that
+// controller apps can be tested without Mininet or a real datapath.
+//
+// A Switch has numbered ports, each wired to a function that takes the
+// frames the switch sends out of it.  Frames are fed in with Receive.  The
+// switch forwards them through a single flow table with priorities,
+// wildcards and timeouts, buffers misses and sends them to the controller
+// as PacketIns, and answers the controller's PacketOuts, FlowMods, stats
+// requests and barriers the way the reference switch does.
+package softswitch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"goof/of"
+	"goof/packets"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The BufferId of a packet that is not buffered.
+const NoBuffer = 0xffffffff
+
+// How many bytes of a missed packet are sent to the controller until it
+// sets another MissSendLen.
+const DefaultMissSendLen = 128
+
+// How often flow timeouts are checked while connected.
+const expireInterval = 100 * time.Millisecond
+
+type port struct {
+	desc  of.PhyPort
+	out   func(frame []byte)
+	stats of.PortStat
+}
+
+// Reports whether the port passes frames in the direction that drops on
+// config bits block.
+func (p *port) up(block uint32) bool {
+	return p.desc.Config&(of.OfppcPortDown|block) == 0 &&
+		p.desc.State&of.OfppsLinkDown == 0
+}
+
+type buffer struct {
+	id     uint32
+	inPort uint16
+	frame  []byte // nil once used
+}
+
+// A frame to hand to a port's out function once the switch is unlocked.
+type delivery struct {
+	out   func(frame []byte)
+	frame []byte
+}
+
+type Switch struct {
+	DatapathId uint64
+	NBuffers   int           // packets buffered for the controller; set before Serve
+	Desc       *of.DescStats // answer to desc stats requests
+
+	mu          sync.Mutex
+	ports       map[uint16]*port
+	table       of.FlowTable
+	buffers     []buffer
+	nextBuffer  uint32
+	flags       of.ConfigFlags
+	missSendLen uint16
+	lookups     uint64
+	matched     uint64
+	conn        net.Conn
+	out         *outbox
+	ready       chan bool // closed once the controller has the features
+	now         func() time.Time
+}
+
+func New(dpid uint64) *Switch {
+	return &Switch{
+		DatapathId:  dpid,
+		NBuffers:    256,
+		Desc:        of.NewDescStats("goof", "softswitch", "softswitch", "None", fmt.Sprintf("dpid %016x", dpid)),
+		ports:       make(map[uint16]*port),
+		missSendLen: DefaultMissSendLen,
+		ready:       make(chan bool),
+		now:         time.Now,
+	}
+}
+
+// Returns the hardware address of a port, made up from the datapath ID.
+func (s *Switch) portAddr(no uint16) [of.EthAlen]uint8 {
+	return [of.EthAlen]uint8{0x02, byte(s.DatapathId >> 16), byte(s.DatapathId >> 8),
+		byte(s.DatapathId), byte(no >> 8), byte(no)}
+}
+
+// Adds port no, whose outgoing frames go to out.  The controller is told if
+// the switch is connected.  Adding a port that exists replaces it.
+func (s *Switch) AddPort(no uint16, name string, out func(frame []byte)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := &port{out: out}
+	p.desc.PortNo = no
+	p.desc.HwAddr = s.portAddr(no)
+	copy(p.desc.Name[:len(p.desc.Name)-1], name)
+	p.desc.Curr = of.Ppf1GBFd | of.PpfCopper
+	p.desc.Supported = p.desc.Curr
+	p.stats.PortNo = no
+	s.ports[no] = p
+	s.portStatus(of.PortAdd, p)
+}
+
+func (s *Switch) RemovePort(no uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.ports[no]
+	if !ok {
+		return
+	}
+	delete(s.ports, no)
+	s.portStatus(of.PortDeleted, p)
+}
+
+// Sets or clears the link down state of a port, as pulling a cable would.
+func (s *Switch) SetLinkDown(no uint16, down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.ports[no]
+	if !ok || (p.desc.State&of.OfppsLinkDown != 0) == down {
+		return
+	}
+	p.desc.State ^= of.OfppsLinkDown
+	s.portStatus(of.PortModified, p)
+}
+
+func (s *Switch) portStatus(reason of.Ppr, p *port) {
+	s.send(&of.PortStatus{Header: &of.Header{}, Reason: reason, Desc: p.desc})
+}
+
+// Returns the port numbers in order, so that floods are deterministic.
+func (s *Switch) portNumbers() []uint16 {
+	nos := make([]uint16, 0, len(s.ports))
+	for no := range s.ports {
+		nos = append(nos, no)
+	}
+	sort.Slice(nos, func(i, j int) bool { return nos[i] < nos[j] })
+	return nos
+}
+
+// Handles a frame arriving on a port.  The frame is copied, so the caller
+// may reuse it.  Frames the switch forwards are handed to the out functions
+// of the ports before Receive returns.
+func (s *Switch) Receive(in uint16, frame []byte) {
+	frame = append([]byte(nil), frame...)
+	var d []delivery
+	s.mu.Lock()
+	s.receive(in, frame, &d)
+	s.mu.Unlock()
+	deliver(d)
+}
+
+func deliver(d []delivery) {
+	for _, x := range d {
+		x.out(x.frame)
+	}
+}
+
+func (s *Switch) receive(in uint16, frame []byte, d *[]delivery) {
+	p, ok := s.ports[in]
+	if !ok {
+		return
+	}
+	p.stats.RxPackets++
+	p.stats.RxBytes += uint64(len(frame))
+	if !p.up(of.OfppcNoRecv) {
+		p.stats.RxDropped++
+		return
+	}
+	s.lookup(in, frame, d)
+}
+
+// Runs a frame through the flow table, sending it to the controller on a
+// miss.
+func (s *Switch) lookup(in uint16, frame []byte, d *[]delivery) {
+	f, _ := packets.Parse(frame)
+	if f == nil {
+		return // shorter than an Ethernet header
+	}
+	match := of.MatchFromPacket(in, f)
+	s.lookups++
+	e := s.table.Lookup(&match)
+	if e == nil {
+		if p, ok := s.ports[in]; !ok || p.desc.Config&of.OfppcNoPacketIn == 0 {
+			s.packetIn(in, frame, of.ReasonNoMatch, s.missSendLen)
+		}
+		return
+	}
+	s.matched++
+	s.hit(e, frame)
+	s.execute(in, frame, e.Actions, d)
+}
+
+func (s *Switch) hit(e *of.FlowEntry, frame []byte) {
+	e.PacketCount++
+	e.ByteCount += uint64(len(frame))
+	e.LastUsed = s.now()
+}
+
+// Applies actions to frame, which the switch owns, in order.
+func (s *Switch) execute(in uint16, frame []byte, actions []of.Action, d *[]delivery) {
+	for _, a := range actions {
+		switch a := a.(type) {
+		case *of.ActionOutput:
+			s.output(in, frame, a.Port, a.MaxLen, d)
+		case *of.ActionEnqueue:
+			s.output(in, frame, a.Port, 0, d) // there are no queues
+		default:
+			frame = modify(frame, a)
+		}
+	}
+}
+
+// Sends a copy of frame out of port, which may be one of the fake ports.
+func (s *Switch) output(in uint16, frame []byte, port, maxLen uint16, d *[]delivery) {
+	switch port {
+	case of.OFPP_IN_PORT:
+		s.transmit(in, frame, d)
+	case of.OFPP_TABLE:
+		s.lookup(in, append([]byte(nil), frame...), d)
+	case of.OFPP_NORMAL, of.PortFlood, of.OFPP_ALL:
+		for _, no := range s.portNumbers() {
+			if no == in || port != of.OFPP_ALL && s.ports[no].desc.Config&of.OfppcNoFlood != 0 {
+				continue
+			}
+			s.transmit(no, frame, d)
+		}
+	case of.OFPP_CONTROLLER:
+		s.packetIn(in, frame, of.ReasonAction, maxLen)
+	case of.OFPP_LOCAL, of.OFPP_NONE:
+	default:
+		if port != in { // sending back out of in_port takes OFPP_IN_PORT
+			s.transmit(port, frame, d)
+		}
+	}
+}
+
+func (s *Switch) transmit(no uint16, frame []byte, d *[]delivery) {
+	p, ok := s.ports[no]
+	if !ok {
+		return
+	}
+	if !p.up(of.OfppcNoFwd) || p.out == nil {
+		p.stats.TxDropped++
+		return
+	}
+	p.stats.TxPackets++
+	p.stats.TxBytes += uint64(len(frame))
+	*d = append(*d, delivery{p.out, append([]byte(nil), frame...)})
+}
+
+// Sends the first maxLen bytes of frame to the controller, buffering the
+// whole frame if there is room.
+func (s *Switch) packetIn(in uint16, frame []byte, reason uint8, maxLen uint16) {
+	if s.out == nil {
+		return
+	}
+	id := uint32(NoBuffer)
+	data := frame
+	if s.NBuffers > 0 {
+		id = s.buffer(in, frame)
+		if len(data) > int(maxLen) {
+			data = data[:maxLen]
+		}
+	}
+	s.send(&of.PacketIn{Header: &of.Header{}, BufferId: id, TotalLen: uint16(len(frame)),
+		InPort: in, Reason: reason, Data: data})
+}
+
+// Stores a frame for a later PacketOut or FlowMod, overwriting the oldest
+// buffer when all are in use.
+func (s *Switch) buffer(in uint16, frame []byte) uint32 {
+	if len(s.buffers) != s.NBuffers {
+		s.buffers = make([]buffer, s.NBuffers)
+	}
+	id := s.nextBuffer
+	s.nextBuffer++
+	if s.nextBuffer == NoBuffer {
+		s.nextBuffer = 0
+	}
+	s.buffers[id%uint32(len(s.buffers))] = buffer{id, in, frame}
+	return id
+}
+
+// Returns a buffered frame and forgets it.  The error code is set if there
+// is no such buffer.
+func (s *Switch) takeBuffer(id uint32) (uint16, []byte, uint16, bool) {
+	if len(s.buffers) == 0 {
+		return 0, nil, of.BadRequestBufferUnknown, false
+	}
+	b := &s.buffers[id%uint32(len(s.buffers))]
+	if b.id != id {
+		return 0, nil, of.BadRequestBufferUnknown, false
+	}
+	if b.frame == nil {
+		return 0, nil, of.BadRequestBufferEmpty, false
+	}
+	in, frame := b.inPort, b.frame
+	b.frame = nil
+	return in, frame, 0, true
+}
+
+// Removes the flows whose timeouts have passed.
+func (s *Switch) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed, reasons := s.table.Expire(s.now())
+	for i, e := range removed {
+		s.flowRemoved(e, reasons[i])
+	}
+}
+
+func (s *Switch) flowRemoved(e *of.FlowEntry, reason of.FlowRemovedReason) {
+	if e.Flags&of.SendFlowRem == 0 {
+		return
+	}
+	d := s.now().Sub(e.Created)
+	m := &of.FlowRemoved{}
+	m.Match = e.Match
+	m.Cookie = e.Cookie
+	m.Priority = e.Priority
+	m.Reason = reason
+	m.DurationSec = uint32(d / time.Second)
+	m.DurationNsec = uint32(d % time.Second)
+	m.IdleTimeout = e.IdleTimeout
+	m.PacketCount = e.PacketCount
+	m.ByteCount = e.ByteCount
+	s.send(m)
+}
+
+// Returns the number of entries in the flow table.
+func (s *Switch) FlowCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.table.Len()
+}
+
+// Returns the counters of a port.
+func (s *Switch) PortStats(no uint16) (of.PortStat, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.ports[no]
+	if !ok {
+		return of.PortStat{}, false
+	}
+	return p.stats, true
+}
+
+// Returns the EtherType of a frame, past any VLAN tags, and the offset of
+// the payload.
+func etherType(frame []byte) (packets.EthType, int) {
+	off := 12
+	for off+2 <= len(frame) {
+		t := packets.EthType(binary.BigEndian.Uint16(frame[off:]))
+		if t != packets.EthTypeVLAN && t != packets.EthTypeQinQ {
+			return t, off + 2
+		}
+		off += 4
+	}
+	return 0, len(frame)
+}
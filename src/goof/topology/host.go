@@ -0,0 +1,259 @@
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"goof/packets"
+	"sync"
+	"time"
+)
+
+var ErrTimeout = errors.New("timed out")
+var ErrRefused = errors.New("connection refused")
+
+// Keys of the replies a host waits for.
+type (
+	arpKey  struct{ ip uint32 }
+	echoKey struct{ id, seq uint16 }
+	synKey  struct {
+		ip           uint32
+		sport, dport uint16
+	}
+)
+
+// A host with one interface.  It answers ARP requests for its address and
+// pings, and accepts TCP connections to the ports it listens on far enough
+// to answer a SYN with a SYN-ACK; closed ports answer with a RST.
+type Host struct {
+	Name string
+	MAC  [6]byte
+	IP   uint32
+
+	send func(frame []byte)
+
+	mu        sync.Mutex
+	arp       map[uint32][6]byte
+	waiting   map[interface{}]chan error
+	listening map[uint16]bool
+	next      uint16 // echo sequence numbers and TCP source ports
+	received  []*packets.EthFrame
+}
+
+func newHost(name string, i int) *Host {
+	return &Host{
+		Name:      name,
+		MAC:       [6]byte{0, 0, 0, 0, byte(i >> 8), byte(i)},
+		IP:        0x0a000000 | uint32(i),
+		arp:       make(map[uint32][6]byte),
+		waiting:   make(map[interface{}]chan error),
+		listening: make(map[uint16]bool),
+	}
+}
+
+// Sends a frame out of the host's interface.
+func (h *Host) Send(frame []byte) {
+	h.send(append([]byte(nil), frame...))
+}
+
+func (h *Host) sendFrame(dst [6]byte, body interface{}) error {
+	b, err := packets.NewEthFrame(h.MAC, dst, body).Serialize()
+	if err != nil {
+		return err
+	}
+	h.send(b)
+	return nil
+}
+
+// Registers interest in a reply; the caller must then wait for it.
+func (h *Host) expect(key interface{}) chan error {
+	c := make(chan error, 1)
+	h.mu.Lock()
+	h.waiting[key] = c
+	h.mu.Unlock()
+	return c
+}
+
+func (h *Host) wait(key interface{}, c chan error, timeout time.Duration) error {
+	select {
+	case err := <-c:
+		return err
+	case <-time.After(timeout):
+		h.mu.Lock()
+		delete(h.waiting, key)
+		h.mu.Unlock()
+		return ErrTimeout
+	}
+}
+
+// Delivers the outcome of something waited for.  Replies nobody waits for
+// are dropped.
+func (h *Host) wake(key interface{}, err error) {
+	h.mu.Lock()
+	c, ok := h.waiting[key]
+	delete(h.waiting, key)
+	h.mu.Unlock()
+	if ok {
+		c <- err
+	}
+}
+
+func (h *Host) nextNumber() uint16 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.next++
+	return h.next
+}
+
+// Returns the MAC address of ip, sending an ARP request unless the host
+// already knows it.
+func (h *Host) Resolve(ip uint32, timeout time.Duration) ([6]byte, error) {
+	h.mu.Lock()
+	mac, ok := h.arp[ip]
+	h.mu.Unlock()
+	if ok {
+		return mac, nil
+	}
+	key := arpKey{ip}
+	c := h.expect(key)
+	h.send(packets.NewARPRequest(h.MAC, h.IP, ip).FrameBytes())
+	if err := h.wait(key, c, timeout); err != nil {
+		return mac, fmt.Errorf("ARP for %s: %v", formatIP(ip), err)
+	}
+	h.mu.Lock()
+	mac = h.arp[ip]
+	h.mu.Unlock()
+	return mac, nil
+}
+
+// Sends one echo request to ip and waits for the reply.
+func (h *Host) Ping(ip uint32, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	mac, err := h.Resolve(ip, timeout)
+	if err != nil {
+		return err
+	}
+	key := echoKey{uint16(h.IP), h.nextNumber()}
+	c := h.expect(key)
+	err = h.sendFrame(mac, packets.NewIPv4(h.IP, ip, &packets.ICMPHeader{
+		Type: packets.ICMPEchoRequest, ID: key.id, Seq: key.seq, Payload: []byte("goof ping")}))
+	if err != nil {
+		return err
+	}
+	return h.wait(key, c, time.Until(deadline))
+}
+
+// Makes the host accept TCP connections on port.
+func (h *Host) Listen(port uint16) {
+	h.mu.Lock()
+	h.listening[port] = true
+	h.mu.Unlock()
+}
+
+// Sends a SYN to port on ip and waits for the SYN-ACK, which is answered
+// with an ACK.  Returns ErrRefused if the port is closed.
+func (h *Host) Dial(ip uint32, port uint16, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	mac, err := h.Resolve(ip, timeout)
+	if err != nil {
+		return err
+	}
+	key := synKey{ip, 32768 + h.nextNumber(), port}
+	c := h.expect(key)
+	err = h.sendFrame(mac, packets.NewIPv4(h.IP, ip, &packets.TCPHeader{
+		SrcPort: key.sport, DstPort: port, Seq: 1000, Flags: packets.TCPSyn, Window: 65535}))
+	if err != nil {
+		return err
+	}
+	return h.wait(key, c, time.Until(deadline))
+}
+
+// Returns the frames addressed to the host that it received, and forgets
+// them.
+func (h *Host) Received() []*packets.EthFrame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.received
+	h.received = nil
+	return r
+}
+
+// Handles a frame arriving on the interface.  Frames for other hosts, as
+// switches flood them, are dropped as a NIC would.
+func (h *Host) receive(frame []byte) {
+	f, err := packets.Parse(frame)
+	if err != nil || f.DstMAC != h.MAC && f.DstMAC != packets.BroadcastMAC {
+		return
+	}
+	h.mu.Lock()
+	h.received = append(h.received, f)
+	h.mu.Unlock()
+	switch body := f.Body.(type) {
+	case *packets.ARPPacket:
+		h.receiveARP(body)
+	case *packets.IPFragment:
+		if body.DstAddr != h.IP {
+			return
+		}
+		switch l4 := body.Body.(type) {
+		case *packets.ICMPHeader:
+			h.receiveICMP(f, body, l4)
+		case *packets.TCPHeader:
+			h.receiveTCP(f, body, l4)
+		}
+	}
+}
+
+func (h *Host) receiveARP(p *packets.ARPPacket) {
+	if p.TargetIP != h.IP {
+		return
+	}
+	h.mu.Lock()
+	h.arp[p.SenderIP] = p.SenderHW
+	h.mu.Unlock()
+	switch p.Operation {
+	case packets.ARPRequest:
+		h.send(packets.NewARPReply(p, h.MAC).FrameBytes())
+	case packets.ARPReply:
+		h.wake(arpKey{p.SenderIP}, nil)
+	}
+}
+
+func (h *Host) receiveICMP(f *packets.EthFrame, ip *packets.IPFragment, icmp *packets.ICMPHeader) {
+	switch icmp.Type {
+	case packets.ICMPEchoRequest:
+		h.sendFrame(f.SrcMAC, packets.NewIPv4(h.IP, ip.SrcAddr, &packets.ICMPHeader{
+			Type: packets.ICMPEchoReply, ID: icmp.ID, Seq: icmp.Seq,
+			Payload: append([]byte(nil), icmp.Payload...)}))
+	case packets.ICMPEchoReply:
+		h.wake(echoKey{icmp.ID, icmp.Seq}, nil)
+	}
+}
+
+func (h *Host) receiveTCP(f *packets.EthFrame, ip *packets.IPFragment, tcp *packets.TCPHeader) {
+	reply := func(flags packets.TCPFlags, seq uint32) {
+		h.sendFrame(f.SrcMAC, packets.NewIPv4(h.IP, ip.SrcAddr, &packets.TCPHeader{
+			SrcPort: tcp.DstPort, DstPort: tcp.SrcPort, Seq: seq, Ack: tcp.Seq + 1,
+			Flags: flags, Window: 65535}))
+	}
+	key := synKey{ip.SrcAddr, tcp.DstPort, tcp.SrcPort}
+	switch {
+	case tcp.Flags&packets.TCPRst != 0:
+		h.wake(key, ErrRefused)
+	case tcp.Flags&(packets.TCPSyn|packets.TCPAck) == packets.TCPSyn|packets.TCPAck:
+		reply(packets.TCPAck, tcp.Ack)
+		h.wake(key, nil)
+	case tcp.Flags&packets.TCPSyn != 0:
+		h.mu.Lock()
+		open := h.listening[tcp.DstPort]
+		h.mu.Unlock()
+		if open {
+			reply(packets.TCPSyn|packets.TCPAck, 5000)
+		} else {
+			reply(packets.TCPRst|packets.TCPAck, 0)
+		}
+	}
+}
+
+func formatIP(ip uint32) string {
+	return fmt.Sprintf("%d.%d.%d.%d", byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
+}
@@ -0,0 +1,208 @@
+package topology
+
+import (
+	"fmt"
+	"goof/controller"
+	"goof/softswitch"
+	"net"
+	"sync"
+	"time"
+)
+
+// A frame on its way across a link.
+type transfer struct {
+	to    func(frame []byte)
+	frame []byte
+}
+
+// The switches and hosts of a Spec, with links between them.  Frames cross
+// links one at a time on a goroutine of the network's own, so a switch
+// flooding into another never recurses into it, and hosts answer on that
+// goroutine too.
+type Network struct {
+	Switches []*softswitch.Switch
+	Hosts    []*Host
+
+	nodes map[string]interface{} // *softswitch.Switch or *Host
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	queue   []transfer
+	busy    bool
+	stopped bool
+	pumped  chan bool // closed when the pump returns
+
+	conns   []net.Conn // to the controller
+	serving sync.WaitGroup
+}
+
+// Builds the network described by spec.  Its switches are not connected to
+// a controller until Start or Dial.
+func New(spec *Spec) (*Network, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	n := &Network{nodes: make(map[string]interface{}), pumped: make(chan bool)}
+	n.cond.L = &n.mu
+	for i, name := range spec.Switches {
+		sw := softswitch.New(uint64(i + 1))
+		n.Switches = append(n.Switches, sw)
+		n.nodes[name] = sw
+	}
+	for i, name := range spec.Hosts {
+		h := newHost(name, i+1)
+		n.Hosts = append(n.Hosts, h)
+		n.nodes[name] = h
+	}
+	ports := make(map[string]uint16)
+	// Returns the function that delivers frames to node, and attaches
+	// send, which sends frames out of it.
+	attach := func(node string, send func(frame []byte)) func(frame []byte) {
+		switch x := n.nodes[node].(type) {
+		case *softswitch.Switch:
+			ports[node]++
+			no := ports[node]
+			x.AddPort(no, fmt.Sprintf("%s-eth%d", node, no), send)
+			return func(frame []byte) { x.Receive(no, frame) }
+		case *Host:
+			x.send = send
+			return x.receive
+		}
+		panic("unknown node " + node)
+	}
+	for _, l := range spec.Links {
+		var toA, toB func(frame []byte)
+		toA = attach(l.A, func(frame []byte) { n.post(toB, frame) })
+		toB = attach(l.B, func(frame []byte) { n.post(toA, frame) })
+	}
+	go n.pump()
+	return n, nil
+}
+
+// Returns the switch or host called name, or nil.
+func (n *Network) Switch(name string) *softswitch.Switch {
+	sw, _ := n.nodes[name].(*softswitch.Switch)
+	return sw
+}
+
+func (n *Network) Host(name string) *Host {
+	h, _ := n.nodes[name].(*Host)
+	return h
+}
+
+// Queues a frame to cross a link.  The frame must not be changed after.
+func (n *Network) post(to func(frame []byte), frame []byte) {
+	n.mu.Lock()
+	if !n.stopped {
+		n.queue = append(n.queue, transfer{to, frame})
+		n.cond.Broadcast()
+	}
+	n.mu.Unlock()
+}
+
+func (n *Network) pump() {
+	defer close(n.pumped)
+	for {
+		n.mu.Lock()
+		for len(n.queue) == 0 && !n.stopped {
+			n.busy = false
+			n.cond.Broadcast()
+			n.cond.Wait()
+		}
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		t := n.queue[0]
+		n.queue = n.queue[1:]
+		n.busy = true
+		n.mu.Unlock()
+		t.to(t.frame)
+	}
+}
+
+// Waits until no frame is on a link.  Frames still on their way to or from
+// the controller are not waited for.
+func (n *Network) Settle() {
+	n.mu.Lock()
+	for (len(n.queue) > 0 || n.busy) && !n.stopped {
+		n.cond.Wait()
+	}
+	n.mu.Unlock()
+}
+
+// How long Start and Dial wait for the controller to take each switch up.
+const startTimeout = 5 * time.Second
+
+// Connects every switch to the controller app h over an in-memory
+// connection, as if each had connected to controller.Controller.Accept, and
+// waits until the app has every switch's features.
+func (n *Network) Start(h controller.NewSwitchHandler) error {
+	for _, sw := range n.Switches {
+		ctrlEnd, swEnd := net.Pipe()
+		go h(controller.NewSwitch(ctrlEnd))
+		n.serve(sw, swEnd)
+	}
+	return n.waitReady()
+}
+
+// Connects every switch to the controller listening at addr and waits
+// until the controller has every switch's features.
+func (n *Network) Dial(addr string) error {
+	for _, sw := range n.Switches {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		n.serve(sw, conn)
+	}
+	return n.waitReady()
+}
+
+func (n *Network) waitReady() error {
+	for _, sw := range n.Switches {
+		if !sw.WaitReady(startTimeout) {
+			return fmt.Errorf("switch %016x did not connect", sw.DatapathId)
+		}
+	}
+	return nil
+}
+
+func (n *Network) serve(sw *softswitch.Switch, conn net.Conn) {
+	n.conns = append(n.conns, conn)
+	n.serving.Add(1)
+	go func() {
+		defer n.serving.Done()
+		sw.Serve(conn)
+	}()
+}
+
+// Disconnects the switches and stops carrying frames.
+func (n *Network) Stop() {
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	n.serving.Wait()
+	n.mu.Lock()
+	n.stopped = true
+	n.cond.Broadcast()
+	n.mu.Unlock()
+	<-n.pumped
+}
+
+// Has every host ping every other one, like Mininet's pingAll, and returns
+// an error for each pair that got no reply.
+func (n *Network) PingAll(timeout time.Duration) []error {
+	var errs []error
+	for _, src := range n.Hosts {
+		for _, dst := range n.Hosts {
+			if src == dst {
+				continue
+			}
+			if err := src.Ping(dst.IP, timeout); err != nil {
+				errs = append(errs, fmt.Errorf("%s -> %s: %v", src.Name, dst.Name, err))
+			}
+		}
+	}
+	return errs
+}
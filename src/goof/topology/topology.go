@@ -0,0 +1,164 @@
+// Package topology wires emulated switches and hosts into networks, so that
+// controller apps can be tested the way Mininet tests them, from a Go test
+// and without root.
+//
+// A Spec names the switches and hosts and lists the links between them.
+// Tree, Linear and FatTree build the usual ones; any other is written out
+// by hand.  New turns a Spec into a Network of softswitch.Switches and
+// Hosts, and Start connects every switch to a controller app.
+package topology
+
+import (
+	"fmt"
+)
+
+// A link between two nodes, named as in the Spec.
+type Link struct {
+	A, B string
+}
+
+// The shape of a network.  Switch ports are numbered from 1 in the order
+// the switch's links are listed, and datapath IDs and host addresses follow
+// the order of Switches and Hosts, as in Mininet: switch i has datapath ID
+// i, host i has IP 10.0.0.i and MAC 00:00:00:00:00:i, counting from 1.
+type Spec struct {
+	Switches []string
+	Hosts    []string
+	Links    []Link
+}
+
+// Checks that names are unique, that links join known nodes, and that
+// every host has exactly one link.
+func (s *Spec) Validate() error {
+	kinds := make(map[string]string)
+	for _, name := range s.Switches {
+		if kinds[name] != "" {
+			return fmt.Errorf("duplicate node %q", name)
+		}
+		kinds[name] = "switch"
+	}
+	for _, name := range s.Hosts {
+		if kinds[name] != "" {
+			return fmt.Errorf("duplicate node %q", name)
+		}
+		kinds[name] = "host"
+	}
+	if len(s.Hosts) > 254 {
+		return fmt.Errorf("%d hosts do not fit in 10.0.0.0/24", len(s.Hosts))
+	}
+	links := make(map[string]int)
+	for _, l := range s.Links {
+		for _, name := range []string{l.A, l.B} {
+			if kinds[name] == "" {
+				return fmt.Errorf("link %s-%s: unknown node %q", l.A, l.B, name)
+			}
+			links[name]++
+		}
+		if l.A == l.B {
+			return fmt.Errorf("link %s-%s loops back", l.A, l.B)
+		}
+	}
+	for _, name := range s.Hosts {
+		if links[name] != 1 {
+			return fmt.Errorf("host %q has %d links, want 1", name, links[name])
+		}
+	}
+	return nil
+}
+
+func (s *Spec) addSwitch() string {
+	name := fmt.Sprintf("s%d", len(s.Switches)+1)
+	s.Switches = append(s.Switches, name)
+	return name
+}
+
+func (s *Spec) addHost(name string) string {
+	if name == "" {
+		name = fmt.Sprintf("h%d", len(s.Hosts)+1)
+	}
+	s.Hosts = append(s.Hosts, name)
+	return name
+}
+
+func (s *Spec) addLink(a, b string) {
+	s.Links = append(s.Links, Link{a, b})
+}
+
+// A tree of switches depth levels deep, each with fanout children, with
+// the hosts at the leaves.  Nodes are numbered depth first, like Mininet's
+// TreeTopo.
+func Tree(depth, fanout int) *Spec {
+	s := &Spec{}
+	s.addTree(depth, fanout)
+	return s
+}
+
+func (s *Spec) addTree(depth, fanout int) string {
+	if depth == 0 {
+		return s.addHost("")
+	}
+	sw := s.addSwitch()
+	for i := 0; i < fanout; i++ {
+		s.addLink(sw, s.addTree(depth-1, fanout))
+	}
+	return sw
+}
+
+// A chain of k switches with n hosts on each, like Mininet's LinearTopo.
+// With one host per switch the hosts are h1 to hk; otherwise host j of
+// switch i is hjsi.
+func Linear(k, n int) *Spec {
+	s := &Spec{}
+	last := ""
+	for i := 1; i <= k; i++ {
+		sw := s.addSwitch()
+		for j := 1; j <= n; j++ {
+			name := fmt.Sprintf("h%d", i)
+			if n > 1 {
+				name = fmt.Sprintf("h%ds%d", j, i)
+			}
+			s.addLink(s.addHost(name), sw)
+		}
+		if last != "" {
+			s.addLink(sw, last)
+		}
+		last = sw
+	}
+	return s
+}
+
+// A k-ary fat tree: k pods of k/2 edge and k/2 aggregation switches, with
+// (k/2)^2 core switches above them and k/2 hosts on each edge switch.  k
+// must be even.  The core switches come first, then each pod's aggregation
+// and edge switches.
+//
+// Fat trees have loops, so flooding a broadcast goes on forever; they are
+// for apps that compute routes rather than learn them.
+func FatTree(k int) *Spec {
+	s := &Spec{}
+	half := k / 2
+	var core []string
+	for i := 0; i < half*half; i++ {
+		core = append(core, s.addSwitch())
+	}
+	for pod := 0; pod < k; pod++ {
+		var agg []string
+		for i := 0; i < half; i++ {
+			a := s.addSwitch()
+			agg = append(agg, a)
+			for j := 0; j < half; j++ {
+				s.addLink(a, core[i*half+j])
+			}
+		}
+		for i := 0; i < half; i++ {
+			e := s.addSwitch()
+			for _, a := range agg {
+				s.addLink(e, a)
+			}
+			for j := 0; j < half; j++ {
+				s.addLink(e, s.addHost(""))
+			}
+		}
+	}
+	return s
+}
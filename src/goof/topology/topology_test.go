@@ -0,0 +1,119 @@
+package topology
+
+import (
+	"goof/controller"
+	"goof/of"
+	"testing"
+	"time"
+)
+
+func TestSpecs(t *testing.T) {
+	for _, c := range []struct {
+		name                   string
+		spec                   *Spec
+		switches, hosts, links int
+	}{
+		{"tree 1,2", Tree(1, 2), 1, 2, 2},
+		{"tree 2,3", Tree(2, 3), 4, 9, 12},
+		{"linear 4,1", Linear(4, 1), 4, 4, 7},
+		{"linear 3,2", Linear(3, 2), 3, 6, 8},
+		{"fat tree 4", FatTree(4), 20, 16, 48},
+	} {
+		if err := c.spec.Validate(); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if len(c.spec.Switches) != c.switches || len(c.spec.Hosts) != c.hosts ||
+			len(c.spec.Links) != c.links {
+			t.Errorf("%s: %d switches, %d hosts, %d links; want %d, %d, %d", c.name,
+				len(c.spec.Switches), len(c.spec.Hosts), len(c.spec.Links),
+				c.switches, c.hosts, c.links)
+		}
+	}
+
+	// Mininet numbers a tree depth first.
+	tree := Tree(2, 2)
+	want := []Link{{"s2", "h1"}, {"s2", "h2"}, {"s1", "s2"}, {"s3", "h3"}, {"s3", "h4"}, {"s1", "s3"}}
+	for i, l := range want {
+		if tree.Links[i] != l {
+			t.Errorf("link %d is %v, want %v", i, tree.Links[i], l)
+		}
+	}
+	if h := Linear(2, 2).Hosts; h[0] != "h1s1" || h[3] != "h2s2" {
+		t.Errorf("linear hosts %v", h)
+	}
+
+	for _, bad := range []*Spec{
+		{Switches: []string{"s1", "s1"}},
+		{Switches: []string{"s1"}, Hosts: []string{"h1"}, Links: []Link{{"s1", "h2"}}},
+		{Switches: []string{"s1"}, Hosts: []string{"h1"}},
+		{Switches: []string{"s1"}, Links: []Link{{"s1", "s1"}}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("%+v is valid", bad)
+		}
+	}
+}
+
+// A hub: every packet is flooded by the controller and no flow is set up.
+func hub(sw *controller.Switch) {
+	sw.HandlePacketIn = func(msg *of.PacketIn) {
+		sw.Send(&of.PacketOut{BufferId: msg.BufferId, InPort: msg.InPort,
+			Actions: []of.Action{&of.ActionOutput{Port: of.PortFlood}}})
+	}
+	sw.Serve()
+}
+
+func TestPingAllHub(t *testing.T) {
+	n, err := New(Linear(3, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if err := n.Start(hub); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range n.PingAll(2 * time.Second) {
+		t.Error(err)
+	}
+	if got := n.Host("h1s1").IP; got != 0x0a000001 {
+		t.Errorf("h1s1 has IP %x", got)
+	}
+}
+
+func TestDial(t *testing.T) {
+	n, err := New(Tree(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if err := n.Start(hub); err != nil {
+		t.Fatal(err)
+	}
+	h1, h2 := n.Host("h1"), n.Host("h2")
+	h2.Listen(80)
+	if err := h1.Dial(h2.IP, 80, 2*time.Second); err != nil {
+		t.Errorf("dial open port: %v", err)
+	}
+	if err := h1.Dial(h2.IP, 81, 2*time.Second); err != ErrRefused {
+		t.Errorf("dial closed port: %v, want %v", err, ErrRefused)
+	}
+	if err := h1.Ping(0x0a0000fe, 100*time.Millisecond); err == nil {
+		t.Error("ping of a missing host succeeded")
+	}
+}
+
+func TestNoController(t *testing.T) {
+	n, err := New(Tree(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	// The switch has no flows and nobody to ask, so it drops everything.
+	if err := n.Host("h1").Ping(n.Host("h2").IP, 100*time.Millisecond); err == nil {
+		t.Error("ping succeeded without a controller")
+	}
+	n.Settle()
+	if got := n.Host("h2").Received(); len(got) != 0 {
+		t.Errorf("h2 received %d frames", len(got))
+	}
+}